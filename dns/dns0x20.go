@@ -0,0 +1,78 @@
+package dns
+
+import (
+	mathrand "math/rand/v2"
+	"strings"
+)
+
+// CaseRandomization With this set the letters of the name in each
+// query go out in a random mix of upper and lower case, and a
+// response whose question doesn't have exactly the same mix is
+// thrown away as a forgery (the "0x20" trick, draft-vixie-dnsext-
+// dns0x20).  Servers answer names case insensitively but copy the
+// question back as it was sent, so someone spoofing responses has
+// to guess the case of every letter on top of the query ID.  A
+// server that doesn't copy it back properly counts as failing.
+// This is DefaultResolver's, see WithCaseRandomization for the
+// others.
+var CaseRandomization = false
+
+// WithCaseRandomization This is CaseRandomization for the Resolver.
+func WithCaseRandomization(on bool) Option {
+	return func(res *Resolver) {
+		*res.caseRandomization = on
+	}
+}
+
+// randomizesCase Whether the manager's queries go out with their
+// case randomized, going by the setting of the Resolver it is for
+// (DefaultResolver's if it isn't for one).
+func (manager *serverCommManager) randomizesCase() bool {
+	if manager.caseRandomization == nil {
+		return CaseRandomization
+	}
+	return *manager.caseRandomization
+}
+
+// randomizeCase This returns name with each letter flipped to upper
+// or lower case at random.
+func randomizeCase(name string) string {
+	out := []byte(name)
+	var bits uint64
+	letters := 0
+	for i, c := range out {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if letters%64 == 0 {
+				bits = mathrand.Uint64()
+			}
+			if bits&1 == 1 {
+				out[i] = c ^ 0x20
+			}
+			bits >>= 1
+			letters++
+		}
+	}
+	return string(out)
+}
+
+// echoedCase This checks the question in msg has sent (the
+// randomized name) in exactly the same case, a response without a
+// question having nothing to check.  When it matches, the records
+// for that name get name (as it was before being randomized) back,
+// so the mixed case never gets any further.
+func echoedCase(msg *DNSMessage, sent, name string) bool {
+	if msg.Question.QName != "" {
+		if strings.TrimSuffix(msg.Question.QName, ".") != strings.TrimSuffix(sent, ".") {
+			return false
+		}
+		msg.Question.QName = name
+	}
+	for _, section := range [][]DNSAnswer{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			if section[i].RName == sent {
+				section[i].RName = name
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package dns
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www.a-very-long-label-with-more-than-sixty-four-letters-in-it.example.com"
+	seen := map[string]bool{}
+	for range 20 {
+		randomized := randomizeCase(name)
+		if !strings.EqualFold(randomized, name) {
+			t.Fatalf("randomizeCase(%q) = %q", name, randomized)
+		}
+		seen[randomized] = true
+	}
+	if len(seen) < 19 {
+		t.Errorf("only %d different names out of 20", len(seen))
+	}
+	if randomized := randomizeCase("_sip._tcp.123.example."); !strings.EqualFold(randomized, "_sip._tcp.123.example.") {
+		t.Errorf("unexpected %q", randomized)
+	}
+}
+
+func TestCaseRandomization(t *testing.T) {
+	saved := CaseRandomization
+	CaseRandomization = true
+	defer func() { CaseRandomization = saved }()
+
+	var echo func(string) string
+	res := New()
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		return &DNSMessage{
+			Question: DNSQuestion{QName: echo(request.name), QType: request.qtype, QClass: IN},
+			Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+			}},
+		}
+	})
+
+	echo = func(name string) string { return name }
+	result, err := res.Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RName != "www.example.com" {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+
+	// with 20 letters there is next to no chance of them all coming
+	// out lower case anyway
+	echo = strings.ToLower
+	if result, _ := res.Lookup("mail.server.example.com", RTYPE_A); len(result) != 0 {
+		t.Errorf("a response in the wrong case was accepted: %v", result)
+	}
+}
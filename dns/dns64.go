@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+)
+
+// NAT64WellKnownPrefix The prefix NAT64 gateways use unless set up
+// otherwise (RFC 6052 2.1).
+var NAT64WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// DNS64 and DNS64Prefix With DNS64 set, DefaultResolver makes up
+// AAAA records for names which only have A records (RFC 6147), by
+// putting the IPv4 address into DNS64Prefix as RFC 6052 describes,
+// so that clients on an IPv6 only network can reach them through a
+// NAT64 gateway.  The prefix has to be 32, 40, 48, 56, 64 or 96 bits
+// long, with any other length nothing is made up.  Resolvers made by
+// New have their own, see WithDNS64.
+var DNS64 bool
+var DNS64Prefix = NAT64WellKnownPrefix
+
+// WithDNS64 This turns DNS64 on, using prefix (see DNS64).
+func WithDNS64(prefix netip.Prefix) Option {
+	return func(res *Resolver) {
+		*res.dns64 = true
+		*res.dns64Prefix = prefix
+	}
+}
+
+// nat64Prefix The prefix to make up AAAA records with, false when
+// DNS64 is off or the prefix isn't one we can use.
+func (res *Resolver) nat64Prefix() (netip.Prefix, bool) {
+	if !*res.dns64 {
+		return netip.Prefix{}, false
+	}
+	prefix := *res.dns64Prefix
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, false
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+		return prefix.Masked(), true
+	}
+	return netip.Prefix{}, false
+}
+
+// synthesizeAAAA This is the DNS64 part of LookupCtx, given what
+// came back for the AAAA lookup of name.  When that has no usable
+// AAAA records (IPv4 mapped addresses don't count) and name has A
+// records, the answers become the A chain with each A record turned
+// into a AAAA one.  Otherwise they are left as they are.
+func (res *Resolver) synthesizeAAAA(ctx context.Context, name string, answers []*DNSAnswer, err error) ([]*DNSAnswer, error) {
+	prefix, ok := res.nat64Prefix()
+	if !ok || ctx.Err() != nil {
+		return answers, err
+	}
+	for _, answer := range answers {
+		if aaaa, ok := answer.RData.(AAAA_RECORD); ok && !aaaa.AAAA.Is4In6() {
+			return answers, err
+		}
+	}
+	aAnswers, _ := res.followCNAMEs(ctx, name, RTYPE_A)
+	var synthesized []*DNSAnswer
+	found := false
+	for _, answer := range aAnswers {
+		a, ok := answer.RData.(A_RECORD)
+		if !ok {
+			synthesized = append(synthesized, answer)
+			continue
+		}
+		aaaa := *answer
+		aaaa.RType = RTYPE_AAAA
+		aaaa.RData = AAAA_RECORD{embedIPv4(prefix, a.A)}
+		synthesized = append(synthesized, &aaaa)
+		found = true
+	}
+	if !found {
+		return answers, err
+	}
+	return synthesized, nil
+}
+
+// embedIPv4 This puts addr into prefix the way RFC 6052 2.2 says,
+// skipping over bits 64 to 71 which have to stay zero.
+func embedIPv4(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	out := prefix.Addr().As16()
+	pos := prefix.Bits() / 8
+	for _, octet := range addr.As4() {
+		if pos == 8 {
+			pos++
+		}
+		out[pos] = octet
+		pos++
+	}
+	return netip.AddrFrom16(out)
+}
@@ -0,0 +1,68 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	// the examples from RFC 6052 2.4
+	addr := parseAddrNoerror("192.0.2.33")
+	for _, test := range []struct{ prefix, want string }{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	} {
+		if got := embedIPv4(netip.MustParsePrefix(test.prefix), addr); got != parseAddrNoerror(test.want) {
+			t.Errorf("embedIPv4(%s) = %v, want %s", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	records := map[string][]DNSAnswer{
+		"v4.example.com A":       {{RName: "v4.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.33")}}},
+		"alias.example.com AAAA": {{RName: "alias.example.com", RType: RTYPE_CNAME, TTL: 300, RData: CNAME_RECORD{"v4.example.com"}}},
+		"alias.example.com A":    {{RName: "alias.example.com", RType: RTYPE_CNAME, TTL: 300, RData: CNAME_RECORD{"v4.example.com"}}},
+		"dual.example.com A":     {{RName: "dual.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.44")}}},
+		"dual.example.com AAAA":  {{RName: "dual.example.com", RType: RTYPE_AAAA, TTL: 300, RData: AAAA_RECORD{parseAddrNoerror("2001:db8::44")}}},
+	}
+	fake := fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		return &DNSMessage{Answers: records[request.name+" "+request.qtype.String()]}
+	})
+
+	res := New(WithDNS64(NAT64WellKnownPrefix))
+	res.connect = fake
+	result, err := res.Lookup("v4.example.com", RTYPE_AAAA)
+	if err != nil || len(result) != 1 || result[0].RType != RTYPE_AAAA ||
+		result[0].RData.(AAAA_RECORD).AAAA != parseAddrNoerror("64:ff9b::192.0.2.33") {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	result, err = res.Lookup("alias.example.com", RTYPE_AAAA)
+	if err != nil || len(result) != 2 || result[0].RType != RTYPE_CNAME ||
+		result[1].RName != "v4.example.com" || result[1].RType != RTYPE_AAAA {
+		t.Errorf("unexpected result through a CNAME %v, %v", result, err)
+	}
+	result, err = res.Lookup("dual.example.com", RTYPE_AAAA)
+	if err != nil || len(result) != 1 || result[0].RData.(AAAA_RECORD).AAAA != parseAddrNoerror("2001:db8::44") {
+		t.Errorf("real AAAA records should be left alone, got %v, %v", result, err)
+	}
+	if result, _ := res.Lookup("nothing.example.com", RTYPE_AAAA); len(result) != 0 {
+		t.Errorf("unexpected result %v", result)
+	}
+
+	res = New()
+	res.connect = fake
+	if result, _ := res.Lookup("v4.example.com", RTYPE_AAAA); len(result) != 0 {
+		t.Errorf("DNS64 is off, but got %v", result)
+	}
+	res = New(WithDNS64(netip.MustParsePrefix("2001:db8::/80")))
+	res.connect = fake
+	if result, _ := res.Lookup("v4.example.com", RTYPE_AAAA); len(result) != 0 {
+		t.Errorf("unusable prefix, but got %v", result)
+	}
+}
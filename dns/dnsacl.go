@@ -0,0 +1,32 @@
+package dns
+
+import "net/netip"
+
+// ACL Which clients something is allowed for, by address.  A client
+// in any of Deny isn't, whatever Allow says, and otherwise one in
+// any of Allow is.  With no Allow every client not denied is, so the
+// zero ACL allows everyone.  IPv4 clients reached over IPv6 (as
+// ::ffff:a.b.c.d) are matched by their IPv4 address.
+type ACL struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// Permits Whether acl allows the client at addr
+func (acl ACL) Permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range acl.Deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(acl.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range acl.Allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl := ACL{
+		Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")},
+		Deny:  []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")},
+	}
+	for addr, want := range map[string]bool{
+		"10.1.2.3":         true,
+		"::ffff:10.1.2.3":  true,
+		"10.9.0.1":         false,
+		"192.0.2.1":        false,
+		"2001:db8::1":      true,
+		"2001:db9::1":      false,
+		"::ffff:192.0.2.1": false,
+	} {
+		if got := acl.Permits(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: got %v, want %v", addr, got, want)
+		}
+	}
+	if !(ACL{}).Permits(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("the zero ACL denied a client")
+	}
+	if (ACL{Deny: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}}).Permits(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("a denied client was allowed")
+	}
+}
+
+func TestServerACLs(t *testing.T) {
+	res := withSingleRoot(New())
+	res.connect = answeringWith("192.0.2.100")
+	local := []DNSAnswer{
+		{RName: "nas.home.arpa", RType: RTYPE_A, RClass: IN, TTL: 60, RData: A_RECORD{netip.MustParseAddr("10.0.0.5")}},
+		{RName: "www.home.arpa", RType: RTYPE_CNAME, RClass: IN, TTL: 60, RData: CNAME_RECORD{"www.example.com."}},
+	}
+	srv := &Server{
+		Resolver:     res,
+		Views:        []View{{Clients: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Records: local}},
+		QueryACL:     ACL{Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Deny: []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")}},
+		RecursionACL: ACL{Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}},
+	}
+	srv.begin()
+	defer srv.running.Done()
+	for _, test := range []struct {
+		client  string
+		name    string
+		status  RCODE
+		answers int
+		ra      bool
+	}{
+		{"10.0.0.1", "www.example.com", RCODE_OK, 1, true},
+		{"10.0.0.1", "www.home.arpa", RCODE_OK, 2, true},
+		// no recursion, so only the local records
+		{"10.1.0.1", "nas.home.arpa", RCODE_OK, 1, false},
+		{"10.1.0.1", "www.home.arpa", RCODE_OK, 1, false},
+		{"10.1.0.1", "www.example.com", RCODE_REFUSE, 0, false},
+		// not allowed to query at all
+		{"10.9.0.1", "nas.home.arpa", RCODE_REFUSE, 0, false},
+		{"192.0.2.1", "www.example.com", RCODE_REFUSE, 0, false},
+	} {
+		query := &DNSMessage{Question: DNSQuestion{QName: test.name, QType: RTYPE_A, QClass: IN}}
+		response := srv.answer(query, netip.MustParseAddr(test.client))
+		if response.Header.Status != test.status || len(response.Answers) != test.answers || response.Header.RecursionAvailable != test.ra {
+			t.Errorf("%s from %s: got %+v %v", test.name, test.client, response.Header, response.Answers)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// policyEntry One row of the RFC 6724 policy table
+type policyEntry struct {
+	prefix     netip.Prefix
+	precedence uint8
+	label      uint8
+}
+
+// policyTable The default policy table from RFC 6724 section 2.1,
+// longest prefix first so the first match is the one that counts.
+// IPv4 addresses go through it as IPv4 mapped IPv6 addresses.
+var policyTable = []policyEntry{
+	{netip.MustParsePrefix("::1/128"), 50, 0},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 35, 4},
+	{netip.MustParsePrefix("::/96"), 1, 3},
+	{netip.MustParsePrefix("2001::/32"), 5, 5},
+	{netip.MustParsePrefix("2002::/16"), 30, 2},
+	{netip.MustParsePrefix("3ffe::/16"), 1, 12},
+	{netip.MustParsePrefix("fec0::/10"), 1, 11},
+	{netip.MustParsePrefix("fc00::/7"), 3, 13},
+	{netip.MustParsePrefix("::/0"), 40, 1},
+}
+
+func policy(addr netip.Addr) policyEntry {
+	mapped := netip.AddrFrom16(addr.As16())
+	for _, entry := range policyTable {
+		if entry.prefix.Contains(mapped) {
+			return entry
+		}
+	}
+	return policyTable[len(policyTable)-1]
+}
+
+// Address scopes (RFC 4291 2.7), smaller meaning more local
+const (
+	scopeInterfaceLocal = 0x1
+	scopeLinkLocal      = 0x2
+	scopeSiteLocal      = 0x5
+	scopeGlobal         = 0xe
+)
+
+// addrScope The scope of addr, IPv4 loopback and link-local
+// addresses counting as link-local (RFC 6724 3.2)
+func addrScope(addr netip.Addr) int {
+	switch {
+	case addr.IsMulticast() && addr.Is6():
+		return int(addr.As16()[1] & 0xf)
+	case addr.IsLoopback(), addr.IsLinkLocalUnicast():
+		return scopeLinkLocal
+	case addr.Is6() && netip.MustParsePrefix("fec0::/10").Contains(addr):
+		return scopeSiteLocal
+	}
+	return scopeGlobal
+}
+
+// sourceAddr This finds the source address we would use to reach
+// dst, false meaning we can't reach it at all.  Connecting a UDP
+// socket doesn't send anything, it just has the kernel pick the
+// route.  It is a variable so the tests can pretend to have
+// whatever addresses they like.
+var sourceAddr = func(dst netip.Addr) (netip.Addr, bool) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 9)))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), true
+}
+
+// SortAddrs This sorts addrs in place into the order RFC 6724
+// (destination address selection) says to try them, so that taking
+// the first one is a sensible choice: addresses we can actually
+// reach first, then those whose scope and label match the source
+// address we would use, then by the policy table's precedence
+// (which prefers IPv6 to IPv4), smaller scopes and longest matching
+// prefix.  Otherwise the order is kept.  The rules about deprecated
+// addresses, home addresses and native transport are left out since
+// the information isn't available here.
+func SortAddrs(addrs []netip.Addr) {
+	type candidate struct {
+		dst, src     netip.Addr
+		reachable    bool
+		dstPolicy    policyEntry
+		srcPolicy    policyEntry
+		dstScope     int
+		srcScope     int
+		commonPrefix int
+	}
+	candidates := make([]candidate, len(addrs))
+	for i, addr := range addrs {
+		c := candidate{dst: addr, dstPolicy: policy(addr), dstScope: addrScope(addr)}
+		c.src, c.reachable = sourceAddr(addr)
+		if c.reachable {
+			c.srcPolicy, c.srcScope = policy(c.src), addrScope(c.src)
+			c.commonPrefix = commonPrefixLen(c.src, addr)
+		}
+		candidates[i] = c
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		// Rule 1: Avoid unusable destinations
+		if a.reachable != b.reachable {
+			return a.reachable
+		}
+		if !a.reachable {
+			return false
+		}
+		// Rule 2: Prefer matching scope
+		if aMatch, bMatch := a.dstScope == a.srcScope, b.dstScope == b.srcScope; aMatch != bMatch {
+			return aMatch
+		}
+		// Rule 5: Prefer matching label
+		if aMatch, bMatch := a.dstPolicy.label == a.srcPolicy.label, b.dstPolicy.label == b.srcPolicy.label; aMatch != bMatch {
+			return aMatch
+		}
+		// Rule 6: Prefer higher precedence
+		if a.dstPolicy.precedence != b.dstPolicy.precedence {
+			return a.dstPolicy.precedence > b.dstPolicy.precedence
+		}
+		// Rule 8: Prefer smaller scope
+		if a.dstScope != b.dstScope {
+			return a.dstScope < b.dstScope
+		}
+		// Rule 9: Use longest matching prefix, which only makes
+		// sense within IPv6
+		if a.dst.Is6() && b.dst.Is6() && a.commonPrefix != b.commonPrefix {
+			return a.commonPrefix > b.commonPrefix
+		}
+		// Rule 10: Otherwise, leave the order unchanged
+		return false
+	})
+	for i, c := range candidates {
+		addrs[i] = c.dst
+	}
+}
+
+// commonPrefixLen How many leading bits a and b have in common, 0
+// if they aren't the same family.  Only the first 64 bits (the
+// network part) of an IPv6 address count, as RFC 6724 says.
+func commonPrefixLen(a, b netip.Addr) int {
+	if a.Is4() != b.Is4() {
+		return 0
+	}
+	aBytes, bBytes := a.AsSlice(), b.AsSlice()
+	if a.Is6() {
+		aBytes, bBytes = aBytes[:8], bBytes[:8]
+	}
+	n := 0
+	for i := range aBytes {
+		diff := aBytes[i] ^ bBytes[i]
+		if diff == 0 {
+			n += 8
+			continue
+		}
+		for diff&0x80 == 0 {
+			n++
+			diff <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// InterleaveAddrs This returns addrs (already sorted, see SortAddrs)
+// with the families taking turns, starting with the family of the
+// first address, which is the order Happy Eyeballs (RFC 8305 4)
+// wants to try them in.  Within each family the order is kept.
+func InterleaveAddrs(addrs []netip.Addr) []netip.Addr {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	var first, second []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() == addrs[0].Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
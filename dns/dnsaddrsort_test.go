@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// withSources This makes SortAddrs see a host with the given
+// addresses, reaching any destination of the same family (and
+// nothing else) from the first of them with the same scope, or
+// else the first of them of that family.
+func withSources(t *testing.T, sources ...string) {
+	saved := sourceAddr
+	t.Cleanup(func() { sourceAddr = saved })
+	sourceAddr = func(dst netip.Addr) (netip.Addr, bool) {
+		var found netip.Addr
+		for _, source := range sources {
+			src := parseAddrNoerror(source)
+			if src.Is4() != dst.Is4() {
+				continue
+			}
+			if addrScope(src) == addrScope(dst) {
+				return src, true
+			}
+			if !found.IsValid() {
+				found = src
+			}
+		}
+		return found, found.IsValid()
+	}
+}
+
+func parseAddrs(addrs ...string) []netip.Addr {
+	parsed := make([]netip.Addr, len(addrs))
+	for i, addr := range addrs {
+		parsed[i] = parseAddrNoerror(addr)
+	}
+	return parsed
+}
+
+func TestSortAddrs(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		sources []string
+		addrs   []string
+		want    []string
+	}{
+		{"IPv6 preferred", []string{"198.51.100.7", "2001:db8:1::7"},
+			[]string{"192.0.2.1", "2001:db8:2::1"}, []string{"2001:db8:2::1", "192.0.2.1"}},
+		{"unreachable IPv6 last", []string{"198.51.100.7"},
+			[]string{"2001:db8:2::1", "192.0.2.1"}, []string{"192.0.2.1", "2001:db8:2::1"}},
+		{"matching scope", []string{"198.51.100.7", "fe80::7"},
+			[]string{"2001:db8:2::1", "192.0.2.1"}, []string{"192.0.2.1", "2001:db8:2::1"}},
+		{"matching label", []string{"198.51.100.7", "2002:c633:6407::7"},
+			[]string{"2001:db8:2::1", "2002:c000:201::1"}, []string{"2002:c000:201::1", "2001:db8:2::1"}},
+		{"smaller scope", []string{"10.0.0.7", "2001:db8:1::7", "fe80::7"},
+			[]string{"2001:db8:2::1", "fe80::1"}, []string{"fe80::1", "2001:db8:2::1"}},
+		{"longest matching prefix", []string{"2001:db8:1::7"},
+			[]string{"2001:db8:2::1", "2001:db8:1::1"}, []string{"2001:db8:1::1", "2001:db8:2::1"}},
+		{"stable", []string{"198.51.100.7"},
+			[]string{"192.0.2.2", "203.0.113.1", "192.0.2.1"}, []string{"192.0.2.2", "203.0.113.1", "192.0.2.1"}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			withSources(t, test.sources...)
+			addrs := parseAddrs(test.addrs...)
+			SortAddrs(addrs)
+			if want := parseAddrs(test.want...); !slices.Equal(addrs, want) {
+				t.Errorf("got %v, want %v", addrs, want)
+			}
+		})
+	}
+}
+
+func TestInterleaveAddrs(t *testing.T) {
+	addrs := parseAddrs("2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2")
+	want := parseAddrs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3")
+	if got := InterleaveAddrs(addrs); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	withSources(t, "198.51.100.7", "2001:db8:1::7")
+	nr := netTestResolver()
+	nr.Interleave = true
+	hosts, err := nr.LookupHost(context.Background(), "www.example.com")
+	if err != nil || !slices.Equal(hosts, []string{"2001:db8::1", "10.0.0.1"}) {
+		t.Errorf("LookupHost: %v, %v", hosts, err)
+	}
+}
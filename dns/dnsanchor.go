@@ -0,0 +1,452 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnchorState Where a trust anchor is in its life (RFC 5011 4.2)
+type AnchorState int
+
+const (
+	// AnchorAddPend A new key waiting out AddHoldDown
+	AnchorAddPend AnchorState = iota + 1
+	// AnchorValid A key (or DS) to trust
+	AnchorValid
+	// AnchorMissing A trusted key the zone has stopped publishing
+	// without revoking it, which is still trusted
+	AnchorMissing
+	// AnchorRevoked A key the zone has revoked, kept for
+	// RemoveHoldDown so it isn't taken up again as a new one
+	AnchorRevoked
+)
+
+var anchorStateName = map[AnchorState]string{
+	AnchorAddPend: "AddPend",
+	AnchorValid:   "Valid",
+	AnchorMissing: "Missing",
+	AnchorRevoked: "Revoked",
+}
+
+func (s AnchorState) String() string {
+	return anchorStateName[s]
+}
+
+// TrustAnchor A key for Zone that DNSSEC validation starts from.
+// It is either a DS record (as shipped, or as configured) or, once
+// the zone's DNSKEY RRset has been seen and checked against it, the
+// key itself.  Since is when it went into its current State, which
+// the hold-down timers count from.
+type TrustAnchor struct {
+	Zone  string         `json:"zone"`
+	DS    *DS_RECORD     `json:"ds,omitempty"`
+	Key   *DNSKEY_RECORD `json:"key,omitempty"`
+	State AnchorState    `json:"state"`
+	Since time.Time      `json:"since"`
+}
+
+// trusted Whether the anchor can vouch for a DNSKEY RRset
+func (a TrustAnchor) trusted() bool {
+	return a.State == AnchorValid || a.State == AnchorMissing
+}
+
+// matches Whether key is the anchor's key, ignoring the REVOKE flag
+// (which changes the key tag but not the key)
+func (a TrustAnchor) matches(key DNSKEY_RECORD) bool {
+	if a.Key == nil {
+		return a.DS != nil && key.Flags&dnskeyRevoke == 0 && key.MatchesDS(a.Zone, *a.DS)
+	}
+	return a.Key.Algorithm == key.Algorithm && string(a.Key.PublicKey) == string(key.PublicKey) &&
+		a.Key.Flags|dnskeyRevoke == key.Flags|dnskeyRevoke
+}
+
+// DNSKEY flags
+const (
+	dnskeySEP    = 0x0001
+	dnskeyRevoke = 0x0080
+)
+
+// The root zone's key signing key, KSK-2017, as IANA publishes it
+var rootKSK2017 = DS_RECORD{
+	KeyTag:     20326,
+	Algorithm:  AlgRSASHA256,
+	DigestType: 2,
+	Digest: []byte{
+		0xe0, 0x6d, 0x44, 0xb8, 0x0b, 0x8f, 0x1d, 0x39, 0xa9, 0x5c, 0x0b, 0x0d, 0x7c, 0x65, 0xd0, 0x84,
+		0x58, 0xe8, 0x80, 0x40, 0x9b, 0xbc, 0x68, 0x34, 0x57, 0x10, 0x42, 0x37, 0xc7, 0xf8, 0xec, 0x8d,
+	},
+}
+
+// builtinTrustAnchors The anchors every Resolver starts with: the
+// root's current KSK
+func builtinTrustAnchors() []TrustAnchor {
+	ds := rootKSK2017
+	return []TrustAnchor{{Zone: ".", DS: &ds, State: AnchorValid}}
+}
+
+// AddHoldDown and RemoveHoldDown How long a new key has to be seen
+// before it is trusted, and how long a revoked key is remembered,
+// when keeping the trust anchors up to date (RFC 5011 2.4.1 and
+// 4.2).  The hold-down is what stops someone who has stolen a key
+// from quietly adding one of their own: the zone has that long to
+// notice and revoke the stolen one.  These are DefaultResolver's,
+// see WithHoldDowns for the others.
+var AddHoldDown = 30 * 24 * time.Hour
+var RemoveHoldDown = 30 * 24 * time.Hour
+
+// WithHoldDowns This is AddHoldDown and RemoveHoldDown for the
+// Resolver.
+func WithHoldDowns(add, remove time.Duration) Option {
+	return func(res *Resolver) {
+		*res.addHoldDown, *res.removeHoldDown = add, remove
+	}
+}
+
+// ErrUntrustedKeys The DNSKEY RRset isn't signed by any key we
+// trust, so it can't be used to update the trust anchors.
+var ErrUntrustedKeys = errors.New("DNSKEY RRset not signed by a trust anchor")
+
+// TrustAnchors This returns a copy of the current trust anchors.
+func (res *Resolver) TrustAnchors() []TrustAnchor {
+	res.anchorLock.Lock()
+	defer res.anchorLock.Unlock()
+	return slices.Clone(res.anchors)
+}
+
+// LoadTrustAnchors This adds the DS and DNSKEY records in r to the
+// trust anchors, trusted straight away.  The format is that of a
+// zone file, one record per line without parentheses:
+//
+//	example.com. 3600 IN DS 12345 13 2 0123456789abcdef...
+//	example.com. IN DNSKEY 257 3 13 base64...
+//
+// Nothing is added unless the whole of r makes sense.
+func (res *Resolver) LoadTrustAnchors(r io.Reader) error {
+	anchors, err := parseTrustAnchors(r)
+	if err != nil {
+		return err
+	}
+	res.anchorLock.Lock()
+	defer res.anchorLock.Unlock()
+	for _, anchor := range anchors {
+		duplicate := slices.ContainsFunc(res.anchors, func(a TrustAnchor) bool {
+			return a.Zone == anchor.Zone && fmt.Sprint(a.DS, a.Key) == fmt.Sprint(anchor.DS, anchor.Key)
+		})
+		if !duplicate {
+			res.anchors = append(res.anchors, anchor)
+		}
+	}
+	return nil
+}
+
+// LoadTrustAnchorsFile This is LoadTrustAnchors from the file at
+// path.
+func (res *Resolver) LoadTrustAnchorsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := res.LoadTrustAnchors(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func parseTrustAnchors(r io.Reader) ([]TrustAnchor, error) {
+	var anchors []TrustAnchor
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		anchor := TrustAnchor{Zone: absolute(strings.ToLower(fields[0])), State: AnchorValid}
+		fields = fields[1:]
+		// Skip over the optional TTL and class
+		if len(fields) > 0 {
+			if _, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				fields = fields[1:]
+			}
+		}
+		if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+			fields = fields[1:]
+		}
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("line %d: malformed record", lineno)
+		}
+		var nums [3]uint64
+		for i, field := range fields[1:4] {
+			bits := 8
+			if i == 0 {
+				bits = 16
+			}
+			n, err := strconv.ParseUint(field, 10, bits)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad number %q", lineno, field)
+			}
+			nums[i] = n
+		}
+		// the digest or key may be split up with spaces
+		data := strings.Join(fields[4:], "")
+		switch strings.ToUpper(fields[0]) {
+		case "DS":
+			digest, err := hex.DecodeString(data)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad digest: %w", lineno, err)
+			}
+			anchor.DS = &DS_RECORD{KeyTag: uint16(nums[0]), Algorithm: uint8(nums[1]), DigestType: uint8(nums[2]), Digest: digest}
+		case "DNSKEY":
+			key, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad key: %w", lineno, err)
+			}
+			anchor.Key = &DNSKEY_RECORD{Flags: uint16(nums[0]), Protocol: uint8(nums[1]), Algorithm: uint8(nums[2]), PublicKey: key}
+		default:
+			return nil, fmt.Errorf("line %d: %s is not a DS or DNSKEY record", lineno, fields[0])
+		}
+		anchors = append(anchors, anchor)
+	}
+	return anchors, scanner.Err()
+}
+
+// SaveTrustAnchorState This writes the trust anchors, along with
+// where each one is in RFC 5011's state machine, to w as one JSON
+// object per line, for LoadTrustAnchorState to pick up again.
+func (res *Resolver) SaveTrustAnchorState(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, anchor := range res.TrustAnchors() {
+		if err := enc.Encode(anchor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadTrustAnchorState This replaces the trust anchors with the ones
+// SaveTrustAnchorState wrote to r.
+func (res *Resolver) LoadTrustAnchorState(r io.Reader) error {
+	var anchors []TrustAnchor
+	dec := json.NewDecoder(r)
+	for {
+		var anchor TrustAnchor
+		if err := dec.Decode(&anchor); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if (anchor.DS == nil) == (anchor.Key == nil) || anchorStateName[anchor.State] == "" {
+			return fmt.Errorf("bad trust anchor for %s", anchor.Zone)
+		}
+		anchors = append(anchors, anchor)
+	}
+	res.anchorLock.Lock()
+	res.anchors = anchors
+	res.anchorLock.Unlock()
+	return nil
+}
+
+// updateTrustAnchors This is one step of RFC 5011 for zone, given
+// the DNSKEY RRset keys and the RRSIGs over it that were just
+// fetched.  Unless the RRset is signed (validly, at now) by a key we
+// already trust nothing changes and this returns ErrUntrustedKeys.
+// Otherwise every key with the SEP flag is taken through the state
+// machine: new keys wait out AddHoldDown before being trusted, keys
+// that disappear are Missing (but still trusted) until they come
+// back, and keys which sign the RRset with the REVOKE flag set are
+// revoked for good.  A DS anchor whose key turns up is replaced by
+// the key.
+func (res *Resolver) updateTrustAnchors(zone string, keys []DNSKEY_RECORD, sigs []RRSIG_RECORD, now time.Time) error {
+	zone = absolute(strings.ToLower(zone))
+	res.anchorLock.Lock()
+	defer res.anchorLock.Unlock()
+	signedBy := func(key DNSKEY_RECORD) bool {
+		for _, sig := range sigs {
+			if sig.ValidAt(now) && VerifyKeys(zone, keys, sig, key) == nil {
+				return true
+			}
+		}
+		return false
+	}
+	validated := false
+	for _, key := range keys {
+		for _, anchor := range res.anchors {
+			if anchor.Zone == zone && anchor.trusted() && key.Flags&dnskeyRevoke == 0 && anchor.matches(key) && signedBy(key) {
+				validated = true
+			}
+		}
+	}
+	if !validated {
+		return ErrUntrustedKeys
+	}
+
+	var anchors []TrustAnchor
+	seen := make([]bool, len(keys))
+	for _, anchor := range res.anchors {
+		if anchor.Zone != zone {
+			anchors = append(anchors, anchor)
+			continue
+		}
+		present := -1
+		for i, key := range keys {
+			if anchor.matches(key) {
+				present, seen[i] = i, true
+			}
+		}
+		if anchor.Key == nil && present >= 0 {
+			// the DS has done its job, from now on it is the key
+			key := keys[present]
+			key.Flags &^= dnskeyRevoke
+			anchor.Key, anchor.DS = &key, nil
+		}
+		switch {
+		case present >= 0 && keys[present].Flags&dnskeyRevoke != 0 && anchor.State != AnchorRevoked:
+			// only the key itself can revoke it
+			if signedBy(keys[present]) {
+				anchor.State, anchor.Since = AnchorRevoked, now
+			}
+		case anchor.State == AnchorRevoked:
+			if now.Sub(anchor.Since) >= *res.removeHoldDown {
+				continue
+			}
+		case anchor.State == AnchorAddPend:
+			if present < 0 {
+				continue
+			}
+			if now.Sub(anchor.Since) >= *res.addHoldDown {
+				anchor.State, anchor.Since = AnchorValid, now
+			}
+		case anchor.State == AnchorValid && present < 0:
+			anchor.State, anchor.Since = AnchorMissing, now
+		case anchor.State == AnchorMissing && present >= 0:
+			anchor.State, anchor.Since = AnchorValid, now
+		}
+		anchors = append(anchors, anchor)
+	}
+	for i, key := range keys {
+		if !seen[i] && key.Flags&dnskeySEP != 0 && key.Flags&dnskeyRevoke == 0 {
+			key := key
+			anchors = append(anchors, TrustAnchor{Zone: zone, Key: &key, State: AnchorAddPend, Since: now})
+		}
+	}
+	res.anchors = anchors
+	return nil
+}
+
+// RefreshTrustAnchors This fetches the DNSKEY RRset (and its
+// RRSIGs) of every zone we have trust anchors for and updates the
+// anchors from it (see updateTrustAnchors).  The error is the first
+// one there was, the other zones still get updated.
+func (res *Resolver) RefreshTrustAnchors(ctx context.Context) error {
+	var zones []string
+	for _, anchor := range res.TrustAnchors() {
+		if !slices.Contains(zones, anchor.Zone) {
+			zones = append(zones, anchor.Zone)
+		}
+	}
+	var firstErr error
+	for _, zone := range zones {
+		if err := res.refreshTrustAnchors(ctx, zone); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("refreshing trust anchors for %s: %w", zone, err)
+		}
+	}
+	return firstErr
+}
+
+func (res *Resolver) refreshTrustAnchors(ctx context.Context, zone string) error {
+	answers, err := res.LookupCtx(ctx, zone, RTYPE_DNSKEY)
+	if err != nil {
+		return err
+	}
+	var keys []DNSKEY_RECORD
+	for _, answer := range answers {
+		if key, ok := answer.RData.(DNSKEY_RECORD); ok {
+			keys = append(keys, key)
+		}
+	}
+	answers, err = res.LookupCtx(ctx, zone, RTYPE_RRSIG)
+	if err != nil {
+		return err
+	}
+	var sigs []RRSIG_RECORD
+	for _, answer := range answers {
+		if sig, ok := answer.RData.(RRSIG_RECORD); ok && sig.TypeCovered == RTYPE_DNSKEY {
+			sigs = append(sigs, sig)
+		}
+	}
+	return res.updateTrustAnchors(zone, keys, sigs, time.Now())
+}
+
+// StartTrustAnchorUpdates This keeps the trust anchors up to date
+// the RFC 5011 way, so a zone (the root above all) can roll its key
+// without breaking validation.  If there is a file at path the state
+// saved there last time is loaded first.  Then every interval the
+// anchors get refreshed (see RefreshTrustAnchors) and the state is
+// saved to path again, replacing the file in one go so it is never
+// left half written.  Errors from the refreshes go to onError, if it
+// isn't nil.  Call the returned function to stop it.
+func (res *Resolver) StartTrustAnchorUpdates(path string, interval time.Duration, onError func(error)) (stop func(), err error) {
+	if f, err := os.Open(path); err == nil {
+		err = res.LoadTrustAnchorState(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	report := func(err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(res.done)
+	res.background(func(context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report(res.RefreshTrustAnchors(ctx))
+			report(res.saveTrustAnchorStateFile(path))
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	return cancel, nil
+}
+
+// saveTrustAnchorStateFile This is SaveTrustAnchorState to a new
+// file which then replaces the one at path.
+func (res *Resolver) saveTrustAnchorStateFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := res.SaveTrustAnchorState(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey A key signing key for the trust anchor tests
+type testKey struct {
+	private *ecdsa.PrivateKey
+	key     DNSKEY_RECORD
+}
+
+func newTestKey(t *testing.T) *testKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := append(private.X.FillBytes(make([]byte, 32)), private.Y.FillBytes(make([]byte, 32))...)
+	return &testKey{private, DNSKEY_RECORD{Flags: 257, Protocol: 3, Algorithm: AlgECDSAP256SHA256, PublicKey: public}}
+}
+
+// sign This signs the DNSKEY RRset keys of zone with k, the
+// signature being good for an hour either side of now.
+func (k *testKey) sign(t *testing.T, zone string, keys []DNSKEY_RECORD, now time.Time) RRSIG_RECORD {
+	sig := RRSIG_RECORD{
+		TypeCovered: RTYPE_DNSKEY,
+		Algorithm:   k.key.Algorithm,
+		Labels:      uint8(strings.Count(strings.TrimSuffix(zone, "."), ".") + 1),
+		OriginalTTL: 3600,
+		Expiration:  uint32(now.Add(time.Hour).Unix()),
+		Inception:   uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:      k.key.KeyTag(),
+		SignerName:  zone,
+	}
+	hash := sha256.Sum256(keysSignedData(zone, keys, sig))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return sig
+}
+
+func (k *testKey) revoked() *testKey {
+	revoked := *k
+	revoked.key.Flags |= dnskeyRevoke
+	return &revoked
+}
+
+func TestVerifyKeys(t *testing.T) {
+	k := newTestKey(t)
+	now := time.Now()
+	keys := []DNSKEY_RECORD{k.key}
+	sig := k.sign(t, "example.", keys, now)
+	if err := VerifyKeys("example.", keys, sig, k.key); err != nil {
+		t.Errorf("VerifyKeys: %v", err)
+	}
+	other := newTestKey(t)
+	if err := VerifyKeys("example.", append(keys, other.key), sig, k.key); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("signature over a different RRset: %v", err)
+	}
+	data := append(canonicalWireName("example."), k.key.rdata()...)
+	digest := sha256.Sum256(data)
+	if !k.key.MatchesDS("example.", DS_RECORD{k.key.KeyTag(), k.key.Algorithm, 2, digest[:]}) {
+		t.Errorf("key doesn't match its own DS")
+	}
+	if k.key.MatchesDS("example.", DS_RECORD{k.key.KeyTag(), k.key.Algorithm, 2, make([]byte, 32)}) {
+		t.Errorf("key matches the wrong DS")
+	}
+}
+
+func TestTrustAnchorRollover(t *testing.T) {
+	res := New()
+	if anchors := res.TrustAnchors(); len(anchors) != 1 || anchors[0].Zone != "." || anchors[0].DS.KeyTag != 20326 {
+		t.Fatalf("unexpected built in anchors %v", anchors)
+	}
+
+	zone := "example."
+	key1, key2 := newTestKey(t), newTestKey(t)
+	digest := sha256.Sum256(append(canonicalWireName(zone), key1.key.rdata()...))
+	file := fmt.Sprintf("; the zone's first key\nexample. 3600 IN DS %d 13 2 %X\n", key1.key.KeyTag(), digest)
+	if err := res.LoadTrustAnchors(strings.NewReader(file)); err != nil {
+		t.Fatalf("LoadTrustAnchors: %v", err)
+	}
+	state := func() map[uint16]AnchorState {
+		states := make(map[uint16]AnchorState)
+		for _, anchor := range res.TrustAnchors() {
+			if anchor.Zone != zone {
+				continue
+			}
+			if anchor.Key == nil {
+				states[anchor.DS.KeyTag] = anchor.State
+			} else {
+				states[anchor.Key.KeyTag()] = anchor.State
+			}
+		}
+		return states
+	}
+	// without the monotonic reading, which doesn't get saved
+	now := time.Now().Round(0)
+	update := func(keys []DNSKEY_RECORD, signers ...*testKey) error {
+		var sigs []RRSIG_RECORD
+		for _, signer := range signers {
+			sigs = append(sigs, signer.sign(t, zone, keys, now))
+		}
+		return res.updateTrustAnchors(zone, keys, sigs, now)
+	}
+	tag1, tag2 := key1.key.KeyTag(), key2.key.KeyTag()
+	for _, step := range []struct {
+		desc    string
+		advance time.Duration
+		keys    []DNSKEY_RECORD
+		signers []*testKey
+		want    map[uint16]AnchorState
+	}{
+		{"first fetch", 0, []DNSKEY_RECORD{key1.key}, []*testKey{key1},
+			map[uint16]AnchorState{tag1: AnchorValid}},
+		{"new key", time.Hour, []DNSKEY_RECORD{key1.key, key2.key}, []*testKey{key1},
+			map[uint16]AnchorState{tag1: AnchorValid, tag2: AnchorAddPend}},
+		{"still holding down", 29 * 24 * time.Hour, []DNSKEY_RECORD{key1.key, key2.key}, []*testKey{key1},
+			map[uint16]AnchorState{tag1: AnchorValid, tag2: AnchorAddPend}},
+		{"held down long enough", 24 * time.Hour, []DNSKEY_RECORD{key1.key, key2.key}, []*testKey{key1},
+			map[uint16]AnchorState{tag1: AnchorValid, tag2: AnchorValid}},
+		{"key gone missing", time.Hour, []DNSKEY_RECORD{key1.key}, []*testKey{key1},
+			map[uint16]AnchorState{tag1: AnchorValid, tag2: AnchorMissing}},
+		{"key back", time.Hour, []DNSKEY_RECORD{key1.key, key2.key}, []*testKey{key1},
+			map[uint16]AnchorState{tag1: AnchorValid, tag2: AnchorValid}},
+		{"old key revoked", time.Hour, []DNSKEY_RECORD{key1.revoked().key, key2.key}, []*testKey{key1.revoked(), key2},
+			map[uint16]AnchorState{tag1: AnchorRevoked, tag2: AnchorValid}},
+		{"revoked key forgotten", 31 * 24 * time.Hour, []DNSKEY_RECORD{key2.key}, []*testKey{key2},
+			map[uint16]AnchorState{tag2: AnchorValid}},
+	} {
+		now = now.Add(step.advance)
+		if err := update(step.keys, step.signers...); err != nil {
+			t.Fatalf("%s: %v", step.desc, err)
+		}
+		if got := state(); fmt.Sprint(got) != fmt.Sprint(step.want) {
+			t.Errorf("%s: states %v, want %v", step.desc, got, step.want)
+		}
+	}
+
+	// the revoked key can't vouch for anything any more, and nor
+	// can a key we've never seen
+	key3 := newTestKey(t)
+	if err := update([]DNSKEY_RECORD{key1.key, key3.key}, key1, key3); !errors.Is(err, ErrUntrustedKeys) {
+		t.Errorf("expected ErrUntrustedKeys, got %v", err)
+	}
+
+	var saved bytes.Buffer
+	if err := res.SaveTrustAnchorState(&saved); err != nil {
+		t.Fatalf("SaveTrustAnchorState: %v", err)
+	}
+	other := New()
+	if err := other.LoadTrustAnchorState(&saved); err != nil {
+		t.Fatalf("LoadTrustAnchorState: %v", err)
+	}
+	if fmt.Sprint(other.TrustAnchors()) != fmt.Sprint(res.TrustAnchors()) {
+		t.Errorf("state didn't survive saving and loading:\n%v\n%v", other.TrustAnchors(), res.TrustAnchors())
+	}
+
+	if err := res.LoadTrustAnchors(strings.NewReader("example. IN DS 1 2 zz\n")); err == nil {
+		t.Errorf("expected an error for a malformed anchor")
+	}
+}
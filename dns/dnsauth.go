@@ -0,0 +1,227 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Zone A zone a Server answers for authoritatively, from its records
+// alone (see Server.Zones).  Make one with NewZone or LoadZoneFile;
+// it can't be changed once made, so it is safe to share.
+//
+// The answers are the usual ones of RFC 1034 4.3.2: the records of
+// the type asked for with AA set, or if the name has none of them a
+// CNAME, which is followed as far as the Server's zones go.  A name
+// that has no records of the type gets an empty answer (NODATA),
+// and one that doesn't exist NXDOMAIN, both with the zone's SOA in
+// the authority section so they can be cached (RFC 2308 3).  A name
+// at or below a delegation (NS records other than the apex's) gets
+// a referral to the child zone's servers, with whatever glue the
+// zone has for them.  Wildcards (RFC 4592) stand in for the names
+// that don't exist below their parent.
+type Zone struct {
+	// Origin The name of the zone's apex, cleaned
+	Origin string
+	// SOA The zone's SOA record
+	SOA DNSAnswer
+
+	// The records by (cleaned) owner name, and every name in the
+	// zone that exists, which takes in the empty non-terminals
+	// between the apex and the owner names
+	records map[string][]DNSAnswer
+	exists  map[string]bool
+}
+
+// ErrBadZone What NewZone says about records that don't make a zone,
+// wrapped with what is wrong with them.
+var ErrBadZone = errors.New("dns: bad zone")
+
+// maxZoneChase How many CNAMEs a Server follows through its zones
+// for one answer
+const maxZoneChase = 8
+
+// NewZone This makes the Zone for origin from records, which need
+// to have exactly one SOA record, at origin, and nothing outside of
+// it or of any other class than IN.  With origin "" the SOA record
+// says where the apex is.  ParseZone makes the records from a zone
+// file.
+func NewZone(origin string, records []DNSAnswer) (*Zone, error) {
+	z := &Zone{records: make(map[string][]DNSAnswer), exists: make(map[string]bool)}
+	for _, record := range records {
+		if record.RType != RTYPE_SOA {
+			continue
+		}
+		if z.SOA.RType == RTYPE_SOA {
+			return nil, fmt.Errorf("%w: more than one SOA record", ErrBadZone)
+		}
+		z.SOA = record
+	}
+	if z.SOA.RType != RTYPE_SOA {
+		return nil, fmt.Errorf("%w: no SOA record", ErrBadZone)
+	}
+	z.Origin = cleanName(origin)
+	if origin == "" {
+		z.Origin = cleanName(z.SOA.RName)
+	}
+	if cleanName(z.SOA.RName) != z.Origin {
+		return nil, fmt.Errorf("%w: the SOA record is for %s, not %s", ErrBadZone, z.SOA.RName, z.Origin)
+	}
+	for _, record := range records {
+		name := cleanName(record.RName)
+		if !inSubtree(name, z.Origin) {
+			return nil, fmt.Errorf("%w: %s is outside %s", ErrBadZone, record.RName, z.Origin)
+		}
+		if record.RClass != IN {
+			return nil, fmt.Errorf("%w: %s has class %v", ErrBadZone, record.RName, record.RClass)
+		}
+		z.records[name] = append(z.records[name], record)
+		for ; !z.exists[name]; name = parentName(name) {
+			z.exists[name] = true
+			if name == z.Origin {
+				break
+			}
+		}
+	}
+	return z, nil
+}
+
+// LoadZoneFile This reads the zone file at path (see ParseZoneFile)
+// and makes the Zone for origin from it (see NewZone).
+func LoadZoneFile(path, origin string) (*Zone, error) {
+	records, err := ParseZoneFile(path, origin)
+	if err != nil {
+		return nil, err
+	}
+	return NewZone(origin, records)
+}
+
+// parentName The name with its first label taken off, "." for a
+// name with only the one
+func parentName(name string) string {
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		return parent
+	}
+	return "."
+}
+
+// zone The most specific of the Server's Zones that name is in, nil
+// if none of them are.
+func (srv *Server) zone(name string) *Zone {
+	name = cleanName(name)
+	var best *Zone
+	for _, z := range srv.Zones {
+		if inSubtree(name, z.Origin) && (best == nil || len(z.Origin) > len(best.Origin)) {
+			best = z
+		}
+	}
+	return best
+}
+
+// negativeSOA The zone's SOA as it goes in the authority section of
+// a negative answer, with the TTL that answer may be cached for (RFC
+// 2308 5)
+func (z *Zone) negativeSOA() DNSAnswer {
+	soa := z.SOA
+	if data, ok := soa.RData.(SOA_RECORD); ok && data.Minimum < soa.TTL {
+		soa.TTL = data.Minimum
+	}
+	return soa
+}
+
+// answer This adds the zone's answer for name/t to response.  If
+// the answer is a CNAME, next is where it leads, for the rest of the
+// answer to be found.  referral says the answer is a referral, in which case the
+// child zone's servers are in the authority section and response
+// isn't authoritative.
+func (z *Zone) answer(response *DNSMessage, name string, t RTYPE) (next string, referral bool) {
+	clean := cleanName(name)
+	// a delegation on the way down from the apex takes in everything
+	// below it, though the DS records at it are the parent's
+	var below []string
+	for n := clean; n != z.Origin; n = parentName(n) {
+		below = append(below, n)
+	}
+	for i := len(below) - 1; i >= 0; i-- {
+		if below[i] == clean && t == RTYPE_DS {
+			break
+		}
+		if ns := z.rrset(below[i], RTYPE_NS); len(ns) > 0 {
+			response.Header.Authoritative = false
+			response.Authorities = append(response.Authorities, ns...)
+			response.Additionals = append(response.Additionals, z.glue(ns)...)
+			return "", true
+		}
+	}
+	response.Header.Authoritative = true
+	records := z.records[clean]
+	owner := ""
+	if !z.exists[clean] {
+		// the wildcard at the closest encloser stands in for the
+		// name (RFC 4592 3.3.1)
+		encloser := parentName(clean)
+		for !z.exists[encloser] {
+			encloser = parentName(encloser)
+		}
+		records, owner = z.records["*."+encloser], name
+		if len(records) == 0 {
+			response.Header.Status = RCODE_NXNAME
+			response.Authorities = append(response.Authorities, z.negativeSOA())
+			return "", false
+		}
+	}
+	found := false
+	var cname *DNSAnswer
+	for i, record := range records {
+		if record.RType == t || t == RTYPE_ANY {
+			if owner != "" {
+				record.RName = owner
+			}
+			response.Answers, found = append(response.Answers, record), true
+		} else if record.RType == RTYPE_CNAME {
+			cname = &records[i]
+		}
+	}
+	if found {
+		return "", false
+	}
+	if cname == nil {
+		response.Authorities = append(response.Authorities, z.negativeSOA())
+		return "", false
+	}
+	record := *cname
+	if owner != "" {
+		record.RName = owner
+	}
+	response.Answers = append(response.Answers, record)
+	if target, ok := cname.RData.(CNAME_RECORD); ok {
+		return target.CNAME, false
+	}
+	return "", false
+}
+
+// rrset The zone's records of type t for the (cleaned) name
+func (z *Zone) rrset(name string, t RTYPE) []DNSAnswer {
+	var out []DNSAnswer
+	for _, record := range z.records[name] {
+		if record.RType == t {
+			out = append(out, record)
+		}
+	}
+	return out
+}
+
+// glue The addresses the zone has for the servers in ns
+func (z *Zone) glue(ns []DNSAnswer) []DNSAnswer {
+	var out []DNSAnswer
+	for _, record := range ns {
+		server, ok := record.RData.(NS_RECORD)
+		if !ok {
+			continue
+		}
+		name := cleanName(server.NS)
+		out = append(out, z.rrset(name, RTYPE_A)...)
+		out = append(out, z.rrset(name, RTYPE_AAAA)...)
+	}
+	return out
+}
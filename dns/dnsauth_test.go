@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testAuthZone = `$ORIGIN home.arpa.
+$TTL 3600
+@	SOA	ns1 hostmaster 1 7200 900 1209600 300
+	NS	ns1
+ns1	A	10.0.0.53
+nas	A	10.0.0.5
+files	CNAME	nas
+web	CNAME	www.example.com.
+*.dyn	A	10.0.0.99
+a.b.deep	TXT	"deep"
+lab	NS	ns.lab
+ns.lab	A	10.0.1.53
+`
+
+func TestServerZones(t *testing.T) {
+	records, err := ParseZone(strings.NewReader(testAuthZone), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone, err := NewZone("", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.Origin != "home.arpa" {
+		t.Errorf("origin %q", zone.Origin)
+	}
+	res := withSingleRoot(New())
+	res.connect = answeringWith("192.0.2.101")
+	srv := &Server{Resolver: res, Zones: []*Zone{zone}}
+	srv.begin()
+	defer srv.running.Done()
+
+	for _, test := range []struct {
+		name        string
+		t           RTYPE
+		rd          bool
+		status      RCODE
+		aa          bool
+		answers     string
+		authorities string
+		additionals string
+	}{
+		{"nas.home.arpa", RTYPE_A, true, RCODE_OK, true, "nas.home.arpa 10.0.0.5", "", ""},
+		{"NAS.home.arpa.", RTYPE_A, true, RCODE_OK, true, "nas.home.arpa 10.0.0.5", "", ""},
+		{"nas.home.arpa", RTYPE_AAAA, true, RCODE_OK, true, "", "home.arpa SOA 300", ""},
+		{"missing.home.arpa", RTYPE_A, true, RCODE_NXNAME, true, "", "home.arpa SOA 300", ""},
+		{"b.deep.home.arpa", RTYPE_A, true, RCODE_OK, true, "", "home.arpa SOA 300", ""},
+		{"files.home.arpa", RTYPE_A, true, RCODE_OK, true, "files.home.arpa nas.home.arpa. nas.home.arpa 10.0.0.5", "", ""},
+		{"files.home.arpa", RTYPE_A, false, RCODE_OK, true, "files.home.arpa nas.home.arpa. nas.home.arpa 10.0.0.5", "", ""},
+		{"host.dyn.home.arpa", RTYPE_A, true, RCODE_OK, true, "host.dyn.home.arpa 10.0.0.99", "", ""},
+		// out of the zone, on to the resolver if the client wants
+		{"web.home.arpa", RTYPE_A, true, RCODE_OK, true, "web.home.arpa www.example.com. www.example.com 192.0.2.101", "", ""},
+		{"web.home.arpa", RTYPE_A, false, RCODE_OK, true, "web.home.arpa www.example.com.", "", ""},
+		{"pc.lab.home.arpa", RTYPE_A, false, RCODE_OK, false, "", "lab.home.arpa ns.lab.home.arpa.", "ns.lab.home.arpa 10.0.1.53"},
+		{"pc.lab.home.arpa", RTYPE_A, true, RCODE_OK, false, "pc.lab.home.arpa 192.0.2.101", "", ""},
+		{"www.example.com", RTYPE_A, true, RCODE_OK, false, "www.example.com 192.0.2.101", "", ""},
+	} {
+		query := &DNSMessage{
+			Header:   DNSHeader{RecursionDesired: test.rd},
+			Question: DNSQuestion{QName: test.name, QType: test.t, QClass: IN},
+		}
+		response := srv.answer(query, netip.MustParseAddr("10.0.0.2"))
+		describe := func(records []DNSAnswer) string {
+			var out []string
+			for _, record := range records {
+				out = append(out, cleanName(record.RName))
+				switch data := record.RData.(type) {
+				case A_RECORD:
+					out = append(out, data.A.String())
+				case CNAME_RECORD:
+					out = append(out, data.CNAME)
+				case NS_RECORD:
+					out = append(out, data.NS)
+				case SOA_RECORD:
+					out = append(out, "SOA", strconv.Itoa(int(record.TTL)))
+				}
+			}
+			return strings.Join(out, " ")
+		}
+		if response.Header.Status != test.status || response.Header.Authoritative != test.aa ||
+			describe(response.Answers) != test.answers || describe(response.Authorities) != test.authorities ||
+			describe(response.Additionals) != test.additionals {
+			t.Errorf("%s %v (rd %v): got %v aa %v [%s] [%s] [%s]", test.name, test.t, test.rd,
+				response.Header.Status, response.Header.Authoritative,
+				describe(response.Answers), describe(response.Authorities), describe(response.Additionals))
+		}
+	}
+}
+
+func TestNewZone(t *testing.T) {
+	soa := DNSAnswer{RName: "example.com", RType: RTYPE_SOA, RClass: IN, TTL: 60, RData: SOA_RECORD{MName: "ns.example.com.", RName: "hostmaster.example.com."}}
+	a := DNSAnswer{RName: "www.example.com", RType: RTYPE_A, RClass: IN, TTL: 60, RData: A_RECORD{netip.MustParseAddr("192.0.2.1")}}
+	outside := a
+	outside.RName = "www.example.org"
+	chaos := a
+	chaos.RClass = 3
+	for _, test := range []struct {
+		name    string
+		origin  string
+		records []DNSAnswer
+	}{
+		{"no SOA", "example.com", []DNSAnswer{a}},
+		{"two SOAs", "example.com", []DNSAnswer{soa, soa}},
+		{"SOA elsewhere", "www.example.com", []DNSAnswer{soa, a}},
+		{"outside", "", []DNSAnswer{soa, outside}},
+		{"class", "", []DNSAnswer{soa, chaos}},
+	} {
+		if _, err := NewZone(test.origin, test.records); !errors.Is(err, ErrBadZone) {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "home.arpa.zone")
+	os.WriteFile(path, []byte(testAuthZone), 0o644)
+	zone, err := LoadZoneFile(path, "home.arpa.")
+	if err != nil || zone.Origin != "home.arpa" || len(zone.rrset("nas.home.arpa", RTYPE_A)) != 1 {
+		t.Errorf("unexpected zone %+v, %v", zone, err)
+	}
+}
@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Budget How much work a single lookup may do before giving up, so
+// that a badly (or maliciously) set up zone can't keep us busy for
+// ever.  Everything a lookup does on the way counts, following the
+// CNAMEs and looking up the addresses of nameservers included.
+// Anything 0 or less means no limit.
+type Budget struct {
+	// Queries is how many queries may be sent to the servers,
+	// retries and those over TCP included
+	Queries int
+	// CNAMEs is how many CNAMEs may be followed
+	CNAMEs int
+	// Referrals is how many referrals may be followed
+	Referrals int
+}
+
+// DefaultBudget The budget for lookups which don't say otherwise
+// (see WithBudget).
+var DefaultBudget = Budget{
+	Queries:   100,
+	CNAMEs:    8,
+	Referrals: 30,
+}
+
+// ErrTooManyQueries This is what lookups return when they use up
+// their Budget of queries.
+var ErrTooManyQueries = errors.New("dns: lookup sent too many queries")
+
+// ErrTooManyReferrals This is what lookups return when they use up
+// their Budget of referrals.
+var ErrTooManyReferrals = errors.New("dns: lookup followed too many referrals")
+
+type budgetKey struct{}
+
+type budgetSpentKey struct{}
+
+// WithBudget This returns a context which makes LookupCtx and
+// QueryLookupCtx use budget rather than the Resolver's default
+// (DefaultBudget unless New was given another).
+func WithBudget(ctx context.Context, budget Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, budget)
+}
+
+// budgetSpent What a lookup has used of its budget so far.  It is
+// shared by everything the lookup does, some of which happens at
+// the same time (see askGluelessServers).
+type budgetSpent struct {
+	budget    Budget
+	queries   atomic.Int32
+	cnames    atomic.Int32
+	referrals atomic.Int32
+	// the last server the RateLimit kept the lookup from asking,
+	// since it last went to ask any (see mayQuery)
+	rateLimited atomic.Pointer[RateLimitError]
+}
+
+// withBudgetSpent This starts keeping track of what the lookup with
+// ctx spends, unless something further up already is.
+func (res *Resolver) withBudgetSpent(ctx context.Context) context.Context {
+	if ctx.Value(budgetSpentKey{}) != nil {
+		return ctx
+	}
+	budget, ok := ctx.Value(budgetKey{}).(Budget)
+	if !ok {
+		budget = *res.budget
+	}
+	return context.WithValue(ctx, budgetSpentKey{}, &budgetSpent{budget: budget})
+}
+
+// spent What the lookup with ctx has spent, or nil for one which
+// doesn't keep track (and so can spend as much as it likes)
+func spent(ctx context.Context) *budgetSpent {
+	s, _ := ctx.Value(budgetSpentKey{}).(*budgetSpent)
+	return s
+}
+
+// spend This takes one from counter and says whether that stayed
+// within limit.
+func spend(counter *atomic.Int32, limit int) bool {
+	return limit <= 0 || int(counter.Add(1)) <= limit
+}
+
+// spendQuery Whether the lookup with ctx may send another query
+func spendQuery(ctx context.Context) bool {
+	s := spent(ctx)
+	return s == nil || spend(&s.queries, s.budget.Queries)
+}
+
+// spendCNAME Whether the lookup with ctx may follow another CNAME
+func spendCNAME(ctx context.Context) bool {
+	s := spent(ctx)
+	return s == nil || spend(&s.cnames, s.budget.CNAMEs)
+}
+
+// spendReferral Whether the lookup with ctx may follow another
+// referral
+func spendReferral(ctx context.Context) bool {
+	s := spent(ctx)
+	return s == nil || spend(&s.referrals, s.budget.Referrals)
+}
+
+// queriesLeft Whether the lookup with ctx has any queries left to
+// send
+func queriesLeft(ctx context.Context) bool {
+	s := spent(ctx)
+	return s == nil || s.budget.Queries <= 0 || int(s.queries.Load()) < s.budget.Queries
+}
@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBudgetQueries(t *testing.T) {
+	initTestsData(4)
+	var queries atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		queries.Add(1)
+		return &DNSMessage{Header: DNSHeader{Status: RCODE_SERVFAIL}}
+	})
+
+	ctx := WithBudget(context.Background(), Budget{Queries: 3})
+	ctx = WithRetryPolicy(ctx, RetryPolicy{Timeout: DefaultRetryPolicy.Timeout, Attempts: 10})
+	if result, err := LookupCtx(ctx, "www.example.com", RTYPE_A); len(result) != 0 || !errors.Is(err, ErrTooManyQueries) {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("sent %d queries, want 3", n)
+	}
+}
+
+func TestBudgetReferrals(t *testing.T) {
+	initTestsData(4)
+	// every server delegates one label further down, the servers
+	// being 10.53.0.n for the zone n labels down
+	name := "www.a.b.c.d.e.example"
+	labels := strings.Split(name, ".")
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		n := 0
+		if prefix := netip.MustParsePrefix("10.53.0.0/24"); prefix.Contains(addr) {
+			n = int(addr.As4()[3])
+		}
+		if n+1 >= len(labels) {
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+			}}}
+		}
+		zone := strings.Join(labels[len(labels)-n-1:], ".")
+		return referral(zone, "ns."+zone, netip.AddrFrom4([4]byte{10, 53, 0, byte(n + 1)}))
+	})
+
+	ctx := WithBudget(context.Background(), Budget{Referrals: 3})
+	if result, err := LookupCtx(ctx, name, RTYPE_A); len(result) != 0 || !errors.Is(err, ErrTooManyReferrals) {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	// with enough of them it gets there
+	ctx = WithBudget(context.Background(), Budget{Referrals: len(labels)})
+	if result, err := LookupCtx(ctx, name, RTYPE_A); err != nil || len(result) != 1 {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+}
+
+func TestBudgetCNAMEs(t *testing.T) {
+	initTestsData(4)
+	// long0 -> long1 -> long2 -> ...
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		name := strings.TrimSuffix(request.name, ".example.com")
+		i, err := strconv.Atoi(strings.TrimPrefix(name, "long"))
+		if err != nil {
+			return &DNSMessage{}
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_CNAME, TTL: 300, RData: CNAME_RECORD{"long" + strconv.Itoa(i+1) + ".example.com"},
+		}}}
+	})
+
+	ctx := WithBudget(context.Background(), Budget{CNAMEs: 2})
+	result, err := LookupCtx(ctx, "long0.example.com", RTYPE_A)
+	if !errors.Is(err, ErrCNAMEChainTooLong) || len(result) != 3 {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+}
@@ -1,11 +1,17 @@
 package dns
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"hash/fnv"
+	"log/slog"
 	"net/netip"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,152 +20,440 @@ import (
 type dnsCacheEntry struct {
 	expires time.Time
 	data    []RDATA // Changed type signature
+	// Roughly how many bytes this entry takes up, see entrySize
+	size int64
+
+	// Pinned entries (see CachePin) never expire and are never
+	// evicted, flushed or overwritten by upstream data.
+	pinned bool
+
+	// Whether the server the data came from set the AD bit (see
+	// WithDNSSECFlags)
+	authenticated bool
+
+	// How many times this entry has been handed out to a client
+	// (which is what prefetching goes by), how many times it has
+	// been used at all, lookups along the way included (which is
+	// what leastUsed goes by), and whether a prefetch for it is
+	// already in flight.
+	accesses    atomic.Uint64
+	uses        atomic.Uint64
+	prefetching atomic.Bool
 }
 
 // dnsCacheUnit This is our basic unit of locking within
 // the cache itself.  It consists of both a RWMutex and
-// a map between the name/rtype and the cache entry.
+// a map between the name and what is cached for it.
 // The name should be all lower case when looking/storing
 // in this cache.
 type dnsCacheUnit struct {
+	// Changing anything for a name takes this shared plus the
+	// lock for the name itself (see dnsCacheName), so writes to
+	// different names never wait on each other.  Things that go
+	// over the whole shard (resizing, sweeping, flushing a subtree)
+	// take it exclusively.  Lookups don't take any lock.
 	lock sync.RWMutex
-	// An entry itself is a 2-level map, the first being the name
-	// (with the trailing '.', in all lower case)
-	// and the second being the
-	// cache entry itself.
-	entries map[string]map[RTYPE]*dnsCacheEntry
+	// The names (without the trailing '.', in all lower case),
+	// each mapping to its *dnsCacheName.
+	names sync.Map
+	// The sum of the sizes of everything in names
+	bytes atomic.Int64
+	// Set (under the exclusive lock) once ResizeCache has copied
+	// this shard's entries into a new set of shards.  Anyone who
+	// finds it set needs to go look up the new shard.
+	retired atomic.Bool
+	// The cache this shard belongs to
+	table *dnsCacheTable
+
+	// Counters for CacheStats.  These are atomics rather than
+	// being protected by lock since lookups don't hold any lock.
+	lookups   atomic.Uint64
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	expired   atomic.Uint64
+	inserts   atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// MinCacheTTL and MaxCacheTTL This is the range we clamp the
+// lifetime of everything going through cacheSet to, no matter
+// what TTL the server hands us.  Some servers hand out absurdly
+// long TTLs (up to 68 years is legal) so we cap it to something
+// sane, and raising MinCacheTTL stops a zone with 1 second TTLs
+// from making us go upstream on practically every query.  These
+// are DefaultResolver's, see WithCacheTTLs for the others.
+var MinCacheTTL time.Duration = 0
+var MaxCacheTTL = 7 * 24 * time.Hour
+
+// WithCacheTTLs This clamps the lifetime of everything the Resolver
+// caches to between min and max, like MinCacheTTL and MaxCacheTTL
+// do for DefaultResolver.
+func WithCacheTTLs(min, max time.Duration) Option {
+	return func(res *Resolver) {
+		*res.minTTL = min
+		*res.maxTTL = max
+	}
+}
+
+// PrefetchWindow and PrefetchThreshold control prefetching:
+// When an answer that has been looked up at least PrefetchThreshold
+// times is served from the cache within PrefetchWindow of it
+// expiring, it gets re-resolved in the background so that popular
+// names never have to wait on the upstream servers.  Setting
+// PrefetchWindow to 0 turns this off.  These are DefaultResolver's,
+// see WithPrefetch for the others.
+var PrefetchWindow = 10 * time.Second
+var PrefetchThreshold uint64 = 5
+
+// WithPrefetch This sets when the Resolver prefetches, the way
+// PrefetchWindow and PrefetchThreshold do for DefaultResolver.  A
+// window of 0 turns prefetching off.
+func WithPrefetch(window time.Duration, threshold uint64) Option {
+	return func(res *Resolver) {
+		*res.prefetchWindow = window
+		*res.prefetchThreshold = threshold
+	}
+}
+
+// MergeRRsets When this is set (the default) cacheSet adds records
+// to an existing live entry for the same name and type rather than
+// replacing it, see dnsCacheTable.merge.  This is DefaultResolver's,
+// see WithMergeRRsets for the others.
+var MergeRRsets = true
+
+// WithMergeRRsets This is MergeRRsets for the Resolver.
+func WithMergeRRsets(merge bool) Option {
+	return func(res *Resolver) {
+		*res.mergeRRsets = merge
+	}
 }
 
-var dnsCache []*dnsCacheUnit
-var seed []byte
+// MaxCacheBytes If this is non-zero it is a hard limit on the
+// approximate memory used by the answer cache (see entrySize).
+// Going over it causes entries to be evicted, the ones closest to
+// expiring first.
+var MaxCacheBytes int64 = 0
+
+// MaxInfraCacheBytes The same for the infrastructure cache, except
+// there the least used entries get evicted first.
+var MaxInfraCacheBytes int64 = 0
 
 // This function needs to be called at the start
 // to initialize all the cache entries.  It is
-// public because it is part of the setup process
+// public because it is part of the setup process.
+// Both the answer and infrastructure caches get n
+// shards, use ResizeInfraCache to size the latter
+// separately.
 func InitCache(n uint) {
-	dnsCache = make([]*dnsCacheUnit, n)
-	for i := uint(0); i < n; i++ {
-		dnsCache[i] = &dnsCacheUnit{}
+	res := DefaultResolver
+	res.cache.init(n)
+	res.infra.init(n)
+	res.mdns.init(n)
+	// The seed is only made once, the server managers are
+	// sharded by it as well and they don't get thrown away here
+	if res.seed == nil {
+		res.seed = make([]byte, 16)
+		// The error does NOT need to be handled,
+		// as rand.Read will ALWAYS fail if it doesn't work
+		// with a panic, but just because this is there to
+		// suppress a compiler/IDE warning
+		_, _ = rand.Read(res.seed)
+	}
+	res.initRoot()
+}
+
+// CachePin This puts an entry in the cache which never expires and
+// is never evicted, for things like local overrides.  Records for
+// the same name/type coming back from upstream servers won't
+// replace it, but calling CachePin again will.  Use CacheUnpin to
+// get rid of it.
+func (res *Resolver) CachePin(name string, t RTYPE, data []RDATA) {
+	res.cache.store(cleanName(name), inKey(t), time.Time{}, data, true)
+}
+
+// CacheUnpin This removes a pinned entry.  It does nothing to
+// entries which aren't pinned.
+func (res *Resolver) CacheUnpin(name string, t RTYPE) {
+	res.cache.unpin(cleanName(name), inKey(t))
+}
+
+// expiredAt Whether the entry should be treated as gone at time now
+func (entry *dnsCacheEntry) expiredAt(now time.Time) bool {
+	return !entry.pinned && entry.expires.Before(now)
+}
+
+// ttl The TTL to hand out for this entry.  Pinned entries claim
+// to be good for maxTTL (the Resolver's MaxCacheTTL) so nobody
+// downstream holds onto them forever.
+func (entry *dnsCacheEntry) ttl(maxTTL time.Duration) uint32 {
+	if entry.pinned {
+		return uint32(maxTTL / time.Second)
 	}
-	// The error does NOT need to be handled,
-	// as rand.Read will ALWAYS fail if it doesn't work
-	// with a panic, but just because this is there to
-	// suppress a compiler/IDE warning
-	_, _ = rand.Read(seed)
-	initRoot()
+	return remainingTTL(entry.expires)
 }
 
-func initRoot() {
-	rootNS := NS_RECORD{"a.root-servers.net."}
-	a, _ := netip.ParseAddr("198.41.0.4")
-	rootIP := A_RECORD{a}
-	cacheSet(".", RTYPE_NS,
-		time.Now().Add(time.Hour*24*365),
-		[]RDATA{rootNS})
+// ttlExpires This converts the TTL on a record into the absolute
+// time the cache entry should expire at
+func ttlExpires(ttl uint32) time.Time {
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
 
-	cacheSet("a.root-servers.net.",
-		RTYPE_A,
-		time.Now().Add(time.Hour*24*365),
-		[]RDATA{rootIP})
+// clampExpires This applies the Resolver's MinCacheTTL and
+// MaxCacheTTL to an absolute expiry time
+func (res *Resolver) clampExpires(expires time.Time) time.Time {
+	now := time.Now()
+	if d := expires.Sub(now); d < *res.minTTL {
+		return now.Add(*res.minTTL)
+	} else if d > *res.maxTTL {
+		return now.Add(*res.maxTTL)
+	}
+	return expires
+}
 
+// remainingTTL This is the inverse, the number of seconds left
+// before a cache entry expires so we can hand it back to the caller
+func remainingTTL(expires time.Time) uint32 {
+	d := time.Until(expires)
+	if d <= 0 {
+		return 0
+	}
+	return uint32(d / time.Second)
+}
+
+// cacheShards The current set of shards in the answer cache
+func (res *Resolver) cacheShards() []*dnsCacheUnit {
+	return res.cache.shardList()
+}
+
+// ResizeCache This changes the number of shards in the answer cache
+// while it is in use, for when a lot more parallelism is needed
+// than InitCache was given.
+func (res *Resolver) ResizeCache(n uint) {
+	res.cache.resize(n)
+}
+
+// ResizeInfraCache The same for the infrastructure cache.
+func (res *Resolver) ResizeInfraCache(n uint) {
+	res.infra.resize(n)
 }
 
 // cacheLookup This will look up the entry in the cache for
 // the given name and rtype.  If the name doesn't exist, the rtype
 // doesn't exist, or the record is expired it should return nil
-func cacheLookup(name string, t RTYPE) *dnsCacheEntry {
-	// TODO: You need to implement this and make sure this is thread safe.
-	// TODO: You need to implement this and make sure this is thread safe.
-	name = cleanName(name)
-	hunk_index := nameHash(name) % uint32(len(dnsCache))
-	key := dnsCache[hunk_index]
+func (res *Resolver) cacheLookup(name string, t RTYPE) *dnsCacheEntry {
+	return res.cache.lookup(cleanName(name), inKey(t))
+}
 
-	// Using the READER part of the lock
-	key.lock.RLock()
-	defer key.lock.RUnlock()
+// cacheSet This will set a mapping of name/type to RDATA.
+// It needs to be thread safe BUT its ok to do additional redundant setting
+// if something else at the same time wants to update the data.
+// Depending on MergeRRsets the data either gets added on to the
+// existing data or replaces it.  Pinned entries are never replaced.
+func (res *Resolver) cacheSet(name string, t RTYPE, expires time.Time, data []RDATA) {
+	res.cache.set(cleanName(name), inKey(t), res.clampExpires(expires), data, !*res.mergeRRsets, false)
+}
 
-	key_entries := key.entries
+// cacheReplace This is cacheSet but always replacing what is there,
+// for when we know data is the complete, current RRset.
+func (res *Resolver) cacheReplace(name string, t RTYPE, expires time.Time, data []RDATA) {
+	res.cache.set(cleanName(name), inKey(t), res.clampExpires(expires), data, true, false)
+}
+
+// infraLookup and infraSet These are cacheLookup and cacheSet for
+// the infrastructure cache.
+func (res *Resolver) infraLookup(name string, t RTYPE) *dnsCacheEntry {
+	return res.infra.lookup(cleanName(name), inKey(t))
+}
 
-	// type assertion; cleaner
-	domainMAP, isDomain := key_entries[name]
-	if isDomain { // entry domain in cache?
-		domainCache, inCache := domainMAP[t]
-		if inCache { // entry specific RTYPE exist for that domain??
-			if domainCache.expires.Before(time.Now()) {
-				return nil // entry is expired
+func (res *Resolver) infraSet(name string, t RTYPE, expires time.Time, data []RDATA) {
+	res.infra.set(cleanName(name), inKey(t), res.clampExpires(expires), data, !*res.mergeRRsets, false)
+}
+
+// set This either replaces or merges depending on replace
+func (c *dnsCacheTable) set(name string, k rrKey, expires time.Time, data []RDATA, replace, authenticated bool) {
+	if replace {
+		c.update(name, true, func(key *dnsCacheUnit, n *dnsCacheName, events *cacheEvents) {
+			key.putLocked(n, name, k, expires, data, false, authenticated, events)
+		})
+	} else {
+		c.merge(name, k, expires, data, authenticated)
+	}
+}
+
+// anyLookup This checks the infrastructure cache and then the
+// answer cache, for when either will do (like finding the
+// address of a nameserver).  These lookups are made along the way
+// to an answer, so they don't count in the stats.
+func (res *Resolver) anyLookup(name string, t RTYPE) *dnsCacheEntry {
+	name = cleanName(name)
+	if entry, _ := res.infra.peek(name, inKey(t)); entry != nil {
+		return entry
+	}
+	entry, _ := res.cache.peek(name, inKey(t))
+	return entry
+}
+
+// nameserverAddr This finds the address to reach the nameserver
+// name at.  IPv4 is preferred, but when there is only AAAA glue
+// (an IPv6-only nameserver) that gets used instead, and with
+// ServerNetwork "ip6" only AAAA glue is.
+func (res *Resolver) nameserverAddr(name string) (netip.Addr, bool) {
+	for _, t := range res.serverAddrTypes() {
+		entry := res.anyLookup(name, t)
+		if entry == nil {
+			continue
+		}
+		for _, rdata := range entry.data {
+			if addr, ok := res.serverAddr(rdata); ok {
+				return addr, true
 			}
-			return domainCache // entry exists and in cache and not expired
 		}
 	}
-	return nil
+	return netip.Addr{}, false
 }
 
-// cacheSet This will set a mapping of name/type to RDATA.
-// It needs to be thread safe BUT its ok to do additional redundant setting
-// if something else at the same time wants to update the data.
-// If you want you can add on to the existing data if it makes your life
-// easier.
-func cacheSet(name string, t RTYPE, expires time.Time, data []RDATA) {
-	// TODO: You need to implement this to make sure it is thread safe
-	// TODO: You need to implement this to make sure it is thread safe
-	// first ocmpute which hunk to use
+// entryOverhead Roughly what a dnsCacheEntry plus its spot in
+// the two maps costs us before counting the name and data
+const entryOverhead = 128
+
+// entrySize This estimates how much memory an entry for name
+// holding data takes.  It doesn't need to be exact, just good
+// enough to plan capacity with.
+func entrySize(name string, data []RDATA) int64 {
+	size := int64(entryOverhead + len(name))
+	for _, rdata := range data {
+		size += rdataSize(rdata)
+	}
+	return size
+}
+
+// rdataSize The approximate size of a single RDATA, including
+// the interface value pointing at it.
+func rdataSize(rdata RDATA) int64 {
+	const iface = 16
+	switch r := rdata.(type) {
+	case A_RECORD:
+		return iface + 24
+	case AAAA_RECORD:
+		return iface + 24
+	case NS_RECORD:
+		return iface + 16 + int64(len(r.NS))
+	case CNAME_RECORD:
+		return iface + 16 + int64(len(r.CNAME))
+	case PTR_RECORD:
+		return iface + 16 + int64(len(r.PTR))
+	case TXT_RECORD:
+		size := int64(iface + 24)
+		for _, txt := range r.Txt {
+			size += 16 + int64(len(txt))
+		}
+		return size
+	case MX_RECORD:
+		return iface + 24 + int64(len(r.Exchange))
+	case SRV_RECORD:
+		return iface + 24 + int64(len(r.Target))
+	case SVCB_RECORD:
+		return iface + r.size()
+	case HTTPS_RECORD:
+		return iface + r.size()
+	case DNSKEY_RECORD:
+		return iface + 32 + int64(len(r.PublicKey))
+	case DS_RECORD:
+		return iface + 32 + int64(len(r.Digest))
+	case RRSIG_RECORD:
+		return iface + 72 + int64(len(r.SignerName)+len(r.Signature))
+	case NSEC_RECORD:
+		return iface + 40 + int64(len(r.NextDomain)+len(r.TypeBitmap))
+	case NSEC3_RECORD:
+		return iface + 80 + int64(len(r.Salt)+len(r.NextHashed)+len(r.TypeBitmap))
+	case TLSA_RECORD:
+		return iface + 32 + int64(len(r.CertData))
+	case CAA_RECORD:
+		return iface + 40 + int64(len(r.Tag)+len(r.Value))
+	case SOA_RECORD:
+		return iface + 48 + int64(len(r.MName)+len(r.RName))
+	case RAW_RECORD:
+		return iface + 32 + int64(len(r.Data))
+	}
+	return iface + 64
+}
+
+// CacheBytes The approximate amount of memory currently used by
+// the answer cache, see MaxCacheBytes.
+func (res *Resolver) CacheBytes() int64 {
+	return res.cache.bytes.Load()
+}
+
+// FlushName This removes every record type cached for name, in
+// the answer, infrastructure and multicast DNS caches.  Like all the flush
+// functions it leaves pinned entries alone.
+func (res *Resolver) FlushName(name string) {
 	name = cleanName(name)
-	hunk_index := nameHash(name) % uint32(len(dnsCache))
-	key := dnsCache[hunk_index]
+	res.cache.flushName(name)
+	res.infra.flushName(name)
+	res.mdns.flushName(name)
+}
 
-	// grab the writer locker
-	key.lock.Lock() // this waits until there are no users; using the Reader Lock
-	defer key.lock.Unlock()
+// FlushType This removes just the given record type for name,
+// leaving anything else cached for that name alone.
+func (res *Resolver) FlushType(name string, t RTYPE) {
+	name = cleanName(name)
+	res.cache.flushType(name, t)
+	res.infra.flushType(name, t)
+	res.mdns.flushType(name, t)
+}
 
-	key_entries := key.entries
+// FlushSubtree This removes suffix and every name below it.
+// Flushing "." empties the whole cache apart from pinned entries
+// such as the root hints.
+func (res *Resolver) FlushSubtree(suffix string) {
+	suffix = cleanName(suffix)
+	res.cache.flushSubtree(suffix)
+	res.infra.flushSubtree(suffix)
+	res.mdns.flushSubtree(suffix)
+}
+
+// inSubtree Whether the (cleaned) name is the same as or below
+// the (cleaned) suffix.  This goes by whole labels so that
+// "badexample.com" is not considered part of "example.com"
+func inSubtree(name, suffix string) bool {
+	if suffix == "." || name == suffix {
+		return true
+	}
+	return strings.HasSuffix(name, "."+suffix)
+}
+
+// sweepCache This goes through every shard of the caches and
+// deletes the entries which have expired.  Lookups already ignore
+// expired entries so this is purely about giving the memory back.
+func (res *Resolver) sweepCache() {
+	res.cache.sweep()
+	res.infra.sweep()
+	res.mdns.sweep()
+}
 
-	// discussion
-	// do I even have the map that holds all domain names?
-	// not asking about specific domain name
-	// if key_entries == nil {
-	// 	// map(test.com) -> map(A,NS,CNAME?) -> *dnsCacheEntry
-	// 	key_entries = make(map[string]map[RTYPE]*dnsCacheEntry)
-	// 	// do i even have the specific domain name exist?
-	// 	// now we check for specific domain name
-	// 	if key_entries[name] == nil {
-	// 		// key(test.com) = map(A,NS,CNAME?) -> *dnsCacheEntry
-	// 		key_entries[name] = make(map[RTYPE]*dnsCacheEntry)
-	// 	}
-	// }
-
-	// do I even have the map that holds all domain names?
-	// not asking about specific domain name
-	if key_entries == nil {
-		// map(test.com) -> map(A,NS,CNAME?) -> *dnsCacheEntry
-		key_entries = make(map[string]map[RTYPE]*dnsCacheEntry)
-	}
-	// do i even have the specific domain name exist?
-	// now we check for specific domain name
-	if key_entries[name] == nil {
-		// key(test.com) = map(A,NS,CNAME?) -> *dnsCacheEntry
-		key_entries[name] = make(map[RTYPE]*dnsCacheEntry)
-	}
-
-	// to fix data an array of pointers
-	// slice of pointers
-	// new_data := make([]*RDATA, len(data))
-	// for i := range data {
-	// 	new_data[i] = &data[i]
-	// }
-
-	//to set
-	//get the index from the nameHash function BELOW
-	// create a new dnsCacheEntry object and set its parameters
-	// discussion
-	newvar := &dnsCacheEntry{
-		expires: expires,
-		data:    data,
-	}
-	// discussion
-	// throw that new variable into the entries of the cache entry
-	key_entries[name][t] = newvar
-
-	key.entries = key_entries
+// StartCacheSweeper This starts a goroutine which calls sweepCache
+// every interval.  Call the returned function to stop it.
+func (res *Resolver) StartCacheSweeper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	res.background(func(ctx context.Context) {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				res.sweepCache()
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
 }
 
 // nameHash This is a basic hash function for strings.
@@ -169,21 +463,21 @@ func cacheSet(name string, t RTYPE, expires time.Time, data []RDATA) {
 // where an attacker creates a deliberate hot-spot in the cache)
 // and to ensure that there is a lot of randomization between
 // runs.
-func nameHash(name string) uint32 {
+func (res *Resolver) nameHash(name string) uint32 {
 	l := strings.ToLower(name)
 	h := fnv.New32a()
 	_, _ = h.Write([]byte(l))
-	_, _ = h.Write(seed)
+	_, _ = h.Write(res.seed)
 	return h.Sum32()
 }
 
 // serverHash This is the same thing but for server
 // addressses using the netip.Addr structure
-func serverHash(addr *netip.Addr) uint32 {
+func (res *Resolver) serverHash(addr *netip.Addr) uint32 {
 	l := addr.String()
 	h := fnv.New32a()
 	_, _ = h.Write([]byte(l))
-	_, _ = h.Write(seed)
+	_, _ = h.Write(res.seed)
 	return h.Sum32()
 }
 
@@ -200,14 +494,16 @@ func cleanName(name string) string {
 }
 
 // RICO discussion
-func bestNS(name string) *dnsCacheEntry {
+// bestNS This returns the NS records for the closest enclosing zone
+// we know about, along with the name of that zone.
+func (res *Resolver) bestNS(name string) (*dnsCacheEntry, string) {
 	// CLEAN IT
 	name = cleanName(name)
 	// return the best or most specific nameserver you have in the cache
 	for {
-		entry := cacheLookup(name, RTYPE_NS)
+		entry := res.anyLookup(name, RTYPE_NS)
 		if entry != nil && len(entry.data) > 0 {
-			return entry
+			return entry, name
 		}
 		// WE ARE NOT SUPPOSED TO REACH "."
 		if name == "." {
@@ -222,7 +518,8 @@ func bestNS(name string) *dnsCacheEntry {
 		}
 	}
 	// ROOT SERVER IS ALWAYS IN THE CACHE
-	return cacheLookup(".", RTYPE_NS)
+	entry, _ := res.infra.peek(".", inKey(RTYPE_NS))
+	return entry, "."
 }
 
 // And this is the heart of the lookup:  Every query executed will be
@@ -231,120 +528,672 @@ func bestNS(name string) *dnsCacheEntry {
 // by first looking up the NS record for the domain (if present) and querying that
 //
 // If the value is a CNAME it should also follow the CNAME and return that as part of
-// the answer.  For now we will only deal with RTYPE_A records
-func QueryLookup(name string, t RTYPE) []*DNSAnswer {
-	// TODO You need to implement this
+// the answer (see Lookup).  Both A and AAAA (and the other types the
+// servers hand back) are cached and resolved the same way.
+//
+// Lookups are case insensitive, but the answers for the name itself
+// come back with the same casing the caller used.
+//
+// An RTYPE_ANY query gets everything cached for the name if there
+// is anything, and otherwise whatever the server hands back, which
+// may be just one RRset (RFC 8482).  CNAMEs aren't followed for it.
+//
+// Nothing found is nil whatever the reason, the name not existing
+// and the servers not answering alike; Lookup says which it was.
+func (res *Resolver) QueryLookup(name string, t RTYPE) []*DNSAnswer {
+	answers, _ := res.Lookup(name, t)
+	return answers
+}
+
+// QueryLookupCtx This is QueryLookup but giving up as soon as ctx
+// is done, rather than waiting out the servers.
+func (res *Resolver) QueryLookupCtx(ctx context.Context, name string, t RTYPE) []*DNSAnswer {
+	answers, _ := res.LookupCtx(ctx, name, t)
+	return answers
+}
+
+// ErrCNAMEChainTooLong This is what Lookup returns when following
+// the CNAMEs for a name uses up the CNAMEs in its Budget.
+var ErrCNAMEChainTooLong = errors.New("dns: CNAME chain too long")
+
+// CNAMELoopError This is what Lookup returns when the CNAMEs for a
+// name lead back to a name already in the chain.  Chain is every
+// name visited, starting with the one asked for and ending with
+// the one seen twice.
+type CNAMELoopError struct {
+	Chain []string
+}
+
+func (e *CNAMELoopError) Error() string {
+	return "dns: CNAME loop " + strings.Join(e.Chain, " -> ")
+}
+
+// Lookup This is QueryLookup but it also says why it failed, be it
+// the name not existing (ErrNXDomain), following the CNAMEs going
+// wrong, none of the servers being able to answer (a
+// *ServerFailureError, which is ErrServFail, and ErrTimeout if none
+// of them answered at all), the nameservers having no addresses
+// (ErrNoGlue) or the delegations going round in circles (a
+// *DelegationLoopError, which like a *CNAMELoopError is ErrLoop).
+// The answers are every CNAME along the way, in order, followed by
+// the records of type t for the name at the end of the chain.  On an
+// error the CNAMEs found so far are still returned.  A name with no
+// records of type t is no answers and no error.
+func (res *Resolver) Lookup(name string, t RTYPE) ([]*DNSAnswer, error) {
+	return res.LookupCtx(context.Background(), name, t)
+}
+
+// LookupCtx This is Lookup with a context.  If ctx is done before
+// the answer is found the error is ctx.Err(), along with whatever
+// CNAMEs had been found by then.  Records that came back from the
+// servers before that are still cached.  The RetryPolicy for the
+// lookup can be set with WithRetryPolicy, its Budget with
+// WithBudget and the DNSSEC bits it sends with WithDNSSECFlags.  If
+// MaxConcurrentLookups are already running this waits for one of
+// them to finish first.  Names are tried with the
+// SearchDomains as resolv.conf would.  With DNS64 on, a AAAA lookup
+// of a name which only has A records gets AAAA records made up from
+// them.
+func (res *Resolver) LookupCtx(ctx context.Context, name string, t RTYPE) ([]*DNSAnswer, error) {
+	ctx, leave, ok := res.enter(ctx)
+	if !ok {
+		return nil, ErrClosed
+	}
+	defer leave()
+	ctx, span := res.startSpan(ctx, "dns.lookup", slog.String("dns.name", name), slog.String("dns.type", t.String()))
+	defer span.End()
+	start := time.Now()
+	ctx, reportIfSlow := res.traceSlow(ctx, name, t, start)
+	queried := new(atomic.Bool)
+	ctx = context.WithValue(ctx, lookupQueriedKey{}, queried)
+	answers, err := res.lookupCtx(ctx, name, t)
+	res.metrics.lookedUp(time.Since(start), queried.Load())
+	reportIfSlow(err)
+	span.SetAttributes(slog.Int("dns.answers", len(answers)))
+	if err != nil {
+		span.RecordError(err)
+	}
+	return answers, err
+}
+
+// lookupCtx This does the work for LookupCtx.
+func (res *Resolver) lookupCtx(ctx context.Context, name string, t RTYPE) ([]*DNSAnswer, error) {
+	if err := res.lookups.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer res.lookups.release()
+	// with search domains a name which isn't found is tried again
+	// with the next one, the error being the first one we got
+	var firstErr error
+	for _, candidate := range res.searchNames(name) {
+		answers, err := res.followCNAMEs(ctx, cleanName(candidate), t)
+		if t == RTYPE_AAAA {
+			answers, err = res.synthesizeAAAA(ctx, cleanName(candidate), answers, err)
+		}
+		if len(answers) > 0 || ctx.Err() != nil {
+			return withCallerCase(answers, candidate), err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// followCNAMEs This does the work for Lookup.  A server will often
+// hand back the CNAME along with the records for its target, so we
+// only go and ask again when the answers we have don't already
+// cover the next name in the chain.
+func (res *Resolver) followCNAMEs(ctx context.Context, name string, t RTYPE) ([]*DNSAnswer, error) {
+	if deadline := res.retryPolicy(ctx).Deadline; deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	ctx = res.withBudgetSpent(ctx)
+	answers, err := res.queryLookup(ctx, name, t, false)
+	// An ANY answer includes any CNAME as it is, there is nothing
+	// to follow
+	if t == RTYPE_CNAME || t == RTYPE_ANY {
+		return answers, err
+	}
+	var chain []*DNSAnswer
+	visited := []string{name}
+	for {
+		if final := answersFor(answers, name, t); len(final) > 0 {
+			return append(chain, final...), nil
+		}
+		cnames := answersFor(answers, name, RTYPE_CNAME)
+		if len(cnames) == 0 {
+			return chain, err
+		}
+		// A CNAME we couldn't parse (see RAW_RECORD) can't be followed
+		cname, ok := cnames[0].RData.(CNAME_RECORD)
+		if !ok {
+			return append(chain, cnames[0]), nil
+		}
+		chain = append(chain, cnames[0])
+		name = cleanName(cname.CNAME)
+		for _, seen := range visited {
+			if seen == name {
+				return chain, &CNAMELoopError{Chain: append(visited, name)}
+			}
+		}
+		visited = append(visited, name)
+		if !spendCNAME(ctx) {
+			return chain, ErrCNAMEChainTooLong
+		}
+		if len(answersFor(answers, name, t)) == 0 && len(answersFor(answers, name, RTYPE_CNAME)) == 0 {
+			answers, err = res.queryLookup(ctx, name, t, false)
+		}
+	}
+}
+
+// answersFor The answers of type t for the (cleaned) name
+func answersFor(answers []*DNSAnswer, name string, t RTYPE) []*DNSAnswer {
+	var out []*DNSAnswer
+	for _, answer := range answers {
+		if answer.RType == t && cleanName(answer.RName) == name {
+			out = append(out, answer)
+		}
+	}
+	return out
+}
+
+// WarmParallelism How many lookups WarmCache runs at once on
+// DefaultResolver, see WithWarmParallelism for the others.
+var WarmParallelism = 32
+
+// WithWarmParallelism This is WarmParallelism for the Resolver.
+func WithWarmParallelism(n int) Option {
+	return func(res *Resolver) {
+		*res.warmParallelism = n
+	}
+}
+
+// WarmCache This looks up every type in types for every name in
+// names, WarmParallelism (or the Resolver's own setting) at a time, and returns once they are all
+// done.  It is meant for startup so that the names a service is
+// known to need are already in the cache before it takes traffic.
+func (res *Resolver) WarmCache(names []string, types []RTYPE) {
+	limit := *res.warmParallelism
+	if limit < 1 {
+		limit = 1
+	}
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, name := range names {
+		for _, t := range types {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(name string, t RTYPE) {
+				defer wg.Done()
+				res.followCNAMEs(context.Background(), cleanName(name), t)
+				<-slots
+			}(name, t)
+		}
+	}
+	wg.Wait()
+}
+
+// withCallerCase This rewrites the owner name of every answer for
+// name (however the server or cache had it cased) to exactly how
+// the caller spelled it, minus any trailing '.'.  The answers are
+// always freshly made for each lookup so this can edit them in place.
+func withCallerCase(answers []*DNSAnswer, name string) []*DNSAnswer {
+	clean := cleanName(name)
+	original := strings.TrimSuffix(name, ".")
+	if original == "" {
+		original = "."
+	}
+	for _, answer := range answers {
+		if cleanName(answer.RName) == clean {
+			answer.RName = original
+		}
+	}
+	return answers
+}
+
+// queryLookup This is the actual lookup.  When refresh is set the
+// cache is not consulted for the answer itself (it still is for
+// the nameservers) so that a still-valid entry gets replaced
+// with a fresh one, which is what prefetching needs.  Once ctx is
+// done no more servers get asked and we stop waiting on the one
+// that was.
+//
+// The error is ctx.Err() if ctx is done before we get an answer,
+// ErrNXDomain if the name doesn't exist, a *ServerFailureError if
+// none of the servers for the zone could give us one, a
+// *DelegationLoopError if the delegations never get us to a server
+// that can, ErrNoGlue if the delegation's nameservers have no
+// addresses, ErrNoNameservers if there is no one to ask at all, or
+// ErrTooManyQueries or ErrTooManyReferrals if the lookup used up its
+// Budget first.  If none answered because the RateLimit kept us from
+// asking them, it is a *RateLimitError.
+func (res *Resolver) queryLookup(ctx context.Context, name string, t RTYPE, refresh bool) ([]*DNSAnswer, error) {
 	// rico discsuion
 	// 1.) CLEAN THE STRING
 	// 2.) if the string is empty then return the root server
 	name = cleanName(name)
 
-	// we dont care about CNAME
-	if t == RTYPE_CNAME {
-		return []*DNSAnswer{}
+	// .local names are asked about on the LAN, see MDNSGroups
+	if groups := res.mdnsGroupsFor(name); len(groups) > 0 {
+		return res.mdnsLookup(ctx, name, t, groups)
 	}
 
-	// apparently go needs you to declare var first rather than just the :=
-	// this prevents infinite recursion
-	var QueryLookupWithDepth func(string, int) []*DNSAnswer
-	QueryLookupWithDepth = func(name string, depth int) []*DNSAnswer {
-		// Compute a maximum allowed recursion depth based on how many dots
-		// are in the name to prevent infinit recursion
-		maxDepth := strings.Count(name, ".")
-		if depth > maxDepth {
-			return nil
-		}
+	// each time round is one referral closer to the name, how many
+	// times is limited by the lookup's Budget
+	ctx = res.withBudgetSpent(ctx)
+	trace := tracedLookup(ctx)
+	for missed := false; ; missed = true {
 		// 3.) check cache if it knows; if it does then return it
-		if entry := cacheLookup(name, t); entry != nil && len(entry.data) > 0 {
-			isInCache := make([]*DNSAnswer, len(entry.data))
-			for i, adata := range entry.data {
-				isInCache[i] = &DNSAnswer{
-					RName:  name,
-					RType:  t,
-					RClass: IN,
-					RData:  adata,
+		// (a cached CNAME for the name is an answer as well, the
+		// caller follows it)
+		// only the first look counts in CacheStats, the ones after
+		// each referral and the ones for the address of a glueless
+		// nameserver aren't the client's lookups
+		if !refresh {
+			count := !missed && ctx.Value(gluelessKey{}) == nil
+			if cached := res.cachedLookup(ctx, name, t, count); len(cached) > 0 {
+				res.logCache(ctx, name, t, true)
+				if trace != nil {
+					trace.add(TraceStep{Kind: TraceCacheHit, Name: name, Type: t, Records: derefAnswers(cached)})
 				}
+				return cached, nil
 			}
-			return isInCache
+			if !missed {
+				res.logCache(ctx, name, t, false)
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !queriesLeft(ctx) {
+			return nil, ErrTooManyQueries
 		}
 		// 4.) get the best nameserver or most specific from the cache
-		nsEntry := bestNS(name) // -> rico discussion
-		if nsEntry == nil || len(nsEntry.data) == 0 {
-			return nil
-		}
-		// 5.) get the ip address of that nameserver
-		// 5a.) for data in bestNS(name).data
-		for _, adata := range nsEntry.data {
-			nsRec, isNSRECORD := adata.(NS_RECORD)
-			if !isNSRECORD {
-				continue
+		//     (with Forwarders there is no need, they answer for
+		//     everything)
+		forwarders := res.forwarderAddrs(name)
+		var nsEntry *dnsCacheEntry
+		zone := "."
+		if forwarders == nil {
+			nsEntry, zone = res.bestNS(name) // -> rico discussion
+			if zone == "." {
+				res.maybePrime()
 			}
-			// - lookup the A-RECORD of that NS entry use adata for this variable using adata.(NS_RECORD).NS
-			aRec := cleanName(nsRec.NS)
-			adata := cacheLookup(aRec, RTYPE_A)
-			// - if that A_record is nil then return nil
-			if adata == nil {
-				return nil
+			if nsEntry == nil || len(nsEntry.data) == 0 {
+				return nil, ErrNoNameservers
 			}
-			//	else check if adata.data != nil AND if the length(adata.data) > 0
-			//	if so. then grab the first element and get its netip.Addr maybe a variable named addr := adata.data[0].(A_record).A
-			if adata.data != nil && len(adata.data) > 0 {
-				addr := adata.data[0].(A_RECORD).A
-				// 6.) get the communication manager for the addr from 5.)
-				manager := getServerComm(&addr)
-				// 7.) make a request using dnsRequest_object(requests)
-				req := &serverDNSRequest{
-					name:     name,
-					qtype:    t,
-					response: make(chan *DNSMessage, 1),
-				}
-				// 8.) make/send a request using servercomm.requests <- request
-				manager.requests <- req
-
-				// 9.) wait for response
-				var msg *DNSMessage
-				select {
-				// 9a.) wait for timout
-				case <-time.After(3 * time.Second):
-					msg = nil
-				// 9b.) case response := request.response:
-				case msg = <-req.response:
-				}
-				//	CACHE EVERYTHING
-				//	using this cacheSet(answer.Rname, answer.Rtype, time, []RDATA{ANSWER.Rdata} time.now(add 1 year)
-				// CACHE ANSWERS
-				for _, answers := range msg.Answers {
-					cacheSet(answers.RName, answers.RType, time.Now().Add(365*24*time.Hour), []RDATA{answers.RData})
-				}
-				// CACHE AUTHORITIES
-				for _, authorities := range msg.Authorities {
-					cacheSet(authorities.RName, authorities.RType, time.Now().Add(365*24*time.Hour), []RDATA{authorities.RData})
-				}
-				// CACHE ADDITIONALS
-				for _, additionals := range msg.Additionals {
-					cacheSet(additionals.RName, additionals.RType, time.Now().Add(365*24*time.Hour), []RDATA{additionals.RData})
-				}
-				// then check if answer in cache and if it does then return it
-				if len(msg.Answers) > 0 {
-					out := make([]*DNSAnswer, len(msg.Answers))
-					for i, answer := range msg.Answers {
-						out[i] = &DNSAnswer{
-							RName:  answer.RName,
-							RType:  answer.RType,
-							RClass: IN,
-							RData:  answer.RData,
-						}
-					}
-					return out
+			if trace != nil {
+				trace.add(TraceStep{Kind: TraceDelegation, Name: name, Type: t, Zone: zone, Nameservers: nsNames(nsEntry.data)})
+			}
+		}
+		var err error
+		// 5.) get the ip addresses of those nameservers, best
+		//     first (see rankNameservers)
+		// 6.) - 9.) ask them in turn until one of them answers
+		//     (see askServers)
+		// 5b.) if we have no address for any of them (the delegation
+		//      came without glue) look the addresses up first
+		var msg *DNSMessage
+		if s := spent(ctx); s != nil {
+			s.rateLimited.Store(nil)
+		}
+		if forwarders != nil {
+			msg = res.askServers(withRecursionDesired(ctx), forwarders, name, t)
+		} else if addrs := res.rankNameservers(nsEntry.data); len(addrs) > 0 {
+			msg = res.askServers(ctx, addrs, name, t)
+		} else if msg, err = res.askGluelessServers(ctx, nsEntry.data, name, t); err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil && (msg == nil || serverFailed(msg.Header.Status)) {
+			return nil, ctx.Err()
+		}
+		if (msg == nil || serverFailed(msg.Header.Status)) && !queriesLeft(ctx) {
+			return nil, ErrTooManyQueries
+		}
+		// every server failed, say how the last one did
+		if s := spent(ctx); msg == nil && s != nil && s.rateLimited.Load() != nil {
+			return nil, s.rateLimited.Load()
+		}
+		if msg == nil {
+			return nil, &ServerFailureError{Name: name, Type: t, Zone: zone, Rcode: RCODE_SERVFAIL, Timeout: true}
+		}
+		if serverFailed(msg.Header.Status) {
+			return nil, &ServerFailureError{Name: name, Type: t, Zone: zone, Rcode: msg.Header.Status}
+		}
+		// only believe what the server is authoritative for
+		unfiltered := msg
+		msg = inBailiwick(msg, zone)
+		//	CACHE EVERYTHING
+		//	using the TTL the server gave us for each RRset
+		// CACHE ANSWERS
+		// for the client subnet they hold for, if there is one
+		var scope netip.Prefix
+		if subnet, ok := res.clientSubnet(ctx); ok {
+			scope = ecsScope(msg, subnet)
+		}
+		for _, answers := range groupRRsets(msg.Answers) {
+			answers.subnet = scope
+			answers.authenticated = msg.Header.AuthenticData
+			res.answerSet(*answers, refresh)
+			trace.cached(answers, false)
+		}
+		// CACHE AUTHORITIES
+		// the delegation and its glue go in the infrastructure cache
+		for _, authorities := range groupRRsets(msg.Authorities) {
+			res.referralSet(*authorities)
+			trace.cached(authorities, isReferralSet(authorities))
+		}
+		// CACHE ADDITIONALS
+		for _, additionals := range groupRRsets(msg.Additionals) {
+			res.referralSet(*additionals)
+			trace.cached(additionals, isReferralSet(additionals))
+		}
+		// then check if answer in cache and if it does then return it
+		if len(msg.Answers) > 0 {
+			out := make([]*DNSAnswer, len(msg.Answers))
+			for i, answer := range msg.Answers {
+				out[i] = &DNSAnswer{
+					RName:  answer.RName,
+					RType:  answer.RType,
+					RClass: IN,
+					TTL:    answer.TTL,
+					RData:  answer.RData,
+					// the AD bit covers every record in the answer
+					Authenticated: msg.Header.AuthenticData,
 				}
-				// check if we have better more specific nameserver that was cahced
-				// if we do have a better NS make a recursive call using QueryLookup(name, t)
-				return QueryLookupWithDepth(name, depth+1)
 			}
+			return out, nil
 		}
+		if msg.Header.Status == RCODE_NXNAME {
+			return nil, nxDomain(name)
+		}
+		// a forwarder's answer is the whole answer, there is no
+		// referral to follow
+		if forwarders != nil {
+			return nil, nil
+		}
+		// a referral has to get us closer to the name, one sending us
+		// back to the same zone (or further up) would just go round
+		// and round
+		if selfReferral(unfiltered, zone) {
+			return nil, &DelegationLoopError{Name: name, Zone: zone}
+		}
+		// check if we have better more specific nameserver that was cahced
+		// if we do have a better NS go round again and ask that,
+		// otherwise that was the answer (the name or type doesn't exist)
+		if _, next := res.bestNS(name); next == zone {
+			return nil, nil
+		}
+		if !spendReferral(ctx) {
+			return nil, ErrTooManyReferrals
+		}
+	}
+}
+
+// cachedLookup The answer to name/t from the cache, nil if there
+// isn't one.  When count is set, however many entries it has to
+// try this is one lookup in CacheStats, a hit if the answer cache
+// answered it, and if it gets as far as asking the infrastructure
+// cache one lookup in InfraCacheStats too.  Otherwise nothing is
+// counted.
+func (res *Resolver) cachedLookup(ctx context.Context, name string, t RTYPE, count bool) []*DNSAnswer {
+	if t == RTYPE_ANY {
+		return res.cachedAnyAnswers(name, count)
+	}
+	clean := cleanName(name)
+	tally := func(c *dnsCacheTable, k rrKey, entry *dnsCacheEntry, expired bool) {
+		if count {
+			c.count(clean, k, entry, expired)
+		}
+	}
+	entry, k := res.subnetLookup(ctx, clean, t)
+	if !hasData(entry) {
+		entry, k = res.subnetLookup(ctx, clean, RTYPE_CNAME)
+	}
+	if hasData(entry) {
+		tally(res.cache, k, entry, false)
+		return res.cachedAnswers(name, k.t, entry)
+	}
+	k = inKey(t)
+	entry, expired := res.cache.peek(clean, k)
+	// The NS records in the infrastructure cache are the parent's
+	// copy from a referral, but an NS query wants the zone's own
+	// (authoritative) set, which ends up in the answer cache.
+	if entry == nil && t != RTYPE_NS {
+		infra, infraExpired := res.infra.peek(clean, k)
+		if !hasData(infra) {
+			infra = nil
+		}
+		tally(res.infra, k, infra, infraExpired)
+		if infra != nil {
+			tally(res.cache, k, nil, expired)
+			res.maybePrefetch(name, t, infra)
+			return res.cachedAnswers(name, t, infra)
+		}
+	}
+	if !hasData(entry) {
+		k = inKey(RTYPE_CNAME)
+		entry, _ = res.cache.peek(clean, k)
+	}
+	if !hasData(entry) {
+		tally(res.cache, inKey(t), nil, expired)
 		return nil
 	}
-	return QueryLookupWithDepth(name, 0)
+	tally(res.cache, k, entry, false)
+	res.maybePrefetch(name, t, entry)
+	return res.cachedAnswers(name, k.t, entry)
+}
+
+// hasData Whether entry is there and has records to answer with
+func hasData(entry *dnsCacheEntry) bool {
+	return entry != nil && len(entry.data) > 0
+}
+
+// selfReferral Whether msg, which came from the servers for zone
+// and has no answers, is a referral to zone itself or to a zone
+// above it.  The only referral worth following is to a zone below.
+func selfReferral(msg *DNSMessage, zone string) bool {
+	for _, authority := range msg.Authorities {
+		if authority.RType == RTYPE_NS && inSubtree(zone, cleanName(authority.RName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// inBailiwick This returns a copy of msg with every record which
+// isn't at or below zone removed.  A server only gets to tell us
+// about its own zone, otherwise the server for example.com could
+// hand us an "additional" A record for www.yourbank.com and we'd
+// happily cache it.
+func inBailiwick(msg *DNSMessage, zone string) *DNSMessage {
+	filter := func(records []DNSAnswer) []DNSAnswer {
+		var kept []DNSAnswer
+		for _, record := range records {
+			if inSubtree(cleanName(record.RName), zone) {
+				kept = append(kept, record)
+			}
+		}
+		return kept
+	}
+	filtered := *msg
+	filtered.Answers = filter(msg.Answers)
+	filtered.Authorities = filter(msg.Authorities)
+	filtered.Additionals = filter(msg.Additionals)
+	return &filtered
+}
+
+// cachedAnswers This turns a cache entry for name/t into answers
+func (res *Resolver) cachedAnswers(name string, t RTYPE, entry *dnsCacheEntry) []*DNSAnswer {
+	isInCache := make([]*DNSAnswer, len(entry.data))
+	for i, adata := range entry.data {
+		isInCache[i] = &DNSAnswer{
+			RName:  name,
+			RType:  t,
+			RClass: IN,
+			TTL:    entry.ttl(*res.maxTTL),
+			RData:  adata,
+			// only ever set for the answer cache, see answerSet
+			Authenticated: entry.authenticated,
+		}
+	}
+	return isInCache
+}
+
+// cachedAnyAnswers This answers an ANY query from the cache with
+// every live IN entry in the answer cache for name, in type order.
+// It is whatever we happen to have rather than everything there is,
+// but since RFC 8482 servers only hand back a subset for ANY anyway
+// nobody can count on getting everything.  When count is set it is
+// one lookup in CacheStats.
+func (res *Resolver) cachedAnyAnswers(name string, count bool) []*DNSAnswer {
+	var types []RTYPE
+	for k := range res.cache.shard(name).cached(name).all() {
+		if k.class == IN && !k.subnet.IsValid() {
+			types = append(types, k.t)
+		}
+	}
+	slices.Sort(types)
+	var answers []*DNSAnswer
+	// all of it is one lookup, counted against the first type found
+	var hit *dnsCacheEntry
+	k := inKey(RTYPE_ANY)
+	for _, t := range types {
+		if entry, _ := res.cache.peek(name, inKey(t)); entry != nil {
+			answers = append(answers, res.cachedAnswers(name, t, entry)...)
+			if hit == nil {
+				hit, k = entry, inKey(t)
+			}
+		}
+	}
+	if count {
+		res.cache.count(name, k, hit, false)
+	}
+	return answers
+}
+
+// referralSet This caches a record from the authority or additional
+// section.  NS records and nameserver addresses are what we need to
+// follow delegations, so they go in the infrastructure cache, and
+// anything else (like the SOA on a negative answer) is an answer.
+func (res *Resolver) referralSet(set rrset) {
+	if isReferralSet(&set) {
+		res.infraSet(set.name, set.t, ttlExpires(set.ttl), set.data)
+		return
+	}
+	res.answerSet(set, false)
+}
+
+// isReferralSet Whether referralSet puts set in the infrastructure
+// cache: a delegation or its glue.
+func isReferralSet(set *rrset) bool {
+	switch set.t {
+	case RTYPE_NS, RTYPE_A, RTYPE_AAAA:
+		return set.class == IN
+	}
+	return false
+}
+
+// answerSet This caches an RRset in the answer cache under its own
+// class, replacing whatever is there if replace is set and otherwise
+// just like cacheSet.
+func (res *Resolver) answerSet(set rrset, replace bool) {
+	k := rrKey{set.class, set.t, set.subnet}
+	res.cache.set(set.name, k, res.clampExpires(ttlExpires(set.ttl)), set.data, replace || !*res.mergeRRsets, set.authenticated)
+}
+
+// rrset All the records in a section with the same name, class
+// and type.  The TTL is the lowest of any of them.  subnet is set
+// when they only hold for part of the address space (see
+// WithClientSubnet), and authenticated when the server set the AD
+// bit on the message they came in.
+type rrset struct {
+	name          string
+	class         CLASS
+	t             RTYPE
+	ttl           uint32
+	data          []RDATA
+	subnet        netip.Prefix
+	authenticated bool
+}
+
+// groupRRsets This collects the records of a section into RRsets,
+// in the order each RRset first appears, so that a multi-record
+// RRset is cached in one go.
+func groupRRsets(records []DNSAnswer) []*rrset {
+	var sets []*rrset
+	type setKey struct {
+		name  string
+		class CLASS
+		t     RTYPE
+	}
+	index := make(map[setKey]*rrset)
+	for _, record := range records {
+		name := cleanName(record.RName)
+		// Plenty of servers (and our tests) leave the class as 0,
+		// which can only mean IN since that is all we ask for
+		class := record.RClass
+		if class == 0 {
+			class = IN
+		}
+		key := setKey{name, class, record.RType}
+		set := index[key]
+		if set == nil {
+			set = &rrset{name: name, class: class, t: record.RType, ttl: record.TTL}
+			index[key] = set
+			sets = append(sets, set)
+		}
+		if record.TTL < set.ttl {
+			set.ttl = record.TTL
+		}
+		if !containsRDATA(set.data, record.RData) {
+			set.data = append(set.data, record.RData)
+		}
+	}
+	return sets
+}
+
+// maybePrefetch This kicks off a background refresh of entry if
+// it is both popular and about to expire.  Only one refresh per
+// entry is ever started since the refreshed answer replaces the
+// entry in the cache.
+func (res *Resolver) maybePrefetch(name string, t RTYPE, entry *dnsCacheEntry) {
+	window := *res.prefetchWindow
+	if window <= 0 || entry.pinned || entry.accesses.Load() < *res.prefetchThreshold {
+		return
+	}
+	if time.Until(entry.expires) > window {
+		return
+	}
+	// prefetches are a nice to have, so they only happen when there
+	// is room for them under MaxConcurrentLookups
+	if ok, _ := res.lookups.tryAcquire(); !ok {
+		return
+	}
+	if !entry.prefetching.CompareAndSwap(false, true) {
+		res.lookups.release()
+		return
+	}
+	// an authenticated entry is refreshed the way it was fetched,
+	// otherwise the fresh copy would lose the AD bit
+	authenticated := entry.authenticated
+	started := res.background(func(ctx context.Context) {
+		defer res.lookups.release()
+		// if the refresh failed the entry is still the one in the
+		// cache, and it has to be able to be refreshed again
+		defer entry.prefetching.Store(false)
+		if authenticated {
+			ctx = WithDNSSECFlags(ctx, DNSSECFlags{DO: true})
+		}
+		res.queryLookup(ctx, name, t, true)
+	})
+	if !started {
+		entry.prefetching.Store(false)
+		res.lookups.release()
+	}
 }
 
 // The protocol for generating a request to a server:
@@ -356,15 +1205,120 @@ func QueryLookup(name string, t RTYPE) []*DNSAnswer {
 // Critically, however, a server may simply not respond.  In this
 // case the process will need to instead have a timeout and go on
 // to try another server.
+//
+// ctx is the context of the lookup the request is for, once it is
+// done nobody is waiting for the response any more so the manager
+// can drop the request.  tcp means the request has to go over TCP,
+// because the answer over UDP came back truncated.  id is the query
+// ID to send (which a manager may change, so no two requests in
+// flight to the server share one, see track) and server the address
+// it goes to, which is what deliver checks responses against.  edns, unless it is nil, goes
+// in an OPT record in the additional section (see EDNS.record).  rd
+// and cd are the RD and CD bits for the header (see Forwarders and
+// WithDNSSECFlags).  deadline is
+// when the lookup stops waiting for the response, after which there
+// is no point the manager listening for it either.
 type serverDNSRequest struct {
+	ctx      context.Context
+	id       uint16
+	server   netip.Addr
 	name     string
 	qtype    RTYPE
+	tcp      bool
+	edns     *EDNS
+	rd       bool
+	cd       bool
+	deadline time.Time
 	response chan *DNSMessage
+	// over UDP the query is sent again after retransmit without an
+	// answer, up to retransmits times (see RetryPolicy.Retransmit)
+	retransmit  time.Duration
+	retransmits int
+	// how many times it has been sent again so far
+	retransmitted atomic.Int32
+	// the MAC the query was signed with, if the server has a TSIG
+	// key, under the manager's inflightLock
+	mac []byte
 }
 
+// serverCommManager This is what requests for one server go
+// through.  It also keeps track of how the server has been doing, a
+// smoothed RTT and how many times in a row it has failed us, which
+// is what rankNameservers picks servers by.
 type serverCommManager struct {
 	remote   *netip.Addr
 	requests chan *serverDNSRequest
+
+	// srtt is in nanoseconds, 0 until the server first answers.
+	// lastFailure is the UnixNano time of the latest failure, and
+	// downUntil when the server stops being marked down (see
+	// BreakerThreshold).
+	srtt        atomic.Int64
+	failures    atomic.Uint32
+	lastFailure atomic.Int64
+	downUntil   atomic.Int64
+	// noEDNS is set once the server has shown it doesn't do EDNS
+	noEDNS atomic.Bool
+
+	// Our client cookie for the server and the last server cookie
+	// it gave us (see DNSCookies), both under cookieLock
+	cookieLock   sync.Mutex
+	clientCookie []byte
+	serverCookie []byte
+
+	// The connection to the server that TCP requests share (see
+	// tcpConn), nil when there isn't one open, under tcpLock.  If
+	// tls is set every request goes over it, wrapped in TLS (see
+	// DoTServers).  If doh or doq is set the requests go over
+	// HTTPS or QUIC instead (see DoHServers and DoQServers).
+	tcpLock sync.Mutex
+	tcp     *tcpConn
+	tls     *tls.Config
+	doh     *dohUpstream
+	doq     *doqUpstream
+
+	// How many callers of getServerComm haven't released the
+	// manager yet, when it was last released as UnixNano, and the
+	// timer that closes it once it has been idle for
+	// IdleServerTimeout (see watchIdle)
+	refs      atomic.Int32
+	lastUsed  atomic.Int64
+	idleTimer *time.Timer
+
+	// The requests sent to the server that haven't been answered or
+	// given up on yet, by query ID (see track), under inflightLock
+	inflightLock sync.Mutex
+	inflight     map[uint16]*inflightRequest
+
+	// The server's bucket for RateLimit
+	bucket tokenBucket
+
+	// The key queries to the server are signed with, nil if they
+	// aren't (see TSIGKeys)
+	tsig *TSIGKey
+
+	// The logger setting of the Resolver the manager is for (see
+	// Logger), its counters (see Metrics), its settings for what
+	// goes into queries (see CaseRandomization, DNSCookies and
+	// UDPPayloadSize), for marking the server down (see
+	// BreakerThreshold) and for TCP (see AlwaysTCP and
+	// TCPIdleTimeout), set by establishServerComm
+	logger            **slog.Logger
+	metrics           *resolverMetrics
+	caseRandomization *bool
+	cookies           *bool
+	udpPayloadSize    *uint16
+	breakerThreshold  *int
+	breakerBackoff    *time.Duration
+	breakerMaxBackoff *time.Duration
+	alwaysTCP         *bool
+	tcpIdleTimeout    *time.Duration
+
+	// closeOnce makes sure close only happens once, and stopped (nil
+	// for managers not made by netCommManager) is closed once the
+	// goroutines sending its requests have all returned
+	closeOnce sync.Once
+	stopped   chan struct{}
 }
 
 type serverCommUnit struct {
@@ -377,34 +1331,43 @@ type serverCommUnit struct {
 	entries map[netip.Addr]*serverCommManager
 }
 
-var serverCommCache []*serverCommUnit
-
 // And this inits the cache for server communication.
 func InitServerComm(n uint) {
-	serverCommCache = make([]*serverCommUnit, n)
+	DefaultResolver.initServerComm(n)
+}
+
+func (res *Resolver) initServerComm(n uint) {
+	res.serverComm = make([]*serverCommUnit, n)
 	for i := uint(0); i < n; i++ {
-		serverCommCache[i] = &serverCommUnit{}
+		res.serverComm[i] = &serverCommUnit{}
 	}
 }
 
-func getServerComm(addr *netip.Addr) *serverCommManager {
+func (res *Resolver) getServerComm(addr *netip.Addr) *serverCommManager {
+	// an IPv4 mapped address is the IPv4 one, so both get the same
+	// manager
+	unmapped := addr.Unmap()
+	addr = &unmapped
 	// TODO you need to implement this
 	// this picks which serverCommUnit hunk holds
 
-	hunk_index := serverHash(addr) % uint32(len(serverCommCache))
-	key := serverCommCache[hunk_index]
+	hunk_index := res.serverHash(addr) % uint32(len(res.serverComm))
+	key := res.serverComm[hunk_index]
 	key.lock.RLock()
 	key_entries := key.entries
 
 	// cache hit
 	existing_manager, isCached := key_entries[*addr]
 	if isCached {
+		// taken while the lock is held so closeIdleServerComm can't
+		// close it in between (see release)
+		existing_manager.refs.Add(1)
 		key.lock.RUnlock()
 		return existing_manager
 	}
 	// cache miss
 	key.lock.RUnlock()
-	comm_manager := establishServerComm(addr)
+	comm_manager := res.establishServerComm(addr)
 
 	return comm_manager
 }
@@ -413,17 +1376,39 @@ func getServerComm(addr *netip.Addr) *serverCommManager {
 // make sure that there isn't another write that happened in the meantime.
 // If there isn't it should invoke commConnect to get the new server manager
 // to be set/returned.
-func establishServerComm(addr *netip.Addr) *serverCommManager {
+//
+// Either way the manager comes back in use, and has to be released
+// once the caller is done with it.
+func (res *Resolver) establishServerComm(addr *netip.Addr) *serverCommManager {
 	// TODO you need to implement this.
-	hunk_index := serverHash(addr) % uint32(len(serverCommCache))
-	key := serverCommCache[hunk_index]
+	hunk_index := res.serverHash(addr) % uint32(len(res.serverComm))
+	key := res.serverComm[hunk_index]
 
 	key.lock.Lock()
 	defer key.lock.Unlock()
 
+	// someone else may have won the race between our RUnlock
+	// in getServerComm and grabbing the write lock here
+	if existing_manager, isCached := key.entries[*addr]; isCached {
+		existing_manager.refs.Add(1)
+		return existing_manager
+	}
+	if key.entries == nil {
+		key.entries = make(map[netip.Addr]*serverCommManager)
+	}
+
 	// cache miss
-	//new_manager := key_entries[*addr]
-	new_manager := commConnect(addr)
+	new_manager := res.commConnect(addr)
+	// before anyone else can get at it, so its goroutines only
+	// ever see it set
+	new_manager.logger, new_manager.metrics = res.logger, res.metrics
+	new_manager.caseRandomization, new_manager.cookies = res.caseRandomization, res.cookies
+	new_manager.udpPayloadSize = res.udpPayloadSize
+	new_manager.breakerThreshold, new_manager.breakerBackoff, new_manager.breakerMaxBackoff = res.breakerThreshold, res.breakerBackoff, res.breakerMaxBackoff
+	new_manager.alwaysTCP, new_manager.tcpIdleTimeout = res.alwaysTCP, res.tcpIdleTimeout
+	new_manager.refs.Add(1)
+	key.entries[*addr] = new_manager
+	res.watchIdle(key, new_manager)
 
 	return new_manager
 }
@@ -431,10 +1416,15 @@ func establishServerComm(addr *netip.Addr) *serverCommManager {
 // commConnect We have our function to create an interface
 // to the server manager be a variable rather than a declared
 // function to enable testing:  The test infrastructure will use
-// a mock version of the function to establish a connection.  If we were
-// building a complete server we wolud have this function
-// instead do the actual connections.
-// This needs to be exposed for now.
+// a mock version of the function to establish a connection.  By
+// default it is netCommManager, which does the actual connections.
+// This needs to be exposed for now.  Only DefaultResolver uses it
+// (see plainConnect), the others go straight to netCommManager.
 
-// For now we only accept IPv4 (A) record based addresses.
-var commConnect func(*netip.Addr) *serverCommManager
+// The address may be either IPv4 or IPv6, depending on which glue
+// the nameserver had.  Whatever the manager receives goes to the
+// request through its deliver, which drops anything that isn't
+// really the response.
+var commConnect = func(addr *netip.Addr) *serverCommManager {
+	return netCommManager(&serverCommManager{remote: addr}, nil)
+}
@@ -0,0 +1,609 @@
+package dns
+
+import (
+	"iter"
+	"net/netip"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rrKey What entries are keyed on within a name.  The class is part
+// of it so that a CHAOS TXT record can never be handed out for an
+// IN TXT query, or the other way round.  subnet is the zero Prefix
+// except for answers which only hold for part of the address space
+// (see WithClientSubnet).
+type rrKey struct {
+	class  CLASS
+	t      RTYPE
+	subnet netip.Prefix
+}
+
+// inKey The key for type t in class IN, which is all we resolve
+func inKey(t RTYPE) rrKey {
+	return rrKey{class: IN, t: t}
+}
+
+// dnsCacheTypes The entries cached for one name.  Each type has its
+// own slot, so replacing the entry for a type already there is just
+// a store into the slot.
+type dnsCacheTypes map[rrKey]*atomic.Pointer[dnsCacheEntry]
+
+// dnsCacheName Everything cached for a single name.  The types
+// map is copy-on-write: it is never changed once stored, instead
+// writers (holding lock) build a new one and swap it in whenever a
+// type is added or removed, so lookups can read it without taking
+// any lock at all.
+type dnsCacheName struct {
+	lock  sync.Mutex
+	types atomic.Pointer[dnsCacheTypes]
+	// Set (under lock) once the name has been taken out of its
+	// shard.  Anyone who finds it set after getting the lock needs
+	// to go look the name up again.
+	removed bool
+}
+
+// dnsCacheTable This is a complete sharded cache: the shards
+// themselves plus the bookkeeping that goes with them.  Each
+// Resolver has two of these, cache for answers and infra for the
+// nameserver records and glue needed to chase delegations, so
+// that a flood of one-off lookups can't push out what we need
+// to resolve anything at all.
+type dnsCacheTable struct {
+	// The current set of shards.  It is only ever replaced
+	// wholesale by init or resize, so use shardList (or
+	// shard/lockName) to get at it.
+	shards atomic.Pointer[[]*dnsCacheUnit]
+	// The total over all the shards of dnsCacheUnit.bytes
+	bytes atomic.Int64
+	// The limit on bytes, 0 for no limit.  This points at the
+	// Resolver's setting (for DefaultResolver the package level
+	// one) so it can be changed at any time.
+	maxBytes *int64
+	// The Resolver's MaxCacheTTL and cache hooks, the same way
+	maxTTL *time.Duration
+	hooks  *cacheHooks
+	// evictFirst This is the eviction policy:  It returns
+	// whether a should be thrown out before b.
+	evictFirst func(a, b *dnsCacheEntry) bool
+	// hash This picks the shard for a name, see nameHash
+	hash func(string) uint32
+	// Whether this is the infrastructure cache
+	infra bool
+
+	// Only one resize at a time
+	resizeLock sync.Mutex
+	// The counters from shards thrown away by resize, so the
+	// aggregate numbers keep counting up across a resize.
+	retiredLock     sync.Mutex
+	retiredCounters CacheShardStats
+}
+
+// soonestExpiring The eviction policy for the answer cache, the
+// entries closest to expiry (so already expired ones) go first.
+func soonestExpiring(a, b *dnsCacheEntry) bool {
+	return a.expires.Before(b.expires)
+}
+
+// leastUsed The eviction policy for the infrastructure cache.
+// Expired entries go first, after that it is the ones which have
+// been used the least, since a delegation we keep coming back to
+// is worth far more than one we saw once.
+func leastUsed(a, b *dnsCacheEntry) bool {
+	now := time.Now()
+	if a.expiredAt(now) != b.expiredAt(now) {
+		return a.expiredAt(now)
+	}
+	return a.uses.Load() < b.uses.Load()
+}
+
+// init This throws away everything and starts again with n shards
+func (c *dnsCacheTable) init(n uint) {
+	c.bytes.Store(0)
+	c.retiredLock.Lock()
+	c.retiredCounters = CacheShardStats{}
+	c.retiredLock.Unlock()
+	shards := c.newShards(n)
+	c.shards.Store(&shards)
+}
+
+func (c *dnsCacheTable) newShards(n uint) []*dnsCacheUnit {
+	shards := make([]*dnsCacheUnit, n)
+	for i := uint(0); i < n; i++ {
+		shards[i] = &dnsCacheUnit{table: c}
+	}
+	return shards
+}
+
+// shardList The current set of shards
+func (c *dnsCacheTable) shardList() []*dnsCacheUnit {
+	return *c.shards.Load()
+}
+
+// shard This finds the shard for the (cleaned) name without
+// locking anything, which is all lookups need.
+func (c *dnsCacheTable) shard(name string) *dnsCacheUnit {
+	for {
+		shards := c.shardList()
+		key := shards[c.hash(name)%uint32(len(shards))]
+		if !key.retired.Load() {
+			return key
+		}
+	}
+}
+
+// lockName This finds the shard for the (cleaned) name, takes the
+// shard's lock shared and then locks the name itself, which is what
+// is needed to change anything for that name.  If the cache got
+// resized while we were waiting for the shard we try again with the
+// new set of shards.  Unless create is set, a name which isn't in
+// the cache is not added and comes back nil (with the shard still
+// locked).
+func (c *dnsCacheTable) lockName(name string, create bool) (*dnsCacheUnit, *dnsCacheName) {
+	for {
+		shards := c.shardList()
+		key := shards[c.hash(name)%uint32(len(shards))]
+		key.lock.RLock()
+		if !key.retired.Load() {
+			return key, key.lockNameLocked(name, create)
+		}
+		key.lock.RUnlock()
+	}
+}
+
+// lockNameLocked This is the second half of lockName.  A name which
+// got removed from the shard while we waited for its lock is no use
+// to us so we go and get (or make) the one that replaced it.
+func (key *dnsCacheUnit) lockNameLocked(name string, create bool) *dnsCacheName {
+	for {
+		v, ok := key.names.Load(name)
+		if !ok {
+			if !create {
+				return nil
+			}
+			v, _ = key.names.LoadOrStore(name, &dnsCacheName{})
+		}
+		n := v.(*dnsCacheName)
+		n.lock.Lock()
+		if !n.removed {
+			return n
+		}
+		n.lock.Unlock()
+	}
+}
+
+// update This runs fn with the lock for name held (see lockName),
+// then once that lock has been let go evicts from the shard if the
+// cache has gone over its limit, and finally makes any hook calls
+// fn queued up.  fn isn't called at all if create isn't set and
+// there is nothing cached for name.
+func (c *dnsCacheTable) update(name string, create bool, fn func(key *dnsCacheUnit, n *dnsCacheName, events *cacheEvents)) {
+	var events cacheEvents
+	key, n := c.lockName(name, create)
+	if n != nil {
+		fn(key, n, &events)
+		n.lock.Unlock()
+	}
+	if limit := *c.maxBytes; limit > 0 && c.bytes.Load() > limit {
+		key.evict(name, &events)
+	}
+	key.lock.RUnlock()
+	events.fire()
+}
+
+// walk This calls fn on every shard with its lock held exclusively,
+// one shard at a time, so fn can change any name in the shard
+// without locking the name.  If the cache gets resized part way
+// through we go over the new shards again, so fn needs to be
+// something that is fine to repeat (like deleting things).
+func (c *dnsCacheTable) walk(fn func(key *dnsCacheUnit, events *cacheEvents)) {
+	for {
+		current := c.shards.Load()
+		for _, key := range *current {
+			var events cacheEvents
+			key.lock.Lock()
+			if !key.retired.Load() {
+				fn(key, &events)
+			}
+			key.lock.Unlock()
+			events.fire()
+		}
+		if c.shards.Load() == current {
+			return
+		}
+	}
+}
+
+// resize This changes the number of shards while the cache is in
+// use.  Every old shard is locked exclusively while its names are
+// copied over to the new ones, and it stays locked until the new
+// shards have been swapped in, at which point it is marked retired
+// so that anything which was waiting on it goes and looks again.
+// Lookups carry on reading the old shards until then, which is
+// fine since nothing can change them while they are locked; a shard
+// is never retired while it is still in the current set, so shard
+// doesn't have to go round waiting for the swap.
+func (c *dnsCacheTable) resize(n uint) {
+	if n == 0 {
+		return
+	}
+	c.resizeLock.Lock()
+	defer c.resizeLock.Unlock()
+
+	old := c.shardList()
+	shards := c.newShards(n)
+	// Always lock in order, and nothing else ever holds more than
+	// one shard lock at a time, so this can't deadlock.
+	for _, key := range old {
+		key.lock.Lock()
+	}
+	for _, key := range old {
+		key.names.Range(func(kname, v any) bool {
+			name := kname.(string)
+			dst := shards[c.hash(name)%uint32(n)]
+			// The types map itself is never changed once it has
+			// been stored, so the new shard can share it.
+			copied := &dnsCacheName{}
+			types := v.(*dnsCacheName).types.Load()
+			copied.types.Store(types)
+			for _, entry := range copied.all() {
+				dst.bytes.Add(entry.size)
+			}
+			dst.names.Store(name, copied)
+			return true
+		})
+	}
+	c.shards.Store(&shards)
+	for _, key := range old {
+		key.retired.Store(true)
+		c.retireStats(key)
+		key.lock.Unlock()
+	}
+}
+
+// lookup This will look up the entry in the cache for the given
+// (cleaned) name and rtype.  If the name doesn't exist, the rtype
+// doesn't exist, or the record is expired it returns nil.  This
+// doesn't take any locks at all, see dnsCacheName.  It counts as a
+// lookup in the stats, so it is only for lookups made for a client.
+func (c *dnsCacheTable) lookup(name string, k rrKey) *dnsCacheEntry {
+	entry, expired := c.peek(name, k)
+	c.count(name, k, entry, expired)
+	return entry
+}
+
+// peek This is lookup without counting it in the stats, calling
+// the hit hook or counting towards PrefetchThreshold, for the
+// lookups made along the way (finding the nameservers for a zone
+// and their addresses and so on) rather than for a client.  expired says whether there was an entry but
+// it had expired.
+func (c *dnsCacheTable) peek(name string, k rrKey) (*dnsCacheEntry, bool) {
+	return c.shard(name).peekEntry(name, k)
+}
+
+// peekEntry This does the actual work of peek.
+func (key *dnsCacheUnit) peekEntry(name string, k rrKey) (*dnsCacheEntry, bool) {
+	domainCache, inCache := key.cached(name).entry(k)
+	if !inCache {
+		return nil, false
+	}
+	if domainCache.expiredAt(time.Now()) {
+		return nil, true
+	}
+	domainCache.uses.Add(1)
+	return domainCache, false
+}
+
+// count This counts a lookup made for a client in the stats: a hit
+// if entry (the entry for name/k) answered it, which is also one
+// more time the entry was handed out (see maybePrefetch), otherwise
+// a miss, which expired says was down to the entry having expired.
+func (c *dnsCacheTable) count(name string, k rrKey, entry *dnsCacheEntry, expired bool) {
+	key := c.shard(name)
+	key.lookups.Add(1)
+	if entry == nil {
+		key.misses.Add(1)
+		if expired {
+			key.expired.Add(1)
+		}
+		return
+	}
+	key.hits.Add(1)
+	entry.accesses.Add(1)
+	if hit := *c.hooks.hit; hit != nil {
+		hit(key.event(name, k, entry))
+	}
+}
+
+// cached This returns what is cached for the (cleaned) name, nil if
+// there is nothing.
+func (key *dnsCacheUnit) cached(name string) *dnsCacheName {
+	v, ok := key.names.Load(name)
+	if !ok {
+		return nil
+	}
+	return v.(*dnsCacheName)
+}
+
+// get The current types map for the name, nil if there is none (or
+// the name is nil).  The map must not be modified.
+func (n *dnsCacheName) get() dnsCacheTypes {
+	if n == nil {
+		return nil
+	}
+	if types := n.types.Load(); types != nil {
+		return *types
+	}
+	return nil
+}
+
+// entry The entry for k, if there is one
+func (n *dnsCacheName) entry(k rrKey) (*dnsCacheEntry, bool) {
+	slot, ok := n.get()[k]
+	if !ok {
+		return nil, false
+	}
+	return slot.Load(), true
+}
+
+// all This iterates over the types cached for the name and their
+// entries.
+func (n *dnsCacheName) all() iter.Seq2[rrKey, *dnsCacheEntry] {
+	return func(yield func(rrKey, *dnsCacheEntry) bool) {
+		for k, slot := range n.get() {
+			if !yield(k, slot.Load()) {
+				return
+			}
+		}
+	}
+}
+
+// store This sets the entry for the (cleaned) name and type.
+// Unless pinned is set, it won't replace a pinned entry.
+func (c *dnsCacheTable) store(name string, k rrKey, expires time.Time, data []RDATA, pinned bool) {
+	c.update(name, true, func(key *dnsCacheUnit, n *dnsCacheName, events *cacheEvents) {
+		key.putLocked(n, name, k, expires, data, pinned, false, events)
+	})
+}
+
+// merge This is store except that if there is already a live entry
+// for name/k the new data is added to it rather than replacing
+// it.  Records we already have aren't duplicated, and the merged
+// entry expires whenever the earlier of the two would have, so
+// nothing ever outlives the TTL it came with.  It is only
+// authenticated if both halves were.
+func (c *dnsCacheTable) merge(name string, k rrKey, expires time.Time, data []RDATA, authenticated bool) {
+	c.update(name, true, func(key *dnsCacheUnit, n *dnsCacheName, events *cacheEvents) {
+		if old, ok := n.entry(k); ok && !old.pinned && !old.expiredAt(time.Now()) {
+			merged := append([]RDATA(nil), old.data...)
+			for _, rdata := range data {
+				if !containsRDATA(merged, rdata) {
+					merged = append(merged, rdata)
+				}
+			}
+			if old.expires.Before(expires) {
+				expires = old.expires
+			}
+			data = merged
+			authenticated = authenticated && old.authenticated
+		}
+		key.putLocked(n, name, k, expires, data, false, authenticated, events)
+	})
+}
+
+// containsRDATA Whether rdata is already in data.  This compares
+// deeply since not every RDATA type can be compared with ==.
+func containsRDATA(data []RDATA, rdata RDATA) bool {
+	for _, have := range data {
+		if reflect.DeepEqual(have, rdata) {
+			return true
+		}
+	}
+	return false
+}
+
+// putLocked This does the actual work of store.  The lock for
+// the name needs to be held.
+func (key *dnsCacheUnit) putLocked(n *dnsCacheName, name string, k rrKey, expires time.Time, data []RDATA, pinned, authenticated bool, events *cacheEvents) {
+	newvar := &dnsCacheEntry{
+		expires:       expires,
+		data:          data,
+		size:          entrySize(name, data),
+		pinned:        pinned,
+		authenticated: authenticated,
+	}
+	// throw that new variable into the entries of the cache entry
+	if old, ok := n.entry(k); ok {
+		if old.pinned && !pinned {
+			return
+		}
+		if old.expiredAt(time.Now()) {
+			events.add(*key.table.hooks.expire, key, name, k, old)
+		}
+		key.account(-old.size)
+	}
+	n.set(k, newvar)
+	key.account(newvar.size)
+	key.inserts.Add(1)
+	events.add(*key.table.hooks.insert, key, name, k, newvar)
+}
+
+// set This stores entry as the one for k.  If k already has a slot
+// the entry just goes in it.  Otherwise, since lookups read the
+// types map without any lock, it is never changed in place: it gets
+// copied with the new slot added and the copy swapped in.  The lock
+// for the name needs to be held.
+func (n *dnsCacheName) set(k rrKey, entry *dnsCacheEntry) {
+	old := n.get()
+	if slot, ok := old[k]; ok {
+		slot.Store(entry)
+		return
+	}
+	types := make(dnsCacheTypes, len(old)+1)
+	for okey, oslot := range old {
+		types[okey] = oslot
+	}
+	slot := new(atomic.Pointer[dnsCacheEntry])
+	slot.Store(entry)
+	types[k] = slot
+	n.types.Store(&types)
+}
+
+// flushName This removes every non-pinned type cached for name
+func (c *dnsCacheTable) flushName(name string) {
+	c.update(name, false, func(key *dnsCacheUnit, n *dnsCacheName, events *cacheEvents) {
+		for k := range n.all() {
+			key.flushLocked(n, name, k, events)
+		}
+	})
+}
+
+// flushType This removes the entries of type t for name, in any
+// class, unless they are pinned
+func (c *dnsCacheTable) flushType(name string, t RTYPE) {
+	c.update(name, false, func(key *dnsCacheUnit, n *dnsCacheName, events *cacheEvents) {
+		for k := range n.all() {
+			if k.t == t {
+				key.flushLocked(n, name, k, events)
+			}
+		}
+	})
+}
+
+// flushSubtree This removes suffix and every name below it, apart
+// from pinned entries.  Since the names are spread over all the
+// shards by hash we have to walk every one of them, but we only
+// ever hold one shard's lock at a time.
+func (c *dnsCacheTable) flushSubtree(suffix string) {
+	c.walk(func(key *dnsCacheUnit, events *cacheEvents) {
+		key.names.Range(func(kname, v any) bool {
+			name, n := kname.(string), v.(*dnsCacheName)
+			if inSubtree(name, suffix) {
+				for k := range n.all() {
+					key.flushLocked(n, name, k, events)
+				}
+			}
+			return true
+		})
+	})
+}
+
+// unpin This removes a pinned entry, leaving unpinned ones alone
+func (c *dnsCacheTable) unpin(name string, k rrKey) {
+	c.update(name, false, func(key *dnsCacheUnit, n *dnsCacheName, events *cacheEvents) {
+		if entry, ok := n.entry(k); ok && entry.pinned {
+			events.dropped(key, name, k, entry)
+			key.removeLocked(n, name, k)
+		}
+	})
+}
+
+// sweep This deletes every entry which has expired (removeLocked
+// takes care of pruning any name left with no entries at all).
+func (c *dnsCacheTable) sweep() {
+	c.walk(func(key *dnsCacheUnit, events *cacheEvents) {
+		now := time.Now()
+		key.names.Range(func(kname, v any) bool {
+			name, n := kname.(string), v.(*dnsCacheName)
+			for k, entry := range n.all() {
+				if entry.expiredAt(now) {
+					events.add(*key.table.hooks.expire, key, name, k, entry)
+					key.removeLocked(n, name, k)
+				}
+			}
+			return true
+		})
+	})
+}
+
+// account This adjusts the byte counts for the shard and the total.
+func (key *dnsCacheUnit) account(delta int64) {
+	key.bytes.Add(delta)
+	key.table.bytes.Add(delta)
+}
+
+// removeLocked This deletes the entry for name/k, if there is one,
+// and the name itself if it has nothing else left.  Either the lock
+// for the name or the shard's lock held exclusively is needed.
+func (key *dnsCacheUnit) removeLocked(n *dnsCacheName, name string, k rrKey) bool {
+	old := n.get()
+	entry, ok := n.entry(k)
+	if !ok {
+		return false
+	}
+	key.account(-entry.size)
+	if len(old) == 1 {
+		n.types.Store(nil)
+		n.removed = true
+		key.names.CompareAndDelete(name, n)
+		return true
+	}
+	types := make(dnsCacheTypes, len(old)-1)
+	for okey, oslot := range old {
+		if okey != k {
+			types[okey] = oslot
+		}
+	}
+	n.types.Store(&types)
+	return true
+}
+
+// flushLocked This removes a non-pinned entry and counts it as an
+// eviction.  The same locking as removeLocked is needed.
+func (key *dnsCacheUnit) flushLocked(n *dnsCacheName, name string, k rrKey, events *cacheEvents) {
+	if entry, ok := n.entry(k); ok && !entry.pinned {
+		events.dropped(key, name, k, entry)
+		key.removeLocked(n, name, k)
+		key.evictions.Add(1)
+	}
+}
+
+// evict This throws out entries from this shard, in the order
+// given by the table's eviction policy, until the table is back
+// under its limit or there is nothing left in the shard besides
+// pinned entries and whatever is cached for keepName, which we just
+// wrote to.  The shard's lock needs to be held shared, but no name
+// locks, since we lock each name we evict from in turn.  Each shard
+// only ever evicts from itself, which means the total can briefly
+// sit above the limit until inserts into other shards catch up.
+func (key *dnsCacheUnit) evict(keepName string, events *cacheEvents) {
+	type candidate struct {
+		name  string
+		k     rrKey
+		entry *dnsCacheEntry
+	}
+	var candidates []candidate
+	key.names.Range(func(kname, v any) bool {
+		name := kname.(string)
+		if name == keepName {
+			return true
+		}
+		for k, entry := range v.(*dnsCacheName).all() {
+			if !entry.pinned {
+				candidates = append(candidates, candidate{name, k, entry})
+			}
+		}
+		return true
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		return key.table.evictFirst(candidates[i].entry, candidates[j].entry)
+	})
+	for _, c := range candidates {
+		if key.table.bytes.Load() <= *key.table.maxBytes {
+			return
+		}
+		n := key.lockNameLocked(c.name, false)
+		if n == nil {
+			continue
+		}
+		// Someone else may have replaced or removed it already
+		if entry, _ := n.entry(c.k); entry == c.entry {
+			events.dropped(key, c.name, c.k, c.entry)
+			key.removeLocked(n, c.name, c.k)
+			key.evictions.Add(1)
+		}
+		n.lock.Unlock()
+	}
+}
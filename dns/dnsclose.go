@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed What a lookup on a Resolver that has been closed gets
+var ErrClosed = errors.New("dns: resolver closed")
+
+// Close This shuts the Resolver down for good.  Lookups still going
+// are cancelled, as are the queries they have out, and Close waits
+// for them to return, along with everything the Resolver has going
+// in the background (prefetching, priming, StartCacheSweeper and
+// StartTrustAnchorUpdates).  Then every server manager is closed
+// with its sockets and connections, so nothing of the Resolver is
+// left running.  Lookups after Close fail with ErrClosed.  Calling
+// Close again does nothing.
+func (res *Resolver) Close() error {
+	res.lifeLock.Lock()
+	if res.closed {
+		res.lifeLock.Unlock()
+		return nil
+	}
+	res.closed = true
+	res.lifeLock.Unlock()
+	res.shutdown()
+	res.running.Wait()
+	for _, key := range res.serverComm {
+		key.lock.Lock()
+		for addr, manager := range key.entries {
+			if manager.idleTimer != nil {
+				manager.idleTimer.Stop()
+			}
+			delete(key.entries, addr)
+			manager.close()
+		}
+		key.lock.Unlock()
+	}
+	return nil
+}
+
+// begin This counts something that uses the Resolver in as running,
+// so that Close waits for it, unless the Resolver is closed.  It
+// has to call res.running.Done once it is finished.
+func (res *Resolver) begin() bool {
+	res.lifeLock.Lock()
+	defer res.lifeLock.Unlock()
+	if res.closed {
+		return false
+	}
+	res.running.Add(1)
+	return true
+}
+
+// enter This is begin for something with a context, which it gets
+// back cancelled once the Resolver is closed as well.  leave has to
+// be called once it is finished.
+func (res *Resolver) enter(ctx context.Context) (_ context.Context, leave func(), ok bool) {
+	if !res.begin() {
+		return ctx, nil, false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(res.done, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		res.running.Done()
+	}, true
+}
+
+// background This runs f in a goroutine of its own, with a context
+// which is cancelled when the Resolver is closed, and which Close
+// waits for.  It does nothing once the Resolver is closed.
+func (res *Resolver) background(f func(ctx context.Context)) bool {
+	if !res.begin() {
+		return false
+	}
+	go func() {
+		defer res.running.Done()
+		f(res.done)
+	}()
+	return true
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClose(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	// a server that never answers, so the lookup is still waiting
+	// when the resolver is closed
+	queried := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+			select {
+			case queried <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	res := withSingleRoot(New(
+		WithDial(dialLocal(conn.LocalAddr().String())),
+		WithDefaultRetryPolicy(RetryPolicy{Timeout: 10 * time.Second}),
+	))
+	done := make(chan error, 1)
+	go func() {
+		_, err := res.Lookup("www.example.com", RTYPE_A)
+		done <- err
+	}()
+	<-queried
+	root := parseAddrNoerror("198.41.0.4")
+	manager := res.getServerComm(&root)
+	manager.release()
+
+	start := time.Now()
+	if err := res.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("the lookup succeeded with no answer")
+		}
+	default:
+		t.Fatalf("Close returned before the lookup did")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Close took %v", elapsed)
+	}
+	select {
+	case <-manager.stopped:
+	default:
+		t.Errorf("the manager is still sending")
+	}
+	for _, key := range res.serverComm {
+		if len(key.entries) != 0 {
+			t.Errorf("managers left after Close: %v", key.entries)
+		}
+	}
+	if _, err := res.Lookup("www.example.com", RTYPE_A); !errors.Is(err, ErrClosed) {
+		t.Errorf("lookup after Close got %v, want ErrClosed", err)
+	}
+	if err := res.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
@@ -0,0 +1,782 @@
+package dns
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrBadConfig This is what ParseConfig and Validate fail with,
+// joined with everything that is wrong with the config, a line each.
+var ErrBadConfig = errors.New("dns: bad config")
+
+// Config How to run a Server, as a config file says (see
+// ParseConfig), so one can be deployed without writing any Go.
+// Server makes the Server and its Resolver from it, and
+// ListenAndServe runs it.
+type Config struct {
+	// Listen The addresses to answer on, over both UDP and TCP, ":53"
+	// if there are none
+	Listen []string
+	// Timeout, UDPSize, IdleTimeout and MaxTCPConns The Server's, 0
+	// for its defaults
+	Timeout     time.Duration
+	UDPSize     uint16
+	IdleTimeout time.Duration
+	MaxTCPConns int
+	// QueryACL and RecursionACL The Server's
+	QueryACL     ACL
+	RecursionACL ACL
+	// Zones The zone files to answer for authoritatively
+	Zones []ZoneConfig
+	// Upstreams How to talk to particular upstream servers
+	Upstreams []UpstreamConfig
+	// Forward Which zones' queries are forwarded, and where.  A rule
+	// for "." forwards everything else (see Forwarders); with none
+	// the Resolver iterates from the root.
+	Forward []ForwardRule
+	Cache   CacheConfig
+	Log     LogConfig
+
+	// The line each key was on, by its name in the file, for errors
+	lines map[string]int
+}
+
+// ZoneConfig A zone file to load, see LoadZoneFile
+type ZoneConfig struct {
+	Origin string
+	File   string
+}
+
+// UpstreamConfig How to talk to the server at Addr.  Transport is
+// "udp" (the default, with TCP for truncated answers), "tls" which
+// needs the AuthName on the server's certificate (see DoTServer), or
+// "https" which needs its URL (see DoHServer).  DNS-over-QUIC needs a
+// QUIC package and so can only be set up in Go, with WithDoQ.  If
+// TSIG is set queries to it are signed with the key.
+type UpstreamConfig struct {
+	Addr      netip.Addr
+	Transport string
+	AuthName  string
+	URL       string
+	TSIG      *TSIGKey
+}
+
+// ForwardRule The queries for the names in Zone go to Servers, see
+// ForwardZones
+type ForwardRule struct {
+	Zone    string
+	Servers []netip.Addr
+}
+
+// CacheConfig The sizes of the caches, 0 for the defaults, and the
+// range the TTLs of what goes in them is clamped to (see
+// WithCacheTTLs), 0 for MinCacheTTL or MaxCacheTTL.
+type CacheConfig struct {
+	MaxBytes      int64
+	MaxInfraBytes int64
+	Shards        uint
+	MinTTL        time.Duration
+	MaxTTL        time.Duration
+}
+
+// LogConfig Where the Resolver and Server log to: File ("" for
+// stderr), as Format "text" (the default) or "json", at Level and
+// above.  If QueryLog is set every query is logged there too.
+type LogConfig struct {
+	Level    slog.Level
+	Format   string
+	File     string
+	QueryLog *QueryLog
+}
+
+// LoadConfigFile This is ParseConfig on the file at path.  Zone
+// files and log files named in it with relative paths are taken to
+// be relative to the directory it is in.
+func LoadConfigFile(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+	defer f.Close()
+	cfg, err := parseConfig(f, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig This reads a config file from r, which is a subset of
+// TOML (see the example), and checks it with Validate.  Durations
+// are strings time.ParseDuration understands, addresses and
+// prefixes are as netip has them.  A key that isn't one of those
+// below is an error rather than being ignored, so a misspelt one
+// doesn't go unnoticed, and so is a value of the wrong type.  The
+// error is ErrBadConfig along with everything wrong with the file,
+// each on a line of its own starting with where it is.
+//
+//	[server]
+//	listen = ["127.0.0.1:53", "[::1]:53"]
+//	timeout = "4s"          # also udp_size, idle_timeout, max_tcp_conns
+//
+//	[acl]
+//	query_allow = ["127.0.0.0/8", "10.0.0.0/8"]
+//	recursion_deny = ["10.99.0.0/16"]   # also query_deny, recursion_allow
+//
+//	[[zone]]
+//	origin = "home.arpa"
+//	file = "home.arpa.zone"
+//
+//	[[upstream]]
+//	address = "1.1.1.1"
+//	transport = "tls"       # or "udp", "https" (with url = "...")
+//	auth_name = "cloudflare-dns.com"
+//	# tsig_name, tsig_algorithm and tsig_secret (base64) sign queries
+//
+//	[[forward]]
+//	zone = "corp.example.com"
+//	servers = ["10.0.0.53"]
+//
+//	[[forward]]
+//	zone = "."
+//	servers = ["1.1.1.1"]
+//
+//	[cache]
+//	max_bytes = 67108864    # also max_infra_bytes and shards
+//	min_ttl = "30s"
+//	max_ttl = "24h"
+//
+//	[log]
+//	level = "info"          # debug, info, warn or error
+//	format = "json"
+//	file = "/var/log/dns/resolver.log"
+//	queries = "/var/log/dns/queries.log"
+//	# also query_format, query_max_size, query_max_age, query_max_backups
+func ParseConfig(r io.Reader) (*Config, error) {
+	return parseConfig(r, "")
+}
+
+// parseConfig This is ParseConfig, with relative paths taken to be
+// relative to dir.
+func parseConfig(r io.Reader, dir string) (*Config, error) {
+	doc, err := parseTOML(r)
+	if err != nil {
+		return nil, errors.Join(ErrBadConfig, err)
+	}
+	d := &configDecoder{cfg: &Config{lines: map[string]int{}}, dir: dir}
+	d.decode(doc)
+	d.cfg.validate(&d.configProblems)
+	if err := d.err(); err != nil {
+		return nil, err
+	}
+	return d.cfg, nil
+}
+
+// configProblems What is wrong with a config, with the line each
+// problem is on where it is known
+type configProblems struct {
+	lines    map[string]int
+	problems []configProblem
+}
+
+type configProblem struct {
+	line int
+	text string
+}
+
+// add This records that the value of key is wrong.
+func (p *configProblems) add(key, format string, args ...any) {
+	text := key + ": " + fmt.Sprintf(format, args...)
+	// a key that isn't in the file is put down to its table
+	line := 0
+	for name := key; line == 0; {
+		line = p.lines[name]
+		i := strings.LastIndexAny(name, ".[")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	if line > 0 {
+		text = fmt.Sprintf("line %d: %s", line, text)
+	}
+	p.problems = append(p.problems, configProblem{line, text})
+}
+
+// err ErrBadConfig and the problems, in the order they are in the
+// file, nil if there aren't any
+func (p *configProblems) err() error {
+	if len(p.problems) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(p.problems, func(a, b configProblem) int {
+		return a.line - b.line
+	})
+	errs := []error{ErrBadConfig}
+	for _, problem := range p.problems {
+		errs = append(errs, errors.New(problem.text))
+	}
+	return errors.Join(errs...)
+}
+
+// configDecoder This turns a config file into a Config, noting the
+// keys and values it can't make sense of.
+type configDecoder struct {
+	configProblems
+	cfg *Config
+	dir string
+}
+
+// decode This fills in the Config from doc.
+func (d *configDecoder) decode(doc *tomlDocument) {
+	d.lines = d.cfg.lines
+	d.table(doc.root, nil)
+	for name, tables := range doc.tables {
+		decode, ok := map[string]func(*tomlTable){
+			"server":   d.server,
+			"acl":      d.acl,
+			"zone":     d.zone,
+			"upstream": d.upstream,
+			"forward":  d.forward,
+			"cache":    d.cache,
+			"log":      d.log,
+		}[name]
+		if !ok {
+			d.lines[name] = tables[0].line
+			d.add(name, "unknown table, expected server, acl, zone, upstream, forward, cache or log")
+			continue
+		}
+		single := name == "server" || name == "acl" || name == "cache" || name == "log"
+		if doc.arrays[name] == single {
+			d.lines[name] = tables[0].line
+			if single {
+				d.add(name, "is a table of its own, [%s] not [[%s]]", name, name)
+			} else {
+				d.add(name, "there can be more than one, so it is [[%s]] not [%s]", name, name)
+			}
+			continue
+		}
+		for _, table := range tables {
+			decode(table)
+		}
+	}
+}
+
+// table This hands each key in t to set along with its full name,
+// noting the line it is on, and complains about the ones set doesn't
+// know (all of them if it is nil).
+func (d *configDecoder) table(t *tomlTable, set func(key, name string, v tomlValue) bool) {
+	for _, key := range t.order {
+		name := key
+		if t.name != "" {
+			name = t.name + "." + key
+		}
+		v := t.keys[key]
+		d.lines[name] = v.line
+		if set == nil {
+			d.add(name, "the settings go in the tables, like [server]")
+		} else if !set(key, name, v) {
+			d.add(name, "unknown key")
+		}
+	}
+}
+
+func (d *configDecoder) server(t *tomlTable) {
+	cfg := d.cfg
+	d.table(t, func(key, name string, v tomlValue) bool {
+		switch key {
+		case "listen":
+			cfg.Listen = d.strings(name, v)
+		case "timeout":
+			cfg.Timeout = d.duration(name, v)
+		case "udp_size":
+			cfg.UDPSize = uint16(d.int(name, v, 512, 65535))
+		case "idle_timeout":
+			cfg.IdleTimeout = d.duration(name, v)
+		case "max_tcp_conns":
+			cfg.MaxTCPConns = int(d.int(name, v, 1, 1<<20))
+		default:
+			return false
+		}
+		return true
+	})
+}
+
+func (d *configDecoder) acl(t *tomlTable) {
+	cfg := d.cfg
+	d.table(t, func(key, name string, v tomlValue) bool {
+		switch key {
+		case "query_allow":
+			cfg.QueryACL.Allow = d.prefixes(name, v)
+		case "query_deny":
+			cfg.QueryACL.Deny = d.prefixes(name, v)
+		case "recursion_allow":
+			cfg.RecursionACL.Allow = d.prefixes(name, v)
+		case "recursion_deny":
+			cfg.RecursionACL.Deny = d.prefixes(name, v)
+		default:
+			return false
+		}
+		return true
+	})
+}
+
+func (d *configDecoder) zone(t *tomlTable) {
+	var zone ZoneConfig
+	d.table(t, func(key, name string, v tomlValue) bool {
+		switch key {
+		case "origin":
+			zone.Origin = d.string(name, v)
+		case "file":
+			zone.File = d.path(name, v)
+		default:
+			return false
+		}
+		return true
+	})
+	d.lines[t.name] = t.line
+	d.cfg.Zones = append(d.cfg.Zones, zone)
+}
+
+func (d *configDecoder) upstream(t *tomlTable) {
+	var upstream UpstreamConfig
+	var key TSIGKey
+	var secret bool
+	d.table(t, func(k, name string, v tomlValue) bool {
+		switch k {
+		case "address":
+			upstream.Addr = d.addr(name, v)
+		case "transport":
+			upstream.Transport = d.string(name, v)
+		case "auth_name":
+			upstream.AuthName = d.string(name, v)
+		case "url":
+			upstream.URL = d.string(name, v)
+		case "tsig_name":
+			key.Name = d.string(name, v)
+		case "tsig_algorithm":
+			key.Algorithm = d.string(name, v)
+		case "tsig_secret":
+			s := d.string(name, v)
+			var err error
+			if key.Secret, err = base64.StdEncoding.DecodeString(s); err != nil {
+				d.add(name, "isn't base64: %v", err)
+			}
+			secret = true
+		default:
+			return false
+		}
+		return true
+	})
+	if key.Name != "" || key.Algorithm != "" || secret {
+		upstream.TSIG = &key
+	}
+	d.lines[t.name] = t.line
+	d.cfg.Upstreams = append(d.cfg.Upstreams, upstream)
+}
+
+func (d *configDecoder) forward(t *tomlTable) {
+	var rule ForwardRule
+	d.table(t, func(key, name string, v tomlValue) bool {
+		switch key {
+		case "zone":
+			rule.Zone = d.string(name, v)
+		case "servers":
+			rule.Servers = d.addrs(name, v)
+		default:
+			return false
+		}
+		return true
+	})
+	d.lines[t.name] = t.line
+	d.cfg.Forward = append(d.cfg.Forward, rule)
+}
+
+func (d *configDecoder) cache(t *tomlTable) {
+	cache := &d.cfg.Cache
+	d.table(t, func(key, name string, v tomlValue) bool {
+		switch key {
+		case "max_bytes":
+			cache.MaxBytes = d.int(name, v, 0, 1<<62)
+		case "max_infra_bytes":
+			cache.MaxInfraBytes = d.int(name, v, 0, 1<<62)
+		case "shards":
+			cache.Shards = uint(d.int(name, v, 1, 1<<16))
+		case "min_ttl":
+			cache.MinTTL = d.duration(name, v)
+		case "max_ttl":
+			cache.MaxTTL = d.duration(name, v)
+		default:
+			return false
+		}
+		return true
+	})
+}
+
+func (d *configDecoder) log(t *tomlTable) {
+	log := &d.cfg.Log
+	queries := &QueryLog{}
+	d.table(t, func(key, name string, v tomlValue) bool {
+		switch key {
+		case "level":
+			if err := log.Level.UnmarshalText([]byte(d.string(name, v))); err != nil {
+				d.add(name, "expected debug, info, warn or error")
+			}
+		case "format":
+			log.Format = d.string(name, v)
+		case "file":
+			log.File = d.path(name, v)
+		case "queries":
+			queries.Path = d.path(name, v)
+		case "query_format":
+			switch format := d.string(name, v); format {
+			case "text":
+				queries.Format = QueryLogText
+			case "json":
+				queries.Format = QueryLogJSON
+			default:
+				d.add(name, "%q isn't text or json", format)
+			}
+		case "query_max_size":
+			queries.MaxSize = d.int(name, v, 0, 1<<62)
+		case "query_max_age":
+			queries.MaxAge = d.duration(name, v)
+		case "query_max_backups":
+			queries.MaxBackups = int(d.int(name, v, 0, 1<<20))
+		default:
+			return false
+		}
+		return true
+	})
+	if queries.Path != "" {
+		log.QueryLog = queries
+	} else if slices.ContainsFunc(t.order, func(key string) bool { return strings.HasPrefix(key, "query_") }) {
+		d.lines["log.queries"] = t.line
+		d.add("log.queries", "the query_ settings need the file to log the queries to")
+	}
+}
+
+// typeName What the type of v is called in errors
+func typeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "a string"
+	case int64:
+		return "a number"
+	case bool:
+		return "true or false"
+	}
+	return "an array"
+}
+
+func (d *configDecoder) string(name string, v tomlValue) string {
+	s, ok := v.value.(string)
+	if !ok {
+		d.add(name, "expected a string, not %s", typeName(v.value))
+	}
+	return s
+}
+
+// path This is string for a file name, which when relative is
+// relative to the config file.
+func (d *configDecoder) path(name string, v tomlValue) string {
+	path := d.string(name, v)
+	if path != "" && d.dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(d.dir, path)
+	}
+	return path
+}
+
+// int A number from min to max
+func (d *configDecoder) int(name string, v tomlValue, min, max int64) int64 {
+	n, ok := v.value.(int64)
+	if !ok {
+		d.add(name, "expected a number, not %s", typeName(v.value))
+		return 0
+	}
+	if n < min || n > max {
+		d.add(name, "%d is out of range, it goes from %d to %d", n, min, max)
+		return 0
+	}
+	return n
+}
+
+func (d *configDecoder) duration(name string, v tomlValue) time.Duration {
+	s, ok := v.value.(string)
+	if !ok {
+		d.add(name, `expected a duration like "30s", not %s`, typeName(v.value))
+		return 0
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		d.add(name, `%q isn't a duration like "30s" or "1h30m"`, s)
+	} else if duration < 0 {
+		d.add(name, "can't be negative")
+		return 0
+	}
+	return duration
+}
+
+func (d *configDecoder) strings(name string, v tomlValue) []string {
+	elements, ok := v.value.([]tomlValue)
+	if !ok {
+		d.add(name, "expected an array of strings, not %s", typeName(v.value))
+		return nil
+	}
+	var out []string
+	for i, element := range elements {
+		s, ok := element.value.(string)
+		if !ok {
+			d.add(name, "element %d should be a string, not %s", i, typeName(element.value))
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (d *configDecoder) addr(name string, v tomlValue) netip.Addr {
+	s := d.string(name, v)
+	addr, err := netip.ParseAddr(s)
+	if err != nil && s != "" {
+		d.add(name, "%q isn't an IP address", s)
+	}
+	return addr.Unmap()
+}
+
+func (d *configDecoder) addrs(name string, v tomlValue) []netip.Addr {
+	var addrs []netip.Addr
+	for _, s := range d.strings(name, v) {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			d.add(name, "%q isn't an IP address", s)
+			continue
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs
+}
+
+// prefixes The prefixes in v, a plain address being one on its own
+func (d *configDecoder) prefixes(name string, v tomlValue) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range d.strings(name, v) {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			d.add(name, "%q isn't an address or a prefix like 10.0.0.0/8", s)
+			continue
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// Validate This checks the settings make sense together, which
+// ParseConfig does before handing the Config back.  The error is
+// ErrBadConfig along with every problem there is.
+func (cfg *Config) Validate() error {
+	p := &configProblems{lines: cfg.lines}
+	cfg.validate(p)
+	return p.err()
+}
+
+// validate This is Validate, adding the problems to p.
+func (cfg *Config) validate(p *configProblems) {
+	for i, addr := range cfg.Listen {
+		name := fmt.Sprintf("server.listen[%d]", i)
+		if p.lines != nil {
+			p.lines[name] = p.lines["server.listen"]
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			p.add(name, "%q isn't host:port (like 127.0.0.1:53 or [::1]:53)", addr)
+		}
+	}
+	for i, zone := range cfg.Zones {
+		name := fmt.Sprintf("zone[%d]", i)
+		if zone.File == "" {
+			p.add(name, "needs the file the zone is in")
+		}
+		if zone.Origin == "" {
+			p.add(name, "needs the origin of the zone")
+		}
+	}
+	upstreams := map[netip.Addr]int{}
+	for i, upstream := range cfg.Upstreams {
+		name := fmt.Sprintf("upstream[%d]", i)
+		if !upstream.Addr.IsValid() {
+			p.add(name, "needs the address of the server")
+		} else if j, ok := upstreams[upstream.Addr]; ok {
+			p.add(name, "%v is already upstream[%d]", upstream.Addr, j)
+		} else {
+			upstreams[upstream.Addr] = i
+		}
+		switch upstream.Transport {
+		case "", "udp":
+		case "tls":
+			if upstream.AuthName == "" {
+				p.add(name+".auth_name", "tls needs the name on the server's certificate")
+			}
+		case "https":
+			if !strings.HasPrefix(upstream.URL, "https://") {
+				p.add(name+".url", "https needs the server's https:// URL")
+			}
+		case "quic":
+			p.add(name+".transport", "quic needs a QUIC package, it can only be set up in Go (see WithDoQ)")
+		default:
+			p.add(name+".transport", "%q isn't udp, tls or https", upstream.Transport)
+		}
+		if key := upstream.TSIG; key != nil {
+			switch {
+			case key.Name == "" || len(key.Secret) == 0:
+				p.add(name+".tsig_name", "TSIG needs both the key's name and its secret")
+			case tsigHashes[tsigAlgorithm(key.Algorithm)] == nil:
+				p.add(name+".tsig_algorithm", "%q isn't one of hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or hmac-sha512", key.Algorithm)
+			}
+		}
+	}
+	zones := map[string]int{}
+	for i, rule := range cfg.Forward {
+		name := fmt.Sprintf("forward[%d]", i)
+		if rule.Zone == "" {
+			p.add(name, `needs the zone to forward, "." for everything`)
+		} else if j, ok := zones[cleanName(rule.Zone)]; ok {
+			p.add(name, "%s is already forwarded by forward[%d]", rule.Zone, j)
+		} else {
+			zones[cleanName(rule.Zone)] = i
+		}
+		if len(rule.Servers) == 0 {
+			p.add(name, "needs the servers to forward to")
+		}
+	}
+	if minTTL, maxTTL := cfg.Cache.ttls(); minTTL > maxTTL {
+		switch {
+		case cfg.Cache.MaxTTL == 0:
+			p.add("cache.min_ttl", "%v is more than the default max_ttl, %v", minTTL, maxTTL)
+		case cfg.Cache.MinTTL == 0:
+			p.add("cache.max_ttl", "%v is less than the default min_ttl, %v", maxTTL, minTTL)
+		default:
+			p.add("cache.min_ttl", "%v is more than max_ttl, %v", minTTL, maxTTL)
+		}
+	}
+	switch cfg.Log.Format {
+	case "", "text", "json":
+	default:
+		p.add("log.format", "%q isn't text or json", cfg.Log.Format)
+	}
+}
+
+// ttls The range the TTLs get clamped to, with the defaults filled in
+func (cache CacheConfig) ttls() (time.Duration, time.Duration) {
+	minTTL, maxTTL := cache.MinTTL, cache.MaxTTL
+	if minTTL == 0 {
+		minTTL = MinCacheTTL
+	}
+	if maxTTL == 0 {
+		maxTTL = MaxCacheTTL
+	}
+	return minTTL, maxTTL
+}
+
+// Server This makes the Server the Config describes, with a Resolver
+// of its own, loading the zone files and opening the log files.
+// Closing the Server closes the Resolver and the log file as well.
+func (cfg *Config) Server() (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	logger, logFile, err := cfg.Log.logger()
+	if err != nil {
+		return nil, err
+	}
+	options := []Option{WithLogger(logger), WithCacheTTLs(cfg.Cache.ttls())}
+	if cfg.Cache.MaxBytes > 0 || cfg.Cache.MaxInfraBytes > 0 {
+		options = append(options, WithMaxCacheBytes(cfg.Cache.MaxBytes, cfg.Cache.MaxInfraBytes))
+	}
+	if cfg.Cache.Shards > 0 {
+		options = append(options, WithCacheShards(cfg.Cache.Shards))
+	}
+	for _, upstream := range cfg.Upstreams {
+		switch upstream.Transport {
+		case "tls":
+			options = append(options, WithDoT(upstream.Addr, DoTServer{AuthName: upstream.AuthName}))
+		case "https":
+			options = append(options, WithDoH(upstream.Addr, DoHServer{URL: upstream.URL}))
+		}
+		if upstream.TSIG != nil {
+			options = append(options, WithTSIG(upstream.Addr, *upstream.TSIG))
+		}
+	}
+	for _, rule := range cfg.Forward {
+		options = append(options, WithForwardZone(rule.Zone, rule.Servers...))
+	}
+	srv := &Server{
+		Resolver:     New(options...),
+		Timeout:      cfg.Timeout,
+		UDPSize:      cfg.UDPSize,
+		IdleTimeout:  cfg.IdleTimeout,
+		MaxTCPConns:  cfg.MaxTCPConns,
+		QueryACL:     cfg.QueryACL,
+		RecursionACL: cfg.RecursionACL,
+		QueryLog:     cfg.Log.QueryLog,
+	}
+	srv.owned = []io.Closer{srv.Resolver}
+	if logFile != nil {
+		srv.owned = append(srv.owned, logFile)
+	}
+	for _, zone := range cfg.Zones {
+		z, err := LoadZoneFile(zone.File, zone.Origin)
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+		srv.Zones = append(srv.Zones, z)
+	}
+	return srv, nil
+}
+
+// ListenAndServe This answers with srv, made by Server, on every one
+// of the Listen addresses over both UDP and TCP until srv is closed,
+// like Server.ListenAndServe.  If listening on any of them fails
+// nothing is served and that is the error.
+func (cfg *Config) ListenAndServe(srv *Server) error {
+	if len(cfg.Listen) == 0 {
+		return srv.ListenAndServe()
+	}
+	return srv.listenAndServe(cfg.Listen)
+}
+
+// logger The logger the Log settings say to use, and the file it
+// writes to for the caller to close (nil when it is stderr)
+func (log LogConfig) logger() (*slog.Logger, io.Closer, error) {
+	w := io.Writer(os.Stderr)
+	var file io.Closer
+	if log.File != "" {
+		f, err := os.OpenFile(log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening the log: %w", err)
+		}
+		w, file = f, f
+	}
+	options := &slog.HandlerOptions{Level: log.Level}
+	if log.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, options)), file, nil
+	}
+	return slog.New(slog.NewTextHandler(w, options)), file, nil
+}
@@ -0,0 +1,189 @@
+package dns
+
+import (
+	"errors"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	zone := "$TTL 300\n@ IN SOA ns admin 1 3600 600 86400 300\n@ IN NS ns\nns IN A 10.0.0.1\n"
+	if err := os.WriteFile(filepath.Join(dir, "home.arpa.zone"), []byte(zone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "dns.toml")
+	config := `# a resolver for the office
+[server]
+listen = [
+	"127.0.0.1:5353",  # v4
+	'[::1]:5353',
+]
+timeout = "2s"
+udp_size = 1_232
+
+[acl]
+query_allow = ["127.0.0.0/8", "10.0.0.0/8", "::1"]
+recursion_deny = ["10.99.0.0/16"]
+
+[[zone]]
+origin = "home.arpa"
+file = "home.arpa.zone"
+
+[[upstream]]
+address = "1.1.1.1"
+transport = "tls"
+auth_name = "cloudflare-dns.com"
+tsig_name = "office"
+tsig_algorithm = "hmac-sha256"
+tsig_secret = "c2VjcmV0"
+
+[[forward]]
+zone = "Corp.Example.com."
+servers = ["10.0.0.53"]
+
+[[forward]]
+zone = "."
+servers = ["1.1.1.1", "9.9.9.9"]
+
+[cache]
+max_bytes = 1048576
+shards = 8
+min_ttl = "30s"
+max_ttl = "24h"
+
+[log]
+level = "warn"
+format = "json"
+file = "resolver.log"
+queries = "queries.log"
+query_max_backups = 3
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(cfg.Listen, []string{"127.0.0.1:5353", "[::1]:5353"}) || cfg.Timeout != 2*time.Second || cfg.UDPSize != 1232 {
+		t.Errorf("unexpected server settings %+v", cfg)
+	}
+	if len(cfg.QueryACL.Allow) != 3 || cfg.QueryACL.Allow[2] != netip.MustParsePrefix("::1/128") ||
+		!cfg.QueryACL.Permits(parseAddrNoerror("10.1.2.3")) || cfg.RecursionACL.Permits(parseAddrNoerror("10.99.0.1")) {
+		t.Errorf("unexpected ACLs %+v, %+v", cfg.QueryACL, cfg.RecursionACL)
+	}
+	if len(cfg.Upstreams) != 1 || cfg.Upstreams[0].TSIG == nil || string(cfg.Upstreams[0].TSIG.Secret) != "secret" {
+		t.Errorf("unexpected upstreams %+v", cfg.Upstreams)
+	}
+	if cfg.Log.File != filepath.Join(dir, "resolver.log") || cfg.Log.QueryLog == nil || cfg.Log.QueryLog.MaxBackups != 3 {
+		t.Errorf("unexpected log settings %+v", cfg.Log)
+	}
+
+	srv, err := cfg.Server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	res := srv.Resolver
+	if len(srv.Zones) != 1 || srv.QueryLog != cfg.Log.QueryLog || srv.Timeout != 2*time.Second {
+		t.Errorf("unexpected server %+v", srv)
+	}
+	debug := res.debugConfig()
+	if !slices.Equal(debug.Forwarders, []netip.Addr{parseAddrNoerror("1.1.1.1"), parseAddrNoerror("9.9.9.9")}) ||
+		len(debug.ForwardZones["corp.example.com"]) != 1 || len(debug.DoTServers) != 1 || len(debug.TSIGServers) != 1 ||
+		debug.MaxCacheBytes != 1048576 {
+		t.Errorf("unexpected resolver settings %+v", debug)
+	}
+	if len(res.cacheShards()) != 8 || *res.minTTL != 30*time.Second || *res.maxTTL != 24*time.Hour {
+		t.Errorf("unexpected cache settings: %d shards, TTLs from %v to %v", len(res.cacheShards()), *res.minTTL, *res.maxTTL)
+	}
+	if MinCacheTTL == 30*time.Second || MaxCacheTTL == 24*time.Hour {
+		t.Errorf("the config changed MinCacheTTL or MaxCacheTTL")
+	}
+	if !res.log().Enabled(t.Context(), slog.LevelWarn) || res.log().Enabled(t.Context(), slog.LevelInfo) {
+		t.Errorf("the logger isn't at warn")
+	}
+
+	// closing the Server closes the Resolver and the log file
+	logFile, ok := srv.owned[len(srv.owned)-1].(*os.File)
+	if !ok || logFile.Name() != cfg.Log.File {
+		t.Fatalf("the log file isn't closed with the Server: %v", srv.owned)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logFile.WriteString("after Close\n"); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("writing the log after Close gave %v", err)
+	}
+	if _, err := res.Lookup("www.example.com", RTYPE_A); !errors.Is(err, ErrClosed) {
+		t.Errorf("lookup after Close gave %v", err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		name, config, want string
+	}{
+		{"syntax", "[server]\nlisten = [\"127.0.0.1:53\"\ntimeout = \"1s\"\n",
+			"line 3: expected ',' or ']' in the array"},
+		{"duplicate key", "[cache]\nshards = 4\nshards = 8\n",
+			"line 3: shards was already set on line 2"},
+		{"min_ttl over the default", "[cache]\nmin_ttl = \"200h\"\n",
+			"line 2: cache.min_ttl: 200h0m0s is more than the default max_ttl, 168h0m0s"},
+		{"problems", `listen = ["127.0.0.1:53"]
+[server]
+listn = ["127.0.0.1:53"]
+timeout = 5
+udp_size = 100
+
+[[upstream]]
+address = "1.1.1.1"
+transport = "tls"
+
+[[upstream]]
+address = "1.1.1.1"
+transport = "quic"
+
+[[forward]]
+zone = "example.com"
+servers = ["10.0.0.300"]
+
+[cache]
+min_ttl = "1h"
+max_ttl = "1m"
+
+[log]
+level = "loud"
+query_max_size = 100
+`, strings.Join([]string{
+			"line 1: listen: the settings go in the tables, like [server]",
+			"line 3: server.listn: unknown key",
+			`line 4: server.timeout: expected a duration like "30s", not a number`,
+			"line 5: server.udp_size: 100 is out of range, it goes from 512 to 65535",
+			"line 7: upstream[0].auth_name: tls needs the name on the server's certificate",
+			"line 11: upstream[1]: 1.1.1.1 is already upstream[0]",
+			"line 13: upstream[1].transport: quic needs a QUIC package, it can only be set up in Go (see WithDoQ)",
+			"line 15: forward[0]: needs the servers to forward to",
+			`line 17: forward[0].servers: "10.0.0.300" isn't an IP address`,
+			"line 20: cache.min_ttl: 1h0m0s is more than max_ttl, 1m0s",
+			"line 23: log.queries: the query_ settings need the file to log the queries to",
+			"line 24: log.level: expected debug, info, warn or error",
+		}, "\n")},
+	} {
+		_, err := ParseConfig(strings.NewReader(test.config))
+		if !errors.Is(err, ErrBadConfig) {
+			t.Errorf("%s: error %v isn't ErrBadConfig", test.name, err)
+			continue
+		}
+		if got := strings.TrimPrefix(err.Error(), ErrBadConfig.Error()+"\n"); got != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, test.want)
+		}
+	}
+}
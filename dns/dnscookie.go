@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/rand"
+)
+
+// EDNS option code for cookies (RFC 7873)
+const ednsCookie = 10
+
+// DNSCookies With this set every query that has an OPT record (see
+// UDPPayloadSize) carries a DNS cookie (RFC 7873): a random client
+// cookie of our own for each server, plus the server cookie that
+// server last gave us.  A response from a server that does cookies
+// has to echo our client cookie, which someone spoofing responses
+// off-path can't know, and servers may go easier (on rate limits
+// say) on clients showing a server cookie they handed out.  Servers
+// that don't do cookies just ignore them.  This is DefaultResolver's,
+// see WithDNSCookies for the others.
+var DNSCookies = true
+
+// WithDNSCookies This is DNSCookies for the Resolver.
+func WithDNSCookies(on bool) Option {
+	return func(res *Resolver) {
+		*res.cookies = on
+	}
+}
+
+// sendsCookies Whether the manager's queries carry cookies, the same
+// way randomizesCase goes by its Resolver.
+func (manager *serverCommManager) sendsCookies() bool {
+	if manager.cookies == nil {
+		return DNSCookies
+	}
+	return *manager.cookies
+}
+
+// cookieOption The cookie option to send to the server: our client
+// cookie followed by its server cookie if we have one.
+func (manager *serverCommManager) cookieOption() EDNSOption {
+	manager.cookieLock.Lock()
+	defer manager.cookieLock.Unlock()
+	if manager.clientCookie == nil {
+		manager.clientCookie = make([]byte, 8)
+		_, _ = rand.Read(manager.clientCookie)
+	}
+	data := append([]byte(nil), manager.clientCookie...)
+	return EDNSOption{Code: ednsCookie, Data: append(data, manager.serverCookie...)}
+}
+
+// checkCookie This checks the cookie in a response from the server
+// to a query that had one.  A response without one is fine, the
+// server just doesn't do cookies, but one whose client cookie isn't
+// ours (or is malformed) is a forgery and gets thrown out.  If the
+// cookie is good the server cookie in it is kept for next time.
+func (manager *serverCommManager) checkCookie(msg *DNSMessage) bool {
+	cookie, ok := msg.EDNS.Option(ednsCookie)
+	if !ok {
+		return true
+	}
+	// 8 bytes of client cookie then 8 to 32 of server cookie
+	if len(cookie) < 16 || len(cookie) > 40 {
+		return false
+	}
+	manager.cookieLock.Lock()
+	defer manager.cookieLock.Unlock()
+	if !bytes.Equal(cookie[:8], manager.clientCookie) {
+		return false
+	}
+	manager.serverCookie = append([]byte(nil), cookie[8:]...)
+	return true
+}
+
+// withCookie This is edns with our cookie for the server added, a
+// copy so that edns itself can be sent again later with whatever
+// server cookie is current then.
+func (manager *serverCommManager) withCookie(edns *EDNS) *EDNS {
+	if edns == nil || !manager.sendsCookies() {
+		return edns
+	}
+	withCookie := *edns
+	withCookie.Options = append(append([]EDNSOption(nil), edns.Options...), manager.cookieOption())
+	return &withCookie
+}
@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"bytes"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestDNSCookies(t *testing.T) {
+	serverCookie := []byte("servercookie")
+	var lock sync.Mutex
+	var clientCookies [][]byte
+	forge := false
+	res := New()
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		var cookie []byte
+		for _, option := range request.edns.Options {
+			if option.Code == ednsCookie {
+				cookie = option.Data
+			}
+		}
+		if len(cookie) < 8 {
+			t.Errorf("query without a client cookie")
+			return nil
+		}
+		lock.Lock()
+		clientCookies = append(clientCookies, cookie[:8])
+		lock.Unlock()
+		reply := EDNS{UDPSize: 1232}
+		if forge {
+			reply.Options = []EDNSOption{{Code: ednsCookie, Data: append([]byte("12345678"), serverCookie...)}}
+		} else {
+			reply.Options = []EDNSOption{{Code: ednsCookie, Data: append(append([]byte(nil), cookie[:8]...), serverCookie...)}}
+		}
+		if !bytes.Equal(cookie[8:], serverCookie) {
+			// the upper bits of BADCOOKIE go in the OPT record
+			reply.ExtendedRcode = uint8(RCODE_BADCOOKIE >> 4)
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_BADCOOKIE & 0xf}, Additionals: []DNSAnswer{reply.record()}}
+		}
+		msg := &DNSMessage{Additionals: []DNSAnswer{reply.record()}}
+		msg.Answers = []DNSAnswer{{RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")}}}
+		return msg
+	})
+
+	if result, err := res.Lookup("www.example.com", RTYPE_A); err != nil || len(result) != 1 {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	lock.Lock()
+	if len(clientCookies) != 2 || !bytes.Equal(clientCookies[0], clientCookies[1]) {
+		t.Errorf("expected a BADCOOKIE and a retry with the same client cookie, got %x", clientCookies)
+	}
+	lock.Unlock()
+
+	forge = true
+	if result, _ := res.Lookup("mail.example.com", RTYPE_A); len(result) != 0 {
+		t.Errorf("a response with the wrong client cookie was accepted: %v", result)
+	}
+}
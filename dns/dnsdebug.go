@@ -0,0 +1,204 @@
+package dns
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// DebugState What a Resolver looks like on the inside right now, for
+// working out what a running one is up to (see DebugHandler).  Like
+// Metrics it is read a piece at a time, so under load the pieces may
+// not quite agree with each other.
+type DebugState struct {
+	Config DebugConfig `json:"config"`
+	// Cache and InfraCache The counters of the two caches, shard by
+	// shard (see CacheStats)
+	Cache      CacheStatistics `json:"cache"`
+	InfraCache CacheStatistics `json:"infra_cache"`
+	// Records What is in the caches, see DumpCache
+	Records []CacheRecord `json:"records"`
+	// Servers The servers the Resolver has a manager for, by address
+	Servers []DebugServer `json:"servers"`
+	// Lookups and Queries How many lookups are running and how many
+	// queries are waiting on a server
+	Lookups int `json:"lookups"`
+	Queries int `json:"queries"`
+}
+
+// DebugServer How the Resolver is getting on with one server
+type DebugServer struct {
+	Addr netip.Addr `json:"addr"`
+	// Transport "udp", "tls", "https" or "quic"
+	Transport string `json:"transport"`
+	// SRTT The smoothed RTT, 0 until the server first answers
+	SRTT time.Duration `json:"srtt"`
+	// Failures How many times in a row it has failed, and DownUntil
+	// when it stops being marked down if it is (see
+	// BreakerThreshold)
+	Failures  uint32    `json:"failures"`
+	DownUntil time.Time `json:"down_until,omitzero"`
+	NoEDNS    bool      `json:"no_edns,omitempty"`
+	TSIG      bool      `json:"tsig,omitempty"`
+	// Inflight How many queries to it haven't been answered yet
+	Inflight int `json:"inflight"`
+	// InUse How many lookups are using the manager, and LastUsed
+	// when the last of them stopped (see IdleServerTimeout)
+	InUse    int32     `json:"in_use"`
+	LastUsed time.Time `json:"last_used,omitzero"`
+}
+
+// DebugConfig The Resolver's settings.  Secrets are left out: the
+// proxy's password is masked and only the servers TSIG keys are for
+// are listed.
+type DebugConfig struct {
+	RetryPolicy          RetryPolicy             `json:"retry_policy"`
+	Budget               Budget                  `json:"budget"`
+	MaxConcurrentLookups int                     `json:"max_concurrent_lookups"`
+	MaxInflightQueries   int                     `json:"max_inflight_queries"`
+	MaxCacheBytes        int64                   `json:"max_cache_bytes"`
+	MaxInfraCacheBytes   int64                   `json:"max_infra_cache_bytes"`
+	SearchDomains        []string                `json:"search_domains"`
+	Ndots                int                     `json:"ndots"`
+	DNS64                bool                    `json:"dns64"`
+	DNS64Prefix          netip.Prefix            `json:"dns64_prefix,omitzero"`
+	ServerNetwork        string                  `json:"server_network"`
+	UpstreamProxy        string                  `json:"upstream_proxy,omitempty"`
+	UpstreamRateLimit    RateLimit               `json:"upstream_rate_limit"`
+	Forwarders           []netip.Addr            `json:"forwarders"`
+	ForwardZones         map[string][]netip.Addr `json:"forward_zones,omitempty"`
+	DoTServers           []netip.Addr            `json:"dot_servers"`
+	DoHServers           []netip.Addr            `json:"doh_servers"`
+	DoQServers           []netip.Addr            `json:"doq_servers"`
+	TSIGServers          []netip.Addr            `json:"tsig_servers"`
+	MDNSGroups           []netip.AddrPort        `json:"mdns_groups"`
+}
+
+// Debug A snapshot of the Resolver's insides, see DebugState.
+// Everything in the caches is in it, which for a big cache is a lot.
+func (res *Resolver) Debug() DebugState {
+	return res.debug(true)
+}
+
+// debug This is Debug, leaving the Records out unless records is set.
+func (res *Resolver) debug(records bool) DebugState {
+	state := DebugState{
+		Config:     res.debugConfig(),
+		Cache:      res.CacheStats(),
+		InfraCache: res.InfraCacheStats(),
+		Lookups:    res.lookups.inUse(),
+		Queries:    res.queries.inUse(),
+	}
+	if records {
+		state.Records = res.DumpCache()
+	}
+	for _, unit := range res.serverComm {
+		unit.lock.RLock()
+		for _, manager := range unit.entries {
+			state.Servers = append(state.Servers, manager.debug())
+		}
+		unit.lock.RUnlock()
+	}
+	slices.SortFunc(state.Servers, func(a, b DebugServer) int {
+		return a.Addr.Compare(b.Addr)
+	})
+	return state
+}
+
+// debugConfig The Resolver's settings as DebugConfig has them
+func (res *Resolver) debugConfig() DebugConfig {
+	config := DebugConfig{
+		RetryPolicy:          *res.retry,
+		Budget:               *res.budget,
+		MaxConcurrentLookups: *res.lookups.limit,
+		MaxInflightQueries:   *res.queries.limit,
+		MaxCacheBytes:        *res.cache.maxBytes,
+		MaxInfraCacheBytes:   *res.infra.maxBytes,
+		SearchDomains:        slices.Clone(*res.search),
+		Ndots:                *res.ndots,
+		DNS64:                *res.dns64,
+		DNS64Prefix:          *res.dns64Prefix,
+		ServerNetwork:        *res.network,
+		UpstreamProxy:        *res.proxy,
+		UpstreamRateLimit:    *res.rateLimit,
+		Forwarders:           slices.Clone(*res.forwarders),
+		ForwardZones:         maps.Clone(*res.forwardZones),
+		DoTServers:           sortedKeys(*res.dot),
+		DoHServers:           sortedKeys(*res.doh),
+		DoQServers:           sortedKeys(*res.doq),
+		TSIGServers:          sortedKeys(*res.tsig),
+		MDNSGroups:           slices.Clone(*res.mdnsGroups),
+	}
+	if proxy, err := url.Parse(config.UpstreamProxy); err == nil {
+		config.UpstreamProxy = proxy.Redacted()
+	}
+	return config
+}
+
+// sortedKeys The addresses in m, in order
+func sortedKeys[V any](m map[netip.Addr]V) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	return addrs
+}
+
+// debug How the manager's server is doing, as DebugServer has it
+func (manager *serverCommManager) debug() DebugServer {
+	server := DebugServer{
+		Addr:      *manager.remote,
+		Transport: "udp",
+		SRTT:      time.Duration(manager.srtt.Load()),
+		Failures:  manager.failures.Load(),
+		NoEDNS:    manager.noEDNS.Load(),
+		TSIG:      manager.tsig != nil,
+		InUse:     manager.refs.Load(),
+	}
+	switch {
+	case manager.doh != nil:
+		server.Transport = "https"
+	case manager.doq != nil:
+		server.Transport = "quic"
+	case manager.tls != nil:
+		server.Transport = "tls"
+	}
+	if manager.down() {
+		server.DownUntil = time.Unix(0, manager.downUntil.Load())
+	}
+	if lastUsed := manager.lastUsed.Load(); lastUsed != 0 {
+		server.LastUsed = time.Unix(0, lastUsed)
+	}
+	manager.inflightLock.Lock()
+	server.Inflight = len(manager.inflight)
+	manager.inflightLock.Unlock()
+	return server
+}
+
+// DebugHandler This serves the Resolver's DebugState as JSON, for
+// looking inside a running one with curl.  With a "name" parameter
+// only the cache records for that name and the names below it are
+// included, and with "records=0" none of them are.  There is a lot
+// in it that is nobody else's business, so it is for somewhere only
+// the operators can reach, like net/http/pprof's handlers.
+func (res *Resolver) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		state := res.debug(query.Get("records") != "0")
+		if name := query.Get("name"); name != "" {
+			name = cleanName(name)
+			state.Records = slices.DeleteFunc(state.Records, func(record CacheRecord) bool {
+				return !inSubtree(record.Name, name)
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(state)
+	})
+}
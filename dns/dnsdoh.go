@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+)
+
+// DoHServer How to talk to a server over DNS-over-HTTPS (RFC 8484).
+// URL is its URI template, like "https://dns.example.net/dns-query{?dns}".
+// Queries are always POSTed, so the template's variables are left
+// out.  The certificate has to be valid for the host in URL and
+// chain up to one of RootCAs, nil meaning the system's roots.  The
+// host is only for the certificate (and the SNI and Host header),
+// the connection always goes to the server's address, so there is
+// nothing to look up first.
+type DoHServer struct {
+	URL     string
+	RootCAs *x509.CertPool
+}
+
+// DoHServers The servers DefaultResolver asks over DNS-over-HTTPS
+// rather than plain UDP and TCP, by address.  Each one gets an HTTP
+// client of its own, whose connections (HTTP/2 where the server
+// does it, so many queries share one) are kept for the queries
+// after.  A server in both DoHServers and DoTServers is asked over
+// DoH.  Changes only apply to servers the resolver hasn't talked to
+// yet.  Resolvers made by New have their own, see WithDoH.
+var DoHServers map[netip.Addr]DoHServer
+
+// WithDoH This makes the Resolver ask the server at addr over
+// DNS-over-HTTPS, like DoHServers does for DefaultResolver.
+func WithDoH(addr netip.Addr, server DoHServer) Option {
+	return func(res *Resolver) {
+		servers := maps.Clone(*res.doh)
+		if servers == nil {
+			servers = make(map[netip.Addr]DoHServer)
+		}
+		servers[addr.Unmap()] = server
+		*res.doh = servers
+	}
+}
+
+// dohMediaType The content type of DNS messages over HTTPS
+const dohMediaType = "application/dns-message"
+
+// uriTemplateExpr The expressions in a URI template (RFC 6570)
+var uriTemplateExpr = regexp.MustCompile(`\{[^}]*\}`)
+
+// dohUpstream The URL to POST queries to and the client to do it
+// with.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+// dohUpstream The DoH upstream for the server at addr, nil if it
+// isn't one to use DNS-over-HTTPS with.
+func (res *Resolver) dohUpstream(addr netip.Addr) *dohUpstream {
+	server, ok := (*res.doh)[addr.Unmap()]
+	if !ok {
+		return nil
+	}
+	dial := res.serverDial()
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			return dial(ctx, network, net.JoinHostPort(addr.String(), port))
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: server.RootCAs, MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   *res.tcpIdleTimeout,
+	}
+	return &dohUpstream{
+		url:    uriTemplateExpr.ReplaceAllString(server.URL, ""),
+		client: &http.Client{Transport: transport},
+	}
+}
+
+// sendDoH This is send for DNS-over-HTTPS.  The query goes with ID
+// 0, as RFC 8484 4.1 asks so that HTTP caches can share answers,
+// which is safe since nothing can be slipped into an HTTPS
+// response.  The response is given req's ID before it is
+// delivered.  Anything other than a 200 with a DNS message in it
+// counts as no response at all.
+func (manager *serverCommManager) sendDoH(ctx context.Context, packet []byte, req *serverDNSRequest) {
+	packet[0], packet[1] = 0, 0
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, manager.doh.url, bytes.NewReader(packet))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", dohMediaType)
+	request.Header.Set("Accept", dohMediaType)
+	response, err := manager.doh.client.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); response.StatusCode != http.StatusOK || mediaType != dohMediaType {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 65535))
+	if err != nil {
+		return
+	}
+	msg, err := manager.unpack(body, req)
+	if err != nil {
+		return
+	}
+	if msg.Header.ID == 0 {
+		msg.Header.ID = req.id
+	}
+	manager.dispatch(msg)
+}
+
+// ServeHTTP This makes a Server an http.Handler answering
+// DNS-over-HTTPS (RFC 8484), so it can be put behind any Go HTTP
+// server at a path like /dns-query.  The query is either POSTed as
+// an application/dns-message body or, with GET, base64url encoded
+// (without padding) in the dns parameter of the URL.  The response
+// is never cut down the way UDP ones are, and with any records in
+// it, it can be cached by the HTTP caches along the way for as long
+// as the shortest of their TTLs.  Anything that isn't a query gets
+// a 4xx status instead, and once the Server is closed every request
+// gets 503.  TLS is up to the HTTP server.
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var packet []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if packet, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil || len(packet) == 0 {
+			http.Error(w, "missing or malformed dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != dohMediaType {
+			http.Error(w, "content type must be "+dohMediaType, http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if packet, err = io.ReadAll(io.LimitReader(r.Body, 0x10000)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(packet) > 0xffff {
+			http.Error(w, "message too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !srv.begin() {
+		http.Error(w, ErrServerClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer srv.running.Done()
+	client, _ := netip.ParseAddrPort(r.RemoteAddr)
+	out, response := srv.respond(packet, client.Addr().Unmap(), false)
+	if out == nil && len(packet) >= headerSize && packet[2]&(flagQR>>8) == 0 {
+		// dropped by the Policy; over UDP the client would time out
+		http.Error(w, "no response", http.StatusGatewayTimeout)
+		return
+	}
+	if out == nil {
+		http.Error(w, "not a DNS query", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	if ttl, ok := smallestTTL(response); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	_, _ = w.Write(out)
+}
+
+// smallestTTL The smallest TTL of the records in msg's answer and
+// authority sections, and whether it has any
+func smallestTTL(msg *DNSMessage) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]DNSAnswer{msg.Answers, msg.Authorities} {
+		for _, record := range section {
+			if !found || record.TTL < ttl {
+				ttl, found = record.TTL, true
+			}
+		}
+	}
+	return ttl, found
+}
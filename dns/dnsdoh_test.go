@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDoH(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query, err := unpackMessage(body)
+		lock.Lock()
+		requests = append(requests, r.Method+" "+r.Proto+" "+r.Host+r.URL.Path+" "+r.Header.Get("Content-Type"))
+		lock.Unlock()
+		if err != nil || query.Header.ID != 0 {
+			t.Errorf("bad query %+v, %v", query, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		answer := wireRecord(RTYPE_A, 300, []byte{192, 0, 2, 11})
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(wireResponse(0, 0, query.Question.QName, query.Question.QType, 1, answer))
+	}))
+	server.EnableHTTP2 = true
+	var conns atomic.Int32
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	// the httptest certificate is for example.com, and the
+	// connection goes to the test server whatever the host
+	res := withSingleRoot(New(
+		WithDial(dialLocal(server.Listener.Addr().String())),
+		WithDoH(parseAddrNoerror("198.41.0.4"), DoHServer{URL: "https://example.com/dns-query{?dns}", RootCAs: pool}),
+	))
+	for _, name := range []string{"www.example.com", "mail.example.com"} {
+		result, err := res.Lookup(name, RTYPE_A)
+		if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.11")}) {
+			t.Errorf("unexpected result %v, %v", result, err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	want := "POST HTTP/2.0 example.com/dns-query application/dns-message"
+	if len(requests) != 2 || requests[0] != want || requests[1] != want {
+		t.Errorf("requests %q, want two of %q", requests, want)
+	}
+	if conns.Load() != 1 {
+		t.Errorf("%d connections, want 1", conns.Load())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	upstream := withSingleRoot(New())
+	upstream.connect = answeringWith("192.0.2.94")
+	srv := &Server{Resolver: upstream}
+	server := httptest.NewTLSServer(srv)
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	// the package's own DoH client can use it
+	res := withSingleRoot(New(
+		WithDial(dialLocal(server.Listener.Addr().String())),
+		WithDoH(parseAddrNoerror("198.41.0.4"), DoHServer{URL: "https://example.com/dns-query", RootCAs: pool}),
+	))
+	result, err := res.Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.94")}) {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+
+	client := server.Client()
+	query, _ := packQuery(0, "mail.example.com", RTYPE_A, true, false, nil)
+	response, err := client.Get(server.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	msg, err := unpackMessage(body)
+	if err != nil || len(msg.Answers) != 1 || msg.Answers[0].RName != "mail.example.com" {
+		t.Errorf("unexpected response to GET %v, %v", msg, err)
+	}
+	if response.Header.Get("Content-Type") != dohMediaType || response.Header.Get("Cache-Control") != "max-age=300" {
+		t.Errorf("unexpected headers %v", response.Header)
+	}
+
+	for _, test := range []struct {
+		name    string
+		request func() (*http.Response, error)
+		want    int
+	}{
+		{"wrong content type", func() (*http.Response, error) {
+			return client.Post(server.URL, "text/plain", bytes.NewReader(query))
+		}, http.StatusUnsupportedMediaType},
+		{"bad base64", func() (*http.Response, error) {
+			return client.Get(server.URL + "?dns=!!!")
+		}, http.StatusBadRequest},
+		{"no query", func() (*http.Response, error) {
+			return client.Get(server.URL)
+		}, http.StatusBadRequest},
+		{"a response", func() (*http.Response, error) {
+			return client.Post(server.URL, dohMediaType, bytes.NewReader(wireResponse(0, 0, "example.com", RTYPE_A, 0, nil)))
+		}, http.StatusBadRequest},
+		{"put", func() (*http.Response, error) {
+			request, _ := http.NewRequest(http.MethodPut, server.URL, bytes.NewReader(query))
+			return client.Do(request)
+		}, http.StatusMethodNotAllowed},
+	} {
+		response, err := test.request()
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, response.StatusCode, test.want)
+		}
+	}
+
+	srv.Close()
+	response, err = client.Post(server.URL, dohMediaType, bytes.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d after Close", response.StatusCode)
+	}
+}
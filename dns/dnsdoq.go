@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"maps"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// QUICStream One bidirectional stream of a QUIC connection.  Close
+// only closes our side, sending the FIN, and the response can still
+// be read after it.
+type QUICStream interface {
+	io.Reader
+	io.Writer
+	Close() error
+	SetDeadline(t time.Time) error
+}
+
+// QUICConn A QUIC connection, as DNS-over-QUIC needs it.  The
+// standard library has no QUIC, so this is what a QUIC package gets
+// wrapped in to plug it in (see DoQServer): with quic-go for
+// instance OpenStream is OpenStreamSync and CloseWithError is the
+// same but for the type of the code.
+type QUICConn interface {
+	OpenStream(ctx context.Context) (QUICStream, error)
+	CloseWithError(code uint64, reason string) error
+}
+
+// DoQServer How to talk to a server over DNS-over-QUIC (RFC 9250).
+// Dial makes the QUIC connection to address with config, which
+// checks the server's certificate is valid for AuthName and chains
+// up to one of RootCAs (nil meaning the system's roots).  config
+// has a session cache, so a Dial that can resume sessions and send
+// early data (quic-go's DialEarly) gets the query off in the first
+// flight when the server allows it.  That is safe here since we
+// only ever send queries, which nothing is harmed by seeing twice
+// (RFC 9250 4.5).  Connection migration is up to the QUIC package
+// too: the connection is kept for as long as it lasts, and only
+// replaced once it stops working.  Dial does its own connecting, so
+// WithDial doesn't come into it.
+type DoQServer struct {
+	AuthName string
+	RootCAs  *x509.CertPool
+	Dial     func(ctx context.Context, address string, config *tls.Config) (QUICConn, error)
+}
+
+// DoQServers The servers DefaultResolver asks over DNS-over-QUIC
+// rather than plain UDP and TCP, by address.  Every query gets a
+// stream of its own on one connection to port 853.  DoHServers
+// and then DoTServers come first for a server in more than one.
+// Changes only apply to servers the resolver hasn't talked to yet.
+// Resolvers made by New have their own, see WithDoQ.
+var DoQServers map[netip.Addr]DoQServer
+
+// WithDoQ This makes the Resolver ask the server at addr over
+// DNS-over-QUIC, like DoQServers does for DefaultResolver.
+func WithDoQ(addr netip.Addr, server DoQServer) Option {
+	return func(res *Resolver) {
+		servers := maps.Clone(*res.doq)
+		if servers == nil {
+			servers = make(map[netip.Addr]DoQServer)
+		}
+		servers[addr.Unmap()] = server
+		*res.doq = servers
+	}
+}
+
+// doqErrorNone The DOQ_NO_ERROR code for closing connections
+const doqErrorNone = 0
+
+// doqUpstream The QUIC connection to a DoQ server, nil until it is
+// first needed and again once it has failed, under lock.
+type doqUpstream struct {
+	dial   func(ctx context.Context, address string, config *tls.Config) (QUICConn, error)
+	config *tls.Config
+	lock   sync.Mutex
+	conn   QUICConn
+}
+
+// doqUpstream The DoQ upstream for the server at addr, nil if it
+// isn't one to use DNS-over-QUIC with.
+func (res *Resolver) doqUpstream(addr netip.Addr) *doqUpstream {
+	server, ok := (*res.doq)[addr.Unmap()]
+	if !ok || server.Dial == nil {
+		return nil
+	}
+	return &doqUpstream{
+		dial: server.Dial,
+		config: &tls.Config{
+			ServerName:         server.AuthName,
+			RootCAs:            server.RootCAs,
+			MinVersion:         tls.VersionTLS13,
+			NextProtos:         []string{"doq"},
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+	}
+}
+
+// connection The connection to the server, dialling it if there
+// isn't one.
+func (u *doqUpstream) connection(ctx context.Context, address string) (QUICConn, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn == nil {
+		conn, err := u.dial(ctx, address, u.config)
+		if err != nil {
+			return nil, err
+		}
+		u.conn = conn
+	}
+	return u.conn, nil
+}
+
+// drop This closes conn and forgets it, unless it has already been
+// replaced.
+func (u *doqUpstream) drop(conn QUICConn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn == conn {
+		_ = conn.CloseWithError(doqErrorNone, "")
+		u.conn = nil
+	}
+}
+
+// sendDoQ This is send for DNS-over-QUIC.  The query goes on a new
+// stream with ID 0 (RFC 9250 4.2.1) and the length in front as over
+// TCP, and the response comes back on the same stream, which is all
+// the matching it needs.  It is given req's ID before it is
+// delivered.  If a stream can't be opened the connection is taken
+// to be gone, and a new one is made.
+func (manager *serverCommManager) sendDoQ(ctx context.Context, packet []byte, req *serverDNSRequest) {
+	packet[0], packet[1] = 0, 0
+	var stream QUICStream
+	for range 2 {
+		conn, err := manager.doq.connection(ctx, manager.address())
+		if err != nil {
+			return
+		}
+		if s, err := conn.OpenStream(ctx); err == nil {
+			stream = s
+			break
+		}
+		manager.doq.drop(conn)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	if stream == nil {
+		return
+	}
+	_ = stream.SetDeadline(req.deadline)
+	stop := context.AfterFunc(ctx, func() { _ = stream.SetDeadline(time.Now()) })
+	defer stop()
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packet)), uint16(len(packet)))
+	if _, err := stream.Write(append(framed, packet...)); err != nil {
+		return
+	}
+	if err := stream.Close(); err != nil {
+		return
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return
+	}
+	buf := wireBuffers.Get().(*[65535]byte)
+	defer wireBuffers.Put(buf)
+	frame := buf[:binary.BigEndian.Uint16(length[:])]
+	if _, err := io.ReadFull(stream, frame); err != nil {
+		return
+	}
+	msg, err := manager.unpack(frame, req)
+	if err != nil {
+		return
+	}
+	if msg.Header.ID == 0 {
+		msg.Header.ID = req.id
+	}
+	manager.dispatch(msg)
+}
@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQUICConn A QUIC connection to a DoQ server which answers every
+// query with an A record, once the stream it came on is closed.
+// After broken is set it won't open any more streams.
+type fakeQUICConn struct {
+	lock    sync.Mutex
+	broken  bool
+	queries []*DNSMessage
+}
+
+func (c *fakeQUICConn) OpenStream(context.Context) (QUICStream, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.broken {
+		return nil, errors.New("connection gone")
+	}
+	return &fakeQUICStream{conn: c}, nil
+}
+
+func (c *fakeQUICConn) CloseWithError(uint64, string) error {
+	return nil
+}
+
+type fakeQUICStream struct {
+	conn     *fakeQUICConn
+	query    bytes.Buffer
+	response io.Reader
+}
+
+func (s *fakeQUICStream) Write(p []byte) (int, error) {
+	return s.query.Write(p)
+}
+
+func (s *fakeQUICStream) Close() error {
+	packet := s.query.Bytes()
+	if len(packet) < 2 || int(binary.BigEndian.Uint16(packet)) != len(packet)-2 {
+		return errors.New("bad length")
+	}
+	query, err := unpackMessage(packet[2:])
+	if err != nil {
+		return err
+	}
+	s.conn.lock.Lock()
+	s.conn.queries = append(s.conn.queries, query)
+	s.conn.lock.Unlock()
+	answer := wireRecord(RTYPE_A, 300, []byte{192, 0, 2, 12})
+	response := wireResponse(0, 0, query.Question.QName, query.Question.QType, 1, answer)
+	s.response = bytes.NewReader(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+	return nil
+}
+
+func (s *fakeQUICStream) Read(p []byte) (int, error) {
+	if s.response == nil {
+		return 0, io.EOF
+	}
+	return s.response.Read(p)
+}
+
+func (s *fakeQUICStream) SetDeadline(time.Time) error {
+	return nil
+}
+
+func TestDoQ(t *testing.T) {
+	var lock sync.Mutex
+	var conns []*fakeQUICConn
+	var dialled []string
+	dial := func(_ context.Context, address string, config *tls.Config) (QUICConn, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if config.ServerName != "dns.example.net" || !slices.Equal(config.NextProtos, []string{"doq"}) {
+			t.Errorf("unexpected TLS config %+v", config)
+		}
+		dialled = append(dialled, address)
+		conn := &fakeQUICConn{}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+	res := withSingleRoot(New(WithDoQ(parseAddrNoerror("198.41.0.4"), DoQServer{AuthName: "dns.example.net", Dial: dial})))
+	lookup := func(name string) {
+		result, err := res.Lookup(name, RTYPE_A)
+		if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.12")}) {
+			t.Errorf("unexpected result %v, %v", result, err)
+		}
+	}
+	lookup("www.example.com")
+	lookup("mail.example.com")
+	lock.Lock()
+	if len(conns) != 1 || len(conns[0].queries) != 2 || !slices.Equal(dialled, []string{"198.41.0.4:853"}) {
+		t.Errorf("%d connections to %v, want one to 198.41.0.4:853 with both queries", len(conns), dialled)
+	}
+	for _, query := range conns[0].queries {
+		if query.Header.ID != 0 {
+			t.Errorf("query with ID %d", query.Header.ID)
+		}
+	}
+	// once the connection is gone the next query gets a new one
+	conns[0].lock.Lock()
+	conns[0].broken = true
+	conns[0].lock.Unlock()
+	lock.Unlock()
+	lookup("ftp.example.com")
+	lock.Lock()
+	defer lock.Unlock()
+	if len(conns) != 2 || len(conns[1].queries) != 1 {
+		t.Errorf("%d connections, want a second one for the last query", len(conns))
+	}
+}
@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+)
+
+// EDNS option code for Client Subnet (RFC 7871)
+const ednsClientSubnet = 8
+
+// ECSSourceBits4 and ECSSourceBits6 The most of a client's address
+// that goes to the servers with WithClientSubnet, the rest being
+// zeroed for the client's privacy.  These are the lengths RFC 7871
+// 11.1 recommends.  These are DefaultResolver's, see
+// WithECSSourceBits for the others.
+var ECSSourceBits4 = 24
+var ECSSourceBits6 = 56
+
+// WithECSSourceBits This sets how much of a client's address the
+// Resolver sends, like ECSSourceBits4 and ECSSourceBits6 do for
+// DefaultResolver.
+func WithECSSourceBits(v4, v6 int) Option {
+	return func(res *Resolver) {
+		*res.ecsBits4 = v4
+		*res.ecsBits6 = v6
+	}
+}
+
+type clientSubnetKey struct{}
+
+// WithClientSubnet This returns a context which makes LookupCtx and
+// QueryLookupCtx send subnet (cut down to the Resolver's
+// ECSSourceBits4 or ECSSourceBits6 bits) to the servers in an EDNS Client Subnet
+// option, so servers which tailor their answers to where the client
+// is (CDNs mostly) can answer for that client rather than for us.
+//
+// An answer that says it only holds for part of the address space
+// (a SCOPE PREFIX-LENGTH other than 0) is cached for that part
+// only, and only lookups with a client subnet inside it get it from
+// the cache, so answers for different subnets don't clobber each
+// other.  Everything else is cached for everyone as usual.
+func WithClientSubnet(ctx context.Context, subnet netip.Prefix) context.Context {
+	return context.WithValue(ctx, clientSubnetKey{}, subnet)
+}
+
+// clientSubnet The subnet to send for a lookup with ctx, false if
+// there isn't one.
+func (res *Resolver) clientSubnet(ctx context.Context) (netip.Prefix, bool) {
+	subnet, ok := ctx.Value(clientSubnetKey{}).(netip.Prefix)
+	if !ok || !subnet.IsValid() {
+		return netip.Prefix{}, false
+	}
+	addr := subnet.Addr().Unmap()
+	bits := min(subnet.Bits(), *res.ecsBits6)
+	if addr.Is4() {
+		bits = min(subnet.Bits(), *res.ecsBits4)
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), true
+}
+
+// ecsOption This is the Client Subnet option for subnet, as it goes
+// in a query: FAMILY, SOURCE PREFIX-LENGTH, a SCOPE PREFIX-LENGTH of
+// 0 and then only as many bytes of the address as the prefix needs.
+func ecsOption(subnet netip.Prefix) EDNSOption {
+	family := uint16(1)
+	if subnet.Addr().Is6() {
+		family = 2
+	}
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, uint8(subnet.Bits()), 0)
+	data = append(data, subnet.Addr().AsSlice()[:(subnet.Bits()+7)/8]...)
+	return EDNSOption{Code: ednsClientSubnet, Data: data}
+}
+
+// parseECS This reads a Client Subnet option, returning the address
+// and the source and scope prefix lengths.
+func parseECS(data []byte) (addr netip.Addr, source, scope int, ok bool) {
+	if len(data) < 4 {
+		return netip.Addr{}, 0, 0, false
+	}
+	source, scope = int(data[2]), int(data[3])
+	var buf [16]byte
+	size := 4
+	if family := binary.BigEndian.Uint16(data); family == 2 {
+		size = 16
+	} else if family != 1 {
+		return netip.Addr{}, 0, 0, false
+	}
+	if len(data)-4 > size || source > size*8 || scope > size*8 {
+		return netip.Addr{}, 0, 0, false
+	}
+	copy(buf[:], data[4:])
+	if size == 4 {
+		addr = netip.AddrFrom4([4]byte(buf[:4]))
+	} else {
+		addr = netip.AddrFrom16(buf)
+	}
+	return addr, source, scope, true
+}
+
+// ecsScope The part of the address space the answer in msg holds
+// for, when it was asked with sent as the client subnet.  It is the
+// zero Prefix when the answer holds for everyone: there was no
+// Client Subnet option in the response, or its scope was 0.  A
+// response whose option doesn't match what was sent gets the
+// narrowest scope, sent itself, to be on the safe side, as does one
+// claiming a scope narrower than what was sent (RFC 7871 7.3.1).
+func ecsScope(msg *DNSMessage, sent netip.Prefix) netip.Prefix {
+	option, ok := msg.EDNS.Option(ednsClientSubnet)
+	if !ok {
+		return netip.Prefix{}
+	}
+	addr, source, scope, ok := parseECS(option)
+	if !ok || source != sent.Bits() || netip.PrefixFrom(addr, source).Masked() != sent {
+		return sent
+	}
+	if scope == 0 {
+		return netip.Prefix{}
+	}
+	return netip.PrefixFrom(sent.Addr(), min(scope, source)).Masked()
+}
+
+// subnetLookup This finds the answer for name/t cached for the most
+// specific subnet that holds the lookup's client subnet, and its
+// key.  The entry is nil if there is none or the lookup has no
+// client subnet.  It doesn't count in the stats, see cachedLookup.
+func (res *Resolver) subnetLookup(ctx context.Context, name string, t RTYPE) (*dnsCacheEntry, rrKey) {
+	subnet, ok := res.clientSubnet(ctx)
+	if !ok {
+		return nil, rrKey{}
+	}
+	name = cleanName(name)
+	var best *dnsCacheEntry
+	var bestKey rrKey
+	bestBits := -1
+	for k := range res.cache.shard(name).cached(name).all() {
+		if k.class == IN && k.t == t && k.subnet.IsValid() && k.subnet.Bits() > bestBits &&
+			k.subnet.Bits() <= subnet.Bits() && k.subnet.Contains(subnet.Addr()) {
+			if entry, _ := res.cache.peek(name, k); entry != nil {
+				best, bestKey, bestBits = entry, k, k.subnet.Bits()
+			}
+		}
+	}
+	return best, bestKey
+}
@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+)
+
+func TestECSOption(t *testing.T) {
+	subnet, _ := DefaultResolver.clientSubnet(WithClientSubnet(context.Background(), netip.MustParsePrefix("198.51.100.77/32")))
+	if subnet != netip.MustParsePrefix("198.51.100.0/24") {
+		t.Errorf("client subnet cut down to %v", subnet)
+	}
+	option := ecsOption(subnet)
+	if want := []byte{0, 1, 24, 0, 198, 51, 100}; string(option.Data) != string(want) {
+		t.Errorf("option data %v, want %v", option.Data, want)
+	}
+	addr, source, scope, ok := parseECS(option.Data)
+	if !ok || addr != parseAddrNoerror("198.51.100.0") || source != 24 || scope != 0 {
+		t.Errorf("parseECS gave %v %d %d %v", addr, source, scope, ok)
+	}
+	subnet, _ = DefaultResolver.clientSubnet(WithClientSubnet(context.Background(), netip.MustParsePrefix("2001:db8:1:2:3::/80")))
+	if subnet != netip.MustParsePrefix("2001:db8:1::/56") || len(ecsOption(subnet).Data) != 4+7 {
+		t.Errorf("IPv6 client subnet %v", subnet)
+	}
+	if _, ok := DefaultResolver.clientSubnet(context.Background()); ok {
+		t.Errorf("client subnet without WithClientSubnet")
+	}
+}
+
+func TestClientSubnetCache(t *testing.T) {
+	var queries atomic.Int32
+	res := New()
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		queries.Add(1)
+		msg := &DNSMessage{Answers: []DNSAnswer{{RName: request.name, RType: RTYPE_A, TTL: 300}}}
+		var client netip.Addr
+		if request.edns != nil {
+			for _, option := range request.edns.Options {
+				if option.Code == ednsClientSubnet {
+					client, _, _, _ = parseECS(option.Data)
+					// the answer depends on the first 16 bits
+					option.Data[3] = 16
+					reply := EDNS{UDPSize: 1232, Options: []EDNSOption{option}}
+					msg.Additionals = append(msg.Additionals, reply.record())
+				}
+			}
+		}
+		switch {
+		case !client.IsValid():
+			msg.Answers[0].RData = A_RECORD{parseAddrNoerror("10.0.0.1")}
+		case client.As4()[0] == 198:
+			msg.Answers[0].RData = A_RECORD{parseAddrNoerror("10.0.0.198")}
+		default:
+			msg.Answers[0].RData = A_RECORD{parseAddrNoerror("10.0.0.203")}
+		}
+		return msg
+	})
+	lookup := func(subnet string) netip.Addr {
+		ctx := context.Background()
+		if subnet != "" {
+			ctx = WithClientSubnet(ctx, netip.MustParsePrefix(subnet))
+		}
+		result, err := res.LookupCtx(ctx, "cdn.example.com", RTYPE_A)
+		if err != nil || len(result) != 1 {
+			t.Fatalf("unexpected result %v, %v", result, err)
+		}
+		return result[0].RData.(A_RECORD).A
+	}
+	for _, test := range []struct {
+		subnet  string
+		want    string
+		queries int32
+	}{
+		{"198.51.100.0/24", "10.0.0.198", 1},
+		{"203.0.113.0/24", "10.0.0.203", 2},
+		// same /16 as the first, so from the cache
+		{"198.51.7.0/24", "10.0.0.198", 2},
+		{"", "10.0.0.1", 3},
+		{"", "10.0.0.1", 3},
+		{"203.0.113.0/24", "10.0.0.203", 3},
+	} {
+		if addr := lookup(test.subnet); addr != parseAddrNoerror(test.want) || queries.Load() != test.queries {
+			t.Errorf("lookup for %q: %v after %d queries, want %s after %d", test.subnet, addr, queries.Load(), test.want, test.queries)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package dns
+
+// UDPPayloadSize The biggest UDP response we tell servers we can
+// take, in the OPT record (EDNS0, RFC 6891) that goes on every
+// query.  Without it servers stop at 512 bytes and anything bigger
+// comes back truncated and has to be asked for again over TCP.  The
+// default of 1232 is what DNS Flag Day 2020 settled on, since it
+// gets through practically any path without fragmenting.  Setting
+// it to 0 leaves EDNS out altogether.  This is DefaultResolver's,
+// see WithUDPPayloadSize for the others.
+var UDPPayloadSize uint16 = 1232
+
+// WithUDPPayloadSize This is UDPPayloadSize for the Resolver.
+func WithUDPPayloadSize(size uint16) Option {
+	return func(res *Resolver) {
+		*res.udpPayloadSize = size
+	}
+}
+
+// payloadSize The UDPPayloadSize of the manager's Resolver, the same
+// way randomizesCase goes by it.
+func (manager *serverCommManager) payloadSize() uint16 {
+	if manager.udpPayloadSize == nil {
+		return UDPPayloadSize
+	}
+	return *manager.udpPayloadSize
+}
+
+// EDNSOption One option from an OPT record, Code saying what it is
+// and Data being its contents as they go on the wire.
+type EDNSOption struct {
+	Code uint16 `json:"code"`
+	Data []byte `json:"data"`
+}
+
+// OPT_RECORD The RDATA of an OPT pseudo-record, see EDNS.
+type OPT_RECORD struct {
+	Options []EDNSOption `json:"options"`
+}
+
+func (o OPT_RECORD) Dummy() {
+}
+
+// EDNS What an OPT pseudo-record says.  An OPT record borrows the
+// fields of an ordinary one: the class is UDPSize and the TTL holds
+// ExtendedRcode (the upper 8 bits of the 12 bit RCODE), Version and
+// the flags, of which only DO (DNSSEC OK) is defined.  Flags has the
+// rest of them as they came, and they go out as it says, which
+// should be 0 until something defines them.  A DNSMessage holds its
+// OPT record as one of these rather than in its additional section.
+type EDNS struct {
+	UDPSize       uint16       `json:"udpSize"`
+	ExtendedRcode uint8        `json:"extendedRcode,omitempty"`
+	Version       uint8        `json:"version,omitempty"`
+	DO            bool         `json:"do,omitempty"`
+	Flags         uint16       `json:"flags,omitempty"`
+	Options       []EDNSOption `json:"options,omitempty"`
+}
+
+// ednsFlagDO The DO bit in the flags of an OPT record
+const ednsFlagDO = 1 << 15
+
+// Option The data of the first option in e with code, and whether
+// there is one.
+func (e *EDNS) Option(code uint16) ([]byte, bool) {
+	if e == nil {
+		return nil, false
+	}
+	for _, option := range e.Options {
+		if option.Code == code {
+			return option.Data, true
+		}
+	}
+	return nil, false
+}
+
+// record This is e as the OPT pseudo-record that goes in the
+// additional section.
+func (e *EDNS) record() DNSAnswer {
+	ttl := uint32(e.ExtendedRcode)<<24 | uint32(e.Version)<<16 | uint32(e.Flags&^ednsFlagDO)
+	if e.DO {
+		ttl |= ednsFlagDO
+	}
+	return DNSAnswer{
+		RName:  ".",
+		RType:  RTYPE_OPT,
+		RClass: CLASS(e.UDPSize),
+		TTL:    ttl,
+		RData:  OPT_RECORD{e.Options},
+	}
+}
+
+// ednsFromRecord This reads an OPT pseudo-record.
+func ednsFromRecord(record DNSAnswer) *EDNS {
+	e := &EDNS{
+		UDPSize:       uint16(record.RClass),
+		ExtendedRcode: uint8(record.TTL >> 24),
+		Version:       uint8(record.TTL >> 16),
+		DO:            record.TTL&ednsFlagDO != 0,
+		Flags:         uint16(record.TTL) &^ ednsFlagDO,
+	}
+	if opt, ok := record.RData.(OPT_RECORD); ok {
+		e.Options = opt.Options
+	}
+	return e
+}
+
+// takeOPT This moves the OPT record (if any) out of the additional
+// section of msg and into msg.EDNS, folding its ExtendedRcode into
+// the header's status, so nothing further on mistakes it for a real
+// record.  The additional section is copied rather than changed in
+// place.
+func (msg *DNSMessage) takeOPT() {
+	var kept []DNSAnswer
+	for _, record := range msg.Additionals {
+		if record.RType != RTYPE_OPT {
+			kept = append(kept, record)
+		} else if msg.EDNS == nil {
+			msg.EDNS = ednsFromRecord(record)
+		}
+	}
+	if msg.EDNS == nil {
+		return
+	}
+	msg.Additionals = kept
+	msg.Header.Status = RCODE(msg.EDNS.ExtendedRcode)<<4 | msg.Header.Status&0xf
+}
+
+// edns The EDNS to send to the server with, nil when EDNS is turned
+// off (see UDPPayloadSize) or the server has shown it doesn't do
+// EDNS.
+func (manager *serverCommManager) edns() *EDNS {
+	size := manager.payloadSize()
+	if size == 0 || manager.noEDNS.Load() {
+		return nil
+	}
+	return &EDNS{UDPSize: max(size, 512)}
+}
+
+// ednsRefused Whether msg is how a server which doesn't do EDNS
+// answers a query with an OPT record: FORMERR with no OPT record of
+// its own (RFC 6891 7).
+func ednsRefused(msg *DNSMessage) bool {
+	return msg != nil && msg.Header.Status == RCODE_FMT && msg.EDNS == nil
+}
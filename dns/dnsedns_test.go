@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestTakeOPT(t *testing.T) {
+	edns := &EDNS{UDPSize: 4096, ExtendedRcode: 1, DO: true, Options: []EDNSOption{{Code: 10, Data: []byte{1, 2}}}}
+	glue := DNSAnswer{RName: "ns1.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.1")}}
+	msg := &DNSMessage{Additionals: []DNSAnswer{glue, edns.record()}}
+	msg.takeOPT()
+	if len(msg.Additionals) != 1 || msg.Additionals[0].RType != RTYPE_A {
+		t.Errorf("OPT record left in the additional section: %v", msg.Additionals)
+	}
+	if msg.EDNS == nil || msg.EDNS.UDPSize != 4096 || !msg.EDNS.DO || len(msg.EDNS.Options) != 1 || msg.EDNS.Options[0].Code != 10 {
+		t.Errorf("unexpected EDNS %+v", msg.EDNS)
+	}
+	if msg.Header.Status != RCODE_BADVERS {
+		t.Errorf("extended RCODE gave %v", msg.Header.Status)
+	}
+
+	plain := &DNSMessage{Additionals: []DNSAnswer{glue}}
+	plain.takeOPT()
+	if plain.EDNS != nil || len(plain.Additionals) != 1 {
+		t.Errorf("unexpected %+v", plain)
+	}
+}
+
+func TestOPTRoundTrip(t *testing.T) {
+	edns := &EDNS{UDPSize: 1400, Version: 0, DO: true, Flags: 0x0001, Options: []EDNSOption{{Code: ednsCookie, Data: []byte("12345678")}}}
+	packet, err := (&DNSMessage{Header: DNSHeader{ID: 1, Response: true}, EDNS: edns}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := unpackMessage(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the OPT record comes back as EDNS, not an additional
+	if len(msg.Additionals) != 0 || msg.EDNS == nil || msg.EDNS.UDPSize != 1400 || !msg.EDNS.DO || msg.EDNS.Flags != 0x0001 {
+		t.Errorf("unexpected %+v with EDNS %+v", msg, msg.EDNS)
+	}
+	if cookie, ok := msg.EDNS.Option(ednsCookie); !ok || string(cookie) != "12345678" {
+		t.Errorf("cookie option %q, %v", cookie, ok)
+	}
+	if _, ok := msg.EDNS.Option(ednsClientSubnet); ok {
+		t.Errorf("found an option that isn't there")
+	}
+	if _, ok := (*EDNS)(nil).Option(ednsCookie); ok {
+		t.Errorf("found an option with no EDNS")
+	}
+}
+
+func TestEDNS(t *testing.T) {
+	var lock sync.Mutex
+	var sizes []uint16
+	res := withSingleRoot(New())
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		lock.Lock()
+		defer lock.Unlock()
+		if request.edns == nil {
+			sizes = append(sizes, 0)
+		} else {
+			sizes = append(sizes, request.edns.UDPSize)
+		}
+		// this server has never heard of EDNS
+		if request.edns != nil {
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_FMT}}
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+		}}}
+	})
+	if result, err := res.Lookup("www.example.com", RTYPE_A); err != nil || len(result) != 1 {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	if result, err := res.Lookup("mail.example.com", RTYPE_A); err != nil || len(result) != 1 {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []uint16{1232, 0, 0}; !slices.Equal(sizes, want) {
+		t.Errorf("sent %v, want %v", sizes, want)
+	}
+}
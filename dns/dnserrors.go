@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The ways a lookup can fail, for telling them apart with errors.Is.
+// What a lookup returns is usually one of the more specific errors
+// (a *ServerFailureError, a *DelegationLoopError and so on), which
+// match the one of these they are a case of.  A lookup whose context
+// is done fails with ctx.Err() instead, and one that uses up its
+// Budget with ErrTooManyQueries or ErrTooManyReferrals.
+var (
+	// ErrNXDomain The name doesn't exist, the servers for its zone
+	// answered NXDOMAIN.  A name that exists but has no records of
+	// the type asked for is no error at all, just no answers.
+	ErrNXDomain = errors.New("dns: no such name")
+	// ErrServFail None of the servers for the zone could answer, see
+	// ServerFailureError.  A response that didn't parse counts as no
+	// response.
+	ErrServFail = errors.New("dns: server failure")
+	// ErrTimeout None of the servers for the zone answered at all
+	// (a *ServerFailureError that is ErrServFail as well)
+	ErrTimeout = errors.New("dns: no response from the servers")
+	// ErrNoGlue None of the nameservers for the zone could be asked
+	// because none of their addresses could be found
+	ErrNoGlue = errors.New("dns: no address for any of the nameservers")
+	// ErrNoNameservers There is no one to ask: the Resolver has no
+	// root hints and no Forwarders
+	ErrNoNameservers = errors.New("dns: no nameservers to ask")
+	// ErrLoop The CNAMEs or the delegations go round in circles, see
+	// CNAMELoopError and DelegationLoopError
+	ErrLoop = errors.New("dns: loop")
+)
+
+// nxDomain The error for name not existing
+func nxDomain(name string) error {
+	return fmt.Errorf("%w: %s", ErrNXDomain, absolute(name))
+}
+
+func (e *ServerFailureError) Is(target error) bool {
+	return target == ErrServFail || target == ErrTimeout && e.Timeout
+}
+
+func (e *DelegationLoopError) Is(target error) bool {
+	return target == ErrLoop
+}
+
+func (e *CNAMELoopError) Is(target error) bool {
+	return target == ErrLoop
+}
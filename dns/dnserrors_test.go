@@ -0,0 +1,75 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestLookupErrors(t *testing.T) {
+	res := withSingleRoot(New(WithDefaultRetryPolicy(RetryPolicy{Timeout: 50 * time.Millisecond, Attempts: 1})))
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch request.name {
+		case "missing.example.com", "ns.example.net":
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_NXNAME}}
+		case "alias.example.com":
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_NXNAME}, Answers: []DNSAnswer{{RName: request.name,
+				RType: RTYPE_CNAME, TTL: 300, RData: CNAME_RECORD{"missing.example.com."}}}}
+		case "broken.example.com":
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_SERVFAIL}}
+		case "loop.example.com":
+			return &DNSMessage{Answers: []DNSAnswer{{RName: request.name, RType: RTYPE_CNAME, TTL: 300,
+				RData: CNAME_RECORD{"loop.example.com."}}}}
+		case "www.example.org":
+			// delegated to a nameserver without glue that doesn't exist
+			return &DNSMessage{Authorities: []DNSAnswer{{RName: "example.org", RType: RTYPE_NS, TTL: 300,
+				RData: NS_RECORD{"ns.example.net."}}}}
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name    string
+		is      []error
+		isNot   []error
+		answers int
+	}{
+		{"missing.example.com", []error{ErrNXDomain}, []error{ErrServFail}, 0},
+		{"alias.example.com", []error{ErrNXDomain}, nil, 1},
+		{"broken.example.com", []error{ErrServFail}, []error{ErrTimeout, ErrNXDomain}, 0},
+		{"silent.example.com", []error{ErrServFail, ErrTimeout}, nil, 0},
+		{"loop.example.com", []error{ErrLoop}, nil, 1},
+		{"www.example.org", []error{ErrNoGlue}, []error{ErrServFail}, 0},
+	}
+	for _, test := range tests {
+		answers, err := res.Lookup(test.name, RTYPE_A)
+		for _, target := range test.is {
+			if !errors.Is(err, target) {
+				t.Errorf("%s: error %v isn't %v", test.name, err, target)
+			}
+		}
+		for _, target := range test.isNot {
+			if errors.Is(err, target) {
+				t.Errorf("%s: error %v is %v", test.name, err, target)
+			}
+		}
+		if len(answers) != test.answers {
+			t.Errorf("%s: %d answers, want %d", test.name, len(answers), test.answers)
+		}
+	}
+
+	// QueryLookup doesn't say, and net.Resolver's errors do
+	if answers := res.QueryLookup("missing.example.com", RTYPE_A); answers != nil {
+		t.Errorf("unexpected answers %v", answers)
+	}
+	nr := &NetResolver{Resolver: res}
+	var dnsErr *net.DNSError
+	if _, err := nr.LookupHost(t.Context(), "missing.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("unexpected error %v for a missing name", err)
+	}
+	if _, err := nr.LookupHost(t.Context(), "silent.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsTimeout {
+		t.Errorf("unexpected error %v for servers that don't answer", err)
+	}
+}
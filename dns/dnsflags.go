@@ -0,0 +1,40 @@
+package dns
+
+import "context"
+
+// DNSSECFlags The DNSSEC bits a lookup sends to the servers.  DO (in
+// the OPT record, so it only goes out with EDNS, see UDPPayloadSize)
+// says we understand DNSSEC and want the signatures, and is what a
+// validating server needs to see before it will set the AD bit on
+// its answers.  CD asks a validating server to hand over the data
+// even if it doesn't validate, for a caller that does its own
+// validation.
+type DNSSECFlags struct {
+	DO bool
+	CD bool
+}
+
+type dnssecFlagsKey struct{}
+
+// WithDNSSECFlags This returns a context which makes LookupCtx and
+// QueryLookupCtx send flags to the servers.  Whatever the flags,
+// every answer a lookup returns has Authenticated set if the server
+// it came from set the AD bit, which the cache remembers along with
+// the records.  That only means something when the server is a
+// validating resolver we trust, reached over a path nobody can
+// tamper with; authoritative servers never set it.
+//
+// The cache is shared, so a lookup with CD set can get answers that
+// were validated and one without it answers that weren't (they won't
+// be Authenticated).  The signatures that come back with DO are
+// cached as RRSIG records for their owner name.
+func WithDNSSECFlags(ctx context.Context, flags DNSSECFlags) context.Context {
+	return context.WithValue(ctx, dnssecFlagsKey{}, flags)
+}
+
+// dnssecFlags The flags for a lookup with ctx, none unless
+// WithDNSSECFlags said otherwise.
+func dnssecFlags(ctx context.Context) DNSSECFlags {
+	flags, _ := ctx.Value(dnssecFlagsKey{}).(DNSSECFlags)
+	return flags
+}
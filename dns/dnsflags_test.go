@@ -0,0 +1,47 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestDNSSECFlags(t *testing.T) {
+	var lock sync.Mutex
+	var cds []bool
+	res := New()
+	// a validating server, which only sets AD for queries with DO
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		lock.Lock()
+		cds = append(cds, request.cd)
+		lock.Unlock()
+		ad := request.edns != nil && request.edns.DO
+		return &DNSMessage{Header: DNSHeader{AuthenticData: ad}, Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+		}}}
+	})
+	ctx := WithDNSSECFlags(context.Background(), DNSSECFlags{DO: true, CD: true})
+	for _, from := range []string{"server", "cache"} {
+		result, err := res.LookupCtx(ctx, "www.example.com", RTYPE_A)
+		if err != nil || len(result) != 1 || !result[0].Authenticated {
+			t.Errorf("from the %s: expected an authenticated answer, got %v, %v", from, result, err)
+		}
+	}
+	result, err := res.LookupCtx(context.Background(), "mail.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].Authenticated {
+		t.Errorf("expected an unauthenticated answer without DO, got %v, %v", result, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(cds) != 2 || !cds[0] || cds[1] {
+		t.Errorf("sent CD bits %v, want [true false]", cds)
+	}
+
+	records := res.DumpCache()
+	for _, record := range records {
+		if record.Name == "www.example.com" && !record.AD {
+			t.Errorf("expected the cached record to be marked AD: %+v", record)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"context"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Forwarders The recursive resolvers (1.1.1.1 and 9.9.9.9 say)
+// DefaultResolver forwards its queries to, with RD set, rather than
+// finding the answers itself starting from the root.  What they
+// answer is cached just the same.  They are tried fastest first,
+// like the servers for a zone are (see rankNameservers), and
+// whatever DoTServers, DoHServers, DoQServers and TSIGKeys say
+// about their addresses applies, so they can be reached over an
+// encrypted transport.  Referrals from them aren't followed.  Empty
+// (the default) means iterating from the root.  Resolvers made by
+// New have their own, see WithForwarders.
+var Forwarders []netip.Addr
+
+// WithForwarders This makes the Resolver forward its queries to the
+// recursive resolvers at addrs, like Forwarders does for
+// DefaultResolver.
+func WithForwarders(addrs ...netip.Addr) Option {
+	return func(res *Resolver) {
+		forwarders := make([]netip.Addr, len(addrs))
+		for i, addr := range addrs {
+			forwarders[i] = addr.Unmap()
+		}
+		*res.forwarders = forwarders
+	}
+}
+
+// ForwardZones The recursive resolvers DefaultResolver forwards the
+// queries for the names in some zones to, by zone, in place of
+// Forwarders (or of iterating, if there are none).  The closest zone
+// to a name is the one that counts, so "corp.example.com" can go to
+// the servers inside the company and everything else to the
+// Forwarders.  The zones are in lower case without the trailing '.',
+// and their forwarders are asked the same way Forwarders are.
+// Resolvers made by New have their own, see WithForwardZone.
+var ForwardZones map[string][]netip.Addr
+
+// WithForwardZone This makes the Resolver forward its queries for
+// the names in zone to the recursive resolvers at addrs, like
+// ForwardZones does for DefaultResolver.  Forwarding "." is the same
+// as WithForwarders.
+func WithForwardZone(zone string, addrs ...netip.Addr) Option {
+	return func(res *Resolver) {
+		forwarders := make([]netip.Addr, len(addrs))
+		for i, addr := range addrs {
+			forwarders[i] = addr.Unmap()
+		}
+		if zone = cleanName(zone); zone == "." {
+			*res.forwarders = forwarders
+			return
+		}
+		zones := maps.Clone(*res.forwardZones)
+		if zones == nil {
+			zones = make(map[string][]netip.Addr)
+		}
+		zones[zone] = forwarders
+		*res.forwardZones = zones
+	}
+}
+
+// forwarderAddrs The forwarders for name in the order to try them,
+// nil if the Resolver iterates itself.
+func (res *Resolver) forwarderAddrs(name string) []netip.Addr {
+	forwarders := *res.forwarders
+	if zones := *res.forwardZones; len(zones) > 0 {
+		for zone := name; ; {
+			if addrs, ok := zones[zone]; ok && len(addrs) > 0 {
+				forwarders = addrs
+				break
+			}
+			if zone == "." {
+				break
+			}
+			_, parent, found := strings.Cut(zone, ".")
+			if !found {
+				parent = "."
+			}
+			zone = parent
+		}
+	}
+	if len(forwarders) == 0 {
+		return nil
+	}
+	return res.rankAddrs(slices.Clone(forwarders))
+}
+
+type recursionDesiredKey struct{}
+
+// withRecursionDesired This returns a context which makes the
+// queries for a lookup go out with RD set.
+func withRecursionDesired(ctx context.Context) context.Context {
+	return context.WithValue(ctx, recursionDesiredKey{}, true)
+}
+
+// recursionDesired Whether the queries for a lookup with ctx go out
+// with RD set
+func recursionDesired(ctx context.Context) bool {
+	rd, _ := ctx.Value(recursionDesiredKey{}).(bool)
+	return rd
+}
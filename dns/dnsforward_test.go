@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestForwarders(t *testing.T) {
+	good, bad := parseAddrNoerror("9.9.9.9"), parseAddrNoerror("192.0.2.53")
+	var lock sync.Mutex
+	asked := map[netip.Addr]int{}
+	res := New(WithForwarders(bad, good))
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		lock.Lock()
+		asked[addr]++
+		lock.Unlock()
+		if !request.rd {
+			t.Errorf("query to %v without RD", addr)
+		}
+		if addr != good {
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_SERVFAIL}}
+		}
+		// a forwarder hands back the whole chain at once
+		return &DNSMessage{Header: DNSHeader{RecursionAvailable: true}, Answers: []DNSAnswer{
+			{RName: request.name, RType: RTYPE_CNAME, RClass: IN, TTL: 300, RData: CNAME_RECORD{"cdn.example.net."}},
+			{RName: "cdn.example.net", RType: RTYPE_A, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.96")}},
+		}}
+	})
+	for range 2 {
+		result, err := res.Lookup("www.example.com", RTYPE_A)
+		if err != nil || len(result) != 2 || result[1].RData != (A_RECORD{parseAddrNoerror("192.0.2.96")}) {
+			t.Errorf("unexpected result %v, %v", result, err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	// the second lookup came from the cache, and nothing went
+	// anywhere but the forwarders
+	if asked[good] != 1 || asked[bad] > 1 || len(asked) > 2 {
+		t.Errorf("servers asked %v", asked)
+	}
+	if entry := res.cacheLookup("cdn.example.net", RTYPE_A); entry == nil {
+		t.Errorf("the forwarder's answer wasn't cached")
+	}
+}
+
+func TestForwardZones(t *testing.T) {
+	corp, public := parseAddrNoerror("10.0.0.53"), parseAddrNoerror("9.9.9.9")
+	res := New(WithForwarders(public), WithForwardZone("Corp.Example.com.", corp))
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		return &DNSMessage{Answers: []DNSAnswer{{RName: request.name, RType: RTYPE_TXT, RClass: IN, TTL: 300,
+			RData: TXT_RECORD{[]string{addr.String()}}}}}
+	})
+	for name, want := range map[string]netip.Addr{
+		"db.corp.example.com": corp,
+		"corp.example.com":    corp,
+		"www.example.com":     public,
+		"xcorp.example.com":   public,
+	} {
+		result, err := res.Lookup(name, RTYPE_TXT)
+		if err != nil || len(result) != 1 || result[0].RData.(TXT_RECORD).Txt[0] != want.String() {
+			t.Errorf("%s: unexpected result %v, %v, want it from %v", name, result, err, want)
+		}
+	}
+}
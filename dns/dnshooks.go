@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"net/netip"
+	"time"
+)
+
+// CacheEvent What the cache hooks get told about an entry.  Data
+// is shared with the cache so it must not be modified.  Subnet is
+// set on answers which only hold for part of the address space (see
+// WithClientSubnet).
+type CacheEvent struct {
+	Name   string
+	Class  CLASS
+	Type   RTYPE
+	Subnet netip.Prefix
+	Data   []RDATA
+	TTL    uint32
+	Pinned bool
+	Infra  bool
+}
+
+// OnCacheInsert, OnCacheHit, OnCacheEvict and OnCacheExpire These
+// are optional hooks for things like metrics or audit logging.
+// They get called for both the answer and infrastructure caches:
+//
+//   - OnCacheInsert whenever an entry is stored (or merged into)
+//   - OnCacheHit whenever a lookup is answered from the cache
+//   - OnCacheEvict when a live entry is flushed, unpinned or thrown
+//     out to stay under the memory limit
+//   - OnCacheExpire when an entry goes away because it expired, be
+//     it by the sweeper, eviction or new data replacing it
+//
+// They run on whichever goroutine touched the cache, but only after
+// every cache lock has been let go, so it is fine for them to call
+// back into the cache.  Set them up before the cache is in use.
+// These are DefaultResolver's, Resolvers made by New have their own,
+// see WithCacheHooks.
+var OnCacheInsert func(CacheEvent)
+var OnCacheHit func(CacheEvent)
+var OnCacheEvict func(CacheEvent)
+var OnCacheExpire func(CacheEvent)
+
+// cacheHooks The hook settings of a Resolver, which its caches share
+type cacheHooks struct {
+	insert *func(CacheEvent)
+	hit    *func(CacheEvent)
+	evict  *func(CacheEvent)
+	expire *func(CacheEvent)
+}
+
+// newCacheHooks Hook settings of its own, all unset
+func newCacheHooks() *cacheHooks {
+	return &cacheHooks{new(func(CacheEvent)), new(func(CacheEvent)), new(func(CacheEvent)), new(func(CacheEvent))}
+}
+
+// WithCacheHooks This sets the Resolver's cache hooks, which work
+// like OnCacheInsert, OnCacheHit, OnCacheEvict and OnCacheExpire do
+// for DefaultResolver.  Any of them can be nil.
+func WithCacheHooks(insert, hit, evict, expire func(CacheEvent)) Option {
+	return func(res *Resolver) {
+		*res.hooks.insert = insert
+		*res.hooks.hit = hit
+		*res.hooks.evict = evict
+		*res.hooks.expire = expire
+	}
+}
+
+// cacheEvents Hook calls waiting for the locks to be released
+type cacheEvents []pendingEvent
+
+type pendingEvent struct {
+	hook  func(CacheEvent)
+	event CacheEvent
+}
+
+// event This builds the CacheEvent for the entry for name/k
+func (key *dnsCacheUnit) event(name string, k rrKey, entry *dnsCacheEntry) CacheEvent {
+	return CacheEvent{
+		Name:   name,
+		Class:  k.class,
+		Type:   k.t,
+		Subnet: k.subnet,
+		Data:   entry.data,
+		TTL:    entry.ttl(*key.table.maxTTL),
+		Pinned: entry.pinned,
+		Infra:  key.table.infra,
+	}
+}
+
+// add This queues up a call to hook (if it is set) for the entry
+func (events *cacheEvents) add(hook func(CacheEvent), key *dnsCacheUnit, name string, k rrKey, entry *dnsCacheEntry) {
+	if hook == nil {
+		return
+	}
+	*events = append(*events, pendingEvent{hook, key.event(name, k, entry)})
+}
+
+// dropped This queues the expire or evict hook for an entry being
+// removed, depending on whether it had expired.
+func (events *cacheEvents) dropped(key *dnsCacheUnit, name string, k rrKey, entry *dnsCacheEntry) {
+	if entry.expiredAt(time.Now()) {
+		events.add(*key.table.hooks.expire, key, name, k, entry)
+	} else {
+		events.add(*key.table.hooks.evict, key, name, k, entry)
+	}
+}
+
+// fire This makes the queued hook calls.  No locks may be held.
+func (events cacheEvents) fire() {
+	for _, p := range events {
+		p.hook(p.event)
+	}
+}
@@ -0,0 +1,104 @@
+package dns
+
+import "time"
+
+// IdleServerTimeout How long the manager for a server is kept once
+// no lookup is using it.  After that it is closed, along with any
+// connections it has open, and forgotten, so that a resolver that
+// has talked to a great many servers over time isn't left holding
+// a goroutine (and maybe a connection) for every one of them.  What
+// it knew about the server goes with it, but by then its failures
+// would have been forgotten anyway (see serverFailureMemory).  0
+// means managers are kept forever.  Changes only apply to managers
+// made after.  This is DefaultResolver's, see WithIdleServerTimeout
+// for the others.
+var IdleServerTimeout = 10 * time.Minute
+
+// WithIdleServerTimeout This is IdleServerTimeout for the Resolver.
+func WithIdleServerTimeout(timeout time.Duration) Option {
+	return func(res *Resolver) {
+		*res.idleServerTimeout = timeout
+	}
+}
+
+// release This says the caller of getServerComm is done with the
+// manager.
+func (manager *serverCommManager) release() {
+	manager.lastUsed.Store(time.Now().UnixNano())
+	manager.refs.Add(-1)
+}
+
+// watchIdle This starts the timer that closes manager, which has
+// just been put in key, once it goes unused for the Resolver's
+// IdleServerTimeout.
+// key.lock has to be held.
+func (res *Resolver) watchIdle(key *serverCommUnit, manager *serverCommManager) {
+	timeout := *res.idleServerTimeout
+	if timeout <= 0 {
+		return
+	}
+	manager.lastUsed.Store(time.Now().UnixNano())
+	manager.idleTimer = time.AfterFunc(timeout, func() {
+		res.closeIdleServerComm(key, manager, timeout)
+	})
+}
+
+// closeIdleServerComm This closes manager and takes it out of key if
+// it has gone unused for timeout, and otherwise checks again once
+// it could have.  A manager is only ever in use while key.lock is
+// held (see getServerComm), so holding it here means nobody can
+// start using the manager while it is being closed.
+func (res *Resolver) closeIdleServerComm(key *serverCommUnit, manager *serverCommManager, timeout time.Duration) {
+	key.lock.Lock()
+	if manager.refs.Load() > 0 {
+		key.lock.Unlock()
+		manager.idleTimer.Reset(timeout)
+		return
+	}
+	if idle := time.Since(time.Unix(0, manager.lastUsed.Load())); idle < timeout {
+		key.lock.Unlock()
+		manager.idleTimer.Reset(timeout - idle)
+		return
+	}
+	if key.entries[*manager.remote] == manager {
+		delete(key.entries, *manager.remote)
+	}
+	key.lock.Unlock()
+	manager.close()
+}
+
+// close This shuts manager down: the goroutine taking its requests
+// stops and its connections are closed.  It must not be in use.
+// Requests already sent are given up on once their askServer
+// returns, and close waits for them to be.  Closing it again does nothing.
+func (manager *serverCommManager) close() {
+	manager.closeOnce.Do(manager.shutdown)
+}
+
+// shutdown This does the work for close.
+func (manager *serverCommManager) shutdown() {
+	close(manager.requests)
+	manager.tcpLock.Lock()
+	tcp := manager.tcp
+	if tcp != nil {
+		_ = tcp.conn.Close()
+	}
+	manager.tcpLock.Unlock()
+	if tcp != nil {
+		<-tcp.dead
+	}
+	if manager.doh != nil {
+		manager.doh.client.CloseIdleConnections()
+	}
+	if manager.doq != nil {
+		manager.doq.lock.Lock()
+		if manager.doq.conn != nil {
+			_ = manager.doq.conn.CloseWithError(doqErrorNone, "")
+			manager.doq.conn = nil
+		}
+		manager.doq.lock.Unlock()
+	}
+	if manager.stopped != nil {
+		<-manager.stopped
+	}
+}
@@ -0,0 +1,53 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIdleServerComm(t *testing.T) {
+	res := withSingleRoot(New(WithIdleServerTimeout(50 * time.Millisecond)))
+	res.connect = answeringWith("10.0.0.1")
+	root := parseAddrNoerror("198.41.0.4")
+	managers := func() map[netip.Addr]*serverCommManager {
+		found := make(map[netip.Addr]*serverCommManager)
+		for _, key := range res.serverComm {
+			key.lock.RLock()
+			for addr, manager := range key.entries {
+				found[addr] = manager
+			}
+			key.lock.RUnlock()
+		}
+		return found
+	}
+
+	if _, err := res.Lookup("www.example.com", RTYPE_A); err != nil {
+		t.Fatal(err)
+	}
+	first := managers()[root]
+	if first == nil || first.refs.Load() != 0 {
+		t.Fatalf("unexpected manager %v after the lookup", first)
+	}
+	// one in use is kept however long it is in use for
+	held := res.getServerComm(&root)
+	time.Sleep(150 * time.Millisecond)
+	if managers()[root] != first || held != first {
+		t.Fatalf("the manager was closed while in use")
+	}
+	held.release()
+	time.Sleep(150 * time.Millisecond)
+	if len(managers()) != 0 {
+		t.Fatalf("idle managers weren't closed: %v", managers())
+	}
+	if _, ok := <-first.requests; ok {
+		t.Errorf("the closed manager's requests channel is still open")
+	}
+	// and the next lookup gets a new one
+	if _, err := res.Lookup("mail.example.com", RTYPE_A); err != nil {
+		t.Fatal(err)
+	}
+	if second := managers()[root]; second == nil || second == first {
+		t.Errorf("unexpected manager %v after closing %v", second, first)
+	}
+}
@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"context"
+	"sync"
+)
+
+// MaxConcurrentLookups and MaxInflightQueries These bound how much
+// DefaultResolver does at once: how many lookups (Lookup and the
+// functions built on it) can be running, and how many queries can be
+// out waiting on the servers.  Anything over the limit waits for a
+// slot, or until its context is done.  0 means no limit.  Resolvers
+// made by New have their own limits, see WithConcurrencyLimits.
+var MaxConcurrentLookups = 0
+var MaxInflightQueries = 0
+
+// limiter A semaphore whose size can be changed at any time, since
+// it points at the setting rather than having its own copy.
+type limiter struct {
+	limit *int
+	lock  sync.Mutex
+	used  int
+	// freed is closed (and replaced) whenever a slot is released,
+	// to wake up everyone waiting for one
+	freed chan struct{}
+}
+
+func newLimiter(limit *int) *limiter {
+	return &limiter{limit: limit, freed: make(chan struct{})}
+}
+
+// tryAcquire This takes a slot if there is one free, without
+// waiting.  If there isn't, it returns the channel which will be
+// closed once there might be.
+func (l *limiter) tryAcquire() (bool, chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if *l.limit <= 0 || l.used < *l.limit {
+		l.used++
+		return true, nil
+	}
+	return false, l.freed
+}
+
+// acquire This waits for a slot, returning ctx.Err() if ctx is done
+// first.  Every successful acquire needs a release.
+func (l *limiter) acquire(ctx context.Context) error {
+	for {
+		ok, freed := l.tryAcquire()
+		if ok {
+			return nil
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// inUse How many slots are taken
+func (l *limiter) inUse() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.used
+}
+
+func (l *limiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.used--
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// WithConcurrencyLimits This limits how many lookups can be running
+// at once and how many queries can be waiting on the servers, like
+// MaxConcurrentLookups and MaxInflightQueries do for
+// DefaultResolver.
+func WithConcurrencyLimits(lookups, queries int) Option {
+	return func(res *Resolver) {
+		*res.lookups.limit = lookups
+		*res.queries.limit = queries
+	}
+}
@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingServer A fake server connection which holds on to every
+// request until release is closed, keeping track of the most it
+// had at once.
+func blockingServer(release chan struct{}, most *atomic.Int32) func(*netip.Addr) *serverCommManager {
+	var waiting atomic.Int32
+	return fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		n := waiting.Add(1)
+		defer waiting.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		<-release
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+		}}}
+	})
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	for _, test := range []struct {
+		name             string
+		lookups, queries int
+	}{{"Lookups", 2, 0}, {"Queries", 0, 2}} {
+		t.Run(test.name, func(t *testing.T) {
+			res := New(WithConcurrencyLimits(test.lookups, test.queries))
+			release := make(chan struct{})
+			var most atomic.Int32
+			res.connect = blockingServer(release, &most)
+
+			var wg sync.WaitGroup
+			for i := range 6 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if result, err := res.Lookup(fmt.Sprintf("www%d.example.com", i), RTYPE_A); err != nil || len(result) != 1 {
+						t.Errorf("unexpected result %v, %v", result, err)
+					}
+				}()
+			}
+			time.Sleep(100 * time.Millisecond)
+			if n := most.Load(); n != 2 {
+				t.Errorf("%d queries went out at once, want 2", n)
+			}
+			close(release)
+			wg.Wait()
+		})
+	}
+}
+
+func TestConcurrencyLimitWait(t *testing.T) {
+	res := New(WithConcurrencyLimits(1, 0))
+	release := make(chan struct{})
+	defer close(release)
+	var most atomic.Int32
+	res.connect = blockingServer(release, &most)
+	go res.Lookup("www.example.com", RTYPE_A)
+	time.Sleep(50 * time.Millisecond)
+
+	// the one slot is taken, so this has to wait and gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := res.LookupCtx(ctx, "www.example.org", RTYPE_A); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if n := most.Load(); n != 1 {
+		t.Errorf("%d queries went out, want 1", n)
+	}
+}
@@ -1 +1,139 @@
 package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultServerIdleTimeout How long a Server keeps a TCP connection
+// open waiting for the next query, unless its IdleTimeout says
+// otherwise.  RFC 7766 6.2.3 suggests a few seconds, so clients
+// doing a handful of queries can reuse the connection without
+// idle ones tying the server up.
+const DefaultServerIdleTimeout = 10 * time.Second
+
+// DefaultServerMaxTCPConns How many TCP connections a Server has
+// open at once, unless its MaxTCPConns says otherwise
+const DefaultServerMaxTCPConns = 256
+
+// serverPipeline How many queries on one TCP connection a Server
+// answers at once.  The client can send more, but they wait to be
+// read until one of these is answered.
+const serverPipeline = 32
+
+// ServeTCP This accepts connections on l and answers the queries
+// that come over them until Close is called, which closes l.  It
+// returns ErrServerClosed then, or whatever accepting failed with
+// before that (l is closed in that case too).
+//
+// Each message is preceded by its length in two bytes (RFC 1035
+// 4.2.2).  A client can send several queries without waiting, and
+// they are answered at the same time, each as soon as it is ready,
+// whatever order that is in (RFC 7766 6.2.1.1); responses aren't
+// cut down as they are over UDP.  A connection that goes
+// IdleTimeout without a query is closed once its answers are sent.
+func (srv *Server) ServeTCP(l net.Listener) error {
+	if !srv.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer srv.untrack(l)
+	maxConns := srv.MaxTCPConns
+	if maxConns <= 0 {
+		maxConns = DefaultServerMaxTCPConns
+	}
+	slots := make(chan struct{}, maxConns)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-srv.done.Done():
+			return ErrServerClosed
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			<-slots
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !srv.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		if !srv.begin() {
+			srv.untrack(conn)
+			return ErrServerClosed
+		}
+		go func() {
+			defer srv.running.Done()
+			defer func() { <-slots }()
+			defer srv.untrack(conn)
+			srv.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn This answers the queries on conn until the client
+// closes it, it goes idle, something on it fails or srv is closed,
+// and returns once every query read off it has been answered.
+func (srv *Server) serveConn(conn net.Conn) {
+	idle := srv.IdleTimeout
+	if idle <= 0 {
+		idle = DefaultServerIdleTimeout
+	}
+	var writeLock sync.Mutex
+	var answering sync.WaitGroup
+	defer answering.Wait()
+	pipeline := make(chan struct{}, serverPipeline)
+	client := clientAddr(conn.RemoteAddr())
+	var length [2]byte
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idle))
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n == 0 {
+			return
+		}
+		buf := wireBuffers.Get().(*[65535]byte)
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			wireBuffers.Put(buf)
+			return
+		}
+		pipeline <- struct{}{}
+		if !srv.begin() {
+			wireBuffers.Put(buf)
+			return
+		}
+		answering.Add(1)
+		go func() {
+			defer srv.running.Done()
+			defer answering.Done()
+			defer func() { <-pipeline }()
+			response, _ := srv.respond(buf[:n], client, false)
+			wireBuffers.Put(buf)
+			if response == nil {
+				return
+			}
+			frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(response)), uint16(len(response)))
+			frame = append(frame, response...)
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			_ = conn.SetWriteDeadline(time.Now().Add(idle))
+			if _, err := conn.Write(frame); err != nil {
+				// the client is gone, so stop reading from it
+				conn.Close()
+			}
+		}()
+	}
+}
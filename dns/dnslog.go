@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logger Where DefaultResolver logs what it is doing, nil (the
+// default) for nowhere.  The events, with the name, type and server
+// they are about as attributes, are:
+//
+//   - at Debug, every lookup answered from the cache or not, every
+//     query sent to a server and what it answered
+//   - at Info, a server that didn't answer in time, or whose
+//     response was turned down (see CaseRandomization and
+//     DNSCookies)
+//   - at Warn, a response that couldn't be read or whose TSIG
+//     signature didn't check out
+//
+// Debug is a lot, so a handler at that level is for tracking down a
+// problem rather than for always having on.  Resolvers made by New
+// have their own, see WithLogger.
+var Logger *slog.Logger
+
+// WithLogger This makes the Resolver log to logger, like Logger does
+// for DefaultResolver.
+func WithLogger(logger *slog.Logger) Option {
+	return func(res *Resolver) {
+		*res.logger = logger
+	}
+}
+
+// discardLogger What logging goes to when there is no Logger
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// log The Resolver's logger, one that throws everything away if it
+// has none.
+func (res *Resolver) log() *slog.Logger {
+	return loggerOr(*res.logger)
+}
+
+// log The logger of the Resolver the manager is for
+func (manager *serverCommManager) log() *slog.Logger {
+	if manager.logger == nil {
+		return discardLogger
+	}
+	return loggerOr(*manager.logger)
+}
+
+func loggerOr(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
+
+// logCache This logs a lookup of name/t being answered from the
+// cache, or not.
+func (res *Resolver) logCache(ctx context.Context, name string, t RTYPE, hit bool) {
+	log := res.log()
+	if !log.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	msg := "cache miss"
+	if hit {
+		msg = "cache hit"
+	}
+	log.DebugContext(ctx, msg, "name", name, "type", t.String())
+}
@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logRecords This is a JSON slog handler's output as one map per
+// record, safe to write to from any goroutine.
+type logRecords struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (l *logRecords) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buf.Write(p)
+}
+
+// find The records with message msg
+func (l *logRecords) find(msg string) []map[string]any {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(l.buf.String()), "\n") {
+		var record map[string]any
+		if json.Unmarshal([]byte(line), &record) == nil && record["msg"] == msg {
+			out = append(out, record)
+		}
+	}
+	return out
+}
+
+func TestLogger(t *testing.T) {
+	records := &logRecords{}
+	res := withSingleRoot(New(
+		WithLogger(slog.New(slog.NewJSONHandler(records, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+		WithDefaultRetryPolicy(RetryPolicy{Timeout: 50 * time.Millisecond, Attempts: 1}),
+	))
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if request.name == "slow.example.com" {
+			return nil
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.106")},
+		}}}
+	})
+
+	res.Lookup("www.example.com.", RTYPE_A)
+	res.Lookup("www.example.com.", RTYPE_A)
+	if misses := records.find("cache miss"); len(misses) != 1 || misses[0]["name"] != "www.example.com" || misses[0]["type"] != "A" || misses[0]["level"] != "DEBUG" {
+		t.Errorf("unexpected cache misses %v", misses)
+	}
+	if hits := records.find("cache hit"); len(hits) != 1 {
+		t.Errorf("unexpected cache hits %v", hits)
+	}
+	if queries := records.find("upstream query"); len(queries) != 1 || queries[0]["server"] != "198.41.0.4" {
+		t.Errorf("unexpected queries %v", queries)
+	}
+	if responses := records.find("upstream response"); len(responses) != 1 || responses[0]["rcode"] != "RCODE_OK" || responses[0]["answers"] != 1.0 {
+		t.Errorf("unexpected responses %v", responses)
+	}
+
+	res.Lookup("slow.example.com.", RTYPE_A)
+	if timeouts := records.find("upstream timeout"); len(timeouts) != 1 || timeouts[0]["name"] != "slow.example.com" || timeouts[0]["level"] != "INFO" {
+		t.Errorf("unexpected timeouts %v", timeouts)
+	}
+
+	addr := parseAddrNoerror("198.41.0.4")
+	manager := res.getServerComm(&addr)
+	defer manager.release()
+	if _, err := manager.unpack([]byte{0, 1, 0x80, 0, 0, 1}, nil); err == nil {
+		t.Fatal("unpacked a broken response")
+	}
+	if bad := records.find("bad upstream response"); len(bad) != 1 || bad[0]["level"] != "WARN" || bad[0]["error"] == "" {
+		t.Errorf("unexpected bad responses %v", bad)
+	}
+
+	// without a logger nothing is logged, and nothing breaks
+	quiet := withSingleRoot(New())
+	quiet.connect = res.connect
+	if answers, _ := quiet.Lookup("www.example.com.", RTYPE_A); len(answers) != 1 {
+		t.Errorf("unexpected answers %v", answers)
+	}
+}
@@ -0,0 +1,236 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// LookupMX This returns the mail exchangers for name, sorted by
+// preference (lowest, i.e. most preferred, first).  Exchangers
+// with the same preference keep the order the server gave them
+// in.  CNAMEs are followed as with Lookup.
+func (res *Resolver) LookupMX(name string) ([]MX_RECORD, error) {
+	answers, err := res.Lookup(name, RTYPE_MX)
+	var records []MX_RECORD
+	for _, answer := range answers {
+		if mx, ok := answer.RData.(MX_RECORD); ok {
+			records = append(records, mx)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Preference < records[j].Preference
+	})
+	return records, err
+}
+
+// ErrNoZoneApex FindZoneApex didn't get an SOA record for name or
+// any of its parents, not even the root.
+var ErrNoZoneApex = errors.New("dns: no zone apex found")
+
+// FindZoneApex This finds the zone name is in by asking for the SOA
+// of name, then its parent and so on up to the root, and returns the
+// first name that has one along with its SOA record.
+//
+// When the name isn't an apex the server's negative answer carries
+// the zone's SOA in its authority section, which gets cached, so
+// once the walk gets up to the apex it is answered from the cache.
+func (res *Resolver) FindZoneApex(name string) (string, SOA_RECORD, error) {
+	name = cleanName(name)
+	for {
+		answers, _ := res.Lookup(absolute(name), RTYPE_SOA)
+		for _, answer := range answers {
+			// A CNAME's target may have an SOA but that doesn't
+			// make name an apex
+			if soa, ok := answer.RData.(SOA_RECORD); ok && cleanName(answer.RName) == name {
+				return name, soa, nil
+			}
+		}
+		if name == "." {
+			return "", SOA_RECORD{}, ErrNoZoneApex
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			parent = "."
+		}
+		name = parent
+	}
+}
+
+// LookupAddr This does a reverse lookup, returning the names addr
+// maps back to.  The answers are cached like any others, under the
+// in-addr.arpa or ip6.arpa name (see ReverseName).
+func (res *Resolver) LookupAddr(addr netip.Addr) ([]string, error) {
+	answers, err := res.Lookup(absolute(ReverseName(addr)), RTYPE_PTR)
+	var names []string
+	for _, answer := range answers {
+		if ptr, ok := answer.RData.(PTR_RECORD); ok {
+			names = append(names, ptr.PTR)
+		}
+	}
+	return names, err
+}
+
+// ReverseName This is the name to ask for PTR records for addr:
+// the bytes in reverse under in-addr.arpa for IPv4, or the nibbles
+// in reverse under ip6.arpa for IPv6.  IPv4 mapped IPv6 addresses
+// are treated as the IPv4 address they map.
+func ReverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	var b strings.Builder
+	if addr.Is4() {
+		ip := addr.As4()
+		for i := len(ip) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip[i])
+		}
+		b.WriteString("in-addr.arpa")
+		return b.String()
+	}
+	ip := addr.As16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
+
+// LookupCAA This returns the CAA records that apply to name.  Per
+// RFC 8659 if name itself has none then its parent is checked, and
+// so on up to (and including) the top level domain, and the first
+// non-empty set found is the one that applies.  No records at all
+// means any CA may issue.
+func (res *Resolver) LookupCAA(name string) ([]CAA_RECORD, error) {
+	name = cleanName(name)
+	for name != "." && name != "" {
+		answers, err := res.Lookup(absolute(name), RTYPE_CAA)
+		var records []CAA_RECORD
+		for _, answer := range answers {
+			if caa, ok := answer.RData.(CAA_RECORD); ok {
+				records = append(records, caa)
+			}
+		}
+		if len(records) > 0 || err != nil {
+			return records, err
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return nil, nil
+}
+
+// LookupTLSA This returns the TLSA records for a service, which
+// live at _port._proto.host (so _443._tcp.www.example.com for
+// HTTPS).  Whether they can be trusted is up to the caller, this
+// resolver doesn't validate DNSSEC.
+func (res *Resolver) LookupTLSA(port uint16, proto, host string) ([]TLSA_RECORD, error) {
+	answers, err := res.Lookup(fmt.Sprintf("_%d._%s.%s", port, proto, host), RTYPE_TLSA)
+	var records []TLSA_RECORD
+	for _, answer := range answers {
+		if tlsa, ok := answer.RData.(TLSA_RECORD); ok {
+			records = append(records, tlsa)
+		}
+	}
+	return records, err
+}
+
+// SRVTarget An SRV record along with the addresses its target
+// resolved to, in the order to try them (see SortAddrs).
+type SRVTarget struct {
+	SRV_RECORD
+	Addrs []netip.Addr
+}
+
+// LookupSRV This looks up _service._proto.name (or just name if
+// service and proto are both empty) and returns the records in the
+// order RFC 2782 says to try them: by priority, and within the same
+// priority a random order weighted by Weight.  Since the order is
+// random it is worth calling this again for each new connection.
+//
+// A single record with a target of "." means the service is
+// decidedly not available there, for which this returns nothing.
+func (res *Resolver) LookupSRV(service, proto, name string) ([]SRV_RECORD, error) {
+	if service != "" || proto != "" {
+		name = "_" + service + "._" + proto + "." + name
+	}
+	answers, err := res.Lookup(name, RTYPE_SRV)
+	var records []SRV_RECORD
+	for _, answer := range answers {
+		if srv, ok := answer.RData.(SRV_RECORD); ok {
+			records = append(records, srv)
+		}
+	}
+	if len(records) == 1 && cleanName(records[0].Target) == "." {
+		return nil, err
+	}
+	return orderSRV(records), err
+}
+
+// ResolveSRV This is LookupSRV plus looking up the addresses of
+// each target, so everything needed to connect comes back in one
+// call.  Targets which don't resolve are left out.
+func (res *Resolver) ResolveSRV(service, proto, name string) ([]SRVTarget, error) {
+	records, err := res.LookupSRV(service, proto, name)
+	var targets []SRVTarget
+	for _, srv := range records {
+		target := SRVTarget{SRV_RECORD: srv}
+		for _, t := range []RTYPE{RTYPE_A, RTYPE_AAAA} {
+			answers, _ := res.Lookup(srv.Target, t)
+			for _, answer := range answers {
+				switch r := answer.RData.(type) {
+				case A_RECORD:
+					target.Addrs = append(target.Addrs, r.A)
+				case AAAA_RECORD:
+					target.Addrs = append(target.Addrs, r.AAAA)
+				}
+			}
+		}
+		if len(target.Addrs) > 0 {
+			SortAddrs(target.Addrs)
+			targets = append(targets, target)
+		}
+	}
+	return targets, err
+}
+
+// orderSRV This sorts records by priority and then shuffles each
+// run of equal priority using the weighted selection from RFC 2782:
+// zero weight records go first so they have a (small) chance of
+// being picked, then one is picked with probability proportional
+// to its weight, and so on until they are all placed.
+func orderSRV(records []SRV_RECORD) []SRV_RECORD {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+	for start := 0; start < len(records); {
+		end := start + 1
+		for end < len(records) && records[end].Priority == records[start].Priority {
+			end++
+		}
+		group := records[start:end]
+		sort.SliceStable(group, func(i, j int) bool {
+			return group[i].Weight == 0 && group[j].Weight != 0
+		})
+		for i := range group {
+			total := 0
+			for _, srv := range group[i:] {
+				total += int(srv.Weight)
+			}
+			pick := rand.IntN(total + 1)
+			sum := 0
+			for j := i; j < len(group); j++ {
+				sum += int(group[j].Weight)
+				if sum >= pick {
+					// move it to the front, keeping the rest in order
+					picked := group[j]
+					copy(group[i+1:j+1], group[i:j])
+					group[i] = picked
+					break
+				}
+			}
+		}
+		start = end
+	}
+	return records
+}
@@ -0,0 +1,297 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLookupMX(t *testing.T) {
+	initTestsData(4)
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if request.qtype != RTYPE_MX {
+			t.Errorf("unexpected %s query for %s", request.qtype, request.name)
+			return &DNSMessage{}
+		}
+		msg := &DNSMessage{}
+		for _, mx := range []MX_RECORD{
+			{20, "backup.example.com."},
+			{10, "mx1.example.com."},
+			{30, "last.example.com."},
+			{10, "mx2.example.com."},
+		} {
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				RName: request.name, RType: RTYPE_MX, TTL: 300, RData: mx,
+			})
+		}
+		return msg
+	})
+
+	for range 2 {
+		records, err := LookupMX("example.com")
+		if err != nil {
+			t.Fatalf("LookupMX: %v", err)
+		}
+		want := []string{"mx1.example.com.", "mx2.example.com.", "backup.example.com.", "last.example.com."}
+		if len(records) != len(want) {
+			t.Fatalf("got %v; want %v", records, want)
+		}
+		for i, mx := range records {
+			if mx.Exchange != want[i] {
+				t.Errorf("records[%d] = %v; want %s", i, mx, want[i])
+			}
+		}
+	}
+	if entry := DefaultResolver.cacheLookup("example.com", RTYPE_MX); entry == nil || len(entry.data) != 4 {
+		t.Errorf("MX records were not cached: %v", entry)
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	initTestsData(4)
+	addrs := map[string]string{
+		"a.example.com": "10.0.0.1",
+		"b.example.com": "10.0.0.2",
+		"c.example.com": "10.0.0.3",
+	}
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		msg := &DNSMessage{}
+		switch {
+		case request.qtype == RTYPE_SRV && request.name == "_sip._tcp.example.com":
+			for _, srv := range []SRV_RECORD{
+				{20, 0, 5060, "c.example.com."},
+				{10, 90, 5060, "a.example.com."},
+				{10, 10, 5061, "b.example.com."},
+				{30, 0, 5060, "missing.example.com."},
+			} {
+				msg.Answers = append(msg.Answers, DNSAnswer{
+					RName: request.name, RType: RTYPE_SRV, TTL: 300, RData: srv,
+				})
+			}
+		case request.qtype == RTYPE_SRV && request.name == "_imap._tcp.example.com":
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				RName: request.name, RType: RTYPE_SRV, TTL: 300, RData: SRV_RECORD{0, 0, 0, "."},
+			})
+		case request.qtype == RTYPE_A && addrs[request.name] != "":
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				RName: request.name, RType: RTYPE_A, TTL: 300,
+				RData: A_RECORD{parseAddrNoerror(addrs[request.name])},
+			})
+		}
+		return msg
+	})
+
+	// a has 9 times the weight of b, so should nearly always be first
+	aFirst := 0
+	for range 500 {
+		records, err := LookupSRV("sip", "tcp", "example.com")
+		if err != nil {
+			t.Fatalf("LookupSRV: %v", err)
+		}
+		if len(records) != 4 || records[2].Target != "c.example.com." || records[3].Target != "missing.example.com." {
+			t.Fatalf("wrong priority order %v", records)
+		}
+		if records[0].Target == "a.example.com." {
+			aFirst++
+		}
+	}
+	if aFirst < 350 || aFirst == 500 {
+		t.Errorf("a.example.com came first %d times out of 500", aFirst)
+	}
+
+	targets, err := ResolveSRV("sip", "tcp", "example.com")
+	if err != nil {
+		t.Fatalf("ResolveSRV: %v", err)
+	}
+	if len(targets) != 3 || targets[2].Target != "c.example.com." ||
+		len(targets[2].Addrs) != 1 || targets[2].Addrs[0] != parseAddrNoerror("10.0.0.3") {
+		t.Errorf("unexpected targets %v", targets)
+	}
+
+	if records, err := LookupSRV("imap", "tcp", "example.com"); err != nil || len(records) != 0 {
+		t.Errorf("expected no records for a \".\" target, got %v %v", records, err)
+	}
+}
+
+func TestLookupAddr(t *testing.T) {
+	initTestsData(4)
+	v6 := parseAddrNoerror("2001:db8::567:89ab")
+	reverse := map[string]string{
+		"4.3.2.1.in-addr.arpa": "host.example.com.",
+		ReverseName(v6):        "v6host.example.com.",
+	}
+	var queries atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		queries.Add(1)
+		msg := &DNSMessage{}
+		if target, ok := reverse[request.name]; ok && request.qtype == RTYPE_PTR {
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				RName: request.name, RType: RTYPE_PTR, TTL: 300, RData: PTR_RECORD{target},
+			})
+		}
+		return msg
+	})
+
+	if name := ReverseName(v6); name != "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa" {
+		t.Errorf("ReverseName(%s) = %s", v6, name)
+	}
+	for range 2 {
+		names, err := LookupAddr(parseAddrNoerror("1.2.3.4"))
+		if err != nil || len(names) != 1 || names[0] != "host.example.com." {
+			t.Fatalf("LookupAddr(1.2.3.4) = %v, %v", names, err)
+		}
+		// the mapped form is the same address
+		names, err = LookupAddr(parseAddrNoerror("::ffff:1.2.3.4"))
+		if err != nil || len(names) != 1 || names[0] != "host.example.com." {
+			t.Fatalf("LookupAddr(::ffff:1.2.3.4) = %v, %v", names, err)
+		}
+		names, err = LookupAddr(v6)
+		if err != nil || len(names) != 1 || names[0] != "v6host.example.com." {
+			t.Fatalf("LookupAddr(%s) = %v, %v", v6, names, err)
+		}
+	}
+	if queries.Load() != 2 {
+		t.Errorf("expected 2 upstream queries, got %d", queries.Load())
+	}
+}
+
+func TestFindZoneApex(t *testing.T) {
+	initTestsData(4)
+	soa := SOA_RECORD{"ns1.example.com.", "hostmaster.example.com.", 2024010101, 7200, 900, 1209600, 300}
+	var apexQueries atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if request.qtype != RTYPE_SOA || !strings.HasSuffix(request.name, "example.com") {
+			return &DNSMessage{}
+		}
+		record := DNSAnswer{RName: "example.com", RType: RTYPE_SOA, TTL: 300, RData: soa}
+		if request.name == "example.com" {
+			apexQueries.Add(1)
+			return &DNSMessage{Answers: []DNSAnswer{record}}
+		}
+		// no SOA here, which comes with the zone's SOA as authority
+		return &DNSMessage{Authorities: []DNSAnswer{record}}
+	})
+
+	zone, got, err := FindZoneApex("a.b.Example.com.")
+	if err != nil || zone != "example.com" || got != soa {
+		t.Fatalf("FindZoneApex = %q, %v, %v", zone, got, err)
+	}
+	// the SOA came along with the answer for a.b.example.com
+	if apexQueries.Load() != 0 {
+		t.Errorf("expected the apex SOA to come from the cache")
+	}
+	if _, _, err := FindZoneApex("www.example.org"); !errors.Is(err, ErrNoZoneApex) {
+		t.Errorf("expected ErrNoZoneApex, got %v", err)
+	}
+}
+
+func TestLookupCAA(t *testing.T) {
+	initTestsData(4)
+	caa := map[string][]CAA_RECORD{
+		"example.com":      {{0, "issue", "ca.example.net"}, {0, "iodef", "mailto:security@example.com"}},
+		"shop.example.com": {{128, "issue", "other-ca.example.org"}},
+	}
+	var asked sync.Map
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		asked.Store(request.name, true)
+		msg := &DNSMessage{}
+		for _, record := range caa[request.name] {
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				RName: request.name, RType: RTYPE_CAA, TTL: 300, RData: record,
+			})
+		}
+		return msg
+	})
+
+	records, err := LookupCAA("www.shop.example.com")
+	if err != nil || len(records) != 1 || records[0].Value != "other-ca.example.org" {
+		t.Errorf("LookupCAA(www.shop.example.com) = %v, %v", records, err)
+	}
+	if _, ok := asked.Load("example.com"); ok {
+		t.Errorf("kept climbing past shop.example.com")
+	}
+	records, err = LookupCAA("a.b.example.com")
+	if err != nil || len(records) != 2 || records[0].Tag != "issue" {
+		t.Errorf("LookupCAA(a.b.example.com) = %v, %v", records, err)
+	}
+	records, err = LookupCAA("www.example.org")
+	if err != nil || len(records) != 0 {
+		t.Errorf("LookupCAA(www.example.org) = %v, %v", records, err)
+	}
+	if _, ok := asked.Load("org"); !ok {
+		t.Errorf("did not climb up to the top level domain")
+	}
+}
+
+func TestQueryLookupNS(t *testing.T) {
+	initTestsData(4)
+	comAddr := parseAddrNoerror("192.0.2.1")
+	exampleAddr := parseAddrNoerror("192.0.2.2")
+	ns := func(zone string, servers ...string) []DNSAnswer {
+		var records []DNSAnswer
+		for _, server := range servers {
+			records = append(records, DNSAnswer{RName: zone, RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{server}})
+		}
+		return records
+	}
+	glue := func(server string, addr netip.Addr) []DNSAnswer {
+		return []DNSAnswer{{RName: server, RType: RTYPE_A, TTL: 300, RData: A_RECORD{addr}}}
+	}
+	var queries atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		queries.Add(1)
+		switch addr {
+		case comAddr:
+			// the parent's copy only lists one of the servers
+			return &DNSMessage{
+				Authorities: ns("example.com", "ns1.example.com."),
+				Additionals: glue("ns1.example.com", exampleAddr),
+			}
+		case exampleAddr:
+			if request.qtype != RTYPE_NS || request.name != "example.com" {
+				t.Errorf("unexpected query %s %s", request.name, request.qtype)
+				return &DNSMessage{}
+			}
+			return &DNSMessage{Answers: ns("example.com", "ns1.example.com.", "ns2.example.com.")}
+		}
+		return &DNSMessage{
+			Authorities: ns("com", "a.gtld-servers.net."),
+			Additionals: glue("a.gtld-servers.net", comAddr),
+		}
+	})
+
+	for range 2 {
+		result := QueryLookup("Example.com", RTYPE_NS)
+		if len(result) != 2 || result[0].RName != "Example.com" || result[1].RData.(NS_RECORD).NS != "ns2.example.com." {
+			t.Fatalf("unexpected result %v", result)
+		}
+	}
+	// root, com and example.com, then the answer was cached
+	if queries.Load() != 3 {
+		t.Errorf("expected 3 upstream queries, got %d", queries.Load())
+	}
+}
+
+func TestLookupTLSA(t *testing.T) {
+	initTestsData(4)
+	digest := []byte{0xde, 0xad, 0xbe, 0xef}
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		msg := &DNSMessage{}
+		if request.qtype == RTYPE_TLSA && request.name == "_443._tcp.www.example.com" {
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				RName: request.name, RType: RTYPE_TLSA, TTL: 300, RData: TLSA_RECORD{3, 1, 1, digest},
+			})
+		}
+		return msg
+	})
+	records, err := LookupTLSA(443, "tcp", "www.example.com")
+	if err != nil || len(records) != 1 || records[0].Usage != 3 || string(records[0].CertData) != string(digest) {
+		t.Fatalf("LookupTLSA = %v, %v", records, err)
+	}
+	if DefaultResolver.cacheLookup("_443._tcp.www.example.com", RTYPE_TLSA) == nil {
+		t.Errorf("TLSA records were not cached")
+	}
+}
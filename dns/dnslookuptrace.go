@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceStep One thing a lookup did, in the order QueryLookupTrace
+// gives them, with the Name and Type it was about.  Which of the
+// other fields are set depends on the Kind.
+type TraceStep struct {
+	Kind TraceStepKind `json:"kind"`
+	Time time.Time     `json:"time"`
+	Name string        `json:"name"`
+	Type RTYPE         `json:"type"`
+	// Zone and Nameservers For TraceDelegation, the closest zone
+	// the Resolver knows the nameservers of, and their names
+	Zone        string   `json:"zone,omitempty"`
+	Nameservers []string `json:"nameservers,omitempty"`
+	// Server, TCP, RTT and Response For TraceQuery, the server
+	// asked, whether it was over TCP, how long it took to answer and
+	// what it said, nil if it didn't answer (RTT being how long it
+	// was waited for)
+	Server   netip.Addr    `json:"server,omitzero"`
+	TCP      bool          `json:"tcp,omitempty"`
+	RTT      time.Duration `json:"rtt,omitempty"`
+	Response *DNSMessage   `json:"response,omitempty"`
+	// Records For TraceCacheHit the answer the cache had, and for
+	// TraceCached the RRset that was put in it, in the
+	// infrastructure cache if Infra is set
+	Records []DNSAnswer `json:"records,omitempty"`
+	Infra   bool        `json:"infra,omitempty"`
+}
+
+// TraceStepKind What a TraceStep was
+type TraceStepKind int
+
+const (
+	// TraceCacheHit The answer was in the cache
+	TraceCacheHit TraceStepKind = iota
+	// TraceDelegation The nameservers to ask were picked from the
+	// cache, those of the zone closest to the name
+	TraceDelegation
+	// TraceQuery A server was asked
+	TraceQuery
+	// TraceCached An RRset from a response was cached
+	TraceCached
+)
+
+var traceStepKindName = map[TraceStepKind]string{
+	TraceCacheHit:   "cache-hit",
+	TraceDelegation: "delegation",
+	TraceQuery:      "query",
+	TraceCached:     "cached",
+}
+
+func (k TraceStepKind) String() string {
+	return traceStepKindName[k]
+}
+
+func (k TraceStepKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// String The step on a line, something like dig +trace would say
+func (s TraceStep) String() string {
+	head := fmt.Sprintf("%s %s %v", s.Kind, absolute(s.Name), s.Type)
+	switch s.Kind {
+	case TraceCacheHit:
+		return fmt.Sprintf("%s: %d records", head, len(s.Records))
+	case TraceDelegation:
+		return fmt.Sprintf("%s: %s NS %s", head, absolute(s.Zone), strings.Join(s.Nameservers, " "))
+	case TraceQuery:
+		transport := "udp"
+		if s.TCP {
+			transport = "tcp"
+		}
+		if s.Response == nil {
+			return fmt.Sprintf("%s @%v/%s: no response after %v", head, s.Server, transport, s.RTT)
+		}
+		return fmt.Sprintf("%s @%v/%s: %s, %d answers, %d authorities, %d additionals in %v", head, s.Server, transport,
+			rcodeString(s.Response.Header.Status), len(s.Response.Answers), len(s.Response.Authorities), len(s.Response.Additionals), s.RTT)
+	case TraceCached:
+		cache := "answer"
+		if s.Infra {
+			cache = "infrastructure"
+		}
+		ttl := uint32(0)
+		if len(s.Records) > 0 {
+			ttl = s.Records[0].TTL
+		}
+		return fmt.Sprintf("%s: %d records for %ds in the %s cache", head, len(s.Records), ttl, cache)
+	}
+	return head
+}
+
+// lookupTrace The steps a lookup being traced has taken so far.
+// Servers are asked at the same time, so steps can come from more
+// than one goroutine.
+type lookupTrace struct {
+	lock  sync.Mutex
+	steps []TraceStep
+}
+
+type lookupTraceKey struct{}
+
+// tracedLookup The trace of the lookup with ctx, nil if it isn't
+// being traced.
+func tracedLookup(ctx context.Context) *lookupTrace {
+	trace, _ := ctx.Value(lookupTraceKey{}).(*lookupTrace)
+	return trace
+}
+
+// add This adds step to the trace, if there is one.
+func (trace *lookupTrace) add(step TraceStep) {
+	if trace == nil {
+		return
+	}
+	step.Time = time.Now()
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+	trace.steps = append(trace.steps, step)
+}
+
+// cached This adds a TraceCached step for set.
+func (trace *lookupTrace) cached(set *rrset, infra bool) {
+	if trace == nil {
+		return
+	}
+	records := make([]DNSAnswer, len(set.data))
+	for i, data := range set.data {
+		records[i] = DNSAnswer{RName: set.name, RType: set.t, RClass: set.class, TTL: set.ttl, RData: data}
+	}
+	trace.add(TraceStep{Kind: TraceCached, Name: set.name, Type: set.t, Records: records, Infra: infra})
+}
+
+// derefAnswers Copies of the answers
+func derefAnswers(answers []*DNSAnswer) []DNSAnswer {
+	out := make([]DNSAnswer, len(answers))
+	for i, answer := range answers {
+		out[i] = *answer
+	}
+	return out
+}
+
+// nsNames The names of the nameservers in data, an NS RRset
+func nsNames(data []RDATA) []string {
+	var names []string
+	for _, rdata := range data {
+		if ns, ok := rdata.(NS_RECORD); ok {
+			names = append(names, ns.NS)
+		}
+	}
+	return names
+}
+
+// QueryLookupTrace This is DefaultResolver.QueryLookupTrace
+func QueryLookupTrace(ctx context.Context, name string, t RTYPE) ([]*DNSAnswer, []TraceStep, error) {
+	return DefaultResolver.QueryLookupTrace(ctx, name, t)
+}
+
+// QueryLookupTrace This is LookupCtx, also returning every step it
+// took to get the answer, in order: the answers it found in the
+// cache, the nameservers it picked for each zone on the way down,
+// every query it sent and what came back, and what it cached from
+// the responses.  The lookups for the addresses of nameservers that
+// came without glue are part of it too.  It is for getting to the
+// bottom of a broken delegation, like dig +trace; an answer already
+// in the cache is a single step, so FlushName first to see the
+// whole way to it.
+func (res *Resolver) QueryLookupTrace(ctx context.Context, name string, t RTYPE) ([]*DNSAnswer, []TraceStep, error) {
+	trace := &lookupTrace{}
+	answers, err := res.LookupCtx(context.WithValue(ctx, lookupTraceKey{}, trace), name, t)
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+	return answers, slices.Clone(trace.steps), err
+}
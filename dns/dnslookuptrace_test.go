@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestQueryLookupTrace(t *testing.T) {
+	res := withSingleRoot(New())
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if addr == parseAddrNoerror("198.41.0.4") {
+			return &DNSMessage{
+				Authorities: []DNSAnswer{{RName: "example.com", RType: RTYPE_NS, TTL: 3600,
+					RData: NS_RECORD{"ns.example.com."}}},
+				Additionals: []DNSAnswer{{RName: "ns.example.com", RType: RTYPE_A, TTL: 3600,
+					RData: A_RECORD{parseAddrNoerror("192.0.2.53")}}},
+			}
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{RName: request.name, RType: RTYPE_A, TTL: 300,
+			RData: A_RECORD{parseAddrNoerror("192.0.2.112")}}}}
+	})
+
+	answers, steps, err := res.QueryLookupTrace(context.Background(), "www.example.com", RTYPE_A)
+	if err != nil || len(answers) != 1 || answers[0].RData.(A_RECORD).A != parseAddrNoerror("192.0.2.112") {
+		t.Fatalf("unexpected answer %v, %v", answers, err)
+	}
+	var got []string
+	for _, step := range steps {
+		line := step.String()
+		// the RTTs are whatever they are
+		if i := strings.LastIndex(line, " in "); step.Kind == TraceQuery && i >= 0 {
+			line = line[:i]
+		}
+		got = append(got, line)
+	}
+	want := []string{
+		"delegation www.example.com. A: . NS a.root-servers.net.",
+		"query www.example.com. A @198.41.0.4/udp: RCODE_OK, 0 answers, 1 authorities, 1 additionals",
+		"cached example.com. NS: 1 records for 3600s in the infrastructure cache",
+		"cached ns.example.com. A: 1 records for 3600s in the infrastructure cache",
+		"delegation www.example.com. A: example.com. NS ns.example.com.",
+		"query www.example.com. A @192.0.2.53/udp: RCODE_OK, 1 answers, 0 authorities, 0 additionals",
+		"cached www.example.com. A: 1 records for 300s in the answer cache",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("trace\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for i := 1; i < len(steps); i++ {
+		if steps[i].Time.Before(steps[i-1].Time) {
+			t.Errorf("step %d is before the one before it", i)
+		}
+	}
+
+	// the second time it comes from the cache
+	_, steps, _ = res.QueryLookupTrace(context.Background(), "www.example.com", RTYPE_A)
+	if len(steps) != 1 || steps[0].Kind != TraceCacheHit || len(steps[0].Records) != 1 {
+		t.Errorf("unexpected trace %v", steps)
+	}
+}
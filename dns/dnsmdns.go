@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"context"
+	mathrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// MDNSGroups Where DefaultResolver sends its queries for names in
+// the link-local domains (see mdnsDomains), rather than looking
+// them up from the root: the multicast DNS groups of RFC 6762, so
+// printers and the like on the LAN can be found by their .local
+// names.  The queries are one-shot ones (RFC 6762 5.1) from a port
+// other than 5353, so the responders answer straight back to it
+// (RFC 6762 6.7), and the first answer wins.  A group the query
+// can't be sent to (ff02::fb without IPv6, say) is skipped.  Empty
+// means those names are looked up like any other.  Resolvers made
+// by New don't use multicast DNS unless WithMDNS says to.
+var MDNSGroups = []netip.AddrPort{
+	netip.MustParseAddrPort("224.0.0.251:5353"),
+	netip.MustParseAddrPort("[ff02::fb]:5353"),
+}
+
+// MDNSTimeout How long a multicast DNS query waits for an answer.
+// There are no negative answers in multicast DNS, so a name nobody
+// answers for takes this long to come back as not found.  This is
+// DefaultResolver's, as is MDNSCacheTTL, see WithMDNSTimeouts for
+// the others.
+var MDNSTimeout = time.Second
+
+// MDNSCacheTTL The longest multicast DNS answers are cached for,
+// whatever TTL they came with.  They go in a cache of their own, so
+// the devices coming and going on the LAN don't push anything out
+// of the answer cache, and responders only hand out 10 seconds to
+// one-shot queries anyway.
+var MDNSCacheTTL = 10 * time.Second
+
+// WithMDNSTimeouts This is MDNSTimeout and MDNSCacheTTL for the
+// Resolver.
+func WithMDNSTimeouts(timeout, cacheTTL time.Duration) Option {
+	return func(res *Resolver) {
+		*res.mdnsTimeout, *res.mdnsCacheTTL = timeout, cacheTTL
+	}
+}
+
+// mdnsDomains The names RFC 6762 has looked up with multicast DNS:
+// .local and the reverse names of the link-local addresses
+var mdnsDomains = []string{
+	"local",
+	"254.169.in-addr.arpa",
+	"8.e.f.ip6.arpa",
+	"9.e.f.ip6.arpa",
+	"a.e.f.ip6.arpa",
+	"b.e.f.ip6.arpa",
+}
+
+// mdnsCacheFlush The top bit of the class of a multicast DNS record,
+// which says it replaces what is cached rather than adding to it
+// (RFC 6762 10.2)
+const mdnsCacheFlush = 0x8000
+
+// WithMDNS This makes the Resolver send its queries for .local
+// names to groups, like MDNSGroups does for DefaultResolver.
+func WithMDNS(groups ...netip.AddrPort) Option {
+	return func(res *Resolver) {
+		*res.mdnsGroups = append([]netip.AddrPort(nil), groups...)
+	}
+}
+
+// mdnsGroupsFor Where to send the queries for the (cleaned) name,
+// nil if it isn't looked up with multicast DNS.
+func (res *Resolver) mdnsGroupsFor(name string) []netip.AddrPort {
+	for _, domain := range mdnsDomains {
+		if inSubtree(name, domain) && name != domain {
+			return *res.mdnsGroups
+		}
+	}
+	return nil
+}
+
+// mdnsLookup This is queryLookup for a name looked up with
+// multicast DNS: the answer comes from the multicast DNS cache if
+// it can, and otherwise whoever on the LAN answers first is asked
+// for it.  If no one answers within MDNSTimeout the name isn't
+// found, which isn't an error.
+func (res *Resolver) mdnsLookup(ctx context.Context, name string, t RTYPE, groups []netip.AddrPort) ([]*DNSAnswer, error) {
+	if t != RTYPE_ANY {
+		if entry := res.mdns.lookup(name, inKey(t)); entry != nil && len(entry.data) > 0 {
+			return res.cachedAnswers(name, t, entry), nil
+		}
+		if entry := res.mdns.lookup(name, inKey(RTYPE_CNAME)); entry != nil && len(entry.data) > 0 {
+			return res.cachedAnswers(name, RTYPE_CNAME, entry), nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	query, err := packQuery(uint16(mathrand.Uint32()), name, t, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	waitCtx, cancel := context.WithTimeout(ctx, *res.mdnsTimeout)
+	defer cancel()
+	stop := context.AfterFunc(waitCtx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	sent := false
+	for _, group := range groups {
+		if _, werr := conn.WriteToUDPAddrPort(query, group); werr == nil {
+			sent = true
+		} else {
+			err = werr
+		}
+	}
+	if !sent {
+		return nil, err
+	}
+	markQueried(ctx)
+	id := uint16(query[0])<<8 | uint16(query[1])
+	buf := wireBuffers.Get().(*[65535]byte)
+	defer wireBuffers.Put(buf)
+	for {
+		n, _, err := conn.ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			// nobody answered, unless it was the caller who gave up
+			return nil, ctx.Err()
+		}
+		msg, err := unpackMessage(buf[:n])
+		// anything that isn't the answer to our query, or has a
+		// non-zero RCODE, is ignored (RFC 6762 18.11)
+		if err != nil || !msg.Header.Response || msg.Header.ID != id || msg.Header.Status != RCODE_OK || len(msg.Answers) == 0 {
+			continue
+		}
+		return res.mdnsCache(msg), nil
+	}
+}
+
+// mdnsCache This puts the records in msg, a multicast DNS response,
+// in the multicast DNS cache and returns its answers.
+func (res *Resolver) mdnsCache(msg *DNSMessage) []*DNSAnswer {
+	var out []*DNSAnswer
+	var records []DNSAnswer
+	for i, section := range [][]DNSAnswer{msg.Answers, msg.Additionals} {
+		for _, record := range section {
+			record.RClass &^= mdnsCacheFlush
+			if record.RClass != IN && record.RClass != 0 {
+				continue
+			}
+			records = append(records, record)
+			if i == 0 {
+				answer := record
+				out = append(out, &answer)
+			}
+		}
+	}
+	for _, set := range groupRRsets(records) {
+		ttl := time.Duration(set.ttl) * time.Second
+		if ttl > *res.mdnsCacheTTL {
+			ttl = *res.mdnsCacheTTL
+		}
+		res.mdns.set(set.name, inKey(set.t), time.Now().Add(ttl), set.data, true, false)
+	}
+	return out
+}
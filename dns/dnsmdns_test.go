@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMDNS(t *testing.T) {
+	timeout := 200 * time.Millisecond
+
+	// a responder that only knows printer.local, answering with
+	// the cache-flush bit set and the address as an additional
+	// record for the CNAME
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			query, err := unpackMessage(buf[:n])
+			if err != nil || cleanName(query.Question.QName) != "printer.local" {
+				continue
+			}
+			response := &DNSMessage{
+				Header:   DNSHeader{ID: query.Header.ID, Response: true, Authoritative: true},
+				Question: query.Question,
+				Answers: []DNSAnswer{{
+					RName: "printer.local", RType: RTYPE_CNAME, RClass: IN | mdnsCacheFlush, TTL: 120, RData: CNAME_RECORD{"brother-1234.local."},
+				}},
+				Additionals: []DNSAnswer{{
+					RName: "brother-1234.local", RType: RTYPE_A, RClass: IN | mdnsCacheFlush, TTL: 120, RData: A_RECORD{parseAddrNoerror("169.254.10.20")},
+				}},
+			}
+			packet, _ := packMessage(response)
+			conn.WriteTo(packet, from)
+		}
+	}()
+
+	res := withSingleRoot(New(WithMDNS(netip.MustParseAddrPort(conn.LocalAddr().String())), WithMDNSTimeouts(timeout, MDNSCacheTTL)))
+	res.connect = answeringWith("192.0.2.104")
+
+	answers, err := res.Lookup("Printer.local", RTYPE_A)
+	if err != nil || len(answers) != 2 || answers[0].RName != "Printer.local" || answers[0].RClass != IN ||
+		answers[1].RData != (A_RECORD{parseAddrNoerror("169.254.10.20")}) {
+		t.Fatalf("unexpected answers %v, %v", answers, err)
+	}
+	// both answers are cached, for no more than MDNSCacheTTL, and
+	// only in the multicast DNS cache
+	if answers, err := res.Lookup("printer.local.", RTYPE_A); err != nil || len(answers) != 2 || queries.Load() != 1 {
+		t.Errorf("unexpected answers from the cache %v, %v (%d queries)", answers, err, queries.Load())
+	}
+	if entry := res.mdns.lookup("brother-1234.local", inKey(RTYPE_A)); entry == nil || time.Until(entry.expires) > MDNSCacheTTL {
+		t.Errorf("unexpected cache entry %+v", entry)
+	}
+	if res.cacheLookup("printer.local", RTYPE_CNAME) != nil {
+		t.Errorf("the multicast DNS answer went in the answer cache")
+	}
+
+	// nobody answers for a name that isn't there
+	start := time.Now()
+	if answers, err := res.Lookup("scanner.local.", RTYPE_A); err != nil || len(answers) != 0 {
+		t.Errorf("unexpected answers %v, %v", answers, err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("gave up after %v", elapsed)
+	}
+
+	// other names go to the servers as usual
+	before := queries.Load()
+	if answers, err := res.Lookup("www.example.com.", RTYPE_A); err != nil || len(answers) != 1 || queries.Load() != before {
+		t.Errorf("unexpected answers %v, %v", answers, err)
+	}
+	if groups := New().mdnsGroupsFor("printer.local"); groups != nil {
+		t.Errorf("New uses multicast DNS: %v", groups)
+	}
+	if groups := DefaultResolver.mdnsGroupsFor("20.10.254.169.in-addr.arpa"); len(groups) != 2 {
+		t.Errorf("DefaultResolver doesn't use multicast DNS for link-local reverse names: %v", groups)
+	}
+}
@@ -0,0 +1,376 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics A snapshot of what a Resolver has been up to, for
+// monitoring it: the counters only ever go up, from when it was
+// made.  It marshals to JSON, so it can be published with expvar:
+//
+//	expvar.Publish("dns", expvar.Func(func() any { return res.Metrics() }))
+//
+// or it can be scraped by Prometheus from MetricsHandler.
+type Metrics struct {
+	// Responses How many responses the servers gave, by the type
+	// asked for and the RCODE they came back with
+	Responses []ResponseCount `json:"responses"`
+	// Timeouts How many queries each server didn't answer in time
+	Timeouts map[netip.Addr]uint64 `json:"timeouts"`
+	// Inflight How many queries are waiting on a server right now
+	Inflight int64 `json:"inflight"`
+	// RTT How long the servers took to answer
+	RTT Histogram `json:"rtt"`
+	// Cache and InfraCache The answer and infrastructure cache
+	// counters, see CacheStats
+	Cache      CacheShardStats `json:"cache"`
+	InfraCache CacheShardStats `json:"infra_cache"`
+}
+
+// ResponseCount How many responses to queries of Type came back with
+// Rcode
+type ResponseCount struct {
+	Type  RTYPE  `json:"type"`
+	Rcode RCODE  `json:"rcode"`
+	Count uint64 `json:"count"`
+}
+
+// Histogram How a set of durations is spread out: Counts[i] of them
+// were no more than Bounds[i] (and more than Bounds[i-1]), and the
+// last of Counts, one more than there are Bounds, is the ones above
+// all of them.  Count is how many there were altogether and Sum what
+// they add up to.
+type Histogram struct {
+	Bounds []time.Duration `json:"bounds"`
+	Counts []uint64        `json:"counts"`
+	Count  uint64          `json:"count"`
+	Sum    time.Duration   `json:"sum"`
+}
+
+// rttBounds The buckets of the RTT histogram
+var rttBounds = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+// lookupBounds The buckets of the lookup latency histograms, finer
+// at the bottom for the ones answered from the cache
+var lookupBounds = append([]time.Duration{
+	50 * time.Microsecond, 100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+}, rttBounds...)
+
+// Mean The average of the durations, 0 if there aren't any
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile The duration that the fraction q of them were no more
+// than, as near as the buckets can tell: the upper bound of the
+// bucket the quantile falls in, or the largest bound if it is above
+// all of them.  It is 0 if there aren't any.
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		if cumulative >= rank {
+			return bound
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// histogram A Histogram being filled in, safe to add to from any
+// goroutine
+type histogram struct {
+	bounds []time.Duration
+	counts []atomic.Uint64
+	sum    atomic.Int64
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// observe This adds d to the histogram.
+func (h *histogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(h.bounds, d)
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// snapshot The Histogram as it is now
+func (h *histogram) snapshot() Histogram {
+	out := Histogram{Bounds: slices.Clone(h.bounds), Counts: make([]uint64, len(h.counts)), Sum: time.Duration(h.sum.Load())}
+	for i := range h.counts {
+		out.Counts[i] = h.counts[i].Load()
+		out.Count += out.Counts[i]
+	}
+	return out
+}
+
+// resolverMetrics The counters behind a Resolver's Metrics.  The
+// methods do nothing on a nil one, for managers that weren't made
+// for a Resolver.
+type resolverMetrics struct {
+	// responseKey to *atomic.Uint64
+	responses sync.Map
+	// netip.Addr to *atomic.Uint64
+	timeouts sync.Map
+	inflight atomic.Int64
+	rtt      *histogram
+	// netip.Addr to *histogram, each server's RTT
+	upstreams sync.Map
+	// how long the lookups took, by whether they had to ask servers
+	cacheHits  *histogram
+	recursions *histogram
+}
+
+type responseKey struct {
+	t     RTYPE
+	rcode RCODE
+}
+
+func newResolverMetrics() *resolverMetrics {
+	return &resolverMetrics{
+		rtt:        newHistogram(rttBounds),
+		cacheHits:  newHistogram(lookupBounds),
+		recursions: newHistogram(lookupBounds),
+	}
+}
+
+// increment This adds one to the counter for key in counters.
+func increment(counters *sync.Map, key any) {
+	counter, ok := counters.Load(key)
+	if !ok {
+		counter, _ = counters.LoadOrStore(key, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// sent This counts a query going out to a server, and returns the
+// function to call once it is done with.
+func (m *resolverMetrics) sent() (done func()) {
+	if m == nil {
+		return func() {}
+	}
+	m.inflight.Add(1)
+	return func() { m.inflight.Add(-1) }
+}
+
+// answered This counts a response from server to a query of type t
+// which took rtt to come back.
+func (m *resolverMetrics) answered(server netip.Addr, t RTYPE, rcode RCODE, rtt time.Duration) {
+	if m == nil {
+		return
+	}
+	increment(&m.responses, responseKey{t, rcode})
+	m.rtt.observe(rtt)
+	h, ok := m.upstreams.Load(server)
+	if !ok {
+		h, _ = m.upstreams.LoadOrStore(server, newHistogram(rttBounds))
+	}
+	h.(*histogram).observe(rtt)
+}
+
+// lookedUp This counts a lookup which took d, and which asked
+// servers if recursed is set.
+func (m *resolverMetrics) lookedUp(d time.Duration, recursed bool) {
+	if recursed {
+		m.recursions.observe(d)
+	} else {
+		m.cacheHits.observe(d)
+	}
+}
+
+// timedOut This counts a query server didn't answer in time.
+func (m *resolverMetrics) timedOut(server netip.Addr) {
+	if m == nil {
+		return
+	}
+	increment(&m.timeouts, server)
+}
+
+// Metrics A snapshot of the Resolver's counters.  Like CacheStats,
+// they are read one at a time, so one taken under load may be very
+// slightly inconsistent between them.
+func (res *Resolver) Metrics() Metrics {
+	m := res.metrics
+	out := Metrics{
+		Timeouts:   make(map[netip.Addr]uint64),
+		Inflight:   m.inflight.Load(),
+		RTT:        m.rtt.snapshot(),
+		Cache:      res.CacheStats().CacheShardStats,
+		InfraCache: res.InfraCacheStats().CacheShardStats,
+	}
+	m.responses.Range(func(k, v any) bool {
+		key := k.(responseKey)
+		out.Responses = append(out.Responses, ResponseCount{Type: key.t, Rcode: key.rcode, Count: v.(*atomic.Uint64).Load()})
+		return true
+	})
+	slices.SortFunc(out.Responses, func(a, b ResponseCount) int {
+		if a.Type != b.Type {
+			return int(a.Type) - int(b.Type)
+		}
+		return int(a.Rcode) - int(b.Rcode)
+	})
+	m.timeouts.Range(func(k, v any) bool {
+		out.Timeouts[k.(netip.Addr)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	return out
+}
+
+// WritePrometheus This writes the Metrics out in the Prometheus text
+// format, every metric's name starting with "dns_".
+func (m Metrics) WritePrometheus(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("dns_upstream_responses_total", "counter", "Responses from the servers, by query type and RCODE.")
+	for _, r := range m.Responses {
+		fmt.Fprintf(b, "dns_upstream_responses_total{type=%q,rcode=%q} %d\n", r.Type.String(), r.Rcode.String(), r.Count)
+	}
+	metric("dns_upstream_timeouts_total", "counter", "Queries a server didn't answer in time, by server.")
+	servers := make([]netip.Addr, 0, len(m.Timeouts))
+	for server := range m.Timeouts {
+		servers = append(servers, server)
+	}
+	slices.SortFunc(servers, netip.Addr.Compare)
+	for _, server := range servers {
+		fmt.Fprintf(b, "dns_upstream_timeouts_total{server=%q} %d\n", server.String(), m.Timeouts[server])
+	}
+	metric("dns_upstream_inflight", "gauge", "Queries waiting on a server.")
+	fmt.Fprintf(b, "dns_upstream_inflight %d\n", m.Inflight)
+	metric("dns_upstream_rtt_seconds", "histogram", "How long the servers took to answer.")
+	writeHistogram(b, "dns_upstream_rtt_seconds", m.RTT)
+
+	caches := []struct {
+		name  string
+		stats CacheShardStats
+	}{{"answer", m.Cache}, {"infra", m.InfraCache}}
+	for _, counter := range []struct {
+		name, kind, help string
+		value            func(CacheShardStats) string
+	}{
+		{"dns_cache_lookups_total", "counter", "Cache lookups.", func(s CacheShardStats) string { return strconv.FormatUint(s.Lookups, 10) }},
+		{"dns_cache_hits_total", "counter", "Cache lookups answered from the cache.", func(s CacheShardStats) string { return strconv.FormatUint(s.Hits, 10) }},
+		{"dns_cache_misses_total", "counter", "Cache lookups not answered from the cache.", func(s CacheShardStats) string { return strconv.FormatUint(s.Misses, 10) }},
+		{"dns_cache_inserts_total", "counter", "Entries stored in the cache.", func(s CacheShardStats) string { return strconv.FormatUint(s.Inserts, 10) }},
+		{"dns_cache_evictions_total", "counter", "Entries removed from the cache before they expired.", func(s CacheShardStats) string { return strconv.FormatUint(s.Evictions, 10) }},
+		{"dns_cache_entries", "gauge", "Entries in the cache.", func(s CacheShardStats) string { return strconv.Itoa(s.Entries) }},
+		{"dns_cache_bytes", "gauge", "Approximate memory used by the cache.", func(s CacheShardStats) string { return strconv.FormatInt(s.Bytes, 10) }},
+	} {
+		metric(counter.name, counter.kind, counter.help)
+		for _, cache := range caches {
+			fmt.Fprintf(b, "%s{cache=%q} %s\n", counter.name, cache.name, counter.value(cache.stats))
+		}
+	}
+	return b.Flush()
+}
+
+// writeHistogram This writes h as the Prometheus histogram name, in
+// seconds.
+func writeHistogram(w io.Writer, name string, h Histogram) {
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound.Seconds(), 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+// MetricsHandler This serves the Resolver's Metrics in the
+// Prometheus text format, for it to scrape.
+func (res *Resolver) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = res.Metrics().WritePrometheus(w)
+	})
+}
+
+// LatencyStats How long a Resolver's lookups have been taking, and
+// its servers to answer, for monitoring it or for picking servers
+// with.  The histograms cover everything since the Resolver was made;
+// the SRTTs follow the recent RTTs.
+type LatencyStats struct {
+	// CacheHits The lookups answered without asking any server, and
+	// Recursions the ones that had to (see LookupCtx)
+	CacheHits  Histogram `json:"cache_hits"`
+	Recursions Histogram `json:"recursions"`
+	// Upstreams Every server that has answered, by address
+	Upstreams []UpstreamStats `json:"upstreams"`
+}
+
+// UpstreamStats How one server has been answering
+type UpstreamStats struct {
+	Addr netip.Addr `json:"addr"`
+	// RTT How long it took to answer
+	RTT Histogram `json:"rtt"`
+	// SRTT The smoothed RTT the servers are ranked by, a moving
+	// average weighted towards the latest, 0 if the Resolver has
+	// closed the server's manager for being idle
+	SRTT time.Duration `json:"srtt"`
+	// Timeouts How many queries it didn't answer in time
+	Timeouts uint64 `json:"timeouts"`
+}
+
+// Stats A snapshot of how long the Resolver's lookups and servers
+// are taking, see LatencyStats.
+func (res *Resolver) Stats() LatencyStats {
+	m := res.metrics
+	stats := LatencyStats{
+		CacheHits:  m.cacheHits.snapshot(),
+		Recursions: m.recursions.snapshot(),
+	}
+	m.upstreams.Range(func(k, v any) bool {
+		addr := k.(netip.Addr)
+		upstream := UpstreamStats{Addr: addr, RTT: v.(*histogram).snapshot()}
+		if timeouts, ok := m.timeouts.Load(addr); ok {
+			upstream.Timeouts = timeouts.(*atomic.Uint64).Load()
+		}
+		if manager := res.existingServerComm(addr); manager != nil {
+			upstream.SRTT = time.Duration(manager.srtt.Load())
+		}
+		stats.Upstreams = append(stats.Upstreams, upstream)
+		return true
+	})
+	slices.SortFunc(stats.Upstreams, func(a, b UpstreamStats) int {
+		return a.Addr.Compare(b.Addr)
+	})
+	return stats
+}
+
+// lookupQueriedKey The context key for whether the lookup has asked
+// a server, for Stats
+type lookupQueriedKey struct{}
+
+// markQueried This notes that the lookup with ctx has asked a server.
+func markQueried(ctx context.Context) {
+	if queried, ok := ctx.Value(lookupQueriedKey{}).(*atomic.Bool); ok {
+		queried.Store(true)
+	}
+}
@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	res := withSingleRoot(New(WithDefaultRetryPolicy(RetryPolicy{Timeout: 50 * time.Millisecond, Attempts: 1})))
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch request.name {
+		case "slow.example.com":
+			return nil
+		case "missing.example.com":
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_NXNAME}}
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: request.qtype, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.107")},
+		}}}
+	})
+	res.Lookup("www.example.com.", RTYPE_A)
+	res.Lookup("www.example.com.", RTYPE_A)
+	res.Lookup("missing.example.com.", RTYPE_A)
+	res.Lookup("slow.example.com.", RTYPE_A)
+
+	m := res.Metrics()
+	want := []ResponseCount{{RTYPE_A, RCODE_OK, 1}, {RTYPE_A, RCODE_NXNAME, 1}}
+	if len(m.Responses) != len(want) || m.Responses[0] != want[0] || m.Responses[1] != want[1] {
+		t.Errorf("unexpected responses %+v", m.Responses)
+	}
+	root := parseAddrNoerror("198.41.0.4")
+	if len(m.Timeouts) != 1 || m.Timeouts[root] != 1 {
+		t.Errorf("unexpected timeouts %v", m.Timeouts)
+	}
+	if m.Inflight != 0 || m.RTT.Count != 2 || len(m.RTT.Counts) != len(m.RTT.Bounds)+1 {
+		t.Errorf("unexpected inflight %d and RTT %+v", m.Inflight, m.RTT)
+	}
+	if m.Cache.Hits == 0 || m.Cache.Lookups < m.Cache.Hits {
+		t.Errorf("unexpected cache stats %+v", m.Cache)
+	}
+	if _, err := json.Marshal(m); err != nil {
+		t.Errorf("Metrics don't marshal: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	res.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE dns_upstream_responses_total counter",
+		`dns_upstream_responses_total{type="A",rcode="RCODE_NXNAME"} 1`,
+		`dns_upstream_timeouts_total{server="198.41.0.4"} 1`,
+		"dns_upstream_inflight 0",
+		`dns_upstream_rtt_seconds_bucket{le="0.001"}`,
+		`dns_upstream_rtt_seconds_bucket{le="+Inf"} 2`,
+		"dns_upstream_rtt_seconds_count 2",
+		`dns_cache_entries{cache="infra"}`,
+	} {
+		if !strings.Contains(body, line+"\n") && !strings.Contains(body, line+" ") {
+			t.Errorf("no %q in\n%s", line, body)
+		}
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestStats(t *testing.T) {
+	res := withSingleRoot(New(WithDefaultRetryPolicy(RetryPolicy{Timeout: 50 * time.Millisecond, Attempts: 1})))
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if request.name == "slow.example.com" {
+			return nil
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: request.qtype, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.113")},
+		}}}
+	})
+	res.Lookup("www.example.com.", RTYPE_A)
+	res.Lookup("www.example.com.", RTYPE_A)
+	res.Lookup("slow.example.com.", RTYPE_A)
+
+	stats := res.Stats()
+	if stats.CacheHits.Count != 1 || stats.Recursions.Count != 2 {
+		t.Errorf("%d cache hits and %d recursions, want 1 and 2", stats.CacheHits.Count, stats.Recursions.Count)
+	}
+	// the one that timed out took at least the timeout
+	if stats.Recursions.Quantile(1) < 50*time.Millisecond || stats.CacheHits.Mean() > stats.Recursions.Mean() {
+		t.Errorf("unexpected lookup latencies %+v and %+v", stats.CacheHits, stats.Recursions)
+	}
+	if len(stats.Upstreams) != 1 {
+		t.Fatalf("unexpected upstreams %+v", stats.Upstreams)
+	}
+	root := stats.Upstreams[0]
+	if root.Addr != parseAddrNoerror("198.41.0.4") || root.RTT.Count != 1 || root.Timeouts != 1 || root.SRTT <= 0 {
+		t.Errorf("unexpected upstream %+v", root)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := Histogram{
+		Bounds: []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond},
+		Counts: []uint64{50, 40, 9, 1},
+		Count:  100,
+		Sum:    time.Second,
+	}
+	for q, want := range map[float64]time.Duration{
+		0.5:  time.Millisecond,
+		0.51: 10 * time.Millisecond,
+		0.9:  10 * time.Millisecond,
+		0.99: 100 * time.Millisecond,
+		1:    100 * time.Millisecond,
+	} {
+		if got := h.Quantile(q); got != want {
+			t.Errorf("quantile %v is %v, want %v", q, got, want)
+		}
+	}
+	if h.Mean() != 10*time.Millisecond {
+		t.Errorf("mean %v", h.Mean())
+	}
+	if (Histogram{}).Quantile(0.5) != 0 || (Histogram{}).Mean() != 0 {
+		t.Errorf("empty histogram has a quantile or mean")
+	}
+}
@@ -3,13 +3,16 @@ package dns
 import (
 	"fmt"
 	"net/netip"
+	"strconv"
+	"strings"
 )
 
 var S = "Fubar"
 
 // RCODE, or response code, is used in DNS for signaling the status of a response,
-// This is an enumeration of the different codes possible.
-type RCODE uint8
+// This is an enumeration of the different codes possible.  With EDNS
+// it is 12 bits, the upper 8 coming from the OPT record.
+type RCODE uint16
 
 const (
 	RCODE_OK RCODE = iota
@@ -18,6 +21,31 @@ const (
 	RCODE_NXNAME
 	RCODE_NOIMPLEMENT
 	RCODE_REFUSE
+	// RCODE_YXDOMAIN to RCODE_NOTZONE are what a server turns a
+	// dynamic update down with (see Update): a name that shouldn't
+	// exist does, an RRset that shouldn't exist does, one that
+	// should doesn't, the server isn't authoritative for the zone
+	// (or the update isn't signed with a key it takes), or a name
+	// isn't in the zone
+	RCODE_YXDOMAIN
+	RCODE_YXRRSET
+	RCODE_NXRRSET
+	RCODE_NOTAUTH
+	RCODE_NOTZONE
+	// RCODE_BADVERS needs the extended RCODE from the OPT record
+	// (see EDNS)
+	RCODE_BADVERS RCODE = 16
+	// RCODE_BADCOOKIE means the server wants to see its own server
+	// cookie (see DNSCookies)
+	RCODE_BADCOOKIE RCODE = 23
+	// RCODE_BADSIG, RCODE_BADKEY, RCODE_BADTIME and RCODE_BADTRUNC
+	// are what a server puts in a TSIG record's Error for a request
+	// whose signature it didn't take (see TSIGKey).  RCODE_BADSIG
+	// is the same number as RCODE_BADVERS.
+	RCODE_BADSIG   RCODE = 16
+	RCODE_BADKEY   RCODE = 17
+	RCODE_BADTIME  RCODE = 18
+	RCODE_BADTRUNC RCODE = 22
 )
 
 var rcodeName = map[RCODE]string{
@@ -27,6 +55,16 @@ var rcodeName = map[RCODE]string{
 	RCODE_NXNAME:      "RCODE_NXNAME",
 	RCODE_NOIMPLEMENT: "RCODE_NOIMPLEMENT",
 	RCODE_REFUSE:      "RCODE_REFUSE",
+	RCODE_YXDOMAIN:    "RCODE_YXDOMAIN",
+	RCODE_YXRRSET:     "RCODE_YXRRSET",
+	RCODE_NXRRSET:     "RCODE_NXRRSET",
+	RCODE_NOTAUTH:     "RCODE_NOTAUTH",
+	RCODE_NOTZONE:     "RCODE_NOTZONE",
+	RCODE_BADVERS:     "RCODE_BADVERS",
+	RCODE_BADCOOKIE:   "RCODE_BADCOOKIE",
+	RCODE_BADKEY:      "RCODE_BADKEY",
+	RCODE_BADTIME:     "RCODE_BADTIME",
+	RCODE_BADTRUNC:    "RCODE_BADTRUNC",
 }
 
 func (rcode RCODE) String() string {
@@ -42,47 +80,82 @@ func (rcode RCODE) String() string {
 type RTYPE uint16
 
 const (
-	RTYPE_A     RTYPE = 1
-	RTYPE_NS          = 2
-	RTYPE_CNAME       = 5
-	RTYPE_SOA         = 6
-	RTYPE_NULL        = 10
-	RTYPE_PTR         = 12
-	RTYPE_MX          = 15
-	RTYPE_TXT         = 16
-	RTYPE_OPT         = 41
-	RTYPE_AAAA        = 28
-	RTYPE_ANY         = 255
+	RTYPE_A      RTYPE = 1
+	RTYPE_NS           = 2
+	RTYPE_CNAME        = 5
+	RTYPE_SOA          = 6
+	RTYPE_NULL         = 10
+	RTYPE_PTR          = 12
+	RTYPE_MX           = 15
+	RTYPE_TXT          = 16
+	RTYPE_OPT          = 41
+	RTYPE_AAAA         = 28
+	RTYPE_SRV          = 33
+	RTYPE_DS           = 43
+	RTYPE_RRSIG        = 46
+	RTYPE_NSEC         = 47
+	RTYPE_DNSKEY       = 48
+	RTYPE_NSEC3        = 50
+	RTYPE_TLSA         = 52
+	RTYPE_SVCB         = 64
+	RTYPE_HTTPS        = 65
+	RTYPE_TSIG         = 250
+	RTYPE_CAA          = 257
+	RTYPE_ANY          = 255
 )
 
 var rtypeName = map[RTYPE]string{
-	RTYPE_A:     "A",
-	RTYPE_NS:    "NS",
-	RTYPE_CNAME: "CNAME",
-	RTYPE_SOA:   "SOA",
-	RTYPE_NULL:  "NULL",
-	RTYPE_PTR:   "PTR",
-	RTYPE_MX:    "MX",
-	RTYPE_TXT:   "TXT",
-	RTYPE_OPT:   "OPT",
-	RTYPE_AAAA:  "AAAA",
-	RTYPE_ANY:   "ANY",
+	RTYPE_A:      "A",
+	RTYPE_NS:     "NS",
+	RTYPE_CNAME:  "CNAME",
+	RTYPE_SOA:    "SOA",
+	RTYPE_NULL:   "NULL",
+	RTYPE_PTR:    "PTR",
+	RTYPE_MX:     "MX",
+	RTYPE_TXT:    "TXT",
+	RTYPE_OPT:    "OPT",
+	RTYPE_AAAA:   "AAAA",
+	RTYPE_SRV:    "SRV",
+	RTYPE_DS:     "DS",
+	RTYPE_RRSIG:  "RRSIG",
+	RTYPE_NSEC:   "NSEC",
+	RTYPE_DNSKEY: "DNSKEY",
+	RTYPE_NSEC3:  "NSEC3",
+	RTYPE_TLSA:   "TLSA",
+	RTYPE_SVCB:   "SVCB",
+	RTYPE_HTTPS:  "HTTPS",
+	RTYPE_TSIG:   "TSIG",
+	RTYPE_CAA:    "CAA",
+	RTYPE_ANY:    "ANY",
 }
 
+// String Types we don't have a name for are shown the RFC 3597
+// way, as TYPEnnn.
 func (rtype RTYPE) String() string {
-	return rtypeName[rtype]
+	if name, ok := rtypeName[rtype]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(rtype))
 }
 
 type CLASS int
 
 const (
-	IN    CLASS = 1
-	CHAOS       = 3
+	IN     CLASS = 1
+	CHAOS        = 3
+	HESIOD       = 4
+	// NONE is the class of the records an Update deletes
+	NONE = 254
+	// ANY is the class of TSIG records
+	ANY = 255
 )
 
 var className = map[CLASS]string{
-	IN:    "IN",
-	CHAOS: "CHAOS",
+	IN:     "IN",
+	CHAOS:  "CHAOS",
+	HESIOD: "HESIOD",
+	NONE:   "NONE",
+	ANY:    "ANY",
 }
 
 func (c CLASS) String() string {
@@ -110,6 +183,8 @@ type SOA_RECORD struct {
 	Refresh uint32 `json:"refresh"`
 	Retry   uint32 `json:"retry"`
 	Expire  uint32 `json:"expire"`
+	// Minimum is the TTL for negative answers from the zone
+	Minimum uint32 `json:"minimum"`
 }
 
 func (r SOA_RECORD) Dummy() {
@@ -145,6 +220,120 @@ type AAAA_RECORD struct {
 func (A AAAA_RECORD) Dummy() {
 }
 
+// PTR_RECORD The name an address maps back to, see LookupAddr
+type PTR_RECORD struct {
+	PTR string `json:"ptr"`
+}
+
+func (p PTR_RECORD) Dummy() {
+}
+
+// TXT_RECORD Free form text, as one or more strings of up to 255
+// bytes each.  A long value (like an SPF policy) gets split over
+// several strings, which are meant to be joined back together.
+type TXT_RECORD struct {
+	Txt []string `json:"txt"`
+}
+
+func (t TXT_RECORD) Dummy() {
+}
+
+func (t TXT_RECORD) String() string {
+	quoted := make([]string, len(t.Txt))
+	for i, txt := range t.Txt {
+		quoted[i] = strconv.Quote(txt)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// MX_RECORD A mail exchanger for the name.  Lower preference
+// values are tried first.
+type MX_RECORD struct {
+	Preference uint16 `json:"preference"`
+	Exchange   string `json:"exchange"`
+}
+
+func (m MX_RECORD) Dummy() {
+}
+
+func (m MX_RECORD) String() string {
+	return fmt.Sprintf("%v %s", m.Preference, m.Exchange)
+}
+
+// SRV_RECORD Where to find a service (RFC 2782).  Targets are
+// tried in order of priority, lowest first, and the weight says
+// how to spread the load among targets with the same priority.
+type SRV_RECORD struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+func (s SRV_RECORD) Dummy() {
+}
+
+func (s SRV_RECORD) String() string {
+	return fmt.Sprintf("%v %v %v %s", s.Priority, s.Weight, s.Port, s.Target)
+}
+
+// TLSA_RECORD A certificate association for DANE (RFC 6698).  Usage
+// says what kind of certificate it constrains (0-3, PKIX-TA, PKIX-EE,
+// DANE-TA and DANE-EE), Selector whether CertData matches the whole
+// certificate (0) or just its public key (1), and MatchingType
+// whether it is the data itself (0), a SHA-256 (1) or a SHA-512 (2).
+type TLSA_RECORD struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	CertData     []byte `json:"cert_data"`
+}
+
+func (t TLSA_RECORD) Dummy() {
+}
+
+func (t TLSA_RECORD) String() string {
+	return fmt.Sprintf("%v %v %v %x", t.Usage, t.Selector, t.MatchingType, t.CertData)
+}
+
+// CAA_RECORD Which certificate authorities may issue for the name
+// (RFC 8659).  The tag is something like "issue", "issuewild" or
+// "iodef", and flags 128 marks the property as critical.
+type CAA_RECORD struct {
+	Flags uint8  `json:"flags"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+func (c CAA_RECORD) Dummy() {
+}
+
+func (c CAA_RECORD) String() string {
+	return fmt.Sprintf("%v %s %q", c.Flags, c.Tag, c.Value)
+}
+
+// RAW_RECORD The RDATA of a type we don't model (RFC 3597), kept
+// exactly as it came off the wire.  These get cached and handed
+// back like anything else, it is up to the caller to make sense of
+// Data.  Type is the record's type, so the RDATA still says what it
+// is when it is passed around without its DNSAnswer.
+type RAW_RECORD struct {
+	Type uint16 `json:"type"`
+	Data []byte `json:"data"`
+}
+
+func (r RAW_RECORD) Dummy() {
+}
+
+// String This is the RFC 3597 presentation form, \# followed by the
+// length and the data in hex.
+func (r RAW_RECORD) String() string {
+	if len(r.Data) == 0 {
+		return "\\# 0"
+	}
+	return fmt.Sprintf("\\# %d %x", len(r.Data), r.Data)
+}
+
 func (r SOA_RECORD) String() string {
 	return fmt.Sprintf("%s %s %v %v %v %v",
 		r.MName,
@@ -158,11 +347,20 @@ func (r SOA_RECORD) String() string {
 // Go does not have unions, but we can define a
 // dummy interface and assign ANYTHING we want as
 // rdata and use a type switch or type assertion
+//
+// TTL is the time to live in seconds as handed to us by the
+// server, which is how long the record may be cached for.
+//
+// Authenticated is only ever set on the answers a lookup returns,
+// when the server that gave us the record set the AD bit (see
+// WithDNSSECFlags).
 type DNSAnswer struct {
-	RName  string `json:"rname"`
-	RType  RTYPE  `json:"rtype"`
-	RClass CLASS  `json:"rclass"`
-	RData  RDATA  `json:"rdata"`
+	RName         string `json:"rname"`
+	RType         RTYPE  `json:"rtype"`
+	RClass        CLASS  `json:"rclass"`
+	TTL           uint32 `json:"ttl"`
+	RData         RDATA  `json:"rdata"`
+	Authenticated bool   `json:"authenticated,omitempty"`
 }
 
 func (a DNSAnswer) String() string {
@@ -173,15 +371,34 @@ func (a DNSAnswer) String() string {
 		a.RData)
 }
 
+// DNSHeader Truncated is the TC bit, set when the answer was too
+// big for the UDP packet it came in.  AuthenticData is the AD bit, a
+// validating server saying it checked the DNSSEC signatures on
+// everything in the answer and authority sections, and
+// CheckingDisabled the CD bit, asking a validating server not to.
+// Response, Authoritative, RecursionDesired and RecursionAvailable
+// are the QR, AA, RD and RA bits, and Opcode the kind of query (0
+// for an ordinary one).
 type DNSHeader struct {
-	ID     uint16 `json:"id"`
-	Status RCODE  `json:"status"`
+	ID                 uint16 `json:"id"`
+	Status             RCODE  `json:"status"`
+	Truncated          bool   `json:"truncated,omitempty"`
+	AuthenticData      bool   `json:"ad,omitempty"`
+	CheckingDisabled   bool   `json:"cd,omitempty"`
+	Response           bool   `json:"qr,omitempty"`
+	Opcode             uint8  `json:"opcode,omitempty"`
+	Authoritative      bool   `json:"aa,omitempty"`
+	RecursionDesired   bool   `json:"rd,omitempty"`
+	RecursionAvailable bool   `json:"ra,omitempty"`
 }
 
+// DNSMessage EDNS is what the OPT record in the additional section
+// said, nil if there wasn't one.
 type DNSMessage struct {
 	Header      DNSHeader   `json:"header"`
 	Question    DNSQuestion `json:"questions"`
 	Answers     []DNSAnswer `json:"answers"`
 	Authorities []DNSAnswer `json:"authorities"`
 	Additionals []DNSAnswer `json:"additionals"`
+	EDNS        *EDNS       `json:"edns,omitempty"`
 }
@@ -46,7 +46,8 @@ func TestRTYPE_String(t *testing.T) {
 		rtype RTYPE
 		want  string
 	}{
-		// TODO: Add test cases.
+		{"Known", RTYPE_AAAA, "AAAA"},
+		{"Unknown", RTYPE(99), "TYPE99"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
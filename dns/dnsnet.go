@@ -0,0 +1,241 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// NetResolver This has the lookup methods of net.Resolver, with the
+// same signatures and the same kind of errors (*net.DNSError), so
+// code written against the standard library can switch over with
+// little more than a change of type.  Resolver is the one that does
+// the work, nil meaning DefaultResolver.
+//
+// Addresses come back in the order to try them (see SortAddrs), or
+// with Interleave set, with IPv6 and IPv4 taking turns as Happy
+// Eyeballs wants (see InterleaveAddrs).
+type NetResolver struct {
+	Resolver   *Resolver
+	Interleave bool
+}
+
+// WithDial This makes the Resolver connect to the servers with dial
+// rather than a net.Dialer, say to go through a proxy.  It has the
+// same signature as net.Resolver's Dial so the same function can be
+// used for both.
+func WithDial(dial func(ctx context.Context, network, address string) (net.Conn, error)) Option {
+	return func(res *Resolver) {
+		res.dial = dial
+	}
+}
+
+func (nr *NetResolver) resolver() *Resolver {
+	if nr == nil || nr.Resolver == nil {
+		return DefaultResolver
+	}
+	return nr.Resolver
+}
+
+// LookupHost This returns the addresses of host, as strings.  An
+// address is handed straight back.
+func (nr *NetResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := nr.LookupNetIP(ctx, "ip", host)
+	hosts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = addr.String()
+	}
+	return hosts, err
+}
+
+// LookupIP This returns the addresses of host, network being "ip"
+// for both IPv4 and IPv6, "ip4" or "ip6".
+func (nr *NetResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, err := nr.LookupNetIP(ctx, network, host)
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = net.IP(addr.AsSlice())
+	}
+	return ips, err
+}
+
+// LookupNetIP This is LookupIP returning netip.Addrs.
+func (nr *NetResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var types []RTYPE
+	switch network {
+	case "ip":
+		types = []RTYPE{RTYPE_A, RTYPE_AAAA}
+	case "ip4":
+		types = []RTYPE{RTYPE_A}
+	case "ip6":
+		types = []RTYPE{RTYPE_AAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if network == "ip" || addr.Is4() == (network == "ip4") {
+			return []netip.Addr{addr}, nil
+		}
+		return nil, netDNSError(nil, host)
+	}
+	var addrs []netip.Addr
+	var firstErr error
+	for _, t := range types {
+		answers, err := nr.resolver().LookupCtx(ctx, host, t)
+		for _, answer := range answers {
+			switch r := answer.RData.(type) {
+			case A_RECORD:
+				addrs = append(addrs, r.A)
+			case AAAA_RECORD:
+				addrs = append(addrs, r.AAAA)
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, netDNSError(firstErr, host)
+	}
+	SortAddrs(addrs)
+	if nr != nil && nr.Interleave {
+		addrs = InterleaveAddrs(addrs)
+	}
+	return addrs, nil
+}
+
+// LookupCNAME This returns the canonical name for host, which is
+// where its CNAMEs (if any) lead.  As with net.Resolver it is an
+// error for host to have no addresses at all.
+func (nr *NetResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	var firstErr error
+	for _, t := range []RTYPE{RTYPE_A, RTYPE_AAAA} {
+		answers, err := nr.resolver().LookupCtx(ctx, host, t)
+		if len(answers) > 0 {
+			return canonicalName(host, answers), nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", netDNSError(firstErr, host)
+}
+
+// LookupNS This returns the nameservers for name.
+func (nr *NetResolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	answers, err := nr.resolver().LookupCtx(ctx, name, RTYPE_NS)
+	var records []*net.NS
+	for _, answer := range answers {
+		if ns, ok := answer.RData.(NS_RECORD); ok {
+			records = append(records, &net.NS{Host: absolute(ns.NS)})
+		}
+	}
+	if len(records) == 0 {
+		return nil, netDNSError(err, name)
+	}
+	return records, nil
+}
+
+// LookupMX This returns the mail exchangers for name, most
+// preferred first.
+func (nr *NetResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	answers, err := nr.resolver().LookupCtx(ctx, name, RTYPE_MX)
+	var records []*net.MX
+	for _, answer := range answers {
+		if mx, ok := answer.RData.(MX_RECORD); ok {
+			records = append(records, &net.MX{Host: absolute(mx.Exchange), Pref: mx.Preference})
+		}
+	}
+	if len(records) == 0 {
+		return nil, netDNSError(err, name)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	return records, nil
+}
+
+// LookupTXT This returns the TXT records for name, the strings of
+// each one joined back together.
+func (nr *NetResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answers, err := nr.resolver().LookupCtx(ctx, name, RTYPE_TXT)
+	var records []string
+	for _, answer := range answers {
+		if txt, ok := answer.RData.(TXT_RECORD); ok {
+			records = append(records, strings.Join(txt.Txt, ""))
+		}
+	}
+	if len(records) == 0 {
+		return nil, netDNSError(err, name)
+	}
+	return records, nil
+}
+
+// LookupSRV This looks up _service._proto.name (or just name if
+// service and proto are both empty) and returns the name the
+// records were actually found at along with the records, in the
+// order to try them (see Resolver.LookupSRV).
+func (nr *NetResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	answers, err := nr.resolver().LookupCtx(ctx, target, RTYPE_SRV)
+	var records []SRV_RECORD
+	for _, answer := range answers {
+		if srv, ok := answer.RData.(SRV_RECORD); ok {
+			records = append(records, srv)
+		}
+	}
+	if len(records) == 0 {
+		return "", nil, netDNSError(err, target)
+	}
+	addrs := make([]*net.SRV, 0, len(records))
+	for _, srv := range orderSRV(records) {
+		addrs = append(addrs, &net.SRV{Target: absolute(srv.Target), Port: srv.Port, Priority: srv.Priority, Weight: srv.Weight})
+	}
+	return canonicalName(target, answers), addrs, nil
+}
+
+// canonicalName Where the CNAMEs in answers (a chain from Lookup)
+// lead from name, with the trailing '.' as net.Resolver has it.
+func canonicalName(name string, answers []*DNSAnswer) string {
+	for _, answer := range answers {
+		if cname, ok := answer.RData.(CNAME_RECORD); ok {
+			name = cname.CNAME
+		}
+	}
+	return absolute(name)
+}
+
+// netDNSError This turns why a lookup of name found nothing into
+// the *net.DNSError net.Resolver would have given, err being nil
+// when the type asked for just doesn't exist for the name.
+func netDNSError(err error, name string) *net.DNSError {
+	dnsErr := &net.DNSError{Name: name, UnwrapErr: err}
+	switch {
+	case err == nil || errors.Is(err, ErrNXDomain):
+		dnsErr.Err = "no such host"
+		dnsErr.IsNotFound = true
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrTimeout):
+		dnsErr.Err = "i/o timeout"
+		dnsErr.IsTimeout = true
+	case errors.Is(err, context.Canceled):
+		dnsErr.Err = "operation was canceled"
+	case errors.Is(err, ErrServFail):
+		dnsErr.Err = "server misbehaving"
+		dnsErr.IsTemporary = true
+	default:
+		dnsErr.Err = err.Error()
+	}
+	return dnsErr
+}
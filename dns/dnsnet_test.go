@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// netTestResolver A NetResolver whose servers know about a handful
+// of names under example.com.
+func netTestResolver() *NetResolver {
+	records := map[string][]DNSAnswer{
+		"www.example.com A":    {{RName: "www.example.com", RType: RTYPE_CNAME, TTL: 300, RData: CNAME_RECORD{"web.example.com."}}},
+		"www.example.com AAAA": {{RName: "www.example.com", RType: RTYPE_CNAME, TTL: 300, RData: CNAME_RECORD{"web.example.com."}}},
+		"web.example.com A":    {{RName: "web.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")}}},
+		"web.example.com AAAA": {{RName: "web.example.com", RType: RTYPE_AAAA, TTL: 300, RData: AAAA_RECORD{parseAddrNoerror("2001:db8::1")}}},
+		"example.com MX": {
+			{RName: "example.com", RType: RTYPE_MX, TTL: 300, RData: MX_RECORD{20, "mx2.example.com"}},
+			{RName: "example.com", RType: RTYPE_MX, TTL: 300, RData: MX_RECORD{10, "mx1.example.com."}},
+		},
+		"example.com NS":  {{RName: "example.com", RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{"ns1.example.com."}}},
+		"example.com TXT": {{RName: "example.com", RType: RTYPE_TXT, TTL: 300, RData: TXT_RECORD{[]string{"v=spf1 ", "-all"}}}},
+		"_sip._tcp.example.com SRV": {
+			{RName: "_sip._tcp.example.com", RType: RTYPE_SRV, TTL: 300, RData: SRV_RECORD{10, 0, 5060, "sip.example.com"}},
+		},
+	}
+	res := New()
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		return &DNSMessage{Answers: records[request.name+" "+request.qtype.String()]}
+	})
+	return &NetResolver{Resolver: res}
+}
+
+func TestNetResolverAddresses(t *testing.T) {
+	withSources(t, "198.51.100.7")
+	nr := netTestResolver()
+	ctx := context.Background()
+	hosts, err := nr.LookupHost(ctx, "www.example.com")
+	if err != nil || !slices.Equal(hosts, []string{"10.0.0.1", "2001:db8::1"}) {
+		t.Errorf("LookupHost: %v, %v", hosts, err)
+	}
+	ips, err := nr.LookupIP(ctx, "ip6", "www.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("LookupIP: %v, %v", ips, err)
+	}
+	if hosts, err := nr.LookupHost(ctx, "192.0.2.1"); err != nil || !slices.Equal(hosts, []string{"192.0.2.1"}) {
+		t.Errorf("LookupHost of an address: %v, %v", hosts, err)
+	}
+	if cname, err := nr.LookupCNAME(ctx, "www.example.com"); err != nil || cname != "web.example.com." {
+		t.Errorf("LookupCNAME: %q, %v", cname, err)
+	}
+	if _, err := nr.LookupIP(ctx, "tcp", "www.example.com"); !errors.As(err, new(net.UnknownNetworkError)) {
+		t.Errorf("expected net.UnknownNetworkError, got %v", err)
+	}
+
+	_, err = nr.LookupHost(ctx, "nothing.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound || dnsErr.Name != "nothing.example.com" {
+		t.Errorf("expected a not found *net.DNSError, got %#v", err)
+	}
+}
+
+func TestNetResolverRecords(t *testing.T) {
+	nr := netTestResolver()
+	ctx := context.Background()
+	mx, err := nr.LookupMX(ctx, "example.com")
+	if err != nil || len(mx) != 2 || *mx[0] != (net.MX{Host: "mx1.example.com.", Pref: 10}) || mx[1].Host != "mx2.example.com." {
+		t.Errorf("LookupMX: %v, %v", mx, err)
+	}
+	txt, err := nr.LookupTXT(ctx, "example.com")
+	if err != nil || !slices.Equal(txt, []string{"v=spf1 -all"}) {
+		t.Errorf("LookupTXT: %q, %v", txt, err)
+	}
+	cname, srv, err := nr.LookupSRV(ctx, "sip", "tcp", "example.com")
+	if err != nil || cname != "_sip._tcp.example.com." || len(srv) != 1 ||
+		*srv[0] != (net.SRV{Target: "sip.example.com.", Port: 5060, Priority: 10}) {
+		t.Errorf("LookupSRV: %q, %v, %v", cname, srv, err)
+	}
+	if _, err := nr.LookupTXT(ctx, "nothing.example.com"); err == nil {
+		t.Errorf("expected an error for a name without TXT records")
+	}
+	// last, since the servers have no address for ns1.example.com
+	// so once the NS records are cached nothing under example.com
+	// can be looked up
+	ns, err := nr.LookupNS(ctx, "example.com")
+	if err != nil || len(ns) != 1 || ns[0].Host != "ns1.example.com." {
+		t.Errorf("LookupNS: %v, %v", ns, err)
+	}
+}
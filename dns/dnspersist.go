@@ -0,0 +1,206 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// persistedEntry This is how a single cache entry looks on disk.
+// We store the absolute expiry rather than a TTL so that
+// anything which went stale while we were down gets dropped
+// when it is loaded back in.
+type persistedEntry struct {
+	Name    string            `json:"name"`
+	Class   CLASS             `json:"class,omitempty"`
+	Type    RTYPE             `json:"type"`
+	Expires time.Time         `json:"expires"`
+	Infra   bool              `json:"infra,omitempty"`
+	Subnet  netip.Prefix      `json:"subnet,omitzero"`
+	AD      bool              `json:"ad,omitempty"`
+	Data    []json.RawMessage `json:"data"`
+}
+
+// SaveCache This writes a snapshot of every live entry in both
+// caches to w, one JSON object per line.  Nothing gets locked, so
+// lookups and updates keep going during the save and each name is
+// saved as it was when we got to it.
+func (res *Resolver) SaveCache(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := res.cache.save(enc, false); err != nil {
+		return err
+	}
+	if err := res.infra.save(enc, true); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (c *dnsCacheTable) save(enc *json.Encoder, infra bool) error {
+	now := time.Now()
+	var err error
+	for _, unit := range c.shardList() {
+		unit.names.Range(func(kname, v any) bool {
+			name := kname.(string)
+			for k, entry := range v.(*dnsCacheName).all() {
+				// Pinned entries are configuration, whoever set
+				// them up will do it again on startup
+				if entry.pinned || entry.expiredAt(now) {
+					continue
+				}
+				p := persistedEntry{
+					Name:    name,
+					Class:   k.class,
+					Type:    k.t,
+					Subnet:  k.subnet,
+					AD:      entry.authenticated,
+					Expires: entry.expires,
+					Infra:   infra,
+					Data:    make([]json.RawMessage, 0, len(entry.data)),
+				}
+				for _, rdata := range entry.data {
+					raw, merr := json.Marshal(rdata)
+					if merr != nil {
+						err = fmt.Errorf("saving %s %v %v: %w", name, k.class, k.t, merr)
+						return false
+					}
+					p.Data = append(p.Data, raw)
+				}
+				if err = enc.Encode(p); err != nil {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadCache This reads a snapshot written by SaveCache back into
+// the cache.  For DefaultResolver InitCache needs to have been
+// called first.  Entries that have already expired are skipped.
+func (res *Resolver) LoadCache(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	now := time.Now()
+	for {
+		var p persistedEntry
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("loading cache: %w", err)
+		}
+		if p.Expires.Before(now) {
+			continue
+		}
+		data := make([]RDATA, 0, len(p.Data))
+		for _, raw := range p.Data {
+			rdata, err := decodeRDATA(p.Type, raw)
+			if err != nil {
+				return fmt.Errorf("loading %s %v: %w", p.Name, p.Type, err)
+			}
+			data = append(data, rdata)
+		}
+		// Snapshots from before the class was saved are all IN
+		if p.Class == 0 {
+			p.Class = IN
+		}
+		cache := res.cache
+		if p.Infra {
+			cache = res.infra
+		}
+		cache.set(cleanName(p.Name), rrKey{p.Class, p.Type, p.Subnet}, res.clampExpires(p.Expires), data, !*res.mergeRRsets, p.AD)
+	}
+}
+
+// decodeRDATA This turns the JSON form of an RDATA back into the
+// concrete record type for t.  Types we don't have an RDATA for
+// were cached as RAW_RECORD.
+func decodeRDATA(t RTYPE, raw json.RawMessage) (RDATA, error) {
+	var err error
+	switch t {
+	case RTYPE_A:
+		var r A_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_AAAA:
+		var r AAAA_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_NS:
+		var r NS_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_CNAME:
+		var r CNAME_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_PTR:
+		var r PTR_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_TXT:
+		var r TXT_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_MX:
+		var r MX_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_SRV:
+		var r SRV_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_SVCB:
+		var r SVCB_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_HTTPS:
+		var r HTTPS_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_DNSKEY:
+		var r DNSKEY_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_DS:
+		var r DS_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_RRSIG:
+		var r RRSIG_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_NSEC:
+		var r NSEC_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_NSEC3:
+		var r NSEC3_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_TLSA:
+		var r TLSA_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_CAA:
+		var r CAA_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	case RTYPE_SOA:
+		var r SOA_RECORD
+		err = json.Unmarshal(raw, &r)
+		return r, err
+	}
+	var r RAW_RECORD
+	err = json.Unmarshal(raw, &r)
+	return r, err
+}
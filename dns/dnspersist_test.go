@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadCache(t *testing.T) {
+	initTestsData(8)
+	DefaultResolver.cacheSet("www.example.com", RTYPE_A, time.Now().Add(time.Hour),
+		[]RDATA{A_RECORD{parseAddrNoerror("10.1.2.3")}})
+	DefaultResolver.cacheSet("example.com", RTYPE_NS, time.Now().Add(time.Hour),
+		[]RDATA{NS_RECORD{"ns1.example.com."}, NS_RECORD{"ns2.example.com."}})
+
+	var buf bytes.Buffer
+	if err := SaveCache(&buf); err != nil {
+		t.Fatalf("SaveCache: %v", err)
+	}
+
+	// Start over with a different shard count to make sure nothing
+	// depends on where an entry used to live
+	initTestsData(3)
+	if DefaultResolver.cacheLookup("www.example.com", RTYPE_A) != nil {
+		t.Fatalf("cache should be empty after InitCache")
+	}
+	if err := LoadCache(&buf); err != nil {
+		t.Fatalf("LoadCache: %v", err)
+	}
+	entry := DefaultResolver.cacheLookup("www.example.com", RTYPE_A)
+	if entry == nil || entry.data[0].(A_RECORD).A != parseAddrNoerror("10.1.2.3") {
+		t.Errorf("A record not restored, got %v", entry)
+	}
+	entry = DefaultResolver.cacheLookup("example.com", RTYPE_NS)
+	if entry == nil || len(entry.data) != 2 {
+		t.Errorf("NS records not restored, got %v", entry)
+	}
+	// The root hints from InitCache should still be there as well
+	if DefaultResolver.infraLookup(".", RTYPE_NS) == nil {
+		t.Errorf("root NS missing after load")
+	}
+}
+
+func TestLoadCacheDropsExpired(t *testing.T) {
+	initTestsData(8)
+	stale := `{"name":"old.example.com","type":1,"expires":"2001-01-01T00:00:00Z","data":[{"a":"10.0.0.1"}]}` + "\n"
+	if err := LoadCache(strings.NewReader(stale)); err != nil {
+		t.Fatalf("LoadCache: %v", err)
+	}
+	if DefaultResolver.cacheLookup("old.example.com", RTYPE_A) != nil {
+		t.Errorf("expired entry should not have been loaded")
+	}
+	if err := LoadCache(strings.NewReader("{not json")); err == nil {
+		t.Errorf("expected an error for a corrupt snapshot")
+	}
+}
+
+func TestSaveLoadCacheClass(t *testing.T) {
+	initTestsData(4)
+	a := []RDATA{A_RECORD{parseAddrNoerror("10.1.2.3")}}
+	DefaultResolver.cache.set("version.example.com", rrKey{class: CHAOS, t: RTYPE_A}, time.Now().Add(time.Hour), a, true, false)
+
+	var buf bytes.Buffer
+	if err := SaveCache(&buf); err != nil {
+		t.Fatalf("SaveCache: %v", err)
+	}
+	initTestsData(4)
+	// An entry from before the class was saved counts as IN
+	old := `{"name":"old.example.com","type":1,"expires":"2999-01-01T00:00:00Z","data":[{"a":"10.0.0.1"}]}` + "\n"
+	buf.WriteString(old)
+	if err := LoadCache(&buf); err != nil {
+		t.Fatalf("LoadCache: %v", err)
+	}
+	if DefaultResolver.cacheLookup("version.example.com", RTYPE_A) != nil {
+		t.Errorf("CHAOS entry came back as IN")
+	}
+	if DefaultResolver.cache.lookup("version.example.com", rrKey{class: CHAOS, t: RTYPE_A}) == nil {
+		t.Errorf("CHAOS entry not restored")
+	}
+	if DefaultResolver.cacheLookup("old.example.com", RTYPE_A) == nil {
+		t.Errorf("entry without a class should load as IN")
+	}
+}
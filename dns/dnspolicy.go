@@ -0,0 +1,250 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Policy A response policy zone (RPZ) for a Server: names, or whole
+// subtrees of them, that get a fixed answer whatever their real one
+// is, which is how ads and malware get blocked.  It is an ordinary
+// zone whose owner names, taken relative to its origin, are the
+// names the rules are for, "*.name" being a rule for everything
+// below name (though not name itself).  What the records at a name
+// say is what happens to a query for it (see PolicyAction):
+//
+//	ads.example.com     CNAME .               ; NXDOMAIN
+//	*.ads.example.com   CNAME *.              ; NODATA
+//	ok.ads.example.com  CNAME rpz-passthru.   ; answered as usual
+//	evil.example.net    CNAME rpz-drop.       ; no response at all
+//	tracker.example.org A     0.0.0.0         ; local data
+//
+// Local data is answered from in place of the real records, with
+// the query's name as the owner; if it has a CNAME but no records
+// of the type asked for, that CNAME is followed as usual.  A rule
+// for the name itself beats any for its subtrees, and the one for
+// the smallest subtree beats the rest.  The SOA and NS records at
+// the origin aren't rules.  Make one with NewPolicy or
+// LoadPolicyFile; Reload swaps in the file's current rules while
+// it is in use.
+type Policy struct {
+	origin string
+	path   string
+	rules  atomic.Pointer[policyRules]
+}
+
+// PolicyAction What a Policy rule does with a query
+type PolicyAction int
+
+const (
+	// PolicyPassthru answers as though there were no rule, for
+	// names that would otherwise be caught by a subtree's rule
+	PolicyPassthru PolicyAction = iota
+	// PolicyNXDOMAIN says the name doesn't exist
+	PolicyNXDOMAIN
+	// PolicyNODATA says the name has no records of the type
+	PolicyNODATA
+	// PolicyDrop sends no response at all
+	PolicyDrop
+	// PolicyLocalData answers with the rule's records
+	PolicyLocalData
+)
+
+var policyActionName = map[PolicyAction]string{
+	PolicyPassthru:  "passthru",
+	PolicyNXDOMAIN:  "nxdomain",
+	PolicyNODATA:    "nodata",
+	PolicyDrop:      "drop",
+	PolicyLocalData: "local-data",
+}
+
+func (a PolicyAction) String() string {
+	return policyActionName[a]
+}
+
+// policyRules A Policy's rules, by the (cleaned) name they are for
+// and by the subtree they cover
+type policyRules struct {
+	names    map[string]*policyRule
+	subtrees map[string]*policyRule
+}
+
+type policyRule struct {
+	action  PolicyAction
+	records []DNSAnswer
+}
+
+// ErrBadPolicy What NewPolicy says about records that aren't a
+// policy zone, wrapped with what is wrong with them.
+var ErrBadPolicy = errors.New("dns: bad policy zone")
+
+// NewPolicy This makes the Policy whose rules are records (from
+// ParseZone, say), with owner names below origin.  With origin ""
+// the SOA record says where the apex is.
+func NewPolicy(origin string, records []DNSAnswer) (*Policy, error) {
+	p := &Policy{origin: policyOrigin(origin)}
+	rules, err := p.parse(records)
+	if err != nil {
+		return nil, err
+	}
+	p.rules.Store(rules)
+	return p, nil
+}
+
+// LoadPolicyFile This reads the policy zone at path (see
+// ParseZoneFile), whose origin is origin unless it says otherwise,
+// and makes the Policy from it.  Reload reads it again.
+func LoadPolicyFile(path, origin string) (*Policy, error) {
+	p := &Policy{origin: policyOrigin(origin), path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload This reads the file the Policy came from again and, if it
+// is all right, puts its rules in place of the old ones.  Queries
+// being answered at the time get either the old rules or the new.
+// If anything is wrong with the file the old rules stay.
+func (p *Policy) Reload() error {
+	if p.path == "" {
+		return fmt.Errorf("%w: not loaded from a file", ErrBadPolicy)
+	}
+	records, err := ParseZoneFile(p.path, p.origin)
+	if err != nil {
+		return err
+	}
+	rules, err := p.parse(records)
+	if err != nil {
+		return err
+	}
+	p.rules.Store(rules)
+	return nil
+}
+
+// policyOrigin The origin cleaned, unless it is "" for the SOA
+// record to say
+func policyOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	return cleanName(origin)
+}
+
+// parse This turns the records of the policy zone into its rules.
+func (p *Policy) parse(records []DNSAnswer) (*policyRules, error) {
+	origin := p.origin
+	for _, record := range records {
+		if origin == "" && record.RType == RTYPE_SOA {
+			origin = cleanName(record.RName)
+		}
+	}
+	if origin == "" {
+		return nil, fmt.Errorf("%w: no origin and no SOA record", ErrBadPolicy)
+	}
+	rules := &policyRules{names: make(map[string]*policyRule), subtrees: make(map[string]*policyRule)}
+	for _, record := range records {
+		owner := cleanName(record.RName)
+		if owner == origin {
+			if record.RType == RTYPE_SOA || record.RType == RTYPE_NS {
+				continue
+			}
+			return nil, fmt.Errorf("%w: a rule at the origin", ErrBadPolicy)
+		}
+		name, ok := strings.CutSuffix(owner, "."+origin)
+		if origin == "." {
+			name, ok = owner, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is outside %s", ErrBadPolicy, record.RName, origin)
+		}
+		table := rules.names
+		if subtree, ok := strings.CutPrefix(name, "*."); ok {
+			table, name = rules.subtrees, subtree
+		}
+		rule := table[name]
+		if rule == nil {
+			rule = &policyRule{action: PolicyLocalData}
+			table[name] = rule
+		}
+		action := PolicyLocalData
+		if cname, ok := record.RData.(CNAME_RECORD); ok {
+			switch strings.ToLower(cname.CNAME) {
+			case ".":
+				action = PolicyNXDOMAIN
+			case "*.":
+				action = PolicyNODATA
+			case "rpz-passthru.":
+				action = PolicyPassthru
+			case "rpz-drop.":
+				action = PolicyDrop
+			case "rpz-tcp-only.":
+				return nil, fmt.Errorf("%w: %s: rpz-tcp-only isn't supported", ErrBadPolicy, record.RName)
+			}
+		}
+		if action != PolicyLocalData || rule.action != PolicyLocalData {
+			if len(rule.records) > 0 || rule.action != PolicyLocalData {
+				return nil, fmt.Errorf("%w: %s has more than one action", ErrBadPolicy, record.RName)
+			}
+			rule.action = action
+			continue
+		}
+		record.RName = ""
+		rule.records = append(rule.records, record)
+	}
+	return rules, nil
+}
+
+// match The rule for name, nil if there isn't one.
+func (p *Policy) match(name string) *policyRule {
+	rules := p.rules.Load()
+	name = cleanName(name)
+	if rule := rules.names[name]; rule != nil {
+		return rule
+	}
+	for name != "." {
+		name = parentName(name)
+		if rule := rules.subtrees[name]; rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// apply This puts the answer the Policy's rule for name/t gives in
+// response.  drop means there should be no response at all, and
+// next, if set, is a CNAME's target which is to be answered for
+// as usual.  ok is false if the Policy has nothing to say about name.
+func (p *Policy) apply(response *DNSMessage, name string, t RTYPE) (next string, drop, ok bool) {
+	rule := p.match(name)
+	if rule == nil || rule.action == PolicyPassthru {
+		return "", false, false
+	}
+	switch rule.action {
+	case PolicyDrop:
+		return "", true, true
+	case PolicyNXDOMAIN:
+		response.Header.Status = RCODE_NXNAME
+		return "", false, true
+	case PolicyNODATA:
+		return "", false, true
+	}
+	var cname *DNSAnswer
+	for i, record := range rule.records {
+		record.RName = name
+		if record.RType == t || t == RTYPE_ANY {
+			response.Answers = append(response.Answers, record)
+		} else if record.RType == RTYPE_CNAME {
+			cname = &rule.records[i]
+		}
+	}
+	if len(response.Answers) > 0 || cname == nil {
+		return "", false, true
+	}
+	record := *cname
+	record.RName = name
+	response.Answers = append(response.Answers, record)
+	return record.RData.(CNAME_RECORD).CNAME, false, true
+}
@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicyZone = `$ORIGIN rpz.home.arpa.
+$TTL 300
+@	SOA	localhost. hostmaster 1 3600 600 86400 60
+	NS	localhost.
+ads.example.com	CNAME	.
+*.ads.example.com	CNAME	*.
+ok.ads.example.com	CNAME	rpz-passthru.
+evil.example.net	CNAME	rpz-drop.
+tracker.example.org	A	0.0.0.0
+tracker.example.org	AAAA	::
+*.example.org	CNAME	sinkhole.example.com.
+`
+
+func TestServerPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpz.zone")
+	if err := os.WriteFile(path, []byte(testPolicyZone), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicyFile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := withSingleRoot(New())
+	res.connect = answeringWith("192.0.2.102")
+	srv := &Server{Resolver: res, Policy: policy}
+	srv.begin()
+	defer srv.running.Done()
+
+	describe := func(response *DNSMessage) string {
+		if response == nil {
+			return "dropped"
+		}
+		out := []string{response.Header.Status.String()}
+		for _, record := range response.Answers {
+			out = append(out, cleanName(record.RName))
+			switch data := record.RData.(type) {
+			case A_RECORD:
+				out = append(out, data.A.String())
+			case AAAA_RECORD:
+				out = append(out, data.AAAA.String())
+			case CNAME_RECORD:
+				out = append(out, data.CNAME)
+			}
+		}
+		return strings.Join(out, " ")
+	}
+	ask := func(name string, t RTYPE) string {
+		return describe(srv.answer(&DNSMessage{
+			Header:   DNSHeader{RecursionDesired: true},
+			Question: DNSQuestion{QName: name, QType: t, QClass: IN},
+		}, netip.MustParseAddr("10.0.0.2")))
+	}
+	for _, test := range []struct {
+		name string
+		t    RTYPE
+		want string
+	}{
+		{"ads.example.com", RTYPE_A, RCODE_NXNAME.String()},
+		{"x.ads.example.com", RTYPE_A, RCODE_OK.String()},
+		{"ok.ads.example.com", RTYPE_A, RCODE_OK.String() + " ok.ads.example.com 192.0.2.102"},
+		{"evil.example.net", RTYPE_A, "dropped"},
+		{"www.evil.example.net", RTYPE_A, RCODE_OK.String() + " www.evil.example.net 192.0.2.102"},
+		{"Tracker.example.org", RTYPE_A, RCODE_OK.String() + " tracker.example.org 0.0.0.0"},
+		{"tracker.example.org", RTYPE_AAAA, RCODE_OK.String() + " tracker.example.org ::"},
+		{"tracker.example.org", RTYPE_TXT, RCODE_OK.String()},
+		// the CNAME is followed to the real answer
+		{"cdn.example.org", RTYPE_A, RCODE_OK.String() + " cdn.example.org sinkhole.example.com. sinkhole.example.com 192.0.2.102"},
+		{"example.org", RTYPE_A, RCODE_OK.String() + " example.org 192.0.2.102"},
+	} {
+		if got := ask(test.name, test.t); got != test.want {
+			t.Errorf("%s %v: got %q, want %q", test.name, test.t, got, test.want)
+		}
+	}
+
+	// a broken file leaves the old rules, a good one replaces them
+	os.WriteFile(path, []byte(testPolicyZone+"ads.example.com\tA\t0.0.0.0\n"), 0o644)
+	if err := policy.Reload(); !errors.Is(err, ErrBadPolicy) {
+		t.Errorf("Reload of a conflicting rule returned %v", err)
+	}
+	if got := ask("ads.example.com", RTYPE_A); got != RCODE_NXNAME.String() {
+		t.Errorf("after a failed Reload got %q", got)
+	}
+	os.WriteFile(path, []byte(strings.Replace(testPolicyZone, "ads.example.com\tCNAME\t.", "ads.example.com\tCNAME\trpz-passthru.", 1)), 0o644)
+	if err := policy.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ask("ads.example.com", RTYPE_A), RCODE_OK.String()+" ads.example.com 192.0.2.102"; got != want {
+		t.Errorf("after Reload got %q, want %q", got, want)
+	}
+
+	// over UDP a dropped query gets nothing back
+	exchange, stop := serveUDP(t, &Server{Resolver: res, Policy: policy})
+	defer stop()
+	packet, _ := packMessage(&DNSMessage{Header: DNSHeader{ID: 102}, Question: DNSQuestion{QName: "evil.example.net", QType: RTYPE_A, QClass: IN}})
+	if response := exchange(packet); response != nil {
+		t.Errorf("got %x for a dropped query", response)
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	rule := func(name, target string) DNSAnswer {
+		return DNSAnswer{RName: name, RType: RTYPE_CNAME, RClass: IN, TTL: 60, RData: CNAME_RECORD{target}}
+	}
+	for _, test := range []struct {
+		name    string
+		records []DNSAnswer
+	}{
+		{"outside", []DNSAnswer{rule("ads.example.com", ".")}},
+		{"at the origin", []DNSAnswer{rule("rpz", ".")}},
+		{"tcp-only", []DNSAnswer{rule("ads.example.com.rpz", "rpz-tcp-only.")}},
+		{"two actions", []DNSAnswer{rule("ads.example.com.rpz", "."), rule("ads.example.com.rpz", "rpz-drop.")}},
+	} {
+		if _, err := NewPolicy("rpz", test.records); !errors.Is(err, ErrBadPolicy) {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+	if _, err := NewPolicy("", []DNSAnswer{rule("ads.example.com.rpz", ".")}); !errors.Is(err, ErrBadPolicy) {
+		t.Errorf("no origin: got %v", err)
+	}
+	policy, err := NewPolicy("rpz.", []DNSAnswer{rule("*.example.com.rpz", "."), rule("*.ads.example.com.rpz", "rpz-drop.")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]PolicyAction{"a.ads.example.com": PolicyDrop, "a.b.example.com": PolicyNXDOMAIN} {
+		if rule := policy.match(name); rule == nil || rule.action != want {
+			t.Errorf("%s: got %+v, want %v", name, rule, want)
+		}
+	}
+	if rule := policy.match("example.com"); rule != nil {
+		t.Errorf("the subtree's rule caught its apex: %+v", rule)
+	}
+	if err := policy.Reload(); !errors.Is(err, ErrBadPolicy) {
+		t.Errorf("Reload without a file returned %v", err)
+	}
+}
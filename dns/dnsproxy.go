@@ -0,0 +1,228 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// UpstreamProxy The proxy DefaultResolver makes its connections to
+// the servers through, as a URL: "socks5://host:port" for a SOCKS5
+// proxy (RFC 1928) or "http://host:port" for an HTTP one taking
+// CONNECT requests, either with an optional user:password.  That
+// covers TCP, DNS-over-TLS and DNS-over-HTTPS.  Queries over UDP
+// (and so DNS-over-QUIC) can't go through either kind, and still
+// go straight to the server, so somewhere only the proxy can get
+// out from wants AlwaysTCP (or WithAlwaysTCP) set too.  "" means
+// no proxy.  Changes only apply to servers the resolver hasn't
+// talked to yet.  Resolvers made by New have their own, see
+// WithProxy.
+var UpstreamProxy = ""
+
+// WithProxy This makes the Resolver connect to the servers through
+// the proxy at proxyURL, like UpstreamProxy does for
+// DefaultResolver.  It goes over the top of WithDial, which is then
+// what connects to the proxy.
+func WithProxy(proxyURL string) Option {
+	return func(res *Resolver) {
+		*res.proxy = proxyURL
+	}
+}
+
+// ErrProxy This is what connecting through a proxy fails with when
+// the proxy won't make the connection, wrapped with what it said.
+var ErrProxy = errors.New("dns: proxy refused the connection")
+
+// serverDial How connections to the servers get made: with res.dial
+// (nil meaning a net.Dialer), through the proxy if there is one.
+// It is nil if both are the defaults.
+func (res *Resolver) serverDial() func(ctx context.Context, network, address string) (net.Conn, error) {
+	if *res.proxy == "" {
+		return res.dial
+	}
+	dial := res.dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	proxy := *res.proxy
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network != "tcp" && network != "tcp4" && network != "tcp6" {
+			return dial(ctx, network, address)
+		}
+		return dialProxy(ctx, dial, proxy, address)
+	}
+}
+
+// dialProxy This connects to address through the proxy at proxyURL,
+// making the connection to the proxy with dial.
+func dialProxy(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), proxyURL, address string) (net.Conn, error) {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	var handshake func(conn net.Conn, proxy *url.URL, address string) error
+	port := ""
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		handshake, port = socks5Connect, "1080"
+	case "http":
+		handshake, port = httpConnect, "80"
+	default:
+		return nil, fmt.Errorf("dns: unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if proxy.Port() != "" {
+		port = proxy.Port()
+	}
+	conn, err := dial(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	// the handshake gives up with ctx like the dial does
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	err = handshake(conn, proxy, address)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect This asks the SOCKS5 proxy at the other end of conn
+// to connect to address, an IP address and port, logging in with
+// the user and password in proxy if it has them (RFC 1929).
+func socks5Connect(conn net.Conn, proxy *url.URL, address string) error {
+	target, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	const (
+		version      = 5
+		authNone     = 0
+		authPassword = 2
+		cmdConnect   = 1
+		atypIPv4     = 1
+		atypIPv6     = 4
+	)
+	method := byte(authNone)
+	if proxy.User != nil {
+		method = authPassword
+	}
+	if _, err := conn.Write([]byte{version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != version || reply[1] != method {
+		return fmt.Errorf("%w: no acceptable authentication method", ErrProxy)
+	}
+	if method == authPassword {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return fmt.Errorf("dns: proxy user or password too long")
+		}
+		login := append([]byte{1, byte(len(user))}, user...)
+		login = append(append(login, byte(len(password))), password...)
+		if _, err := conn.Write(login); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("%w: login failed", ErrProxy)
+		}
+	}
+	request := []byte{version, cmdConnect, 0}
+	if addr := target.Addr().Unmap(); addr.Is4() {
+		request = append(append(request, atypIPv4), addr.AsSlice()...)
+	} else {
+		request = append(append(request, atypIPv6), addr.AsSlice()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, target.Port())
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	// version, reply code, reserved and the type of the bound
+	// address, which comes next and isn't needed
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("%w: SOCKS5 reply %d", ErrProxy, head[1])
+	}
+	var skip int
+	switch head[3] {
+	case atypIPv4:
+		skip = 4 + 2
+	case atypIPv6:
+		skip = 16 + 2
+	case 3:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		skip = int(length[0]) + 2
+	default:
+		return fmt.Errorf("%w: bad SOCKS5 reply", ErrProxy)
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// httpConnect This asks the HTTP proxy at the other end of conn to
+// connect to address with a CONNECT request, with the user and
+// password in proxy for Basic authentication if it has them.
+func httpConnect(conn net.Conn, proxy *url.URL, address string) error {
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return err
+	}
+	// read a byte at a time so nothing past the response's header
+	// gets taken off conn
+	response, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 16), nil)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrProxy, strconv.Quote(response.Status))
+	}
+	return nil
+}
+
+// byteReader A reader which never reads more than one byte at a time
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return b.r.Read(p)
+}
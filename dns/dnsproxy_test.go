@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+// proxyServer This runs a proxy on l which does handshake with each
+// client and then connects it to upstream, whatever it asked for.
+// It returns the addresses the clients asked for.
+func proxyServer(l net.Listener, upstream string, handshake func(conn net.Conn) (string, error)) func() []string {
+	var lock sync.Mutex
+	var targets []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				target, err := handshake(conn)
+				if err != nil {
+					return
+				}
+				lock.Lock()
+				targets = append(targets, target)
+				lock.Unlock()
+				server, err := net.Dial("tcp", upstream)
+				if err != nil {
+					return
+				}
+				defer server.Close()
+				go io.Copy(server, conn)
+				io.Copy(conn, server)
+			}()
+		}
+	}()
+	return func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), targets...)
+	}
+}
+
+// socks5Handshake The server side of a SOCKS5 CONNECT, wanting the
+// user "user" with the password "secret"
+func socks5Handshake(conn net.Conn) (string, error) {
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(conn, head); err != nil || head[2] != 2 {
+		conn.Write([]byte{5, 0xff})
+		return "", errors.New("no password")
+	}
+	conn.Write([]byte{5, 2})
+	var lengths [2]byte
+	io.ReadFull(conn, lengths[:])
+	user := make([]byte, lengths[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, lengths[:1])
+	password := make([]byte, lengths[0])
+	io.ReadFull(conn, password)
+	if string(user) != "user" || string(password) != "secret" {
+		conn.Write([]byte{1, 1})
+		return "", errors.New("bad login")
+	}
+	conn.Write([]byte{1, 0})
+	request := make([]byte, 4)
+	io.ReadFull(conn, request)
+	addr := make([]byte, 4)
+	if request[3] == 4 {
+		addr = make([]byte, 16)
+	}
+	io.ReadFull(conn, addr)
+	var port [2]byte
+	io.ReadFull(conn, port[:])
+	ip, _ := netip.AddrFromSlice(addr)
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port[:])).String(), nil
+}
+
+// httpHandshake The server side of an HTTP CONNECT
+func httpHandshake(conn net.Conn) (string, error) {
+	request, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || request.Method != http.MethodConnect {
+		return "", errors.New("not a CONNECT")
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return request.Host, nil
+}
+
+func TestProxy(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer server.Close()
+	tcpServer(server, [4]byte{192, 0, 2, 12}, 0)
+
+	for _, test := range []struct {
+		scheme    string
+		handshake func(net.Conn) (string, error)
+	}{
+		{"socks5://user:secret@", socks5Handshake},
+		{"http://", httpHandshake},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skip(err)
+		}
+		defer l.Close()
+		targets := proxyServer(l, server.Addr().String(), test.handshake)
+		res := withSingleRoot(New(WithProxy(test.scheme+l.Addr().String()), WithAlwaysTCP(true)))
+		result, err := res.Lookup("www.example.com", RTYPE_A)
+		if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.12")}) {
+			t.Errorf("%s: unexpected result %v, %v", test.scheme, result, err)
+		}
+		if got := targets(); len(got) != 1 || got[0] != "198.41.0.4:53" {
+			t.Errorf("%s: proxy asked to connect to %v", test.scheme, got)
+		}
+	}
+
+	// a proxy that won't have us gets no queries through
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	targets := proxyServer(l, server.Addr().String(), socks5Handshake)
+	res := New(WithProxy("socks5://user:wrong@" + l.Addr().String()))
+	if _, err := res.serverDial()(t.Context(), "tcp", "198.41.0.4:53"); !errors.Is(err, ErrProxy) {
+		t.Errorf("got %v with the wrong password, want ErrProxy", err)
+	}
+	if got := targets(); len(got) != 0 {
+		t.Errorf("proxy connected to %v", got)
+	}
+}
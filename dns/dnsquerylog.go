@@ -0,0 +1,243 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryLog A log of the queries a Server answers, one line for each,
+// written to the file at Path and rotated once it gets too big or
+// too old: the file is renamed to Path with the time it was rotated
+// on the end (Path.20061002T150405.000) and a new one started.  Set it as
+// a Server's QueryLog, and Close it once the Server is closed.  The
+// fields mustn't be changed once it is in use.
+//
+// A line in QueryLogText looks like
+//
+//	2006-10-02T15:04:05.000Z 192.0.2.1 www.example.com. A RCODE_OK 1.234ms recursion
+//
+// and in QueryLogJSON it is an object with the fields of
+// QueryLogEntry.
+type QueryLog struct {
+	// Path The file to log to, which is appended to if it is there
+	Path string
+	// Format How the lines are written, QueryLogText if it is the
+	// zero value
+	Format QueryLogFormat
+	// MaxSize How big the file can get, in bytes, before it is
+	// rotated, no limit if 0
+	MaxSize int64
+	// MaxAge How long the file is written to before it is rotated,
+	// no limit if 0.  It is rotated by the first query after that,
+	// so a quiet server doesn't start empty files.
+	MaxAge time.Duration
+	// MaxBackups How many of the rotated files are kept, the oldest
+	// being removed, all of them if 0
+	MaxBackups int
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// QueryLogFormat How a QueryLog writes its lines
+type QueryLogFormat int
+
+const (
+	// QueryLogText has the fields of a QueryLogEntry separated by
+	// spaces
+	QueryLogText QueryLogFormat = iota
+	// QueryLogJSON has a JSON object for each
+	QueryLogJSON
+)
+
+// QueryLogEntry What a QueryLog has to say about a query
+type QueryLogEntry struct {
+	Time    time.Time     `json:"time"`
+	Client  netip.Addr    `json:"client"`
+	Name    string        `json:"name"`
+	Type    RTYPE         `json:"type"`
+	Rcode   RCODE         `json:"rcode"`
+	Latency time.Duration `json:"latency"`
+	Source  QuerySource   `json:"source"`
+}
+
+// QuerySource Where a Server got its answer to a query from
+type QuerySource int
+
+const (
+	// SourceNone The query wasn't looked up at all: it was refused
+	// or it wasn't understood
+	SourceNone QuerySource = iota
+	// SourcePolicy The Server's Policy answered it
+	SourcePolicy
+	// SourceLocal A View's Records answered it
+	SourceLocal
+	// SourceZone One of the Server's Zones answered it
+	SourceZone
+	// SourceCache The Resolver answered it without asking any server
+	SourceCache
+	// SourceRecursion The Resolver asked servers to answer it (the
+	// answer may still be SERVFAIL)
+	SourceRecursion
+)
+
+var querySourceName = map[QuerySource]string{
+	SourceNone:      "none",
+	SourcePolicy:    "policy",
+	SourceLocal:     "local",
+	SourceZone:      "zone",
+	SourceCache:     "cache",
+	SourceRecursion: "recursion",
+}
+
+func (s QuerySource) String() string {
+	return querySourceName[s]
+}
+
+func (s QuerySource) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// queryLogRotated The time on the end of a rotated file's name
+const queryLogRotated = "20060102T150405.000"
+
+// Log This writes entry to the log, rotating it first if it is due.
+func (l *QueryLog) Log(entry QueryLogEntry) error {
+	var line []byte
+	if l.Format == QueryLogJSON {
+		out, err := json.Marshal(struct {
+			QueryLogEntry
+			Type    string  `json:"type"`
+			Rcode   string  `json:"rcode"`
+			Latency float64 `json:"latency"`
+		}{entry, entry.Type.String(), rcodeString(entry.Rcode), entry.Latency.Seconds()})
+		if err != nil {
+			return err
+		}
+		line = append(out, '\n')
+	} else {
+		line = fmt.Appendf(nil, "%s %v %s %v %s %v %v\n",
+			entry.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00"), entry.Client, absolute(entry.Name),
+			entry.Type, rcodeString(entry.Rcode), entry.Latency, entry.Source)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil && l.due(entry.Time, len(line)) {
+		if err := l.rotate(entry.Time); err != nil {
+			return err
+		}
+	}
+	if l.file == nil {
+		if err := l.open(entry.Time); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// rcodeString The name of rcode, or its number if it hasn't got one
+func rcodeString(rcode RCODE) string {
+	if name := rcode.String(); name != "" {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
+
+// due Whether the file should be rotated before n more bytes go in
+// it at now.
+func (l *QueryLog) due(now time.Time, n int) bool {
+	if l.size == 0 {
+		return false
+	}
+	return l.MaxSize > 0 && l.size+int64(n) > l.MaxSize ||
+		l.MaxAge > 0 && now.Sub(l.opened) >= l.MaxAge
+}
+
+// open This opens Path to append to.
+func (l *QueryLog) open(now time.Time) error {
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size, l.opened = file, info.Size(), now
+	return nil
+}
+
+// rotate This closes the file, renames it for now and removes the
+// rotated files beyond MaxBackups.  The next Log opens a new one.
+func (l *QueryLog) rotate(now time.Time) error {
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(l.Path, l.Path+"."+now.UTC().Format(queryLogRotated)); err != nil {
+		return err
+	}
+	if l.MaxBackups <= 0 {
+		return nil
+	}
+	rotated, err := l.backups()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > l.MaxBackups {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// backups The rotated files there are, oldest first
+func (l *QueryLog) backups() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(l.Path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(l.Path) + "."
+	var rotated []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(queryLogRotated, stamp); err == nil {
+			rotated = append(rotated, filepath.Join(filepath.Dir(l.Path), entry.Name()))
+		}
+	}
+	// the timestamps sort the same as the times they are for
+	slices.Sort(rotated)
+	return rotated, nil
+}
+
+// Close This closes the file.  Logging again opens it again.
+func (l *QueryLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	log := &QueryLog{Path: path, Format: QueryLogJSON}
+	res := withSingleRoot(New())
+	res.connect = answeringWith("192.0.2.108")
+	srv := &Server{Resolver: res, QueryLog: log, RecursionACL: ACL{Deny: []netip.Prefix{netip.MustParsePrefix("10.0.0.9/32")}}}
+	srv.begin()
+	defer srv.running.Done()
+
+	for _, query := range []struct {
+		name   string
+		client string
+	}{
+		{"www.example.com", "10.0.0.2"},
+		{"www.example.com", "10.0.0.2"},
+		{"www.example.com", "10.0.0.9"},
+	} {
+		packet, err := packQuery(1, query.name, RTYPE_A, true, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, _ := srv.respond(packet, netip.MustParseAddr(query.client), true); out == nil {
+			t.Fatalf("no response to %s", query.name)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var got []string
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var entry map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("%q: %v", scanner.Text(), err)
+		}
+		if _, ok := entry["time"].(string); !ok {
+			t.Errorf("no time in %q", scanner.Text())
+		}
+		if _, ok := entry["latency"].(float64); !ok {
+			t.Errorf("no latency in %q", scanner.Text())
+		}
+		got = append(got, strings.Join([]string{
+			entry["client"].(string), entry["name"].(string), entry["type"].(string),
+			entry["rcode"].(string), entry["source"].(string),
+		}, " "))
+	}
+	want := []string{
+		"10.0.0.2 www.example.com A RCODE_OK recursion",
+		"10.0.0.2 www.example.com A RCODE_OK cache",
+		"10.0.0.9 www.example.com A RCODE_REFUSE none",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "queries.log")
+	log := &QueryLog{Path: path, MaxSize: 200, MaxAge: time.Hour, MaxBackups: 2}
+	defer log.Close()
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	entry := func(at time.Duration) QueryLogEntry {
+		return QueryLogEntry{
+			Time:    start.Add(at),
+			Client:  netip.MustParseAddr("192.0.2.1"),
+			Name:    "www.example.com",
+			Type:    RTYPE_AAAA,
+			Rcode:   RCODE_NXNAME,
+			Latency: 1500 * time.Microsecond,
+			Source:  SourceCache,
+		}
+	}
+	if err := log.Log(entry(0)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2026-10-16T12:00:00.000Z 192.0.2.1 www.example.com. AAAA RCODE_NXNAME 1.5ms cache\n"; string(line) != want {
+		t.Errorf("logged %q, want %q", line, want)
+	}
+
+	// the lines are 82 bytes, so the third doesn't fit
+	for _, at := range []time.Duration{time.Second, 2 * time.Second} {
+		if err := log.Log(entry(at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// and after an hour it is rotated whatever its size
+	for _, at := range []time.Duration{time.Hour + 2*time.Second, 3 * time.Hour} {
+		if err := log.Log(entry(at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{
+		"queries.log",
+		"queries.log.20261016T130002.000",
+		"queries.log.20261016T150000.000",
+	}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("files %v, want %v", names, want)
+	}
+	for name, lines := range map[string]int{want[0]: 1, want[1]: 1, want[2]: 1} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(data), "\n"); n != lines {
+			t.Errorf("%s has %d lines, want %d", name, n, lines)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// RateLimit How many queries a second may be sent to any one server,
+// so that a burst of lookups can't hammer a single authoritative
+// server.  Each server gets a token bucket holding up to Burst
+// queries (at least 1), which fills back up at Rate a second.  A
+// query finding the bucket empty waits for its token if it would
+// come within MaxWait, queueing up behind any others waiting, and
+// otherwise isn't sent at all: the server counts as not answering,
+// and if none of the servers for the zone do, the lookup fails with
+// a *RateLimitError.  A Rate of 0 or less means no limit.
+type RateLimit struct {
+	Rate    float64
+	Burst   int
+	MaxWait time.Duration
+}
+
+// UpstreamRateLimit The limit on the queries DefaultResolver sends
+// each server, none by default.  It can be changed at any time.
+// Resolvers made by New have their own, see WithUpstreamRateLimit.
+var UpstreamRateLimit RateLimit
+
+// WithUpstreamRateLimit This limits the queries the Resolver sends
+// each server, like UpstreamRateLimit does for DefaultResolver.
+func WithUpstreamRateLimit(limit RateLimit) Option {
+	return func(res *Resolver) {
+		*res.rateLimit = limit
+	}
+}
+
+// RateLimitError This is what lookups return when the servers they
+// needed to ask couldn't be, because of the RateLimit.  Server is
+// the last of them that was passed over.
+type RateLimitError struct {
+	Server netip.Addr
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("dns: too many queries to %v", e.Server)
+}
+
+// tokenBucket A server's bucket for RateLimit, under lock.  tokens
+// is how many it held at last, and can go below 0 for the queries
+// waiting on tokens still to come.
+type tokenBucket struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// reserve This takes a token for a query at now, and says how long
+// until it is there to be taken.  If that is longer than
+// limit.MaxWait nothing is taken and it returns false.
+func (b *tokenBucket) reserve(limit RateLimit, now time.Time) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	burst := float64(max(limit.Burst, 1))
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if now.After(b.last) {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	if wait > limit.MaxWait {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// unreserve This gives back the token of a query that stopped
+// waiting for it.
+func (b *tokenBucket) unreserve(limit RateLimit) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = min(float64(max(limit.Burst, 1)), b.tokens+1)
+}
+
+// mayQuery Whether askServer may send manager's server another query
+// for the lookup with ctx: it has to be within the lookup's Budget
+// (see spendQuery) and the RateLimit, waiting for the latter if need
+// be.  A query the RateLimit turns away is remembered for the
+// lookup's error.
+func (res *Resolver) mayQuery(ctx context.Context, manager *serverCommManager) bool {
+	if !spendQuery(ctx) {
+		return false
+	}
+	limit := *res.rateLimit
+	if limit.Rate <= 0 {
+		return true
+	}
+	wait, ok := manager.bucket.reserve(limit, time.Now())
+	if !ok {
+		if s := spent(ctx); s != nil {
+			s.rateLimited.Store(&RateLimitError{Server: *manager.remote})
+		}
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		manager.bucket.unreserve(limit)
+		return false
+	}
+}
@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := RateLimit{Rate: 10, Burst: 2, MaxWait: 150 * time.Millisecond}
+	var b tokenBucket
+	now := time.Now()
+	for i, want := range []struct {
+		wait time.Duration
+		ok   bool
+	}{
+		// the burst goes straight away, then a token every 100ms
+		{0, true}, {0, true}, {100 * time.Millisecond, true},
+		// which is already waited for, so the next is 200ms away
+		{200 * time.Millisecond, false},
+	} {
+		wait, ok := b.reserve(limit, now)
+		if ok != want.ok || (wait-want.wait).Abs() > time.Millisecond {
+			t.Errorf("query %d: wait %v, %v; want %v, %v", i, wait, ok, want.wait, want.ok)
+		}
+	}
+	// a second later the bucket is full again, but no fuller
+	for i := range 3 {
+		if wait, ok := b.reserve(limit, now.Add(time.Second)); (i < 2) != (wait == 0) || !ok {
+			t.Errorf("query %d a second later: wait %v, %v", i, wait, ok)
+		}
+	}
+}
+
+func TestUpstreamRateLimit(t *testing.T) {
+	// every lookup is one query to the root, and the second has to
+	// wait for its token
+	res := withSingleRoot(New(WithUpstreamRateLimit(RateLimit{Rate: 10, Burst: 1, MaxWait: time.Second})))
+	res.connect = answeringWith("10.0.0.1")
+	start := time.Now()
+	for _, name := range []string{"www.example.com", "mail.example.com"} {
+		if _, err := res.Lookup(name, RTYPE_A); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("two lookups took %v, want one to wait", elapsed)
+	}
+
+	// with no waiting the second fails straight away
+	res = withSingleRoot(New(WithUpstreamRateLimit(RateLimit{Rate: 0.1, Burst: 1})))
+	res.connect = answeringWith("10.0.0.1")
+	if _, err := res.Lookup("www.example.com", RTYPE_A); err != nil {
+		t.Fatal(err)
+	}
+	_, err := res.Lookup("mail.example.com", RTYPE_A)
+	var limited *RateLimitError
+	if !errors.As(err, &limited) || limited.Server != parseAddrNoerror("198.41.0.4") {
+		t.Errorf("got %v, want a *RateLimitError for the root", err)
+	}
+}
@@ -0,0 +1,386 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rootHints The root nameservers and their addresses.  These get
+// pinned in the infrastructure cache by initRoot and are where
+// every lookup that we know nothing about starts from.
+type rootHints struct {
+	// The NS records for "."
+	servers []RDATA
+	// The A and AAAA glue for each of those servers, by
+	// (cleaned) name and then type
+	glue map[string]map[RTYPE][]RDATA
+}
+
+// rootServers All thirteen root servers with their IPv4 and IPv6
+// addresses, as in the named.root file IANA publishes.
+var rootServers = []struct{ name, v4, v6 string }{
+	{"a.root-servers.net", "198.41.0.4", "2001:503:ba3e::2:30"},
+	{"b.root-servers.net", "170.247.170.2", "2801:1b8:10::b"},
+	{"c.root-servers.net", "192.33.4.12", "2001:500:2::c"},
+	{"d.root-servers.net", "199.7.91.13", "2001:500:2d::d"},
+	{"e.root-servers.net", "192.203.230.10", "2001:500:a8::e"},
+	{"f.root-servers.net", "192.5.5.241", "2001:500:2f::f"},
+	{"g.root-servers.net", "192.112.36.4", "2001:500:12::d0d"},
+	{"h.root-servers.net", "198.97.190.53", "2001:500:1::53"},
+	{"i.root-servers.net", "192.36.148.17", "2001:7fe::53"},
+	{"j.root-servers.net", "192.58.128.30", "2001:503:c27::2:30"},
+	{"k.root-servers.net", "193.0.14.129", "2001:7fd::1"},
+	{"l.root-servers.net", "199.7.83.42", "2001:500:9f::42"},
+	{"m.root-servers.net", "202.12.27.33", "2001:dc3::35"},
+}
+
+// defaultRootHints What we use when no hints file has been loaded,
+// all of rootServers.  Every lookup that starts at the root asks
+// them in the order rankNameservers puts them in, which is random
+// until we know how fast each of them is, and moves on to the next
+// one when one doesn't answer, so a single unreachable root server
+// doesn't get in the way.
+func defaultRootHints() *rootHints {
+	hints := &rootHints{glue: make(map[string]map[RTYPE][]RDATA)}
+	for _, server := range rootServers {
+		hints.servers = append(hints.servers, NS_RECORD{server.name + "."})
+		hints.glue[server.name] = map[RTYPE][]RDATA{
+			RTYPE_A:    {A_RECORD{netip.MustParseAddr(server.v4)}},
+			RTYPE_AAAA: {AAAA_RECORD{netip.MustParseAddr(server.v6)}},
+		}
+	}
+	return hints
+}
+
+// initRoot The root hints live in the infrastructure cache and
+// are pinned so they can never go away.
+func (res *Resolver) initRoot() {
+	res.rootLock.Lock()
+	defer res.rootLock.Unlock()
+	res.installRootHints(nil, res.rootInUse())
+}
+
+// rootInUse The root servers that are in the cache, the primed
+// ones if there are any and otherwise the hints.  rootLock needs to
+// be held.
+func (res *Resolver) rootInUse() *rootHints {
+	if res.primed != nil {
+		return res.primed
+	}
+	return res.root
+}
+
+// installRootHints This pins hints in the infrastructure cache in
+// place of old (which may be nil if there is nothing to replace).
+// The new addresses go in before the root NS records which point
+// at them, and the old addresses only come out afterwards, so a
+// lookup running at the same time always finds a usable server.
+// rootLock needs to be held.
+func (res *Resolver) installRootHints(old, hints *rootHints) {
+	for name, types := range hints.glue {
+		for t, data := range types {
+			res.infra.store(name, inKey(t), time.Time{}, data, true)
+		}
+	}
+	res.infra.store(".", inKey(RTYPE_NS), time.Time{}, hints.servers, true)
+	if old == nil {
+		return
+	}
+	for name, types := range old.glue {
+		for t := range types {
+			if _, ok := hints.glue[name][t]; !ok {
+				res.infra.unpin(name, inKey(t))
+			}
+		}
+	}
+}
+
+// LoadRootHints This reads a root hints file in the usual
+// named.root format and replaces the current root hints with it.
+// It can be called at any time, lookups already in progress just
+// carry on with whichever servers they had.  If the file can't be
+// parsed the current hints are left alone.  Whatever priming found
+// is dropped for the new hints, and if Prime has been used the next
+// lookup to start at the root primes again from them.
+func (res *Resolver) LoadRootHints(r io.Reader) error {
+	hints, err := parseRootHints(r)
+	if err != nil {
+		return err
+	}
+	res.rootLock.Lock()
+	defer res.rootLock.Unlock()
+	res.installRootHints(res.rootInUse(), hints)
+	res.root = hints
+	res.primed = nil
+	if res.nextPrime.Load() != 0 {
+		res.nextPrime.Store(time.Now().UnixNano())
+	}
+	return nil
+}
+
+// LoadRootHintsFile This is LoadRootHints for a file on disk, which
+// is then remembered for ReloadRootHints.
+func (res *Resolver) LoadRootHintsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("loading root hints: %w", err)
+	}
+	defer f.Close()
+	if err := res.LoadRootHints(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	res.rootLock.Lock()
+	res.rootHintsPath = path
+	res.rootLock.Unlock()
+	return nil
+}
+
+// ReloadRootHints This reads the file last given to
+// LoadRootHintsFile again, for when it has been updated.
+func (res *Resolver) ReloadRootHints() error {
+	res.rootLock.Lock()
+	path := res.rootHintsPath
+	res.rootLock.Unlock()
+	if path == "" {
+		return fmt.Errorf("reloading root hints: no hints file loaded")
+	}
+	return res.LoadRootHintsFile(path)
+}
+
+// parseRootHints This reads the records out of a hints file.  Each
+// line is "name [ttl] [class] type rdata" with ';' starting a
+// comment.  Only the NS records for "." and the A/AAAA records for
+// the servers they name are used, anything else is ignored.  The
+// TTLs are ignored as well since the hints are pinned.
+func parseRootHints(r io.Reader) (*rootHints, error) {
+	hints := &rootHints{glue: make(map[string]map[RTYPE][]RDATA)}
+	addrs := make(map[string]map[RTYPE][]RDATA)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := cleanName(fields[0])
+		fields = fields[1:]
+		// Skip over the optional TTL and class
+		if len(fields) > 0 {
+			if _, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				fields = fields[1:]
+			}
+		}
+		if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+			fields = fields[1:]
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: malformed record", lineno)
+		}
+		rtype, value := strings.ToUpper(fields[0]), fields[1]
+		switch rtype {
+		case "NS":
+			if name != "." {
+				continue
+			}
+			ns := NS_RECORD{strings.ToLower(value)}
+			if !strings.HasSuffix(ns.NS, ".") {
+				ns.NS += "."
+			}
+			if !containsRDATA(hints.servers, ns) {
+				hints.servers = append(hints.servers, ns)
+			}
+		case "A", "AAAA":
+			addr, err := netip.ParseAddr(value)
+			if err != nil || addr.Is4() != (rtype == "A") {
+				return nil, fmt.Errorf("line %d: bad %s address %q", lineno, rtype, value)
+			}
+			var rdata RDATA = A_RECORD{addr}
+			t := RTYPE_A
+			if rtype == "AAAA" {
+				rdata = AAAA_RECORD{addr}
+				t = RTYPE_AAAA
+			}
+			if addrs[name] == nil {
+				addrs[name] = make(map[RTYPE][]RDATA)
+			}
+			if !containsRDATA(addrs[name][t], rdata) {
+				addrs[name][t] = append(addrs[name][t], rdata)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading root hints: %w", err)
+	}
+	// Only keep the glue for servers that are actually roots, and
+	// insist that every one of them has an address we can use
+	for _, rdata := range hints.servers {
+		server := cleanName(rdata.(NS_RECORD).NS)
+		if len(addrs[server][RTYPE_A]) == 0 && len(addrs[server][RTYPE_AAAA]) == 0 {
+			return nil, fmt.Errorf("root hints: no address for %s", server)
+		}
+		hints.glue[server] = addrs[server]
+	}
+	if len(hints.servers) == 0 {
+		return nil, fmt.Errorf("root hints: no NS records for the root")
+	}
+	return hints, nil
+}
+
+// PrimeWindow How long before what the last priming query got
+// expires a lookup that starts at the root primes again (in the
+// background), and PrimeRetry how long to wait before trying again
+// when priming fails.  These are DefaultResolver's, see WithPriming
+// for the others.
+var PrimeWindow = time.Hour
+var PrimeRetry = time.Minute
+
+// WithPriming This is PrimeWindow and PrimeRetry for the Resolver.
+func WithPriming(window, retry time.Duration) Option {
+	return func(res *Resolver) {
+		*res.primeWindow, *res.primeRetry = window, retry
+	}
+}
+
+// Prime This sends a priming query (RFC 8109) for the root's NS
+// records to the root servers we know of, and puts the servers and
+// glue it gets back in place of the root hints.  The hints are only
+// a starting point and can be years old, whereas the roots know who
+// they currently are.  It is meant to be called once at startup, and
+// from then on lookups that start at the root prime again in the
+// background when the answer nears the end of its TTL (see
+// PrimeWindow).  If priming keeps failing until the answer expires
+// we go back to the hints.
+//
+// Servers the answer has no glue for are left out.  The error is a
+// *ServerFailureError if none of the servers gave us an answer with
+// at least one server we can reach in it, or ctx.Err() if ctx is
+// done first.
+func (res *Resolver) Prime(ctx context.Context) error {
+	var addrs []netip.Addr
+	if entry, _ := res.infra.peek(".", inKey(RTYPE_NS)); entry != nil {
+		addrs = res.rankNameservers(entry.data)
+	}
+	msg := res.askServers(ctx, addrs, ".", RTYPE_NS)
+	if ctx.Err() != nil && msg == nil {
+		return ctx.Err()
+	}
+	failure := &ServerFailureError{Name: ".", Type: RTYPE_NS, Zone: ".", Rcode: RCODE_SERVFAIL, Timeout: msg == nil}
+	if msg != nil && serverFailed(msg.Header.Status) {
+		failure.Rcode = msg.Header.Status
+	}
+	if msg == nil || serverFailed(msg.Header.Status) {
+		res.nextPrime.Store(time.Now().Add(*res.primeRetry).UnixNano())
+		return failure
+	}
+	primed, ttl := primingHints(msg)
+	if primed == nil {
+		res.nextPrime.Store(time.Now().Add(*res.primeRetry).UnixNano())
+		return failure
+	}
+	expires := res.clampExpires(ttlExpires(ttl))
+	res.rootLock.Lock()
+	defer res.rootLock.Unlock()
+	res.installRootHints(res.rootInUse(), primed)
+	res.primed = primed
+	res.primedExpires = expires
+	res.nextPrime.Store(expires.Add(-*res.primeWindow).UnixNano())
+	return nil
+}
+
+// primingHints This turns the answer to a priming query into root
+// hints, along with the lowest TTL of the records in them.  It
+// returns nil if the answer has no server we have an address for.
+func primingHints(msg *DNSMessage) (*rootHints, uint32) {
+	ttl := uint32(math.MaxUint32)
+	var servers []RDATA
+	for _, answer := range msg.Answers {
+		ns, ok := answer.RData.(NS_RECORD)
+		if !ok || cleanName(answer.RName) != "." {
+			continue
+		}
+		ns.NS = strings.ToLower(ns.NS)
+		if !strings.HasSuffix(ns.NS, ".") {
+			ns.NS += "."
+		}
+		if !containsRDATA(servers, ns) {
+			servers = append(servers, ns)
+		}
+		ttl = min(ttl, answer.TTL)
+	}
+	addrs := make(map[string]map[RTYPE][]RDATA)
+	addrTTLs := make(map[string]uint32)
+	for _, additional := range msg.Additionals {
+		switch additional.RData.(type) {
+		case A_RECORD, AAAA_RECORD:
+		default:
+			continue
+		}
+		name := cleanName(additional.RName)
+		if addrs[name] == nil {
+			addrs[name] = make(map[RTYPE][]RDATA)
+			addrTTLs[name] = math.MaxUint32
+		}
+		if !containsRDATA(addrs[name][additional.RType], additional.RData) {
+			addrs[name][additional.RType] = append(addrs[name][additional.RType], additional.RData)
+		}
+		addrTTLs[name] = min(addrTTLs[name], additional.TTL)
+	}
+	hints := &rootHints{glue: make(map[string]map[RTYPE][]RDATA)}
+	for _, rdata := range servers {
+		server := cleanName(rdata.(NS_RECORD).NS)
+		if len(addrs[server]) == 0 {
+			continue
+		}
+		hints.servers = append(hints.servers, rdata)
+		hints.glue[server] = addrs[server]
+		ttl = min(ttl, addrTTLs[server])
+	}
+	if len(hints.servers) == 0 {
+		return nil, 0
+	}
+	return hints, ttl
+}
+
+// maybePrime This primes again in the background if it is time to
+// (see Prime).  Only one priming query is ever going at once.
+func (res *Resolver) maybePrime() {
+	next := res.nextPrime.Load()
+	if next == 0 || time.Now().UnixNano() < next {
+		return
+	}
+	if !res.priming.CompareAndSwap(false, true) {
+		return
+	}
+	started := res.background(func(ctx context.Context) {
+		defer res.priming.Store(false)
+		res.reprime(ctx)
+	})
+	if !started {
+		res.priming.Store(false)
+	}
+}
+
+// reprime This is Prime for maybePrime, going back to the hints if
+// it fails and what the last priming got has expired.
+func (res *Resolver) reprime(ctx context.Context) {
+	if res.Prime(ctx) == nil {
+		return
+	}
+	res.rootLock.Lock()
+	defer res.rootLock.Unlock()
+	if res.primed != nil && time.Now().After(res.primedExpires) {
+		res.installRootHints(res.primed, res.root)
+		res.primed = nil
+	}
+}
@@ -0,0 +1,218 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// singleRoot Root hints with just a.root-servers.net, which is the
+// only root server the fake servers in most of the tests know about
+// (and ask the same server every time).
+const singleRoot = ".  NS  a.root-servers.net.\na.root-servers.net.  A  198.41.0.4\n"
+
+// withSingleRoot This gives res the singleRoot hints.
+func withSingleRoot(res *Resolver) *Resolver {
+	if err := res.LoadRootHints(strings.NewReader(singleRoot)); err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// resetRootHints This puts back the singleRoot hints so the other
+// tests aren't affected.
+func resetRootHints() {
+	withSingleRoot(DefaultResolver)
+	DefaultResolver.rootLock.Lock()
+	DefaultResolver.rootHintsPath = ""
+	DefaultResolver.rootLock.Unlock()
+}
+
+func TestLoadRootHints(t *testing.T) {
+	initTestsData(4)
+	defer resetRootHints()
+	if err := LoadRootHintsFile("../data/named.root"); err != nil {
+		t.Fatalf("LoadRootHintsFile: %v", err)
+	}
+	entry := DefaultResolver.infraLookup(".", RTYPE_NS)
+	if entry == nil || len(entry.data) != 13 {
+		t.Fatalf("expected 13 root servers, got %v", entry)
+	}
+	for _, letter := range "abcdefghijklm" {
+		server := string(letter) + ".root-servers.net"
+		if DefaultResolver.infraLookup(server, RTYPE_A) == nil || DefaultResolver.infraLookup(server, RTYPE_AAAA) == nil {
+			t.Errorf("missing glue for %s", server)
+		}
+	}
+	m := DefaultResolver.infraLookup("m.root-servers.net", RTYPE_AAAA)
+	if m.data[0].(AAAA_RECORD).AAAA != parseAddrNoerror("2001:dc3::35") {
+		t.Errorf("wrong AAAA for m.root-servers.net: %v", m.data)
+	}
+
+	// The hints survive a flush and starting the cache over
+	FlushSubtree(".")
+	InitCache(4)
+	if entry := DefaultResolver.infraLookup(".", RTYPE_NS); entry == nil || len(entry.data) != 13 {
+		t.Errorf("root hints lost after InitCache, got %v", entry)
+	}
+}
+
+func TestReloadRootHints(t *testing.T) {
+	initTestsData(4)
+	defer resetRootHints()
+	if err := ReloadRootHints(); err == nil {
+		t.Errorf("expected an error reloading with no hints file")
+	}
+
+	path := filepath.Join(t.TempDir(), "named.root")
+	hints := ".  3600000  NS  B.ROOT-SERVERS.NET.\n" +
+		"B.ROOT-SERVERS.NET.  3600000  A  170.247.170.2\n"
+	if err := os.WriteFile(path, []byte(hints), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadRootHintsFile(path); err != nil {
+		t.Fatalf("LoadRootHintsFile: %v", err)
+	}
+	// a.root-servers.net was only there because of the old hints
+	if DefaultResolver.infraLookup("a.root-servers.net", RTYPE_A) != nil {
+		t.Errorf("stale root glue was not removed")
+	}
+
+	hints = "; renumbered\n" +
+		".  IN  NS  B.ROOT-SERVERS.NET.\n" +
+		"B.ROOT-SERVERS.NET.  IN  A  192.0.2.2\n"
+	if err := os.WriteFile(path, []byte(hints), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadRootHints(); err != nil {
+		t.Fatalf("ReloadRootHints: %v", err)
+	}
+	entry := DefaultResolver.infraLookup("b.root-servers.net", RTYPE_A)
+	if entry == nil || entry.data[0].(A_RECORD).A != parseAddrNoerror("192.0.2.2") {
+		t.Errorf("reload did not pick up the new address, got %v", entry)
+	}
+
+	// A broken file leaves the current hints in place
+	if err := os.WriteFile(path, []byte(".  NS  C.ROOT-SERVERS.NET.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadRootHints(); err == nil {
+		t.Errorf("expected an error for a server with no address")
+	}
+	if err := LoadRootHints(strings.NewReader("garbage\n")); err == nil {
+		t.Errorf("expected an error for a malformed line")
+	}
+	entry = DefaultResolver.infraLookup(".", RTYPE_NS)
+	if entry == nil || entry.data[0].(NS_RECORD).NS != "b.root-servers.net." {
+		t.Errorf("bad hints replaced the good ones, got %v", entry)
+	}
+}
+
+func TestPrime(t *testing.T) {
+	var fail atomic.Bool
+	res := New()
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if fail.Load() {
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_SERVFAIL}}
+		}
+		if request.name != "." || request.qtype != RTYPE_NS {
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+			}}}
+		}
+		return &DNSMessage{
+			Answers: []DNSAnswer{
+				{RName: ".", RType: RTYPE_NS, TTL: 518400, RData: NS_RECORD{"A.ROOT-SERVERS.NET."}},
+				{RName: ".", RType: RTYPE_NS, TTL: 518400, RData: NS_RECORD{"b.root-servers.net."}},
+				// no glue, so it gets left out
+				{RName: ".", RType: RTYPE_NS, TTL: 518400, RData: NS_RECORD{"c.root-servers.net."}},
+			},
+			Additionals: []DNSAnswer{
+				{RName: "a.root-servers.net", RType: RTYPE_A, TTL: 518400, RData: A_RECORD{parseAddrNoerror("198.41.0.4")}},
+				{RName: "b.root-servers.net", RType: RTYPE_A, TTL: 3600, RData: A_RECORD{parseAddrNoerror("170.247.170.2")}},
+				{RName: "b.root-servers.net", RType: RTYPE_AAAA, TTL: 518400, RData: AAAA_RECORD{parseAddrNoerror("2801:1b8:10::b")}},
+			},
+		}
+	})
+	if err := res.Prime(context.Background()); err != nil {
+		t.Fatalf("Prime: %v", err)
+	}
+	entry := res.infraLookup(".", RTYPE_NS)
+	if entry == nil || !slices.Equal(entry.data, []RDATA{NS_RECORD{"a.root-servers.net."}, NS_RECORD{"b.root-servers.net."}}) {
+		t.Fatalf("expected the primed root servers, got %v", entry)
+	}
+	if res.infraLookup("b.root-servers.net", RTYPE_AAAA) == nil {
+		t.Errorf("missing glue for b.root-servers.net")
+	}
+	// the lowest TTL says when to prime again
+	next := time.Unix(0, res.nextPrime.Load())
+	if want := time.Now().Add(time.Hour - PrimeWindow); next.After(want) || next.Before(want.Add(-time.Minute)) {
+		t.Errorf("next priming at %v, want about %v", next, want)
+	}
+
+	// priming failing before the answer expires changes nothing,
+	// and once it has expired takes us back to the hints
+	fail.Store(true)
+	res.reprime(context.Background())
+	if entry := res.infraLookup(".", RTYPE_NS); entry == nil || len(entry.data) != 2 {
+		t.Errorf("failed priming dropped the primed servers, got %v", entry)
+	}
+	res.rootLock.Lock()
+	res.primedExpires = time.Now().Add(-time.Second)
+	res.rootLock.Unlock()
+	res.reprime(context.Background())
+	if entry := res.infraLookup(".", RTYPE_NS); entry == nil || len(entry.data) != 13 {
+		t.Errorf("expected to be back on the hints, got %v", entry)
+	}
+	if entry := res.infraLookup("b.root-servers.net", RTYPE_A); entry == nil || entry.data[0].(A_RECORD).A != parseAddrNoerror("170.247.170.2") {
+		t.Errorf("expected the glue from the hints, got %v", entry)
+	}
+	if time.Until(time.Unix(0, res.nextPrime.Load())) > PrimeRetry {
+		t.Errorf("failed priming should be retried within PrimeRetry")
+	}
+}
+
+func TestRootFailover(t *testing.T) {
+	res := New(WithDefaultRetryPolicy(RetryPolicy{Timeout: 20 * time.Millisecond}))
+	if entry := res.infraLookup(".", RTYPE_NS); entry == nil || len(entry.data) != 13 {
+		t.Fatalf("expected all 13 root servers, got %v", entry)
+	}
+	for _, server := range rootServers {
+		if res.infraLookup(server.name, RTYPE_A) == nil || res.infraLookup(server.name, RTYPE_AAAA) == nil {
+			t.Errorf("missing glue for %s", server.name)
+		}
+	}
+	// a.root-servers.net is down, the others all answer
+	var lock sync.Mutex
+	asked := make(map[netip.Addr]bool)
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		lock.Lock()
+		asked[addr] = true
+		lock.Unlock()
+		if addr == parseAddrNoerror("198.41.0.4") {
+			return nil
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+		}}}
+	})
+	for i := range 20 {
+		name := fmt.Sprintf("host%d.example.com", i)
+		if result, err := res.Lookup(name, RTYPE_A); err != nil || len(result) != 1 {
+			t.Errorf("%s: unexpected result %v, %v", name, result, err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(asked) < 2 {
+		t.Errorf("expected the lookups to be spread over the roots, asked %v", asked)
+	}
+}
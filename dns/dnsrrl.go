@@ -0,0 +1,179 @@
+package dns
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ResponseRateLimit Response Rate Limiting for a Server's answers
+// over UDP, so it can't be used to flood somebody else with
+// responses to queries sent in their name.  Responses are counted
+// per client network (the client's address cut down to IPv4Prefix
+// or IPv6Prefix bits), name and type, with every error response
+// to a network counted together, each in a token bucket holding up
+// to Burst responses (Rate if 0, and at least 1) and filling back
+// up at Rate a second.  A response finding its bucket empty isn't sent, except
+// for every Slip-th one, which goes out truncated instead so that
+// a real client whose address is being forged asks again over TCP
+// and still gets its answer (0 means never, 1 always).  Clients in
+// Exempt are never limited, and nor is anything over TCP or HTTPS,
+// where the address can't be forged.  A Rate of 0 or less means no
+// limit.  At most MaxEntries buckets (DefaultRRLMaxEntries if 0) are
+// kept, like BIND's max-table-size, so a flood of queries for
+// different names from different networks can't use up the
+// Server's memory: once that many are in use, responses that would
+// need a new one are limited as if they all shared a bucket that is
+// always empty, until the buckets that have filled back up are
+// thrown away.
+type ResponseRateLimit struct {
+	Rate       float64
+	Burst      int
+	Slip       int
+	IPv4Prefix int
+	IPv6Prefix int
+	Exempt     []netip.Prefix
+	MaxEntries int
+}
+
+// DefaultRRLIPv4Prefix and DefaultRRLIPv6Prefix How much of the
+// client's address makes up its network for a ResponseRateLimit
+// without IPv4Prefix or IPv6Prefix
+const (
+	DefaultRRLIPv4Prefix = 24
+	DefaultRRLIPv6Prefix = 56
+)
+
+// DefaultRRLMaxEntries The most buckets a ResponseRateLimit without
+// MaxEntries keeps
+const DefaultRRLMaxEntries = 20000
+
+// rrlSweep How often the buckets that have filled back up are
+// thrown away
+const rrlSweep = time.Minute
+
+// rrlKey What a response is counted under.  Error responses have
+// no name or type.
+type rrlKey struct {
+	network netip.Prefix
+	name    string
+	qtype   RTYPE
+}
+
+type rrlBucket struct {
+	bucket tokenBucket
+	// how many responses have been held back, under bucket.lock
+	dropped int
+}
+
+// rrlTable The buckets for a Server's ResponseRateLimit, under
+// lock.  overflow is what the responses that find the table full
+// count their drops in.
+type rrlTable struct {
+	lock      sync.Mutex
+	buckets   map[rrlKey]*rrlBucket
+	lastSweep time.Time
+	overflow  rrlBucket
+}
+
+// limit What to do with response, to client, going by the
+// ResponseRateLimit: send it, send it truncated (slip) or neither.
+func (srv *Server) limit(client netip.Addr, response *DNSMessage, now time.Time) (send, slip bool) {
+	limit := srv.RateLimit
+	if limit.Rate <= 0 || !client.IsValid() {
+		return true, false
+	}
+	for _, prefix := range limit.Exempt {
+		if prefix.Contains(client) {
+			return true, false
+		}
+	}
+	bits := limit.IPv4Prefix
+	if bits <= 0 {
+		bits = DefaultRRLIPv4Prefix
+	}
+	if client.Is6() {
+		bits = limit.IPv6Prefix
+		if bits <= 0 {
+			bits = DefaultRRLIPv6Prefix
+		}
+	}
+	network, _ := client.Prefix(min(bits, client.BitLen()))
+	key := rrlKey{network: network}
+	if response.Header.Status == RCODE_OK {
+		key.name, key.qtype = cleanName(response.Question.QName), response.Question.QType
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = max(int(limit.Rate), 1)
+	}
+	maxEntries := limit.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultRRLMaxEntries
+	}
+	bucket, ok := srv.rrl.bucket(key, now, float64(burst)/limit.Rate, maxEntries)
+	if !ok {
+		bucket = &srv.rrl.overflow
+	} else if _, ok := bucket.bucket.reserve(RateLimit{Rate: limit.Rate, Burst: burst}, now); ok {
+		return true, false
+	}
+	bucket.bucket.lock.Lock()
+	defer bucket.bucket.lock.Unlock()
+	bucket.dropped++
+	return false, limit.Slip > 0 && bucket.dropped%limit.Slip == 0
+}
+
+// bucket The bucket for key, made if need be, and false if there
+// isn't one and the table already has maxEntries.  Every rrlSweep
+// the buckets that haven't been used for refill seconds, so are
+// full again, are thrown away, and so they are when the table is
+// full if it has been refill seconds since the last time, which is
+// how long it takes any bucket to fill back up.
+func (t *rrlTable) bucket(key rrlKey, now time.Time, refill float64, maxEntries int) (*rrlBucket, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.buckets == nil {
+		t.buckets = make(map[rrlKey]*rrlBucket)
+		t.lastSweep = now
+	}
+	idle := time.Duration(refill * float64(time.Second))
+	if now.Sub(t.lastSweep) > rrlSweep {
+		t.sweep(now, idle)
+	}
+	b := t.buckets[key]
+	if b != nil {
+		return b, true
+	}
+	if len(t.buckets) >= maxEntries && now.Sub(t.lastSweep) > idle {
+		t.sweep(now, idle)
+	}
+	if len(t.buckets) >= maxEntries {
+		return nil, false
+	}
+	b = &rrlBucket{}
+	t.buckets[key] = b
+	return b, true
+}
+
+// sweep This throws away the buckets that haven't been used for
+// idle.  t.lock has to be held.
+func (t *rrlTable) sweep(now time.Time, idle time.Duration) {
+	t.lastSweep = now
+	for k, b := range t.buckets {
+		b.bucket.lock.Lock()
+		full := now.Sub(b.bucket.last) > idle
+		b.bucket.lock.Unlock()
+		if full {
+			delete(t.buckets, k)
+		}
+	}
+}
+
+// truncated This is response as it goes when it slips: just the
+// header and question, with TC set.
+func truncated(response *DNSMessage) []byte {
+	slipped := &DNSMessage{Header: response.Header, Question: response.Question, EDNS: response.EDNS}
+	slipped.Header.Truncated = true
+	out, _ := packMessage(slipped)
+	return out
+}
@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestResponseRateLimit(t *testing.T) {
+	srv := &Server{RateLimit: ResponseRateLimit{Rate: 2, Burst: 2, Slip: 2, Exempt: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}}
+	now := time.Unix(1700000000, 0)
+	answer := func(name string) *DNSMessage {
+		return &DNSMessage{Question: DNSQuestion{QName: name, QType: RTYPE_A, QClass: IN}}
+	}
+	failure := func(name string) *DNSMessage {
+		msg := answer(name)
+		msg.Header.Status = RCODE_SERVFAIL
+		return msg
+	}
+	client := netip.MustParseAddr("198.51.100.7")
+	type result struct{ send, slip bool }
+	check := func(what string, client netip.Addr, response *DNSMessage, want result) {
+		t.Helper()
+		if send, slip := srv.limit(client, response, now); (result{send, slip}) != want {
+			t.Errorf("%s: got send %v slip %v, want %+v", what, send, slip, want)
+		}
+	}
+	check("first", client, answer("example.com"), result{true, false})
+	check("second", client, answer("Example.com."), result{true, false})
+	check("third", client, answer("example.com"), result{false, false})
+	check("fourth", client, answer("example.com"), result{false, true})
+	// the rest of the network shares the bucket, other networks
+	// and names don't
+	check("same network", netip.MustParseAddr("198.51.100.200"), answer("example.com"), result{false, false})
+	check("other network", netip.MustParseAddr("198.51.101.7"), answer("example.com"), result{true, false})
+	check("other name", client, answer("www.example.com"), result{true, false})
+	check("exempt", netip.MustParseAddr("192.0.2.1"), answer("example.com"), result{true, false})
+	// every error counts together
+	check("error", client, failure("a.example.com"), result{true, false})
+	check("error", client, failure("b.example.com"), result{true, false})
+	check("error", client, failure("c.example.com"), result{false, false})
+
+	// a second later there is room for two more
+	now = now.Add(time.Second)
+	check("refilled", client, answer("example.com"), result{true, false})
+	check("refilled", client, answer("example.com"), result{true, false})
+	// it is the bucket's fourth response held back, so it slips
+	check("refilled", client, answer("example.com"), result{false, true})
+
+	// the full buckets go once they haven't been used for a while
+	now = now.Add(2 * rrlSweep)
+	check("after sweeping", netip.MustParseAddr("2001:db8:1:2::1"), answer("example.com"), result{true, false})
+	srv.rrl.lock.Lock()
+	if n := len(srv.rrl.buckets); n != 1 {
+		t.Errorf("%d buckets left", n)
+	}
+	srv.rrl.lock.Unlock()
+
+	slipped, err := unpackMessage(truncated(&DNSMessage{Header: DNSHeader{ID: 9, Response: true}, Question: answer("example.com").Question, Answers: []DNSAnswer{{
+		RName: "example.com", RType: RTYPE_A, RClass: IN, TTL: 60, RData: A_RECORD{netip.MustParseAddr("192.0.2.1")},
+	}}}))
+	if err != nil || !slipped.Header.Truncated || slipped.Header.ID != 9 || len(slipped.Answers) != 0 || slipped.Question.QName != "example.com" {
+		t.Errorf("unexpected slipped response %+v, %v", slipped, err)
+	}
+}
+
+func TestResponseRateLimitTableSize(t *testing.T) {
+	srv := &Server{RateLimit: ResponseRateLimit{Rate: 1, Slip: 2, MaxEntries: 100}}
+	now := time.Unix(1700000000, 0)
+	client := netip.MustParseAddr("198.51.100.7")
+	answer := func(name string) *DNSMessage {
+		return &DNSMessage{Question: DNSQuestion{QName: name, QType: RTYPE_A, QClass: IN}}
+	}
+	// a flood of queries for different names, each from a network
+	// of its own
+	sent, slipped := 0, 0
+	for i := range 1000 {
+		from := netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 1})
+		send, slip := srv.limit(from, answer(fmt.Sprintf("host%d.example.com", i)), now)
+		if send {
+			sent++
+		}
+		if slip {
+			slipped++
+		}
+	}
+	srv.rrl.lock.Lock()
+	n := len(srv.rrl.buckets)
+	srv.rrl.lock.Unlock()
+	if n != 100 {
+		t.Errorf("%d buckets after the flood, want 100", n)
+	}
+	// only the ones that got a bucket were sent, and every second
+	// one of the rest slipped
+	if sent != 100 || slipped != 450 {
+		t.Errorf("%d sent and %d slipped, want 100 and 450", sent, slipped)
+	}
+	// clients that already have a bucket go on as before
+	if send, _ := srv.limit(netip.MustParseAddr("10.0.0.1"), answer("host0.example.com"), now.Add(time.Second)); !send {
+		t.Errorf("a client with a bucket was limited")
+	}
+	// and once the buckets fill back up there is room again
+	now = now.Add(2 * time.Second)
+	if send, _ := srv.limit(client, answer("example.com"), now); !send {
+		t.Errorf("a new client was still limited after the flood")
+	}
+	srv.rrl.lock.Lock()
+	n = len(srv.rrl.buckets)
+	srv.rrl.lock.Unlock()
+	if n != 2 {
+		t.Errorf("%d buckets after sweeping, want 2", n)
+	}
+}
@@ -0,0 +1,52 @@
+package dns
+
+import "strings"
+
+// SearchDomains and Ndots These work like search and options ndots
+// in resolv.conf, for DefaultResolver.  A name which doesn't end in
+// a '.' and has fewer than Ndots dots in it is tried with each of
+// SearchDomains on the end, in order, before being tried as it is,
+// so "db01" can be looked up as "db01.corp.example.com".  A name
+// with at least Ndots dots is tried as it is first, and one ending
+// in a '.' is only ever tried as it is.  Resolvers made by New have
+// their own, see WithSearch.
+var SearchDomains []string
+var Ndots = 1
+
+// WithSearch This sets the search domains and ndots threshold, like
+// SearchDomains and Ndots do for DefaultResolver.
+func WithSearch(ndots int, domains ...string) Option {
+	return func(res *Resolver) {
+		*res.search = domains
+		*res.ndots = ndots
+	}
+}
+
+// searchNames The names to try, in order, when asked to look up
+// name (see SearchDomains).
+func (res *Resolver) searchNames(name string) []string {
+	domains := *res.search
+	if strings.HasSuffix(name, ".") || len(domains) == 0 {
+		return []string{name}
+	}
+	names := make([]string, 0, len(domains)+1)
+	for _, domain := range domains {
+		domain = strings.Trim(domain, ".")
+		if domain != "" {
+			names = append(names, name+"."+domain)
+		}
+	}
+	if strings.Count(name, ".") >= *res.ndots {
+		return append([]string{name}, names...)
+	}
+	return append(names, name)
+}
+
+// absolute This puts the trailing '.' on name, if it hasn't got
+// one already, so that it isn't tried with the search domains.
+func absolute(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestSearchNames(t *testing.T) {
+	res := New(WithSearch(2, "corp.example.com", "example.com."))
+	for _, test := range []struct {
+		name string
+		want []string
+	}{
+		{"db01", []string{"db01.corp.example.com", "db01.example.com", "db01"}},
+		{"db01.eu", []string{"db01.eu.corp.example.com", "db01.eu.example.com", "db01.eu"}},
+		{"www.example.org", []string{"www.example.org", "www.example.org.corp.example.com", "www.example.org.example.com"}},
+		{"db01.", []string{"db01."}},
+	} {
+		if names := res.searchNames(test.name); !slices.Equal(names, test.want) {
+			t.Errorf("searchNames(%q) = %v, want %v", test.name, names, test.want)
+		}
+	}
+	if names := New().searchNames("db01"); !slices.Equal(names, []string{"db01"}) {
+		t.Errorf("searchNames without search domains = %v", names)
+	}
+}
+
+func TestSearchDomains(t *testing.T) {
+	res := New(WithSearch(1, "eu.example.com", "corp.example.com"))
+	var asked []string
+	requests := make(chan string, 10)
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		requests <- request.name
+		if request.name != "db01.corp.example.com" {
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_NXNAME}}
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+		}}}
+	})
+
+	result, err := res.Lookup("db01", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RName != "db01.corp.example.com" {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	for len(requests) > 0 {
+		asked = append(asked, <-requests)
+	}
+	if want := []string{"db01.eu.example.com", "db01.corp.example.com"}; !slices.Equal(asked, want) {
+		t.Errorf("asked for %v, want %v", asked, want)
+	}
+	// with the trailing '.' it is only tried as it is
+	if result, _ := res.Lookup("db01.", RTYPE_A); len(result) != 0 {
+		t.Errorf("unexpected result %v", result)
+	}
+}
@@ -0,0 +1,253 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The DNSSEC record types (RFC 4034).  This resolver doesn't validate
+// answers itself, it just keeps these around (in the cache and in
+// the answers) so a validation layer can be built on top.  The one
+// thing it does check signatures on is the root's keys, to keep its
+// trust anchors up to date (see StartTrustAnchorUpdates).
+
+// DNSKEY_RECORD A zone's public key.  Flags 256 marks a zone key
+// and 257 a key signing key (the SEP bit), Protocol is always 3.
+type DNSKEY_RECORD struct {
+	Flags     uint16 `json:"flags"`
+	Protocol  uint8  `json:"protocol"`
+	Algorithm uint8  `json:"algorithm"`
+	PublicKey []byte `json:"public_key"`
+}
+
+func (k DNSKEY_RECORD) Dummy() {
+}
+
+func (k DNSKEY_RECORD) String() string {
+	return fmt.Sprintf("%v %v %v %x", k.Flags, k.Protocol, k.Algorithm, k.PublicKey)
+}
+
+// KeyTag This computes the key tag which DS and RRSIG records use
+// to say which key they mean (RFC 4034 appendix B).  Note that it
+// is only a hint, different keys can have the same tag.
+func (k DNSKEY_RECORD) KeyTag() uint16 {
+	rdata := make([]byte, 4, 4+len(k.PublicKey))
+	binary.BigEndian.PutUint16(rdata, k.Flags)
+	rdata[2] = k.Protocol
+	rdata[3] = k.Algorithm
+	rdata = append(rdata, k.PublicKey...)
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// DS_RECORD The digest of a child zone's key, held by the parent
+type DS_RECORD struct {
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     []byte `json:"digest"`
+}
+
+func (d DS_RECORD) Dummy() {
+}
+
+func (d DS_RECORD) String() string {
+	return fmt.Sprintf("%v %v %v %x", d.KeyTag, d.Algorithm, d.DigestType, d.Digest)
+}
+
+// RRSIG_RECORD The signature over the TypeCovered RRset at the same
+// name.  Expiration and Inception are seconds since the epoch, mod
+// 2^32, see ValidAt.
+type RRSIG_RECORD struct {
+	TypeCovered RTYPE  `json:"type_covered"`
+	Algorithm   uint8  `json:"algorithm"`
+	Labels      uint8  `json:"labels"`
+	OriginalTTL uint32 `json:"original_ttl"`
+	Expiration  uint32 `json:"expiration"`
+	Inception   uint32 `json:"inception"`
+	KeyTag      uint16 `json:"key_tag"`
+	SignerName  string `json:"signer_name"`
+	Signature   []byte `json:"signature"`
+}
+
+func (s RRSIG_RECORD) Dummy() {
+}
+
+func (s RRSIG_RECORD) String() string {
+	return fmt.Sprintf("%v %v %v %v %v %v %v %s %x", s.TypeCovered, s.Algorithm, s.Labels,
+		s.OriginalTTL, s.Expiration, s.Inception, s.KeyTag, s.SignerName, s.Signature)
+}
+
+// ValidAt This says whether now is inside the signature's validity
+// period.  The times wrap around in 2106 so they are compared using
+// serial number arithmetic (RFC 1982) rather than directly.
+func (s RRSIG_RECORD) ValidAt(now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(t-s.Inception) >= 0 && int32(s.Expiration-t) >= 0
+}
+
+// NSEC_RECORD Proof of what doesn't exist (RFC 4034): there are no
+// names between the owner and NextDomain in the zone's canonical
+// order, and the owner itself only has the types in TypeBitmap.
+// The bitmap is kept in its wire form, see Types.
+type NSEC_RECORD struct {
+	NextDomain string `json:"next_domain"`
+	TypeBitmap []byte `json:"type_bitmap"`
+}
+
+func (n NSEC_RECORD) Dummy() {
+}
+
+func (n NSEC_RECORD) String() string {
+	return n.NextDomain + typeBitmapString(n.TypeBitmap)
+}
+
+// Types This returns the types in the bitmap, in order
+func (n NSEC_RECORD) Types() ([]RTYPE, error) {
+	return typeBitmapTypes(n.TypeBitmap)
+}
+
+// HasType Whether t is in the bitmap.  A malformed bitmap has
+// nothing in it.
+func (n NSEC_RECORD) HasType(t RTYPE) bool {
+	return typeBitmapHas(n.TypeBitmap, t)
+}
+
+// NSEC3_RECORD The hashed version of NSEC (RFC 5155), which says
+// there are no names whose hash falls between the owner's hash (the
+// first label of the owner name) and NextHashed.  See NSEC3Hash for
+// how names are hashed.
+type NSEC3_RECORD struct {
+	HashAlgorithm uint8  `json:"hash_algorithm"`
+	Flags         uint8  `json:"flags"`
+	Iterations    uint16 `json:"iterations"`
+	Salt          []byte `json:"salt"`
+	NextHashed    []byte `json:"next_hashed"`
+	TypeBitmap    []byte `json:"type_bitmap"`
+}
+
+func (n NSEC3_RECORD) Dummy() {
+}
+
+func (n NSEC3_RECORD) String() string {
+	salt := "-"
+	if len(n.Salt) > 0 {
+		salt = fmt.Sprintf("%x", n.Salt)
+	}
+	return fmt.Sprintf("%v %v %v %s %s", n.HashAlgorithm, n.Flags, n.Iterations, salt,
+		nsec3Encoding.EncodeToString(n.NextHashed)) + typeBitmapString(n.TypeBitmap)
+}
+
+// OptOut Whether the record may cover unsigned delegations, in
+// which case it doesn't prove they don't exist.
+func (n NSEC3_RECORD) OptOut() bool {
+	return n.Flags&1 != 0
+}
+
+// Types This returns the types in the bitmap, in order
+func (n NSEC3_RECORD) Types() ([]RTYPE, error) {
+	return typeBitmapTypes(n.TypeBitmap)
+}
+
+// HasType Whether t is in the bitmap
+func (n NSEC3_RECORD) HasType(t RTYPE) bool {
+	return typeBitmapHas(n.TypeBitmap, t)
+}
+
+// Covers Whether name hashes to somewhere strictly between the
+// owner (whose first label is its hash) and NextHashed, meaning
+// name doesn't exist.  The last record in the zone wraps around
+// to the first.
+func (n NSEC3_RECORD) Covers(owner, name string) bool {
+	label, _, _ := strings.Cut(cleanName(owner), ".")
+	ownerHash, err := nsec3Encoding.DecodeString(strings.ToUpper(label))
+	if err != nil || n.HashAlgorithm != 1 {
+		return false
+	}
+	hash := NSEC3Hash(name, n.Salt, n.Iterations)
+	if bytes.Compare(ownerHash, n.NextHashed) < 0 {
+		return bytes.Compare(ownerHash, hash) < 0 && bytes.Compare(hash, n.NextHashed) < 0
+	}
+	return bytes.Compare(ownerHash, hash) < 0 || bytes.Compare(hash, n.NextHashed) < 0
+}
+
+// nsec3Encoding NSEC3 owner names are the hash in base32 with the
+// extended hex alphabet and no padding.
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// NSEC3Hash This hashes name the way NSEC3 does (SHA-1 is the only
+// algorithm there is): the name in lower case wire form plus the
+// salt, then iterations more times over the previous hash plus the
+// salt.  The first label of an NSEC3 owner name is this in base32hex.
+func NSEC3Hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.New()
+	h.Write(canonicalWireName(name))
+	h.Write(salt)
+	hash := h.Sum(nil)
+	for i := uint16(0); i < iterations; i++ {
+		h.Reset()
+		h.Write(hash)
+		h.Write(salt)
+		hash = h.Sum(hash[:0])
+	}
+	return hash
+}
+
+// typeBitmapTypes This picks apart the type bitmap of an NSEC or
+// NSEC3 record.  It is a series of windows, each being the window
+// number (the high byte of the types in it), the length of the
+// bitmap and then the bitmap itself with the most significant bit
+// of the first byte being the lowest type.
+func typeBitmapTypes(bitmap []byte) ([]RTYPE, error) {
+	var types []RTYPE
+	for len(bitmap) > 0 {
+		if len(bitmap) < 2 {
+			return nil, fmt.Errorf("dns: malformed type bitmap")
+		}
+		window, n := int(bitmap[0]), int(bitmap[1])
+		if n == 0 || n > 32 || n+2 > len(bitmap) {
+			return nil, fmt.Errorf("dns: malformed type bitmap")
+		}
+		for i, b := range bitmap[2 : n+2] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, RTYPE(window<<8|i*8+bit))
+				}
+			}
+		}
+		bitmap = bitmap[n+2:]
+	}
+	return types, nil
+}
+
+func typeBitmapHas(bitmap []byte, t RTYPE) bool {
+	types, _ := typeBitmapTypes(bitmap)
+	return slices.Contains(types, t)
+}
+
+// typeBitmapString The types for String, each preceded by a space
+func typeBitmapString(bitmap []byte) string {
+	types, err := typeBitmapTypes(bitmap)
+	if err != nil {
+		return fmt.Sprintf(" %x", bitmap)
+	}
+	var b strings.Builder
+	for _, t := range types {
+		b.WriteString(" " + t.String())
+	}
+	return b.String()
+}
@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSKEYKeyTag(t *testing.T) {
+	// The example from RFC 4034 section 5.4
+	key, err := base64.StdEncoding.DecodeString("AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/" +
+		"2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvx" +
+		"egXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9Xzc" +
+		"nOf+EPbtG9DMBmADjFDc2w/rljwvFw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnskey := DNSKEY_RECORD{Flags: 256, Protocol: 3, Algorithm: 5, PublicKey: key}
+	if tag := dnskey.KeyTag(); tag != 60485 {
+		t.Errorf("KeyTag() = %d; want 60485", tag)
+	}
+}
+
+func TestRRSIGValidAt(t *testing.T) {
+	now := time.Now()
+	sig := RRSIG_RECORD{
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if !sig.ValidAt(now) {
+		t.Errorf("signature should be valid now")
+	}
+	if sig.ValidAt(now.Add(2*time.Hour)) || sig.ValidAt(now.Add(-2*time.Hour)) {
+		t.Errorf("signature should only be valid between inception and expiration")
+	}
+	// a validity period that straddles the 2106 wraparound
+	wrap := time.Unix(1<<32, 0)
+	sig = RRSIG_RECORD{
+		Inception:  uint32(wrap.Add(-time.Hour).Unix()),
+		Expiration: uint32(wrap.Add(time.Hour).Unix()),
+	}
+	if !sig.ValidAt(wrap) {
+		t.Errorf("signature across the wraparound should be valid")
+	}
+}
+
+func TestTypeBitmap(t *testing.T) {
+	// The example from RFC 4034 section 4.3: A MX RRSIG NSEC TYPE1234
+	bitmap := []byte{0x00, 0x06, 0x40, 0x01, 0x00, 0x00, 0x00, 0x03, 0x04, 0x1b,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20}
+	nsec := NSEC_RECORD{NextDomain: "host.example.com.", TypeBitmap: bitmap}
+	types, err := nsec.Types()
+	if err != nil || !slices.Equal(types, []RTYPE{RTYPE_A, RTYPE_MX, RTYPE_RRSIG, RTYPE_NSEC, 1234}) {
+		t.Errorf("Types() = %v, %v", types, err)
+	}
+	if !nsec.HasType(RTYPE_MX) || nsec.HasType(RTYPE_AAAA) {
+		t.Errorf("HasType is wrong for %v", nsec)
+	}
+	if s := nsec.String(); s != "host.example.com. A MX RRSIG NSEC TYPE1234" {
+		t.Errorf("String() = %q", s)
+	}
+	nsec.TypeBitmap = []byte{0x00, 0x06, 0x40}
+	if _, err := nsec.Types(); err == nil {
+		t.Errorf("a truncated bitmap should be an error")
+	}
+}
+
+func TestNSEC3(t *testing.T) {
+	// The examples from RFC 5155 appendix A
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	for name, want := range map[string]string{
+		"example":     "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example.":  "35mthgpgcu1qg68fab165klnsnk3dpvl",
+		"NS1.example": "2t7b4g4vsa5smi47k61mv5bv1a22bojr",
+	} {
+		if got := strings.ToLower(nsec3Encoding.EncodeToString(NSEC3Hash(name, salt, 12))); got != want {
+			t.Errorf("NSEC3Hash(%q) = %s; want %s", name, got, want)
+		}
+	}
+	next, _ := nsec3Encoding.DecodeString(strings.ToUpper("35mthgpgcu1qg68fab165klnsnk3dpvl"))
+	nsec3 := NSEC3_RECORD{HashAlgorithm: 1, Flags: 1, Iterations: 12, Salt: salt, NextHashed: next}
+	owner := "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example."
+	if !nsec3.OptOut() {
+		t.Errorf("flags 1 is opt-out")
+	}
+	if !nsec3.Covers(owner, "ns1.example") {
+		t.Errorf("ns1.example should be covered")
+	}
+	if nsec3.Covers(owner, "example") || nsec3.Covers(owner, "a.example") {
+		t.Errorf("the endpoints themselves exist")
+	}
+	// the last record in the zone wraps around to the first
+	nsec3.NextHashed, _ = nsec3Encoding.DecodeString(strings.ToUpper("0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"))
+	owner = "35mthgpgcu1qg68fab165klnsnk3dpvl.example."
+	if nsec3.Covers(owner, "ns1.example") || !nsec3.Covers(owner, "x.w.example") {
+		t.Errorf("Covers is wrong around the wraparound")
+	}
+}
+
+func TestDNSSECRecordsCached(t *testing.T) {
+	initTestsData(4)
+	dnskey := DNSKEY_RECORD{257, 3, 13, []byte{1, 2, 3, 4}}
+	rrsig := RRSIG_RECORD{RTYPE_DNSKEY, 13, 2, 3600, 2000000000, 1700000000, dnskey.KeyTag(), "example.com.", []byte{5, 6}}
+	ds := DS_RECORD{dnskey.KeyTag(), 13, 2, []byte{7, 8}}
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		return &DNSMessage{
+			Answers: []DNSAnswer{
+				{RName: "example.com", RType: RTYPE_DNSKEY, TTL: 300, RData: dnskey},
+				{RName: "example.com", RType: RTYPE_RRSIG, TTL: 300, RData: rrsig},
+			},
+			Authorities: []DNSAnswer{
+				{RName: "example.com", RType: RTYPE_DS, TTL: 300, RData: ds},
+			},
+		}
+	})
+	result := QueryLookup("example.com", RTYPE_DNSKEY)
+	if len(result) != 1 || result[0].RData.(DNSKEY_RECORD).Algorithm != 13 {
+		t.Fatalf("unexpected result %v", result)
+	}
+	if DefaultResolver.cacheLookup("example.com", RTYPE_RRSIG) == nil || DefaultResolver.cacheLookup("example.com", RTYPE_DS) == nil {
+		t.Errorf("the RRSIG and DS records should have been cached")
+	}
+
+	var buf bytes.Buffer
+	if err := SaveCache(&buf); err != nil {
+		t.Fatalf("SaveCache: %v", err)
+	}
+	initTestsData(4)
+	if err := LoadCache(&buf); err != nil {
+		t.Fatalf("LoadCache: %v", err)
+	}
+	entry := DefaultResolver.cacheLookup("example.com", RTYPE_RRSIG)
+	if entry == nil {
+		t.Fatalf("RRSIG not restored")
+	}
+	if got := entry.data[0].(RRSIG_RECORD); got.TypeCovered != RTYPE_DNSKEY || got.SignerName != "example.com." ||
+		!bytes.Equal(got.Signature, rrsig.Signature) {
+		t.Errorf("RRSIG restored as %v", got)
+	}
+	if entry := DefaultResolver.cacheLookup("example.com", RTYPE_DS); entry == nil || entry.data[0].(DS_RECORD).KeyTag != ds.KeyTag {
+		t.Errorf("DS restored as %v", entry)
+	}
+}
@@ -0,0 +1,525 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Server A DNS server which answers the queries sent to it by
+// looking them up with a Resolver, which makes a process running
+// one a caching resolver for everything on the network that can
+// reach it.  Like http.Server it is set up by filling in the fields
+// and then calling ListenAndServe (or Serve and ServeTCP with
+// sockets of its own), and it stops when Close is called.  The
+// fields mustn't be changed once it is serving.
+//
+// Every query gets an answer of its own, on a goroutine of its own.
+// Only ordinary queries (opcode 0) for class IN are answered, others
+// get NOTIMP or REFUSED.  The answer is what Lookup returns for the
+// name, which is taken as absolute (the search domains don't apply),
+// with the CNAMEs along the way; a name that doesn't exist (see
+// ErrNXDomain) gets NXDOMAIN and a lookup that fails any other way
+// SERVFAIL.  Clients in one of the Views get answered the way it
+// says, and names in one of the Zones from it.  DO and CD in the query go into the lookup (see
+// WithDNSSECFlags), and the answer has AD set if every record in it
+// was Authenticated and the query had DO or AD set.
+type Server struct {
+	// Addr The address to listen on, ":53" if empty
+	Addr string
+	// Resolver The Resolver to answer with, DefaultResolver if nil
+	Resolver *Resolver
+	// Timeout How long a query gets before it is answered with
+	// SERVFAIL, DefaultServerTimeout if 0
+	Timeout time.Duration
+	// UDPSize The biggest UDP response sent to a client that says
+	// with EDNS it can take one bigger than 512 bytes,
+	// DefaultServerUDPSize if 0.  Anything that doesn't fit is sent
+	// with TC set and nothing but the question, so the client asks
+	// again over TCP.
+	UDPSize uint16
+	// IdleTimeout How long a TCP connection is kept open waiting
+	// for the next query, DefaultServerIdleTimeout if 0
+	IdleTimeout time.Duration
+	// MaxTCPConns How many TCP connections can be open at once,
+	// DefaultServerMaxTCPConns if 0.  Once there are that many, the
+	// next is only accepted when one of them closes.
+	MaxTCPConns int
+	// Views Other ways of answering for some of the clients, see
+	// View
+	Views []View
+	// RateLimit The limit on the responses sent over UDP, none if
+	// it is the zero value (see ResponseRateLimit)
+	RateLimit ResponseRateLimit
+	// Zones The zones answered for authoritatively, see Zone.  The
+	// Resolver is only asked about names outside of them (or
+	// delegated from them, if the client wants recursion).
+	Zones []*Zone
+	// QueryACL Which clients get answered at all, the others get
+	// REFUSED.  RecursionACL Which of them get answers that need the
+	// Resolver, cached or not; the others only get what their View
+	// has in its Records, and REFUSED for anything else.  Both allow
+	// everyone if they are the zero ACL, which is no good for a
+	// Server reachable from the internet.
+	QueryACL     ACL
+	RecursionACL ACL
+	// Policy The rules that override the answers for the names in
+	// it, before Views, Zones or the Resolver are looked at, none if
+	// it is nil (see Policy)
+	Policy *Policy
+	// QueryLog Where every query answered is logged, nowhere if it
+	// is nil (see QueryLog).  A query that can't be logged is still
+	// answered.
+	QueryLog *QueryLog
+
+	// Views with their records indexed, made when the first query
+	// comes in
+	viewsOnce sync.Once
+	views     []*serverView
+	// The buckets for RateLimit
+	rrl rrlTable
+
+	// What Close needs: whether it has been called, the sockets,
+	// listeners and connections it has to close, done which it
+	// cancels, and running which counts the queries being answered
+	// and the TCP connections being served
+	lock     sync.Mutex
+	closed   bool
+	conns    map[io.Closer]struct{}
+	done     context.Context
+	shutdown context.CancelFunc
+	running  sync.WaitGroup
+	// What the Server was made with and Close closes once the
+	// queries are done, in order: for one made by Config.Server its
+	// Resolver and then the log file the Resolver logs to
+	owned []io.Closer
+}
+
+// DefaultServerTimeout How long a Server spends on a query, unless
+// its Timeout says otherwise.  Clients usually give up after about
+// five seconds, so answering SERVFAIL after four lets them know
+// rather than have them wait.
+const DefaultServerTimeout = 4 * time.Second
+
+// DefaultServerUDPSize The biggest UDP response a Server sends,
+// unless its UDPSize says otherwise.  It is the same as the default
+// UDPPayloadSize, for the same reason.
+const DefaultServerUDPSize = 1232
+
+// ErrServerClosed What Serve and ListenAndServe return once the
+// Server has been closed
+var ErrServerClosed = errors.New("dns: server closed")
+
+// ListenAndServe This listens on srv.Addr over both UDP and TCP
+// and answers the queries that arrive, until Close is called.  It
+// always returns an error, ErrServerClosed after Close.  If serving
+// either of them fails, the Server is closed and that is the error.
+func (srv *Server) ListenAndServe() error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":53"
+	}
+	return srv.listenAndServe([]string{addr})
+}
+
+// listenAndServe This is ListenAndServe on every one of addrs.  If
+// listening on any of them fails nothing is served.
+func (srv *Server) listenAndServe(addrs []string) error {
+	var serve []func() error
+	var opened []io.Closer
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			closeAll(opened)
+			return err
+		}
+		opened = append(opened, conn)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeAll(opened)
+			return err
+		}
+		opened = append(opened, l)
+		serve = append(serve, func() error { return srv.Serve(conn) }, func() error { return srv.ServeTCP(l) })
+	}
+	errs := make(chan error, len(serve))
+	for _, f := range serve {
+		go func() { errs <- f() }()
+	}
+	err := <-errs
+	srv.Close()
+	for range len(serve) - 1 {
+		<-errs
+	}
+	return err
+}
+
+// closeAll This closes every one of closers.
+func closeAll(closers []io.Closer) {
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+// Serve This answers the queries that arrive on conn until Close is
+// called, which closes conn.  It returns ErrServerClosed then, or
+// whatever reading from conn failed with before that (conn is
+// closed in that case too).
+func (srv *Server) Serve(conn net.PacketConn) error {
+	if !srv.track(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer srv.untrack(conn)
+	for {
+		buf := wireBuffers.Get().(*[65535]byte)
+		n, from, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			wireBuffers.Put(buf)
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !srv.begin() {
+			wireBuffers.Put(buf)
+			return ErrServerClosed
+		}
+		go func() {
+			defer srv.running.Done()
+			defer wireBuffers.Put(buf)
+			client := clientAddr(from)
+			out, response := srv.respond(buf[:n], client, true)
+			if out == nil {
+				return
+			}
+			if send, slip := srv.limit(client, response, time.Now()); slip {
+				out = truncated(response)
+			} else if !send {
+				return
+			}
+			_, _ = conn.WriteTo(out, from)
+		}()
+	}
+}
+
+// Close This stops the Server: every socket it is serving on is
+// closed, along with every TCP connection, the queries still being
+// answered are cancelled, and Close waits for them to finish.  A
+// Server made by Config.Server then closes its Resolver and log
+// file too.  Calling it again does nothing.
+func (srv *Server) Close() error {
+	srv.lock.Lock()
+	if srv.closed {
+		srv.lock.Unlock()
+		return nil
+	}
+	srv.closed = true
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.init()
+	srv.lock.Unlock()
+	srv.shutdown()
+	srv.running.Wait()
+	var errs []error
+	for _, c := range srv.owned {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// init This sets up done, srv.lock being held.
+func (srv *Server) init() {
+	if srv.done == nil {
+		srv.done, srv.shutdown = context.WithCancel(context.Background())
+	}
+}
+
+// track This adds conn (a socket, listener or connection) to the
+// ones Close closes, unless srv is already closed.
+func (srv *Server) track(conn io.Closer) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.closed {
+		return false
+	}
+	srv.init()
+	if srv.conns == nil {
+		srv.conns = make(map[io.Closer]struct{})
+	}
+	srv.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack This closes conn and forgets about it.
+func (srv *Server) untrack(conn io.Closer) {
+	srv.lock.Lock()
+	delete(srv.conns, conn)
+	srv.lock.Unlock()
+	conn.Close()
+}
+
+func (srv *Server) isClosed() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.closed
+}
+
+// begin This counts a query in as being answered, so that Close
+// waits for it, unless srv is closed.  srv.running.Done has to be
+// called once it is answered.
+func (srv *Server) begin() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.closed {
+		return false
+	}
+	srv.init()
+	srv.running.Add(1)
+	return true
+}
+
+func (srv *Server) resolver() *Resolver {
+	if srv.Resolver != nil {
+		return srv.Resolver
+	}
+	return DefaultResolver
+}
+
+// respond This is the response to the query in packet, in wire
+// form and as it was before packing, or nil if it gets none: it
+// isn't a query at all, it is too broken to even take the ID
+// from, or the Policy drops it.  client is where it came from.  When udp is set the
+// response is cut down to fit in what the client can take.
+func (srv *Server) respond(packet []byte, client netip.Addr, udp bool) ([]byte, *DNSMessage) {
+	start := time.Now()
+	query, err := unpackMessage(packet)
+	if err != nil {
+		// with at least a header we can say what was wrong with it
+		if len(packet) < headerSize || packet[2]&(flagQR>>8) != 0 {
+			return nil, nil
+		}
+		header := DNSHeader{
+			ID:               uint16(packet[0])<<8 | uint16(packet[1]),
+			Response:         true,
+			Opcode:           packet[2] >> 3 & 0xf,
+			RecursionDesired: packet[2]&(flagRD>>8) != 0,
+			Status:           RCODE_FMT,
+		}
+		response := &DNSMessage{Header: header}
+		out, _ := packMessage(response)
+		return out, response
+	}
+	if query.Header.Response {
+		return nil, nil
+	}
+	response, source := srv.answerFrom(query, client)
+	if response == nil {
+		// the Policy says not to answer
+		return nil, nil
+	}
+	out, err := packMessage(response)
+	if err != nil {
+		// something in the answer can't go on the wire
+		response.Header.Status = RCODE_SERVFAIL
+		response.Answers, response.Authorities, response.Additionals = nil, nil, nil
+		if out, err = packMessage(response); err != nil {
+			return nil, nil
+		}
+	}
+	if limit := srv.udpLimit(query); udp && len(out) > limit {
+		response.Header.Truncated = true
+		response.Answers, response.Authorities, response.Additionals = nil, nil, nil
+		out, _ = packMessage(response)
+	}
+	srv.logQuery(start, client, query, response, source)
+	return out, response
+}
+
+// logQuery This writes the query, from client and answered with
+// response from source after starting at start, to the QueryLog.
+func (srv *Server) logQuery(start time.Time, client netip.Addr, query, response *DNSMessage, source QuerySource) {
+	if srv.QueryLog == nil {
+		return
+	}
+	err := srv.QueryLog.Log(QueryLogEntry{
+		Time:    start,
+		Client:  client,
+		Name:    query.Question.QName,
+		Type:    query.Question.QType,
+		Rcode:   response.Header.Status,
+		Latency: time.Since(start),
+		Source:  source,
+	})
+	if err != nil {
+		srv.resolver().log().Warn("query log", "error", err)
+	}
+}
+
+// udpLimit The biggest UDP response the client which sent query
+// can take: 512 bytes, or what its OPT record says up to UDPSize.
+func (srv *Server) udpLimit(query *DNSMessage) int {
+	if query.EDNS == nil || query.EDNS.UDPSize <= 512 {
+		return 512
+	}
+	limit := srv.UDPSize
+	if limit == 0 {
+		limit = DefaultServerUDPSize
+	}
+	return int(min(limit, query.EDNS.UDPSize))
+}
+
+// answer This is the response to query, from client, nil if the
+// Policy says it gets none.
+func (srv *Server) answer(query *DNSMessage, client netip.Addr) *DNSMessage {
+	response, _ := srv.answerFrom(query, client)
+	return response
+}
+
+// answerFrom This is answer, along with where the answer came from.
+func (srv *Server) answerFrom(query *DNSMessage, client netip.Addr) (*DNSMessage, QuerySource) {
+	response := &DNSMessage{
+		Header: DNSHeader{
+			ID:                 query.Header.ID,
+			Response:           true,
+			Opcode:             query.Header.Opcode,
+			RecursionDesired:   query.Header.RecursionDesired,
+			RecursionAvailable: srv.RecursionACL.Permits(client),
+			CheckingDisabled:   query.Header.CheckingDisabled,
+		},
+		Question: query.Question,
+	}
+	if query.EDNS != nil {
+		// RFC 6891 6.1.1: only version 0 is understood
+		response.EDNS = &EDNS{UDPSize: srv.UDPSize, DO: query.EDNS.DO}
+		if response.EDNS.UDPSize == 0 {
+			response.EDNS.UDPSize = DefaultServerUDPSize
+		}
+		if query.EDNS.Version != 0 {
+			response.Header.Status = RCODE_BADVERS
+			return response, SourceNone
+		}
+	}
+	switch {
+	case !srv.QueryACL.Permits(client):
+		response.Header.Status = RCODE_REFUSE
+		return response, SourceNone
+	case query.Header.Opcode != 0:
+		response.Header.Status = RCODE_NOIMPLEMENT
+		return response, SourceNone
+	case query.Question.QName == "":
+		response.Header.Status = RCODE_FMT
+		return response, SourceNone
+	case query.Question.QClass != IN:
+		response.Header.Status = RCODE_REFUSE
+		return response, SourceNone
+	}
+
+	timeout := srv.Timeout
+	if timeout <= 0 {
+		timeout = DefaultServerTimeout
+	}
+	ctx, cancel := context.WithTimeout(srv.done, timeout)
+	defer cancel()
+	ctx = WithDNSSECFlags(ctx, DNSSECFlags{
+		DO: query.EDNS != nil && query.EDNS.DO,
+		CD: query.Header.CheckingDisabled,
+	})
+	res := srv.resolver()
+	name := query.Question.QName
+	authenticated := true
+	if srv.Policy != nil {
+		next, drop, ok := srv.Policy.apply(response, name, query.Question.QType)
+		if drop {
+			return nil, SourcePolicy
+		}
+		if ok && next == "" {
+			return response, SourcePolicy
+		}
+		if ok {
+			name, authenticated = next, false
+		}
+	}
+	if view := srv.view(client); view != nil {
+		if view.Resolver != nil {
+			res = view.Resolver
+		}
+		local, next, ok := view.localAnswers(name, query.Question.QType)
+		response.Answers = append(response.Answers, local...)
+		if ok && next == "" {
+			response.Header.Authoritative = true
+			return response, SourceLocal
+		}
+		if ok {
+			// local data isn't signed
+			name, authenticated = next, false
+		}
+	}
+	// then the zones, following CNAMEs from one to the next
+	recurse := response.Header.RecursionAvailable && query.Header.RecursionDesired
+	for range maxZoneChase {
+		zone := srv.zone(name)
+		if zone == nil {
+			break
+		}
+		authorities, additionals := len(response.Authorities), len(response.Additionals)
+		next, referral := zone.answer(response, name, query.Question.QType)
+		if referral && recurse {
+			// find the answer rather than hand out the referral
+			response.Authorities = response.Authorities[:authorities]
+			response.Additionals = response.Additionals[:additionals]
+			break
+		}
+		// a client that doesn't want recursion gets a CNAME out of
+		// the zones without it being followed
+		if next == "" || !recurse && srv.zone(next) == nil {
+			return response, SourceZone
+		}
+		name, authenticated = next, false
+	}
+	if !response.Header.RecursionAvailable {
+		// the CNAMEs from the View's Records are all it gets
+		if len(response.Answers) == 0 {
+			response.Header.Status = RCODE_REFUSE
+			return response, SourceNone
+		}
+		return response, SourceLocal
+	}
+	// the lookup keeps count of the queries it sends, and if it
+	// sent none it was answered from the cache
+	ctx = res.withBudgetSpent(ctx)
+	answers, err := res.LookupCtx(ctx, absolute(name), query.Question.QType)
+	source := SourceCache
+	if spent(ctx).queries.Load() > 0 {
+		source = SourceRecursion
+	}
+	if errors.Is(err, ErrNXDomain) {
+		// the CNAMEs that led to it are part of the answer
+		response.Header.Status = RCODE_NXNAME
+		for _, answer := range answers {
+			response.Answers = append(response.Answers, *answer)
+		}
+		return response, source
+	}
+	if err != nil {
+		response.Header.Status = RCODE_SERVFAIL
+		return response, source
+	}
+	authenticated = authenticated && len(answers) > 0
+	for _, answer := range answers {
+		response.Answers = append(response.Answers, *answer)
+		authenticated = authenticated && answer.Authenticated
+	}
+	wantAD := query.Header.AuthenticData || query.EDNS != nil && query.EDNS.DO
+	response.Header.AuthenticData = authenticated && wantAD
+	return response, source
+}
@@ -0,0 +1,254 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveUDP This starts srv on a local UDP socket and returns a
+// function that sends it a packet and returns what comes back (nil
+// if nothing does), and one that stops it and returns what Serve did.
+func serveUDP(t *testing.T, srv *Server) (exchange func(packet []byte) []byte, stop func() error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(conn) }()
+	exchange = func(packet []byte) []byte {
+		client, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write(packet)
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 65535)
+		n, err := client.Read(buf)
+		if err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+	return exchange, func() error {
+		srv.Close()
+		return <-served
+	}
+}
+
+func TestServerUDP(t *testing.T) {
+	res := withSingleRoot(New())
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch {
+		case strings.HasPrefix(request.name, "fail."):
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_SERVFAIL}}
+		case strings.HasPrefix(request.name, "missing."):
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_NXNAME}}
+		case request.qtype == RTYPE_TXT:
+			// too big for 512 bytes
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_TXT, RClass: IN, TTL: 300, RData: TXT_RECORD{[]string{strings.Repeat("x", 255), strings.Repeat("y", 255)}},
+			}}}
+		case request.name == "www.example.com":
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_CNAME, RClass: IN, TTL: 300, RData: CNAME_RECORD{"web.example.com."},
+			}}}
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.92")},
+		}}}
+	})
+	srv := &Server{Resolver: res}
+	exchange, stop := serveUDP(t, srv)
+
+	query := func(msg *DNSMessage) *DNSMessage {
+		t.Helper()
+		packet, err := packMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := unpackMessage(exchange(packet))
+		if err != nil {
+			t.Fatalf("bad response to %v: %v", msg.Question, err)
+		}
+		if !response.Header.Response || response.Header.ID != msg.Header.ID {
+			t.Errorf("unexpected header %+v", response.Header)
+		}
+		return response
+	}
+
+	// the CNAME and where it leads, with the client's case kept
+	response := query(&DNSMessage{
+		Header:   DNSHeader{ID: 92, RecursionDesired: true},
+		Question: DNSQuestion{QName: "WWW.example.com", QType: RTYPE_A, QClass: IN},
+	})
+	if response.Header.Status != RCODE_OK || !response.Header.RecursionAvailable || !response.Header.RecursionDesired ||
+		len(response.Answers) != 2 || response.Answers[0].RName != "WWW.example.com" ||
+		response.Answers[1].RData != (A_RECORD{parseAddrNoerror("192.0.2.92")}) {
+		t.Errorf("unexpected response %+v", response)
+	}
+	if response.Question.QName != "WWW.example.com" {
+		t.Errorf("question came back as %v", response.Question)
+	}
+
+	for _, test := range []struct {
+		name  string
+		query DNSMessage
+		want  RCODE
+	}{
+		{"servfail", DNSMessage{Question: DNSQuestion{QName: "fail.example.com", QType: RTYPE_A, QClass: IN}}, RCODE_SERVFAIL},
+		{"nxdomain", DNSMessage{Question: DNSQuestion{QName: "missing.example.com", QType: RTYPE_A, QClass: IN}}, RCODE_NXNAME},
+		{"chaos", DNSMessage{Question: DNSQuestion{QName: "version.bind", QType: RTYPE_TXT, QClass: 3}}, RCODE_REFUSE},
+		{"notify", DNSMessage{Header: DNSHeader{Opcode: 4}, Question: DNSQuestion{QName: "example.com", QType: RTYPE_SOA, QClass: IN}}, RCODE_NOIMPLEMENT},
+		{"no question", DNSMessage{}, RCODE_FMT},
+		{"EDNS version 1", DNSMessage{Question: DNSQuestion{QName: "example.com", QType: RTYPE_A, QClass: IN}, EDNS: &EDNS{UDPSize: 1232, Version: 1}}, RCODE_BADVERS},
+	} {
+		test.query.Header.ID = 7
+		if response := query(&test.query); response.Header.Status != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, response.Header.Status, test.want)
+		}
+	}
+
+	// too big for plain UDP, but it fits with EDNS
+	big := DNSMessage{Header: DNSHeader{ID: 8}, Question: DNSQuestion{QName: "big.example.com", QType: RTYPE_TXT, QClass: IN}}
+	if response := query(&big); !response.Header.Truncated || len(response.Answers) != 0 {
+		t.Errorf("unexpected response without EDNS %+v", response)
+	}
+	big.EDNS = &EDNS{UDPSize: 4096}
+	if response := query(&big); response.Header.Truncated || len(response.Answers) != 1 || response.EDNS == nil || response.EDNS.UDPSize != DefaultServerUDPSize {
+		t.Errorf("unexpected response with EDNS %+v", response)
+	}
+
+	// garbage with a header gets FORMERR, anything shorter nothing
+	if response, err := unpackMessage(exchange([]byte{0, 9, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 3, 'w'})); err != nil || response.Header.ID != 9 || response.Header.Status != RCODE_FMT {
+		t.Errorf("unexpected response to garbage %+v, %v", response, err)
+	}
+	if response := exchange([]byte{0, 9, 1}); response != nil {
+		t.Errorf("got %x for a partial header", response)
+	}
+
+	if err := stop(); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve returned %v", err)
+	}
+	conn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	if err := srv.Serve(conn); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Serve after Close returned %v", err)
+	}
+}
+
+// tcpExchange This sends each of queries over conn without waiting,
+// then reads back as many responses, in whatever order they come.
+func tcpExchange(t *testing.T, conn net.Conn, queries ...*DNSMessage) []*DNSMessage {
+	t.Helper()
+	for _, query := range queries {
+		packet, err := packMessage(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...))
+	}
+	var responses []*DNSMessage
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for range queries {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatalf("reading a response: %v", err)
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			t.Fatalf("reading a response: %v", err)
+		}
+		response, err := unpackMessage(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+func TestServerTCP(t *testing.T) {
+	res := withSingleRoot(New())
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if request.name == "slow.example.com" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		if request.qtype == RTYPE_TXT {
+			var strings []string
+			for range 8 {
+				strings = append(strings, string(make([]byte, 255)))
+			}
+			return &DNSMessage{Answers: []DNSAnswer{{RName: request.name, RType: RTYPE_TXT, RClass: IN, TTL: 300, RData: TXT_RECORD{strings}}}}
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.93")},
+		}}}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	srv := &Server{Resolver: res, IdleTimeout: time.Second, MaxTCPConns: 1}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeTCP(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the quick answer overtakes the slow one, and the big one
+	// isn't truncated
+	responses := tcpExchange(t, conn,
+		&DNSMessage{Header: DNSHeader{ID: 1}, Question: DNSQuestion{QName: "slow.example.com", QType: RTYPE_A, QClass: IN}},
+		&DNSMessage{Header: DNSHeader{ID: 2}, Question: DNSQuestion{QName: "quick.example.com", QType: RTYPE_A, QClass: IN}},
+		&DNSMessage{Header: DNSHeader{ID: 3}, Question: DNSQuestion{QName: "big.example.com", QType: RTYPE_TXT, QClass: IN}},
+	)
+	if responses[2].Header.ID != 1 {
+		t.Errorf("the slow answer wasn't last: %v", responses)
+	}
+	for _, response := range responses {
+		if response.Header.Truncated || len(response.Answers) != 1 {
+			t.Errorf("unexpected response %+v", response)
+		}
+	}
+
+	// with the one connection allowed open, a second has to wait
+	// for it to close
+	other, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	packet, _ := packMessage(&DNSMessage{Header: DNSHeader{ID: 4}, Question: DNSQuestion{QName: "www.example.com", QType: RTYPE_A, QClass: IN}})
+	other.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...))
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := other.Read(make([]byte, 1)); err == nil {
+		t.Errorf("a second connection was served")
+	}
+	// the first goes idle and is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("read from an idle connection")
+	}
+	conn.Close()
+	other.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var length [2]byte
+	if _, err := io.ReadFull(other, length[:]); err != nil {
+		t.Errorf("the second connection wasn't served once the first closed: %v", err)
+	}
+	io.ReadFull(other, make([]byte, binary.BigEndian.Uint16(length[:])))
+
+	srv.Close()
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("ServeTCP returned %v", err)
+	}
+	if _, err := other.Read(make([]byte, 1)); err == nil {
+		t.Errorf("the connection was still open after Close")
+	}
+}
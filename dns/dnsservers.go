@@ -0,0 +1,807 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	mathrand "math/rand/v2"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy How long to wait on the servers and how many times
+// to go back to them.  Each attempt goes through all of a zone's
+// servers (see askServers), and every attempt after the first waits
+// Multiplier times longer on each server than the one before, so a
+// server that is just slow gets a chance to answer.
+type RetryPolicy struct {
+	// Timeout is how long to wait for each server on the first
+	// attempt
+	Timeout time.Duration
+	// Multiplier is how much longer each attempt waits than the
+	// last, 1 (or less) meaning the same time every attempt
+	Multiplier float64
+	// Jitter randomly moves each timeout up or down by up to this
+	// fraction of it, so that lookups which started together don't
+	// all retry together
+	Jitter float64
+	// Attempts is how many times to go through the servers, 1 (or
+	// less) meaning no retries
+	Attempts int
+	// Deadline if non-zero is how long the whole lookup may take,
+	// CNAMEs and referrals included
+	Deadline time.Duration
+	// Retransmit if non-zero is how long to wait for an answer to a
+	// query over UDP before sending it again, up to Retransmits
+	// times, all within the server's timeout.  The copies are the
+	// same query, so an answer to any of them will do, and only
+	// the first counts against the lookup's Budget.
+	Retransmit  time.Duration
+	Retransmits int
+	// Stagger if non-zero is how long to wait for a server before
+	// asking the next one as well, without giving up on the first.
+	// A dead server then only holds the lookup up for Stagger
+	// rather than for the whole Timeout.
+	Stagger time.Duration
+}
+
+// DefaultRetryPolicy The policy for lookups which don't say
+// otherwise (see WithRetryPolicy).  By default each server gets 3
+// seconds and just the one try, in which a query over UDP is sent
+// up to three times, 800ms apart, in case one got lost.  A server
+// that hasn't answered after 400ms has the next one asked alongside
+// it.
+var DefaultRetryPolicy = RetryPolicy{
+	Timeout:     3 * time.Second,
+	Multiplier:  2,
+	Attempts:    1,
+	Retransmit:  800 * time.Millisecond,
+	Retransmits: 2,
+	Stagger:     400 * time.Millisecond,
+}
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy This returns a context which makes LookupCtx and
+// QueryLookupCtx use policy rather than the Resolver's default
+// (DefaultRetryPolicy unless New was given another).
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+// retryPolicy The policy for a lookup with ctx
+func (res *Resolver) retryPolicy(ctx context.Context) RetryPolicy {
+	if policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy); ok {
+		return policy
+	}
+	return *res.retry
+}
+
+// timeout How long to wait for each server on the given attempt
+// (counting from 0)
+func (p RetryPolicy) timeout(attempt int) time.Duration {
+	timeout := float64(p.Timeout)
+	if p.Multiplier > 1 {
+		timeout *= math.Pow(p.Multiplier, float64(attempt))
+	}
+	if p.Jitter > 0 {
+		timeout *= 1 + p.Jitter*(2*mathrand.Float64()-1)
+	}
+	return time.Duration(timeout)
+}
+
+// ParallelQueries How many of a zone's servers get asked at once.
+// With the default of 1 they are asked one at a time, best first,
+// moving on when one fails or hasn't answered within the
+// RetryPolicy's Stagger.  Setting it to 2 or 3 asks that many
+// of the best servers together and takes whichever answers first,
+// which cuts the latency when a server is slow or dead at the cost
+// of more traffic to the servers.  This is DefaultResolver's, see
+// WithParallelQueries for the others.
+var ParallelQueries = 1
+
+// WithParallelQueries This is ParallelQueries for the Resolver.
+func WithParallelQueries(n int) Option {
+	return func(res *Resolver) {
+		*res.parallelQueries = n
+	}
+}
+
+// serverFailureMemory How long a failure counts against a server.
+// After that it gets judged on its RTT alone again, so a server
+// which was down for a while isn't shunned forever.
+var serverFailureMemory = 10 * time.Minute
+
+// BreakerThreshold and BreakerBackoff After BreakerThreshold
+// failures in a row a server is taken to be down, and is left out
+// of lookups (so long as the zone has other servers that aren't) for
+// BreakerBackoff.  After that it gets asked again, and if it fails
+// once more it is left out for twice as long as the time before,
+// and so on up to BreakerMaxBackoff, until it answers.  A
+// BreakerThreshold of 0 turns this off.  These are
+// DefaultResolver's, see WithBreaker for the others.
+var BreakerThreshold = 3
+var BreakerBackoff = 30 * time.Second
+var BreakerMaxBackoff = 10 * time.Minute
+
+// WithBreaker This is BreakerThreshold, BreakerBackoff and
+// BreakerMaxBackoff for the Resolver.
+func WithBreaker(threshold int, backoff, maxBackoff time.Duration) Option {
+	return func(res *Resolver) {
+		*res.breakerThreshold, *res.breakerBackoff, *res.breakerMaxBackoff = threshold, backoff, maxBackoff
+	}
+}
+
+// breaker The manager's breaker settings, going by the Resolver it
+// is for (DefaultResolver's if it isn't for one).
+func (manager *serverCommManager) breaker() (threshold int, backoff, maxBackoff time.Duration) {
+	if manager.breakerThreshold == nil {
+		return BreakerThreshold, BreakerBackoff, BreakerMaxBackoff
+	}
+	return *manager.breakerThreshold, *manager.breakerBackoff, *manager.breakerMaxBackoff
+}
+
+// recordRTT This folds a response time into the smoothed RTT the
+// same way TCP does (RFC 6298), each new sample counting for an
+// eighth, and clears the failures since the server is evidently up.
+func (manager *serverCommManager) recordRTT(rtt time.Duration) {
+	for {
+		old := manager.srtt.Load()
+		srtt := int64(rtt)
+		if old != 0 {
+			srtt = old + (int64(rtt)-old)/8
+		}
+		if manager.srtt.CompareAndSwap(old, srtt) {
+			break
+		}
+	}
+	manager.failures.Store(0)
+	manager.downUntil.Store(0)
+}
+
+// recordFailure This notes that the server timed out or couldn't
+// give us an answer, and if that makes BreakerThreshold in a row
+// (or more) marks it down.  Failures from before
+// serverFailureMemory don't count towards that.
+func (manager *serverCommManager) recordFailure() {
+	now := time.Now()
+	if now.Sub(time.Unix(0, manager.lastFailure.Swap(now.UnixNano()))) > serverFailureMemory {
+		manager.failures.Store(0)
+	}
+	failures := manager.failures.Add(1)
+	threshold, backoff, maxBackoff := manager.breaker()
+	if threshold <= 0 || failures < uint32(threshold) {
+		return
+	}
+	for range failures - uint32(threshold) {
+		if backoff >= maxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	manager.downUntil.Store(now.Add(min(backoff, maxBackoff)).UnixNano())
+}
+
+// down Whether the server is marked down (see BreakerThreshold)
+func (manager *serverCommManager) down() bool {
+	return time.Now().UnixNano() < manager.downUntil.Load()
+}
+
+// score What we rank servers on, lower is better.  It is the
+// smoothed RTT plus timeout for every recent failure in a row.
+// Servers we haven't heard from yet score 0 so each one gets tried
+// (and so measured) at least once.
+func (manager *serverCommManager) score(timeout time.Duration) time.Duration {
+	score := time.Duration(manager.srtt.Load())
+	if failures := manager.failures.Load(); failures > 0 {
+		if time.Since(time.Unix(0, manager.lastFailure.Load())) < serverFailureMemory {
+			score += time.Duration(failures) * timeout
+		}
+	}
+	return score
+}
+
+// serverScore The score for the server at addr, 0 if we have
+// never talked to it, and whether it is marked down.  This doesn't
+// connect to it.
+func (res *Resolver) serverScore(addr netip.Addr) (time.Duration, bool) {
+	manager := res.existingServerComm(addr)
+	if manager == nil {
+		return 0, false
+	}
+	return manager.score(res.retry.Timeout), manager.down()
+}
+
+// existingServerComm The manager for the server at addr, nil if
+// there isn't one.  Unlike getServerComm it doesn't make one, and the
+// manager doesn't need releasing, but it may be closed at any time.
+func (res *Resolver) existingServerComm(addr netip.Addr) *serverCommManager {
+	if len(res.serverComm) == 0 {
+		return nil
+	}
+	key := res.serverComm[res.serverHash(&addr)%uint32(len(res.serverComm))]
+	key.lock.RLock()
+	defer key.lock.RUnlock()
+	return key.entries[addr]
+}
+
+// rankNameservers This returns the addresses of the nameservers in
+// the order to try them: fastest responsive server first, then the
+// slower ones, with the ones that have been failing last.  Servers
+// we have no address for are left out, and so are servers marked
+// down, unless they all are, in which case they are all tried
+// anyway since a slow answer beats none.  Ties (most commonly
+// servers we haven't tried yet) are broken at random to spread the
+// load.
+func (res *Resolver) rankNameservers(data []RDATA) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rdata := range data {
+		ns, ok := rdata.(NS_RECORD)
+		if !ok {
+			continue
+		}
+		// its A record or failing that its AAAA record
+		if addr, ok := res.nameserverAddr(cleanName(ns.NS)); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return res.rankAddrs(addrs)
+}
+
+// rankAddrs This puts the servers at addrs in the order to try
+// them, as rankNameservers does, in place.
+func (res *Resolver) rankAddrs(addrs []netip.Addr) []netip.Addr {
+	mathrand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	scores := make(map[netip.Addr]time.Duration, len(addrs))
+	var up []netip.Addr
+	for _, addr := range addrs {
+		score, down := res.serverScore(addr)
+		scores[addr] = score
+		if !down {
+			up = append(up, addr)
+		}
+	}
+	if len(up) > 0 {
+		addrs = up
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return scores[addrs[i]] < scores[addrs[j]]
+	})
+	return addrs
+}
+
+// askServers This asks the servers at addrs (in order) about name,
+// going through them as many times as the lookup's RetryPolicy
+// says, and returns the first usable answer.  If there isn't one it
+// returns the last failure a server sent back (see serverFailed),
+// or nil if none of them answered at all or ctx is done.
+func (res *Resolver) askServers(ctx context.Context, addrs []netip.Addr, name string, t RTYPE) *DNSMessage {
+	return res.askServersFrom(ctx, queued(addrs), name, t)
+}
+
+// askServersFrom This is askServers for servers whose addresses
+// come from addrs as they are found (see askGluelessServers).  The
+// first attempt asks each one as it comes, the ones after that ask
+// all of those again.
+func (res *Resolver) askServersFrom(ctx context.Context, addrs <-chan netip.Addr, name string, t RTYPE) *DNSMessage {
+	policy := res.retryPolicy(ctx)
+	// for exchange, which has no Resolver to find the default in
+	ctx = WithRetryPolicy(ctx, policy)
+	var failed *DNSMessage
+	var asked []netip.Addr
+	for attempt := 0; attempt < max(policy.Attempts, 1); attempt++ {
+		if attempt > 0 {
+			addrs = queued(asked)
+		}
+		msg, tried := res.askServersOnce(ctx, addrs, name, t, policy.timeout(attempt), policy.Stagger)
+		if attempt == 0 {
+			asked = tried
+		}
+		if msg != nil && !serverFailed(msg.Header.Status) {
+			return msg
+		}
+		if msg != nil {
+			failed = msg
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return failed
+}
+
+// queued A channel with addrs waiting in it, in order, which is
+// then closed
+func queued(addrs []netip.Addr) <-chan netip.Addr {
+	queue := make(chan netip.Addr, len(addrs))
+	for _, addr := range addrs {
+		queue <- addr
+	}
+	close(queue)
+	return queue
+}
+
+// askServersOnce This is one attempt for askServersFrom, keeping
+// the Resolver's ParallelQueries of the servers going at once.  Whenever one fails
+// the next one in line is asked instead, and if stagger is non-zero
+// so is the next one whenever the last one asked has gone that long
+// without answering, the ones before it still being waited on.
+// Once there is an answer the rest are abandoned.  What comes back
+// is the same as for askServers, along with the servers asked.
+func (res *Resolver) askServersOnce(ctx context.Context, addrs <-chan netip.Addr, name string, t RTYPE, timeout, stagger time.Duration) (*DNSMessage, []netip.Addr) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	going := max(*res.parallelQueries, 1)
+	results := make(chan *DNSMessage)
+	var asked []netip.Addr
+	var failed *DNSMessage
+	var staggered <-chan time.Time
+	pending := 0
+	for addrs != nil || pending > 0 {
+		// a nil channel is never ready, so this only takes the next
+		// server when there is room for it
+		var next <-chan netip.Addr
+		if pending < going {
+			next = addrs
+		}
+		select {
+		case addr, ok := <-next:
+			if !ok {
+				addrs = nil
+				continue
+			}
+			asked = append(asked, addr)
+			pending++
+			go func() {
+				msg := res.askServer(ctx, addr, name, t, timeout)
+				select {
+				case results <- msg:
+				case <-ctx.Done():
+				}
+			}()
+			staggered = nil
+			if stagger > 0 {
+				staggered = time.After(stagger)
+			}
+		case <-staggered:
+			// the servers already asked keep going, but the next
+			// one doesn't have to wait for them
+			staggered = nil
+			going++
+		case msg := <-results:
+			pending--
+			if msg != nil && !serverFailed(msg.Header.Status) {
+				return msg, asked
+			}
+			if msg != nil {
+				failed = msg
+			}
+			if ctx.Err() != nil {
+				return failed, asked
+			}
+		case <-ctx.Done():
+			return failed, asked
+		}
+	}
+	return failed, asked
+}
+
+// askServer This asks the server at addr about name and waits up to
+// timeout for it to answer, recording how it did.  It returns nil if
+// the server didn't answer or ctx is done first.
+//
+// An answer with the TC bit set didn't fit in a UDP packet and is
+// only part of what the server has, so we ask again over TCP for
+// the whole thing (RFC 7766).  The truncated one never gets used.
+func (res *Resolver) askServer(ctx context.Context, addr netip.Addr, name string, t RTYPE, timeout time.Duration) *DNSMessage {
+	ctx, leave, ok := res.enter(ctx)
+	if !ok {
+		return nil
+	}
+	defer leave()
+	// 6.) get the communication manager for the addr
+	manager := res.getServerComm(&addr)
+	defer manager.release()
+	if !res.mayQuery(ctx, manager) {
+		return nil
+	}
+	markQueried(ctx)
+	ctx, span := res.startSpan(ctx, "dns.query", slog.String("server.address", addr.String()),
+		slog.String("dns.name", name), slog.String("dns.type", t.String()))
+	defer span.End()
+	ctx = context.WithValue(ctx, querySpanKey{}, span)
+	// how many times the server is asked again, for the span
+	retries := 0
+	defer func() { span.SetAttributes(slog.Int("dns.retries", retries)) }()
+	// one slot under MaxInflightQueries covers the retry over TCP
+	// as well, since that only happens once the first is done
+	if res.queries.acquire(ctx) != nil {
+		return nil
+	}
+	defer res.queries.release()
+	edns := manager.edns()
+	if edns != nil {
+		edns.DO = dnssecFlags(ctx).DO
+	}
+	if subnet, ok := res.clientSubnet(ctx); ok && edns != nil {
+		edns.Options = append(edns.Options, ecsOption(subnet))
+	}
+	msg := manager.exchange(ctx, name, t, false, edns, timeout)
+	// a server that doesn't do EDNS gets asked again without it,
+	// and from then on never with it
+	if edns != nil && ednsRefused(msg) {
+		manager.noEDNS.Store(true)
+		if !res.mayQuery(ctx, manager) {
+			return nil
+		}
+		edns = nil
+		retries++
+		msg = manager.exchange(ctx, name, t, false, nil, timeout)
+	}
+	// BADCOOKIE came with a fresh server cookie, which the server
+	// wants to see before it will answer (RFC 7873 5.3)
+	if edns != nil && msg != nil && msg.Header.Status == RCODE_BADCOOKIE {
+		if !res.mayQuery(ctx, manager) {
+			return nil
+		}
+		retries++
+		msg = manager.exchange(ctx, name, t, false, edns, timeout)
+	}
+	if msg != nil && msg.Header.Truncated {
+		if !res.mayQuery(ctx, manager) {
+			return nil
+		}
+		retries++
+		msg = manager.exchange(ctx, name, t, true, edns, timeout)
+		// there is no going any bigger than TCP
+		if msg != nil && msg.Header.Truncated {
+			manager.recordFailure()
+			return nil
+		}
+	}
+	return msg
+}
+
+// exchange This sends one request to the server, over TCP if tcp is
+// set and with edns in an OPT record unless it is nil, and waits up
+// to timeout for the response.
+func (manager *serverCommManager) exchange(ctx context.Context, name string, t RTYPE, tcp bool, edns *EDNS, timeout time.Duration) *DNSMessage {
+	// 7.) make a request using dnsRequest_object(requests)
+	edns = manager.withCookie(edns)
+	sent := name
+	randomized := manager.randomizesCase()
+	if randomized {
+		sent = randomizeCase(name)
+	}
+	req := &serverDNSRequest{
+		ctx:      ctx,
+		id:       uint16(mathrand.Uint32()),
+		server:   *manager.remote,
+		name:     sent,
+		qtype:    t,
+		tcp:      tcp || manager.tcpAlways(),
+		edns:     edns,
+		rd:       recursionDesired(ctx),
+		cd:       dnssecFlags(ctx).CD,
+		deadline: time.Now().Add(timeout),
+		response: make(chan *DNSMessage, 1),
+	}
+	if policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy); ok && policy.Retransmit > 0 {
+		req.retransmit, req.retransmits = policy.Retransmit, policy.Retransmits
+	}
+	log := manager.log()
+	log.DebugContext(ctx, "upstream query", "server", req.server, "name", name, "type", t.String(), "tcp", req.tcp)
+	// 8.) make/send a request using servercomm.requests <- request
+	select {
+	case manager.requests <- req:
+	case <-ctx.Done():
+		return nil
+	}
+	defer manager.metrics.sent()()
+	// 9.) wait for response
+	start := time.Now()
+	select {
+	// 9a.) wait for timout
+	case <-time.After(timeout):
+		manager.recordFailure()
+		manager.metrics.timedOut(req.server)
+		traceExchange(ctx, req, nil, timeout)
+		tracedLookup(ctx).add(TraceStep{Kind: TraceQuery, Name: name, Type: t, Server: req.server, TCP: req.tcp, RTT: timeout})
+		querySpan(ctx).RecordError(context.DeadlineExceeded)
+		log.InfoContext(ctx, "upstream timeout", "server", req.server, "name", name, "type", t.String(), "timeout", timeout)
+		return nil
+	// 9b.) case response := request.response:
+	case msg := <-req.response:
+		// unpackMessage has done this already, but a manager that
+		// made up the message itself may have left the OPT record
+		// in the additional section
+		if msg != nil {
+			msg.takeOPT()
+		}
+		// a response that doesn't echo the case we sent isn't an
+		// answer to our question (see CaseRandomization), and one
+		// with somebody else's client cookie isn't for us at all
+		if randomized && msg != nil && !echoedCase(msg, sent, name) {
+			manager.recordFailure()
+			log.InfoContext(ctx, "upstream response rejected", "server", req.server, "name", name, "type", t.String(), "reason", "question case changed")
+			return nil
+		}
+		if edns != nil && msg != nil && !manager.checkCookie(msg) {
+			manager.recordFailure()
+			log.InfoContext(ctx, "upstream response rejected", "server", req.server, "name", name, "type", t.String(), "reason", "wrong client cookie")
+			return nil
+		}
+		rtt := time.Since(start)
+		manager.recordRTT(rtt)
+		traceExchange(ctx, req, msg, rtt)
+		tracedLookup(ctx).add(TraceStep{Kind: TraceQuery, Name: name, Type: t, Server: req.server, TCP: req.tcp, RTT: rtt, Response: msg})
+		if msg != nil {
+			manager.metrics.answered(req.server, t, msg.Header.Status, rtt)
+			log.DebugContext(ctx, "upstream response", "server", req.server, "name", name, "type", t.String(),
+				"rcode", msg.Header.Status.String(), "answers", len(msg.Answers), "rtt", rtt)
+		}
+		// a server that couldn't or wouldn't answer is no better
+		// than one that didn't, but one that just doesn't do EDNS
+		// or wants its cookie is fine once asked again
+		if msg == nil || (serverFailed(msg.Header.Status) && !(edns != nil && askAgain(msg))) {
+			manager.recordFailure()
+		}
+		return msg
+	// 9c.) or for the caller to give up
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// ServerNetwork Which addresses DefaultResolver reaches the servers
+// at: "ip" for either IPv4 or IPv6, "ip4" for IPv4 only or "ip6"
+// for IPv6 only, for a host without the other.  With "ip" a server
+// with both is asked over IPv4, and one with only an IPv6 address
+// over that.  Changes apply from the next lookup on.  Resolvers
+// made by New have their own, see WithServerNetwork.
+var ServerNetwork = "ip"
+
+// WithServerNetwork This picks which addresses the Resolver reaches
+// the servers at, like ServerNetwork does for DefaultResolver.
+func WithServerNetwork(network string) Option {
+	return func(res *Resolver) {
+		*res.network = network
+	}
+}
+
+// serverAddrTypes The address records to reach the servers with,
+// in the order to prefer them (see ServerNetwork)
+func (res *Resolver) serverAddrTypes() []RTYPE {
+	switch *res.network {
+	case "ip4":
+		return []RTYPE{RTYPE_A}
+	case "ip6":
+		return []RTYPE{RTYPE_AAAA}
+	}
+	return []RTYPE{RTYPE_A, RTYPE_AAAA}
+}
+
+// serverAddr The address to reach a server at from rdata, an A or
+// AAAA record, if it is one of those.  An IPv4 mapped IPv6 address
+// is taken as the IPv4 address it maps, so that the server only
+// gets the one manager, and a mapped address in an AAAA record is
+// only used when IPv4 is.
+func (res *Resolver) serverAddr(rdata RDATA) (netip.Addr, bool) {
+	var addr netip.Addr
+	switch r := rdata.(type) {
+	case A_RECORD:
+		addr = r.A
+	case AAAA_RECORD:
+		addr = r.AAAA
+	default:
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return netip.Addr{}, false
+	}
+	switch *res.network {
+	case "ip4":
+		return addr, addr.Is4()
+	case "ip6":
+		return addr, addr.Is6()
+	}
+	return addr, true
+}
+
+// MaxGluelessDepth How many glueless nameservers deep a lookup may
+// go, where finding the address of one nameserver means finding the
+// address of another one first, and so on.  This is
+// DefaultResolver's, see WithMaxGluelessDepth for the others.
+var MaxGluelessDepth = 4
+
+// WithMaxGluelessDepth This is MaxGluelessDepth for the Resolver.
+func WithMaxGluelessDepth(depth int) Option {
+	return func(res *Resolver) {
+		*res.maxGluelessDepth = depth
+	}
+}
+
+// gluelessKey The context value holding the nameservers whose
+// addresses the lookup is in the middle of finding, outermost first
+type gluelessKey struct{}
+
+// askGluelessServers This is askServers for the nameservers in data
+// that we have no address for, which happens when a delegation comes
+// without glue (typically because the servers are in another zone).
+// Their addresses all get looked up at once (see resolveNameserver)
+// and each server is asked as soon as we have its address, the way
+// askServersFrom does, until one of them answers.  Finding the
+// addresses gets no longer than the first attempt gives a server
+// to answer, so that nameservers which are themselves hard to find
+// add at most that to the lookup rather than a timeout for every
+// server along the way.  Any lookups still going once there is an
+// answer are abandoned.  If none of them could be asked because
+// finding their addresses goes round in circles the error is a
+// *DelegationLoopError, or ErrGluelessTooDeep if it went on too
+// long, and if none of their addresses could be found at all it is
+// ErrNoGlue.
+func (res *Resolver) askGluelessServers(ctx context.Context, data []RDATA, name string, t RTYPE) (*DNSMessage, error) {
+	var servers []string
+	for _, rdata := range data {
+		if ns, ok := rdata.(NS_RECORD); ok {
+			if _, ok := res.nameserverAddr(cleanName(ns.NS)); !ok {
+				servers = append(servers, cleanName(ns.NS))
+			}
+		}
+	}
+	finding, cancel := context.WithTimeout(ctx, res.retryPolicy(ctx).timeout(0))
+	defer cancel()
+	found := make(chan netip.Addr)
+	// buffered so the lookups never block on them
+	errs := make(chan error, len(servers))
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			addr, err := res.resolveNameserver(finding, server)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case found <- addr:
+			case <-finding.Done():
+			}
+		}(server)
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+		close(errs)
+	}()
+	msg := res.askServersFrom(ctx, found, name, t)
+	if msg != nil && !serverFailed(msg.Header.Status) {
+		return msg, nil
+	}
+	// the lookups are all done (or being abandoned) by now
+	cancel()
+	var giveUp error
+	failures := 0
+	for err := range errs {
+		failures++
+		var loop *DelegationLoopError
+		if giveUp == nil && (errors.As(err, &loop) || errors.Is(err, ErrGluelessTooDeep)) {
+			giveUp = err
+		}
+	}
+	if msg == nil && giveUp != nil {
+		return nil, giveUp
+	}
+	if failures == len(servers) && ctx.Err() == nil && queriesLeft(ctx) {
+		return nil, fmt.Errorf("%w: %s", ErrNoGlue, strings.Join(servers, ", "))
+	}
+	return msg, nil
+}
+
+// errNoNameserverAddr This is what resolveNameserver says when the
+// lookup worked but there was no address for the nameserver
+var errNoNameserverAddr = errors.New("dns: nameserver has no address")
+
+// resolveNameserver This looks up the address of the (cleaned)
+// nameserver name, A first and then AAAA (or just the one of them
+// ServerNetwork says).  The answer is cached so
+// nameserverAddr finds it from then on.  To stop two zones whose
+// servers are in each other from sending us round in circles, a
+// nameserver we are already finding the address of (further up
+// this lookup) isn't looked up again, which is a
+// *DelegationLoopError, and nor is anything past the Resolver's
+// MaxGluelessDepth.
+func (res *Resolver) resolveNameserver(ctx context.Context, server string) (netip.Addr, error) {
+	resolving, _ := ctx.Value(gluelessKey{}).([]string)
+	if slices.Contains(resolving, server) {
+		return netip.Addr{}, &DelegationLoopError{Name: server, Chain: append(slices.Clip(resolving), server)}
+	}
+	if len(resolving) >= *res.maxGluelessDepth {
+		return netip.Addr{}, ErrGluelessTooDeep
+	}
+	ctx = context.WithValue(ctx, gluelessKey{}, append(slices.Clip(resolving), server))
+	err := errNoNameserverAddr
+	for _, t := range res.serverAddrTypes() {
+		var answers []*DNSAnswer
+		answers, err = res.followCNAMEs(ctx, server, t)
+		for _, answer := range answers {
+			if addr, ok := res.serverAddr(answer.RData); ok {
+				return addr, nil
+			}
+		}
+		// no point asking the same servers for the AAAA if they
+		// couldn't tell us about the A
+		if err != nil {
+			return netip.Addr{}, err
+		}
+	}
+	return netip.Addr{}, errNoNameserverAddr
+}
+
+// ErrGluelessTooDeep This is what lookups return when finding the
+// servers to ask needs more than MaxGluelessDepth nameserver
+// addresses looked up, one inside the other.  It is ErrNoGlue.
+var ErrGluelessTooDeep = fmt.Errorf("%w: glueless delegations nested too deep", ErrNoGlue)
+
+// DelegationLoopError This is what lookups return when the
+// delegations for Name go round in circles.  Either the servers for
+// Zone sent us back to Zone itself (or to a zone above it) rather
+// than to one closer to Name, or, when Chain is set, finding the
+// address of a nameserver meant finding the address of the same
+// nameserver first.  Chain is every nameserver along the way,
+// starting with the outermost and ending with the one seen twice.
+type DelegationLoopError struct {
+	Name  string
+	Zone  string
+	Chain []string
+}
+
+func (e *DelegationLoopError) Error() string {
+	if len(e.Chain) > 0 {
+		return "dns: delegation loop resolving nameservers " + strings.Join(e.Chain, " -> ")
+	}
+	return fmt.Sprintf("dns: delegation loop for %s: the servers for %s refer back to themselves", e.Name, e.Zone)
+}
+
+// serverFailed Whether rcode means the server couldn't (or wouldn't)
+// answer the question, as opposed to answering that the name doesn't
+// exist, so another server for the zone should be asked.
+func serverFailed(rcode RCODE) bool {
+	return rcode == RCODE_SERVFAIL || rcode == RCODE_REFUSE || rcode == RCODE_FMT || rcode == RCODE_BADVERS ||
+		rcode == RCODE_BADCOOKIE
+}
+
+// askAgain Whether msg is a failure that askServer deals with by
+// asking the same server again differently, rather than the server
+// actually failing: it doesn't do EDNS or it wants its cookie.
+func askAgain(msg *DNSMessage) bool {
+	return ednsRefused(msg) || msg.Header.Status == RCODE_BADCOOKIE
+}
+
+// ServerFailureError This is what lookups return when none of the
+// servers for Zone could answer the question about Name.  Rcode is
+// the failure the last of them sent back, or RCODE_SERVFAIL if none
+// of them answered at all (which is what a recursive resolver would
+// say in either case), in which case Timeout is set.  It is
+// ErrServFail, and ErrTimeout too when Timeout is set.
+type ServerFailureError struct {
+	Name    string
+	Type    RTYPE
+	Zone    string
+	Rcode   RCODE
+	Timeout bool
+}
+
+func (e *ServerFailureError) Error() string {
+	return fmt.Sprintf("dns: no answer for %s %v from the servers for %s: %v", e.Name, e.Type, e.Zone, e.Rcode)
+}
@@ -0,0 +1,536 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecordRTT(t *testing.T) {
+	manager := &serverCommManager{}
+	manager.recordRTT(80 * time.Millisecond)
+	if srtt := time.Duration(manager.srtt.Load()); srtt != 80*time.Millisecond {
+		t.Errorf("the first sample should be taken as is, got %v", srtt)
+	}
+	manager.recordRTT(160 * time.Millisecond)
+	if srtt := time.Duration(manager.srtt.Load()); srtt != 90*time.Millisecond {
+		t.Errorf("srtt = %v; want 90ms", srtt)
+	}
+	manager.recordFailure()
+	manager.recordFailure()
+	if score := manager.score(DefaultRetryPolicy.Timeout); score != 90*time.Millisecond+2*DefaultRetryPolicy.Timeout {
+		t.Errorf("score() = %v after two failures", score)
+	}
+	manager.recordRTT(90 * time.Millisecond)
+	if score := manager.score(DefaultRetryPolicy.Timeout); score != 90*time.Millisecond {
+		t.Errorf("an answer should clear the failures, score() = %v", score)
+	}
+}
+
+func TestRankNameservers(t *testing.T) {
+	initTestsData(4)
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		return nil
+	})
+	var servers []RDATA
+	var addrs []netip.Addr
+	for i := range 4 {
+		name := fmt.Sprintf("ns%d.example.com", i)
+		addr := parseAddrNoerror(fmt.Sprintf("10.53.0.%d", i))
+		servers = append(servers, NS_RECORD{name + "."})
+		addrs = append(addrs, addr)
+		DefaultResolver.infraSet(name, RTYPE_A, ttlExpires(300), []RDATA{A_RECORD{addr}})
+	}
+	servers = append(servers, NS_RECORD{"glueless.example.com."})
+
+	DefaultResolver.getServerComm(&addrs[0]).recordRTT(200 * time.Millisecond)
+	DefaultResolver.getServerComm(&addrs[1]).recordRTT(20 * time.Millisecond)
+	DefaultResolver.getServerComm(&addrs[2]).recordRTT(10 * time.Millisecond)
+	DefaultResolver.getServerComm(&addrs[2]).recordFailure()
+	// ns3 hasn't been tried yet so it goes first
+	want := []netip.Addr{addrs[3], addrs[1], addrs[0], addrs[2]}
+	if got := DefaultResolver.rankNameservers(servers); !slices.Equal(got, want) {
+		t.Errorf("DefaultResolver.rankNameservers() = %v; want %v", got, want)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	initTestsData(4)
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		return nil
+	})
+	var servers []RDATA
+	var managers []*serverCommManager
+	for i := range 2 {
+		name := fmt.Sprintf("ns%d.example.com", i)
+		addr := parseAddrNoerror(fmt.Sprintf("10.53.0.%d", i))
+		servers = append(servers, NS_RECORD{name + "."})
+		DefaultResolver.infraSet(name, RTYPE_A, ttlExpires(300), []RDATA{A_RECORD{addr}})
+		managers = append(managers, DefaultResolver.getServerComm(&addr))
+	}
+	dead := managers[0]
+	for range BreakerThreshold - 1 {
+		dead.recordFailure()
+	}
+	if dead.down() {
+		t.Fatalf("down after %d failures", BreakerThreshold-1)
+	}
+	dead.recordFailure()
+	until := time.Until(time.Unix(0, dead.downUntil.Load()))
+	if !dead.down() || until > BreakerBackoff || until < BreakerBackoff-time.Second {
+		t.Fatalf("down for %v, want %v", until, BreakerBackoff)
+	}
+	// each failure after that doubles the backoff
+	dead.recordFailure()
+	if until := time.Until(time.Unix(0, dead.downUntil.Load())); until < 2*BreakerBackoff-time.Second {
+		t.Errorf("down for %v after another failure, want %v", until, 2*BreakerBackoff)
+	}
+	if got := DefaultResolver.rankNameservers(servers); !slices.Equal(got, []netip.Addr{*managers[1].remote}) {
+		t.Errorf("rankNameservers() = %v; want just the server that is up", got)
+	}
+	// with every server down they are all tried anyway
+	for range BreakerThreshold {
+		managers[1].recordFailure()
+	}
+	if got := DefaultResolver.rankNameservers(servers); len(got) != 2 {
+		t.Errorf("rankNameservers() = %v; want both servers", got)
+	}
+	dead.recordRTT(10 * time.Millisecond)
+	if dead.down() {
+		t.Errorf("still down after answering")
+	}
+}
+
+func TestFastestServerPreferred(t *testing.T) {
+	initTestsData(4)
+	slow := parseAddrNoerror("10.53.0.1")
+	fast := parseAddrNoerror("10.53.0.2")
+	var slowQueries atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch addr {
+		case slow:
+			slowQueries.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			fallthrough
+		case fast:
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{addr},
+			}}}
+		}
+		return &DNSMessage{
+			Authorities: []DNSAnswer{
+				{RName: "example.com", RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{"slow.example.com."}},
+				{RName: "example.com", RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{"fast.example.com."}},
+			},
+			Additionals: []DNSAnswer{
+				{RName: "slow.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{slow}},
+				{RName: "fast.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{fast}},
+			},
+		}
+	})
+
+	for i := range 10 {
+		if result := QueryLookup(fmt.Sprintf("host%d.example.com", i), RTYPE_A); len(result) != 1 {
+			t.Fatalf("unexpected result %v", result)
+		}
+	}
+	// The slow server gets tried at most once, to measure it
+	if n := slowQueries.Load(); n > 1 {
+		t.Errorf("the slow server got %d queries", n)
+	}
+}
+
+func TestParallelQueries(t *testing.T) {
+	initTestsData(4)
+	ParallelQueries = 2
+	defer func() { ParallelQueries = 1 }()
+	dead := parseAddrNoerror("10.53.0.1")
+	good := parseAddrNoerror("10.53.0.2")
+	abandoned := make(chan bool, 1)
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch addr {
+		case dead:
+			<-request.ctx.Done()
+			abandoned <- true
+			return nil
+		case good:
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{addr},
+			}}}
+		}
+		return &DNSMessage{
+			Authorities: []DNSAnswer{
+				{RName: "example.com", RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{"dead.example.com."}},
+				{RName: "example.com", RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{"good.example.com."}},
+			},
+			Additionals: []DNSAnswer{
+				{RName: "dead.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{dead}},
+				{RName: "good.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{good}},
+			},
+		}
+	})
+
+	start := time.Now()
+	result := QueryLookup("www.example.com", RTYPE_A)
+	if len(result) != 1 || result[0].RData.(A_RECORD).A != good {
+		t.Fatalf("unexpected result %v", result)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultRetryPolicy.Timeout/2 {
+		t.Errorf("the lookup took %v, it shouldn't have waited for the dead server", elapsed)
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Errorf("the request to the dead server wasn't cancelled")
+	}
+}
+
+func TestStaggeredQueries(t *testing.T) {
+	policy := RetryPolicy{Timeout: 2 * time.Second, Attempts: 1, Stagger: 20 * time.Millisecond}
+	res := withSingleRoot(New(WithDefaultRetryPolicy(policy)))
+	good := parseAddrNoerror("10.53.0.4")
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch {
+		case addr == good:
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{addr},
+			}}}
+		case addr.Is4() && addr.As4()[0] == 10:
+			// dead, it never answers
+			return nil
+		}
+		msg := &DNSMessage{}
+		for i := range 4 {
+			server := fmt.Sprintf("ns%d.example.com", i+1)
+			msg.Authorities = append(msg.Authorities, DNSAnswer{
+				RName: "example.com", RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{server + "."},
+			})
+			msg.Additionals = append(msg.Additionals, DNSAnswer{
+				RName: server, RType: RTYPE_A, TTL: 300, RData: A_RECORD{netip.AddrFrom4([4]byte{10, 53, 0, byte(i + 1)})},
+			})
+		}
+		return msg
+	})
+
+	// however many of the dead servers are asked first, each only
+	// holds the lookup up for the Stagger
+	start := time.Now()
+	result, err := res.Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RData.(A_RECORD).A != good {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	if elapsed := time.Since(start); elapsed > policy.Timeout/2 {
+		t.Errorf("the lookup took %v, it waited for the dead servers", elapsed)
+	}
+}
+
+func TestRetryPolicyTimeout(t *testing.T) {
+	policy := RetryPolicy{Timeout: 100 * time.Millisecond, Multiplier: 2}
+	for attempt, want := range []time.Duration{100, 200, 400} {
+		if got := policy.timeout(attempt); got != want*time.Millisecond {
+			t.Errorf("timeout(%d) = %v; want %v", attempt, got, want*time.Millisecond)
+		}
+	}
+	policy.Jitter = 0.1
+	for range 100 {
+		if got := policy.timeout(0); got < 90*time.Millisecond || got > 110*time.Millisecond {
+			t.Fatalf("timeout(0) = %v with 10%% jitter", got)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	initTestsData(4)
+	var queries atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if request.name == "dead.example.com" {
+			return nil
+		}
+		// the first query (only) gets lost
+		if queries.Add(1) == 1 {
+			return nil
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+		}}}
+	})
+
+	policy := RetryPolicy{Timeout: 50 * time.Millisecond, Attempts: 1}
+	ctx := WithRetryPolicy(context.Background(), policy)
+	if result, _ := LookupCtx(ctx, "www.example.com", RTYPE_A); len(result) != 0 {
+		t.Errorf("without retries the lost query should fail the lookup, got %v", result)
+	}
+	policy.Attempts = 2
+	ctx = WithRetryPolicy(context.Background(), policy)
+	if result, err := LookupCtx(ctx, "www.example.com", RTYPE_A); err != nil || len(result) != 1 {
+		t.Errorf("the retry should have got the answer, got %v, %v", result, err)
+	}
+
+	policy = RetryPolicy{Timeout: time.Second, Attempts: 3, Deadline: 100 * time.Millisecond}
+	start := time.Now()
+	_, err := LookupCtx(WithRetryPolicy(context.Background(), policy), "dead.example.com", RTYPE_A)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the lookup took %v, past its deadline", elapsed)
+	}
+}
+
+func TestTruncatedRetriedOverTCP(t *testing.T) {
+	initTestsData(4)
+	var udp, tcp atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		msg := &DNSMessage{}
+		n := 3
+		if request.tcp {
+			tcp.Add(1)
+		} else {
+			udp.Add(1)
+			msg.Header.Truncated = true
+			n = 1
+		}
+		for i := range n {
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				RName: request.name, RType: RTYPE_TXT, TTL: 300, RData: RAW_RECORD{16, []byte{byte(i)}},
+			})
+		}
+		return msg
+	})
+
+	if result := QueryLookup("big.example.com", RTYPE_TXT); len(result) != 3 {
+		t.Errorf("expected the full answer, got %v", result)
+	}
+	if entry := DefaultResolver.cacheLookup("big.example.com", RTYPE_TXT); entry == nil || len(entry.data) != 3 {
+		t.Errorf("expected the full answer to be cached, got %v", entry)
+	}
+	if udp.Load() != 1 || tcp.Load() != 1 {
+		t.Errorf("expected one UDP and one TCP query, got %d and %d", udp.Load(), tcp.Load())
+	}
+}
+
+func TestServerFailureError(t *testing.T) {
+	initTestsData(4)
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch addr {
+		case parseAddrNoerror("10.53.0.1"), parseAddrNoerror("10.53.0.2"):
+			if request.name == "dead.example.com" {
+				return nil
+			}
+			return &DNSMessage{Header: DNSHeader{Status: RCODE_FMT}}
+		}
+		return &DNSMessage{
+			Authorities: []DNSAnswer{
+				{RName: "example.com", RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{"ns1.example.com."}},
+				{RName: "example.com", RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{"ns2.example.com."}},
+			},
+			Additionals: []DNSAnswer{
+				{RName: "ns1.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.53.0.1")}},
+				{RName: "ns2.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.53.0.2")}},
+			},
+		}
+	})
+
+	result, err := Lookup("www.example.com", RTYPE_A)
+	var failure *ServerFailureError
+	if !errors.As(err, &failure) || failure.Rcode != RCODE_FMT || failure.Zone != "example.com" || len(result) != 0 {
+		t.Errorf("expected a FORMERR failure from example.com, got %v, %v", result, err)
+	}
+
+	// servers that never answer at all are a SERVFAIL
+	ctx := WithRetryPolicy(context.Background(), RetryPolicy{Timeout: 50 * time.Millisecond})
+	_, err = LookupCtx(ctx, "dead.example.com", RTYPE_A)
+	if !errors.As(err, &failure) || failure.Rcode != RCODE_SERVFAIL || failure.Name != "dead.example.com" {
+		t.Errorf("expected a SERVFAIL failure, got %v", err)
+	}
+}
+
+func TestGluelessDelegation(t *testing.T) {
+	initTestsData(4)
+	var queries atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		queries.Add(1)
+		if addr == parseAddrNoerror("10.53.0.1") {
+			answer := parseAddrNoerror("10.0.0.1")
+			if request.name == "ns.example.net" {
+				answer = addr
+			}
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{answer},
+			}}}
+		}
+		// the root: example.com's server is in example.net, and
+		// loop.com and loop.org each have their server in the other
+		switch {
+		case strings.HasSuffix(request.name, "example.com"):
+			return referral("example.com", "ns.example.net", netip.Addr{})
+		case strings.HasSuffix(request.name, "example.net"):
+			return referral("example.net", "ns.example.net", parseAddrNoerror("10.53.0.1"))
+		case strings.HasSuffix(request.name, "loop.com"):
+			return referral("loop.com", "ns.loop.org", netip.Addr{})
+		case strings.HasSuffix(request.name, "loop.org"):
+			return referral("loop.org", "ns.loop.com", netip.Addr{})
+		}
+		return &DNSMessage{}
+	})
+
+	result, err := Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RData.(A_RECORD).A != parseAddrNoerror("10.0.0.1") {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+
+	queries.Store(0)
+	result, err = Lookup("www.loop.com", RTYPE_A)
+	var loop *DelegationLoopError
+	if len(result) != 0 || !errors.As(err, &loop) {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	if want := []string{"ns.loop.org", "ns.loop.com", "ns.loop.org"}; !slices.Equal(loop.Chain, want) {
+		t.Errorf("loop %v, want %v", loop.Chain, want)
+	}
+	if n := queries.Load(); n > 10 {
+		t.Errorf("the loop took %d queries to give up on", n)
+	}
+}
+
+func TestGluelessTimeouts(t *testing.T) {
+	policy := RetryPolicy{Timeout: 500 * time.Millisecond, Attempts: 2, Stagger: 20 * time.Millisecond}
+	res := withSingleRoot(New(WithDefaultRetryPolicy(policy)))
+	good := parseAddrNoerror("10.53.0.2")
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch {
+		case addr == good:
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+			}}}
+		case addr.Is4() && addr.As4()[0] == 10:
+			// dead, it never answers
+			return nil
+		}
+		// the root: example.com has a dead server and a good one,
+		// neither with glue, and example.org's server is in
+		// lost.test, whose server is dead
+		answer := func(a netip.Addr) *DNSMessage {
+			return &DNSMessage{Answers: []DNSAnswer{{RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{a}}}}
+		}
+		switch {
+		case strings.HasSuffix(request.name, "example.com"):
+			msg := referral("example.com", "ns1.dead.test", netip.Addr{})
+			msg.Authorities = append(msg.Authorities, referral("example.com", "ns2.good.test", netip.Addr{}).Authorities...)
+			return msg
+		case request.name == "ns1.dead.test":
+			return answer(parseAddrNoerror("10.53.0.1"))
+		case request.name == "ns2.good.test":
+			return answer(good)
+		case strings.HasSuffix(request.name, "example.org"):
+			return referral("example.org", "ns.lost.test", netip.Addr{})
+		case strings.HasSuffix(request.name, "lost.test"):
+			return referral("lost.test", "a.lost.test", parseAddrNoerror("10.53.0.9"))
+		}
+		return &DNSMessage{}
+	})
+
+	// the dead server only holds the lookup up for the Stagger, not
+	// for a timeout on every attempt
+	start := time.Now()
+	result, err := res.Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RData.(A_RECORD).A != parseAddrNoerror("10.0.0.1") {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	if elapsed := time.Since(start); elapsed > policy.Timeout/2 {
+		t.Errorf("the lookup took %v, it waited for the dead server", elapsed)
+	}
+
+	// finding the nameserver's address gives up after one timeout
+	// rather than going through every attempt
+	start = time.Now()
+	if result, err := res.Lookup("www.example.org", RTYPE_A); len(result) != 0 || !errors.Is(err, ErrNoGlue) {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	if elapsed := time.Since(start); elapsed > policy.Timeout*3/2 {
+		t.Errorf("the lookup took %v, finding the nameserver's address wasn't cut short", elapsed)
+	}
+}
+
+func TestSelfReferral(t *testing.T) {
+	initTestsData(4)
+	var queries atomic.Int32
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		queries.Add(1)
+		if addr == parseAddrNoerror("10.53.0.1") {
+			// a lame server for example.com which just sends us
+			// back to example.com
+			return referral("example.com", "ns.example.com", addr)
+		}
+		return referral("example.com", "ns.example.com", parseAddrNoerror("10.53.0.1"))
+	})
+
+	result, err := Lookup("www.example.com", RTYPE_A)
+	var loop *DelegationLoopError
+	if len(result) != 0 || !errors.As(err, &loop) {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	if loop.Name != "www.example.com" || loop.Zone != "example.com" {
+		t.Errorf("unexpected error %v", loop)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("took %d queries to give up, want 2", n)
+	}
+}
+
+// referral A referral to zone, served by server, with glue for it
+// if glue is valid
+func referral(zone, server string, glue netip.Addr) *DNSMessage {
+	msg := &DNSMessage{Authorities: []DNSAnswer{
+		{RName: zone, RType: RTYPE_NS, TTL: 300, RData: NS_RECORD{server + "."}},
+	}}
+	if glue.IsValid() {
+		msg.Additionals = []DNSAnswer{{RName: server, RType: RTYPE_A, TTL: 300, RData: A_RECORD{glue}}}
+	}
+	return msg
+}
+
+func TestServerNetwork(t *testing.T) {
+	dualRoot := singleRoot + "a.root-servers.net.  AAAA  2001:503:ba3e::2:30\n"
+	for _, test := range []struct {
+		network string
+		want    string
+	}{
+		{"ip", "198.41.0.4"},
+		{"ip4", "198.41.0.4"},
+		{"ip6", "2001:503:ba3e::2:30"},
+	} {
+		var asked atomic.Pointer[netip.Addr]
+		res := New(WithServerNetwork(test.network))
+		if err := res.LoadRootHints(strings.NewReader(dualRoot)); err != nil {
+			t.Fatal(err)
+		}
+		res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+			asked.Store(&addr)
+			return &DNSMessage{Answers: []DNSAnswer{{
+				RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+			}}}
+		})
+		if _, err := res.Lookup("www.example.com", RTYPE_A); err != nil {
+			t.Fatalf("%s: %v", test.network, err)
+		}
+		if got := asked.Load(); got == nil || *got != parseAddrNoerror(test.want) {
+			t.Errorf("%s: asked %v, want %s", test.network, got, test.want)
+		}
+	}
+
+	// an IPv4 mapped address is the IPv4 server
+	res := New()
+	mapped := parseAddrNoerror("::ffff:198.41.0.4")
+	manager := res.getServerComm(&mapped)
+	defer manager.release()
+	if *manager.remote != parseAddrNoerror("198.41.0.4") {
+		t.Errorf("manager for %v is for %v", mapped, *manager.remote)
+	}
+}
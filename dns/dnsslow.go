@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// SlowLookupThreshold How long a lookup by DefaultResolver can take
+// before it counts as slow and is reported to OnSlowLookup, 0 (the
+// default) for never.  Every lookup keeps a trace (see
+// QueryLookupTrace) while this is set, so it costs a little even
+// when nothing is slow.  Resolvers made by New have their own, see
+// WithSlowLookups.
+var SlowLookupThreshold time.Duration
+
+// OnSlowLookup What a slow lookup by DefaultResolver is reported to,
+// on the goroutine that made it once it is done.  If it is nil slow
+// lookups are logged to Logger at Warn, with every step of the trace.
+// The lookups for the addresses of nameservers are part of the lookup
+// that needed them, not reported on their own.
+var OnSlowLookup func(SlowLookup)
+
+// SlowLookup A lookup that took longer than SlowLookupThreshold, with
+// the Steps it took (see QueryLookupTrace) and Err being what it
+// returned
+type SlowLookup struct {
+	Name     string
+	Type     RTYPE
+	Duration time.Duration
+	Err      error
+	Steps    []TraceStep
+}
+
+// WithSlowLookups This makes the Resolver report lookups that take
+// longer than threshold to report, like SlowLookupThreshold and
+// OnSlowLookup do for DefaultResolver.
+func WithSlowLookups(threshold time.Duration, report func(SlowLookup)) Option {
+	return func(res *Resolver) {
+		*res.slowThreshold = threshold
+		*res.onSlow = report
+	}
+}
+
+// traceSlow This starts tracing the lookup with ctx, if it is the
+// outermost one and slow lookups are being looked for.  The returned
+// function reports the lookup, which started at start and returned
+// err, if it turned out to be slow.
+func (res *Resolver) traceSlow(ctx context.Context, name string, t RTYPE, start time.Time) (context.Context, func(err error)) {
+	threshold := *res.slowThreshold
+	if threshold <= 0 || ctx.Value(lookupQueriedKey{}) != nil {
+		return ctx, func(error) {}
+	}
+	// QueryLookupTrace's trace does for this one too
+	trace := tracedLookup(ctx)
+	if trace == nil {
+		trace = &lookupTrace{}
+		ctx = context.WithValue(ctx, lookupTraceKey{}, trace)
+	}
+	return ctx, func(err error) {
+		elapsed := time.Since(start)
+		if elapsed < threshold {
+			return
+		}
+		trace.lock.Lock()
+		slow := SlowLookup{Name: name, Type: t, Duration: elapsed, Err: err, Steps: slices.Clone(trace.steps)}
+		trace.lock.Unlock()
+		res.reportSlow(ctx, slow)
+	}
+}
+
+// reportSlow This hands slow to the Resolver's OnSlowLookup, or logs
+// it if it hasn't got one.
+func (res *Resolver) reportSlow(ctx context.Context, slow SlowLookup) {
+	if report := *res.onSlow; report != nil {
+		report(slow)
+		return
+	}
+	steps := make([]string, len(slow.Steps))
+	for i, step := range slow.Steps {
+		steps[i] = step.String()
+	}
+	args := []any{"name", slow.Name, "type", slow.Type.String(), "duration", slow.Duration, "steps", steps}
+	if slow.Err != nil {
+		args = append(args, "error", slow.Err)
+	}
+	res.log().WarnContext(ctx, "slow lookup", args...)
+}
@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"log/slog"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlowLookups(t *testing.T) {
+	handler := func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		if request.name == "slow.example.com" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.114")},
+		}}}
+	}
+
+	var lock sync.Mutex
+	var slow []SlowLookup
+	res := withSingleRoot(New(WithSlowLookups(30*time.Millisecond, func(s SlowLookup) {
+		lock.Lock()
+		defer lock.Unlock()
+		slow = append(slow, s)
+	})))
+	res.connect = fakeCommManager(handler)
+	res.Lookup("www.example.com", RTYPE_A)
+	res.Lookup("slow.example.com", RTYPE_A)
+	// from the cache this time, so quick
+	res.Lookup("slow.example.com", RTYPE_A)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(slow) != 1 || slow[0].Name != "slow.example.com" || slow[0].Type != RTYPE_A || slow[0].Err != nil || slow[0].Duration < 50*time.Millisecond {
+		t.Fatalf("unexpected slow lookups %+v", slow)
+	}
+	var queries []TraceStep
+	for _, step := range slow[0].Steps {
+		if step.Kind == TraceQuery {
+			queries = append(queries, step)
+		}
+	}
+	if len(queries) != 1 || queries[0].Server != parseAddrNoerror("198.41.0.4") || queries[0].RTT < 50*time.Millisecond {
+		t.Errorf("unexpected queries %+v", queries)
+	}
+
+	// with nowhere else to go they are logged
+	records := &logRecords{}
+	res = withSingleRoot(New(
+		WithSlowLookups(30*time.Millisecond, nil),
+		WithLogger(slog.New(slog.NewJSONHandler(records, nil))),
+	))
+	res.connect = fakeCommManager(handler)
+	res.Lookup("www.example.com", RTYPE_A)
+	res.Lookup("slow.example.com", RTYPE_A)
+	logged := records.find("slow lookup")
+	if len(logged) != 1 || logged[0]["name"] != "slow.example.com" || logged[0]["level"] != "WARN" {
+		t.Fatalf("unexpected log records %v", logged)
+	}
+	if steps, _ := logged[0]["steps"].([]any); len(steps) == 0 {
+		t.Errorf("no steps logged: %v", logged[0])
+	}
+}
@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// CacheShardStats The counters for a single cache shard (or,
+// in CacheStatistics, the sum over all of them).
+//
+// Every lookup is either a hit or a miss.  Expired counts the
+// misses where the entry was there but had already expired,
+// and Evictions counts entries removed before they expired.
+type CacheShardStats struct {
+	Lookups   uint64 `json:"lookups"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Expired   uint64 `json:"expired"`
+	Inserts   uint64 `json:"inserts"`
+	Evictions uint64 `json:"evictions"`
+	// Entries is the number of name/type entries currently
+	// stored, including ones which have expired but haven't
+	// been removed yet.
+	Entries int `json:"entries"`
+	// Bytes is the approximate memory used by those entries
+	Bytes int64 `json:"bytes"`
+}
+
+// HitRatio The fraction of lookups which were served from the cache
+func (s CacheShardStats) HitRatio() float64 {
+	if s.Lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Lookups)
+}
+
+func (s *CacheShardStats) add(o CacheShardStats) {
+	s.Lookups += o.Lookups
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Expired += o.Expired
+	s.Inserts += o.Inserts
+	s.Evictions += o.Evictions
+	s.Entries += o.Entries
+	s.Bytes += o.Bytes
+}
+
+// CacheStatistics The aggregate counters plus the breakdown by
+// shard.  A big spread in Entries or Lookups between shards
+// isn't something to worry about, but if the aggregate hit
+// ratio is good and things are still slow it is worth giving
+// InitCache more shards.
+type CacheStatistics struct {
+	CacheShardStats
+	Shards []CacheShardStats `json:"shards"`
+}
+
+// retireStats This folds the counters of a shard which is about
+// to be replaced by a resize into retiredCounters.
+func (c *dnsCacheTable) retireStats(unit *dnsCacheUnit) {
+	c.retiredLock.Lock()
+	defer c.retiredLock.Unlock()
+	c.retiredCounters.Lookups += unit.lookups.Load()
+	c.retiredCounters.Hits += unit.hits.Load()
+	c.retiredCounters.Misses += unit.misses.Load()
+	c.retiredCounters.Expired += unit.expired.Load()
+	c.retiredCounters.Inserts += unit.inserts.Load()
+	c.retiredCounters.Evictions += unit.evictions.Load()
+}
+
+// CacheStats This takes a snapshot of the answer cache counters.
+// The counters are read individually so a snapshot taken under
+// load may be very slightly inconsistent between fields.
+func (res *Resolver) CacheStats() CacheStatistics {
+	return res.cache.stats()
+}
+
+// InfraCacheStats The same for the infrastructure cache
+func (res *Resolver) InfraCacheStats() CacheStatistics {
+	return res.infra.stats()
+}
+
+func (c *dnsCacheTable) stats() CacheStatistics {
+	shards := c.shardList()
+	stats := CacheStatistics{Shards: make([]CacheShardStats, len(shards))}
+	c.retiredLock.Lock()
+	stats.CacheShardStats.add(c.retiredCounters)
+	c.retiredLock.Unlock()
+	for i, unit := range shards {
+		shard := CacheShardStats{
+			Lookups:   unit.lookups.Load(),
+			Hits:      unit.hits.Load(),
+			Misses:    unit.misses.Load(),
+			Expired:   unit.expired.Load(),
+			Inserts:   unit.inserts.Load(),
+			Evictions: unit.evictions.Load(),
+		}
+		unit.names.Range(func(_, v any) bool {
+			shard.Entries += len(v.(*dnsCacheName).get())
+			return true
+		})
+		shard.Bytes = unit.bytes.Load()
+		stats.Shards[i] = shard
+		stats.CacheShardStats.add(shard)
+	}
+	return stats
+}
+
+// CacheRecord One entry in the cache as reported by DumpCache.
+// Entries which have expired but not been swept yet are included
+// with Expired set and a TTL of 0.  Pinned entries are flagged as
+// such, as are ones from the infrastructure cache.  Subnet is set
+// on answers which only hold for part of the address space (see
+// WithClientSubnet), and AD on ones the server set the AD bit for.
+type CacheRecord struct {
+	Name    string       `json:"name"`
+	Class   CLASS        `json:"class"`
+	Type    RTYPE        `json:"type"`
+	Subnet  netip.Prefix `json:"subnet,omitzero"`
+	Data    []RDATA      `json:"data"`
+	TTL     uint32       `json:"ttl"`
+	Expired bool         `json:"expired"`
+	Pinned  bool         `json:"pinned"`
+	AD      bool         `json:"ad,omitempty"`
+	Infra   bool         `json:"infra"`
+	Shard   int          `json:"shard"`
+}
+
+// DumpCache This returns everything currently in both caches,
+// sorted by name, type and class (answer cache first), for
+// debugging and tests.
+func (res *Resolver) DumpCache() []CacheRecord {
+	records := res.cache.dump(false)
+	records = append(records, res.infra.dump(true)...)
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		if records[i].Type != records[j].Type {
+			return records[i].Type < records[j].Type
+		}
+		return records[i].Class < records[j].Class
+	})
+	return records
+}
+
+func (c *dnsCacheTable) dump(infra bool) []CacheRecord {
+	var records []CacheRecord
+	now := time.Now()
+	for i, unit := range c.shardList() {
+		unit.names.Range(func(kname, v any) bool {
+			name := kname.(string)
+			for k, entry := range v.(*dnsCacheName).all() {
+				records = append(records, CacheRecord{
+					Name:    name,
+					Class:   k.class,
+					Type:    k.t,
+					Subnet:  k.subnet,
+					Data:    append([]RDATA(nil), entry.data...),
+					TTL:     entry.ttl(*c.maxTTL),
+					Expired: entry.expiredAt(now),
+					Pinned:  entry.pinned,
+					AD:      entry.authenticated,
+					Infra:   infra,
+					Shard:   i,
+				})
+			}
+			return true
+		})
+	}
+	return records
+}
@@ -0,0 +1,169 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+)
+
+// SvcParamKey The key of a SvcParam in an SVCB or HTTPS record
+// (RFC 9460).  Only the ones defined there get names, anything
+// else is kept but shown as keyNNNNN.
+type SvcParamKey uint16
+
+const (
+	SVCB_MANDATORY       SvcParamKey = 0
+	SVCB_ALPN            SvcParamKey = 1
+	SVCB_NO_DEFAULT_ALPN SvcParamKey = 2
+	SVCB_PORT            SvcParamKey = 3
+	SVCB_IPV4HINT        SvcParamKey = 4
+	SVCB_ECH             SvcParamKey = 5
+	SVCB_IPV6HINT        SvcParamKey = 6
+)
+
+var svcParamKeyName = map[SvcParamKey]string{
+	SVCB_MANDATORY:       "mandatory",
+	SVCB_ALPN:            "alpn",
+	SVCB_NO_DEFAULT_ALPN: "no-default-alpn",
+	SVCB_PORT:            "port",
+	SVCB_IPV4HINT:        "ipv4hint",
+	SVCB_ECH:             "ech",
+	SVCB_IPV6HINT:        "ipv6hint",
+}
+
+func (key SvcParamKey) String() string {
+	if name, ok := svcParamKeyName[key]; ok {
+		return name
+	}
+	return "key" + strconv.Itoa(int(key))
+}
+
+// SvcParam One key=value pair from an SVCB or HTTPS record.  The
+// value is kept in its wire form, the accessors on SVCB_RECORD
+// pick apart the ones we understand.
+type SvcParam struct {
+	Key   SvcParamKey `json:"key"`
+	Value []byte      `json:"value"`
+}
+
+// SVCB_RECORD A service binding (RFC 9460).  A Priority of 0 makes
+// it an alias for Target, otherwise it says the service can be
+// reached at Target ("." meaning the owner name itself) with the
+// given parameters, lower priorities being preferred.
+type SVCB_RECORD struct {
+	Priority uint16     `json:"priority"`
+	Target   string     `json:"target"`
+	Params   []SvcParam `json:"params,omitempty"`
+}
+
+func (r SVCB_RECORD) Dummy() {
+}
+
+// HTTPS_RECORD The same thing as SVCB but specifically for HTTPS,
+// which is what browsers ask for.  It is its own type so the two
+// don't get mixed up in a type switch.
+type HTTPS_RECORD struct {
+	SVCB_RECORD
+}
+
+func (r HTTPS_RECORD) Dummy() {
+}
+
+func (r SVCB_RECORD) String() string {
+	s := fmt.Sprintf("%v %s", r.Priority, r.Target)
+	for _, param := range r.Params {
+		s += fmt.Sprintf(" %v=%x", param.Key, param.Value)
+	}
+	return s
+}
+
+// AliasMode This is true if the record just points at Target
+// rather than describing the service.
+func (r SVCB_RECORD) AliasMode() bool {
+	return r.Priority == 0
+}
+
+// Param This returns the raw value for key, if there is one
+func (r SVCB_RECORD) Param(key SvcParamKey) ([]byte, bool) {
+	for _, param := range r.Params {
+		if param.Key == key {
+			return param.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ALPN This returns the protocol IDs (like "h2" or "h3") from the
+// alpn parameter, each of which is length prefixed on the wire.
+func (r SVCB_RECORD) ALPN() ([]string, error) {
+	value, ok := r.Param(SVCB_ALPN)
+	if !ok {
+		return nil, nil
+	}
+	var alpn []string
+	for len(value) > 0 {
+		n := int(value[0])
+		if n == 0 || n+1 > len(value) {
+			return nil, fmt.Errorf("dns: malformed %v SvcParam", SVCB_ALPN)
+		}
+		alpn = append(alpn, string(value[1:n+1]))
+		value = value[n+1:]
+	}
+	return alpn, nil
+}
+
+// Port This returns the port parameter, and whether there was one
+func (r SVCB_RECORD) Port() (uint16, bool, error) {
+	value, ok := r.Param(SVCB_PORT)
+	if !ok {
+		return 0, false, nil
+	}
+	if len(value) != 2 {
+		return 0, false, fmt.Errorf("dns: malformed %v SvcParam", SVCB_PORT)
+	}
+	return binary.BigEndian.Uint16(value), true, nil
+}
+
+// IPv4Hint This returns the addresses from the ipv4hint parameter
+func (r SVCB_RECORD) IPv4Hint() ([]netip.Addr, error) {
+	return r.hints(SVCB_IPV4HINT, 4)
+}
+
+// IPv6Hint This returns the addresses from the ipv6hint parameter
+func (r SVCB_RECORD) IPv6Hint() ([]netip.Addr, error) {
+	return r.hints(SVCB_IPV6HINT, 16)
+}
+
+func (r SVCB_RECORD) hints(key SvcParamKey, size int) ([]netip.Addr, error) {
+	value, ok := r.Param(key)
+	if !ok {
+		return nil, nil
+	}
+	if len(value) == 0 || len(value)%size != 0 {
+		return nil, fmt.Errorf("dns: malformed %v SvcParam", key)
+	}
+	var addrs []netip.Addr
+	for ; len(value) > 0; value = value[size:] {
+		addr, _ := netip.AddrFromSlice(value[:size])
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// ECH This returns the Encrypted ClientHello config list, which is
+// opaque as far as DNS is concerned and just handed to TLS.
+func (r SVCB_RECORD) ECH() []byte {
+	value, _ := r.Param(SVCB_ECH)
+	return value
+}
+
+// size The approximate size for rdataSize, not counting the
+// interface value
+func (r SVCB_RECORD) size() int64 {
+	size := int64(48 + len(r.Target))
+	for _, param := range r.Params {
+		size += 32 + int64(len(param.Value))
+	}
+	return size
+}
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"bytes"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSvcParams(t *testing.T) {
+	r := SVCB_RECORD{Priority: 1, Target: ".", Params: []SvcParam{
+		{SVCB_ALPN, []byte("\x02h2\x02h3")},
+		{SVCB_PORT, []byte{0x20, 0xfb}},
+		{SVCB_IPV4HINT, []byte{192, 0, 2, 1, 192, 0, 2, 2}},
+		{SVCB_ECH, []byte{0xfe, 0x0d}},
+		{SVCB_IPV6HINT, parseAddrNoerror("2001:db8::1").AsSlice()},
+		{SvcParamKey(65001), []byte("x")},
+	}}
+	if r.AliasMode() {
+		t.Errorf("priority 1 is not alias mode")
+	}
+	if alpn, err := r.ALPN(); err != nil || !slices.Equal(alpn, []string{"h2", "h3"}) {
+		t.Errorf("ALPN() = %v, %v", alpn, err)
+	}
+	if port, ok, err := r.Port(); err != nil || !ok || port != 8443 {
+		t.Errorf("Port() = %v, %v, %v", port, ok, err)
+	}
+	v4, err := r.IPv4Hint()
+	if err != nil || !slices.Equal(v4, []netip.Addr{parseAddrNoerror("192.0.2.1"), parseAddrNoerror("192.0.2.2")}) {
+		t.Errorf("IPv4Hint() = %v, %v", v4, err)
+	}
+	v6, err := r.IPv6Hint()
+	if err != nil || !slices.Equal(v6, []netip.Addr{parseAddrNoerror("2001:db8::1")}) {
+		t.Errorf("IPv6Hint() = %v, %v", v6, err)
+	}
+	if !bytes.Equal(r.ECH(), []byte{0xfe, 0x0d}) {
+		t.Errorf("ECH() = %x", r.ECH())
+	}
+	if s := SvcParamKey(65001).String(); s != "key65001" {
+		t.Errorf("unknown key shown as %s", s)
+	}
+
+	bad := SVCB_RECORD{Priority: 1, Target: ".", Params: []SvcParam{
+		{SVCB_ALPN, []byte("\x05h2")},
+		{SVCB_PORT, []byte{1}},
+		{SVCB_IPV4HINT, []byte{192, 0, 2}},
+	}}
+	if _, err := bad.ALPN(); err == nil {
+		t.Errorf("expected an error for a truncated alpn")
+	}
+	if _, _, err := bad.Port(); err == nil {
+		t.Errorf("expected an error for a short port")
+	}
+	if _, err := bad.IPv4Hint(); err == nil {
+		t.Errorf("expected an error for a partial ipv4hint")
+	}
+}
+
+func TestHTTPSRecord(t *testing.T) {
+	initTestsData(4)
+	https := HTTPS_RECORD{SVCB_RECORD{1, ".", []SvcParam{{SVCB_ALPN, []byte("\x02h3")}}}}
+	commConnect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		msg := &DNSMessage{}
+		if request.qtype == RTYPE_HTTPS {
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				RName: request.name, RType: RTYPE_HTTPS, TTL: 300, RData: https,
+			})
+		}
+		return msg
+	})
+	result := QueryLookup("www.example.com", RTYPE_HTTPS)
+	if len(result) != 1 {
+		t.Fatalf("unexpected result %v", result)
+	}
+	got, ok := result[0].RData.(HTTPS_RECORD)
+	if alpn, _ := got.ALPN(); !ok || !slices.Equal(alpn, []string{"h3"}) {
+		t.Errorf("wrong HTTPS record %v", result[0].RData)
+	}
+
+	// and it survives being saved and loaded
+	var buf bytes.Buffer
+	if err := SaveCache(&buf); err != nil {
+		t.Fatalf("SaveCache: %v", err)
+	}
+	initTestsData(4)
+	if err := LoadCache(&buf); err != nil {
+		t.Fatalf("LoadCache: %v", err)
+	}
+	entry := DefaultResolver.cacheLookup("www.example.com", RTYPE_HTTPS)
+	if entry == nil {
+		t.Fatalf("HTTPS record not restored")
+	}
+	if restored, ok := entry.data[0].(HTTPS_RECORD); !ok ||
+		!bytes.Equal(restored.Params[0].Value, []byte("\x02h3")) || entry.expires.Before(time.Now()) {
+		t.Errorf("HTTPS record restored as %v", entry.data[0])
+	}
+}
@@ -0,0 +1,192 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// AlwaysTCP With this set every query goes over TCP, not just the
+// ones whose answers came back truncated over UDP.  That costs a
+// handshake the first time each server is asked, but the
+// connection is then kept open for the queries after it (see
+// TCPIdleTimeout), and nothing over TCP can be spoofed off-path or
+// truncated.  This is DefaultResolver's, see WithAlwaysTCP for the
+// others.
+var AlwaysTCP = false
+
+// WithAlwaysTCP This is AlwaysTCP for the Resolver.
+func WithAlwaysTCP(on bool) Option {
+	return func(res *Resolver) {
+		*res.alwaysTCP = on
+	}
+}
+
+// TCPIdleTimeout How long a TCP connection to a server is kept open
+// once nothing is waiting on it, in case more queries come along.
+// Servers close idle connections themselves too (RFC 7766 6.2.3),
+// usually after a few seconds, in which case the next query just
+// opens a new one.  This is DefaultResolver's, see
+// WithTCPIdleTimeout for the others.
+var TCPIdleTimeout = 10 * time.Second
+
+// WithTCPIdleTimeout This is TCPIdleTimeout for the Resolver.
+func WithTCPIdleTimeout(timeout time.Duration) Option {
+	return func(res *Resolver) {
+		*res.tcpIdleTimeout = timeout
+	}
+}
+
+// tcpAlways Whether all the manager's queries go over TCP, going by
+// the setting of the Resolver it is for (DefaultResolver's if it
+// isn't for one).
+func (manager *serverCommManager) tcpAlways() bool {
+	if manager.alwaysTCP == nil {
+		return AlwaysTCP
+	}
+	return *manager.alwaysTCP
+}
+
+// tcpIdle How long the manager's TCP connection is kept open once
+// it is idle, going by the setting of the Resolver it is for
+// (DefaultResolver's if it isn't for one).
+func (manager *serverCommManager) tcpIdle() time.Duration {
+	if manager.tcpIdleTimeout == nil {
+		return TCPIdleTimeout
+	}
+	return *manager.tcpIdleTimeout
+}
+
+// tcpConn A TCP connection to a server which any number of requests
+// can be sent over at once (RFC 7766 6.2.1.1).  Responses can come
+// back in any order, and are handed to the manager's dispatch to
+// find the request they answer.
+type tcpConn struct {
+	conn net.Conn
+	// writeLock keeps the messages from different requests from
+	// being interleaved on the wire
+	writeLock sync.Mutex
+	// how many requests are waiting for a response, under lock
+	lock    sync.Mutex
+	waiting int
+	// dead is closed once the connection is no good any more
+	dead chan struct{}
+	// idleTimeout How long it is kept open once nothing is waiting
+	// on it (see TCPIdleTimeout)
+	idleTimeout time.Duration
+}
+
+// tcpConn This is the manager's connection to its server, opening
+// one with dial if there isn't one open already.  For a DNS-over-TLS
+// server that includes the TLS handshake, which checks the server's
+// certificate.
+func (manager *serverCommManager) tcpConn(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error)) (*tcpConn, error) {
+	manager.tcpLock.Lock()
+	defer manager.tcpLock.Unlock()
+	if manager.tcp != nil {
+		return manager.tcp, nil
+	}
+	conn, err := dial(ctx, "tcp", manager.address())
+	if err != nil {
+		return nil, err
+	}
+	if manager.tls != nil {
+		tlsConn := tls.Client(conn, manager.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	c := &tcpConn{conn: conn, dead: make(chan struct{}), idleTimeout: manager.tcpIdle()}
+	manager.tcp = c
+	go manager.readTCP(c)
+	return c, nil
+}
+
+// readTCP This reads the responses coming in on c and delivers them
+// until the connection fails or has been idle for its idleTimeout,
+// then closes it so the next request opens a new one.
+func (manager *serverCommManager) readTCP(c *tcpConn) {
+	defer func() {
+		manager.tcpLock.Lock()
+		if manager.tcp == c {
+			manager.tcp = nil
+		}
+		manager.tcpLock.Unlock()
+		_ = c.conn.Close()
+		close(c.dead)
+	}()
+	buf := wireBuffers.Get().(*[65535]byte)
+	defer wireBuffers.Put(buf)
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+			return
+		}
+		frame := buf[:binary.BigEndian.Uint16(length[:])]
+		if _, err := io.ReadFull(c.conn, frame); err != nil {
+			return
+		}
+		msg, err := manager.unpack(frame, nil)
+		if errors.Is(err, ErrTSIG) {
+			// the message itself was fine, it is just not one
+			// to believe
+			continue
+		}
+		if err != nil {
+			// the stream can't be trusted to still be in step
+			return
+		}
+		manager.dispatch(msg)
+	}
+}
+
+// exchange This sends packet for the in-flight request and waits for
+// it to be delivered.  It returns false if the connection went bad
+// before that, in which case the request may never have reached the
+// server and is worth sending again on a new connection.
+func (c *tcpConn) exchange(ctx context.Context, packet []byte, inflight *inflightRequest) bool {
+	c.lock.Lock()
+	c.waiting++
+	_ = c.conn.SetReadDeadline(time.Time{})
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.waiting--
+		if c.waiting == 0 {
+			// readTCP's read fails once this passes, which closes
+			// the connection
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+		}
+		c.lock.Unlock()
+	}()
+
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packet)), uint16(len(packet)))
+	c.writeLock.Lock()
+	_ = c.conn.SetWriteDeadline(inflight.req.deadline)
+	_, err := c.conn.Write(append(framed, packet...))
+	c.writeLock.Unlock()
+	if err != nil {
+		_ = c.conn.Close()
+		return false
+	}
+	select {
+	case <-inflight.delivered:
+		return true
+	case <-c.dead:
+		select {
+		case <-inflight.delivered:
+			return true
+		default:
+			return false
+		}
+	case <-ctx.Done():
+		return true
+	}
+}
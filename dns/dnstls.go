@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"maps"
+	"net/netip"
+)
+
+// dotPort The port DNS-over-TLS servers listen on (RFC 7858 3.1)
+const dotPort = 853
+
+// DoTServer How to talk to a server over DNS-over-TLS (RFC 7858).
+// Its certificate has to be valid for AuthName, which also goes in
+// the handshake as the SNI, and has to chain up to one of RootCAs,
+// nil meaning the system's roots.  Skipping the check, as the
+// opportunistic profile of RFC 8310 would, isn't offered: it keeps
+// the query from passive eavesdroppers but anyone who can get in
+// the middle can still read and answer it.
+type DoTServer struct {
+	AuthName string
+	RootCAs  *x509.CertPool
+}
+
+// DoTServers The servers DefaultResolver asks over DNS-over-TLS
+// rather than plain UDP and TCP, by address.  Every query to one of
+// them goes over a TLS connection to port 853, which is kept open
+// and shared the same way as the TCP one (see TCPIdleTimeout).  Any
+// other server is asked the usual way.  Changes only apply to
+// servers the resolver hasn't talked to yet.  Resolvers made by New
+// have their own, see WithDoT.
+var DoTServers map[netip.Addr]DoTServer
+
+// WithDoT This makes the Resolver ask the server at addr over
+// DNS-over-TLS, like DoTServers does for DefaultResolver.
+func WithDoT(addr netip.Addr, server DoTServer) Option {
+	return func(res *Resolver) {
+		servers := maps.Clone(*res.dot)
+		if servers == nil {
+			servers = make(map[netip.Addr]DoTServer)
+		}
+		servers[addr.Unmap()] = server
+		*res.dot = servers
+	}
+}
+
+// dotConfig The TLS configuration for the server at addr, nil if it
+// isn't one to use DNS-over-TLS with.
+func (res *Resolver) dotConfig(addr netip.Addr) *tls.Config {
+	server, ok := (*res.dot)[addr.Unmap()]
+	if !ok {
+		return nil
+	}
+	return &tls.Config{
+		ServerName: server.AuthName,
+		RootCAs:    server.RootCAs,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"dot"},
+	}
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned A certificate for name and a pool with it as the root
+func selfSigned(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestDoT(t *testing.T) {
+	cert, pool := selfSigned(t, "dns.example.net")
+	var sni []string
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = append(sni, hello.ServerName)
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	conns := tcpServer(l, [4]byte{192, 0, 2, 10}, 0)
+	var ports []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		ports = append(ports, network+" "+address[strings.LastIndex(address, ":")+1:])
+		return dialLocal(l.Addr().String())(ctx, network, address)
+	}
+	root := parseAddrNoerror("198.41.0.4")
+
+	res := withSingleRoot(New(WithDial(dial), WithDoT(root, DoTServer{AuthName: "dns.example.net", RootCAs: pool})))
+	for _, name := range []string{"www.example.com", "mail.example.com"} {
+		result, err := res.Lookup(name, RTYPE_A)
+		if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.10")}) {
+			t.Errorf("unexpected result %v, %v", result, err)
+		}
+	}
+	if conns.Load() != 1 || len(ports) != 1 || ports[0] != "tcp 853" || len(sni) != 1 || sni[0] != "dns.example.net" {
+		t.Errorf("%d connections to %v with SNI %v, want one to tcp 853 for dns.example.net", conns.Load(), ports, sni)
+	}
+
+	// a certificate for some other name doesn't get a query
+	wrong := withSingleRoot(New(
+		WithDial(dial),
+		WithDoT(root, DoTServer{AuthName: "other.example.net", RootCAs: pool}),
+		WithDefaultRetryPolicy(RetryPolicy{Timeout: 200 * time.Millisecond}),
+	))
+	if result, err := wrong.Lookup("www.example.com", RTYPE_A); err == nil {
+		t.Errorf("got %v from a server with the wrong certificate", result)
+	}
+}
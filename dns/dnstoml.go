@@ -0,0 +1,379 @@
+package dns
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// tomlValue A value from a config file, with the line it is on: a
+// string, an int64, a bool or a []tomlValue
+type tomlValue struct {
+	value any
+	line  int
+}
+
+// tomlTable The keys of one table in a config file, in the order
+// they came in.  name is the table's name with, for one in an array
+// of tables, its index ("upstream[1]"), and "" for the keys before
+// the first table.
+type tomlTable struct {
+	name  string
+	line  int
+	keys  map[string]tomlValue
+	order []string
+}
+
+// tomlDocument A config file: the keys before the first table, and
+// then the tables by name.  A [[name]] table is one of many, a
+// [name] one on its own.
+type tomlDocument struct {
+	root   *tomlTable
+	tables map[string][]*tomlTable
+	arrays map[string]bool
+}
+
+// tomlParser This reads the subset of TOML config files are written
+// in: [table] and [[table]] headers with bare names, and key = value
+// lines with bare keys, the values being strings ("basic", with
+// TOML's escapes, or 'literal'), decimal integers, booleans and
+// arrays of them, which can go over several lines.  Comments start
+// with '#'.  Dotted keys, inline tables, floats, dates, multi-line
+// strings and hex, octal or binary integers aren't understood.
+type tomlParser struct {
+	input string
+	pos   int
+	line  int
+}
+
+// parseTOML This parses the config file in r.
+func parseTOML(r io.Reader) (*tomlDocument, error) {
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &tomlParser{input: string(input), line: 1}
+	doc := &tomlDocument{
+		root:   &tomlTable{line: 1, keys: map[string]tomlValue{}},
+		tables: map[string][]*tomlTable{},
+		arrays: map[string]bool{},
+	}
+	table := doc.root
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) {
+			return doc, nil
+		}
+		switch p.input[p.pos] {
+		case '\n', '#', '\r':
+			if err := p.endOfLine(); err != nil {
+				return nil, err
+			}
+		case '[':
+			table, err = p.header(doc)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if err := p.keyValue(table); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// errorf An error for the line the parser is on
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace This skips spaces and tabs.
+func (p *tomlParser) skipSpace() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// endOfLine This skips what is left of the line, which can only be
+// a comment, and the newline.
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == '#' {
+		for p.pos < len(p.input) && p.input[p.pos] != '\n' {
+			p.pos++
+		}
+	}
+	if p.pos < len(p.input) && p.input[p.pos] == '\r' {
+		p.pos++
+	}
+	if p.pos >= len(p.input) {
+		return nil
+	}
+	if p.input[p.pos] != '\n' {
+		return p.errorf("unexpected %q after the value", p.rest())
+	}
+	p.pos++
+	p.line++
+	return nil
+}
+
+// rest What is left of the line, for errors
+func (p *tomlParser) rest() string {
+	rest, _, _ := strings.Cut(p.input[p.pos:], "\n")
+	return strings.TrimSpace(rest)
+}
+
+// bareKey This reads a key or table name, which is letters, digits,
+// '_' and '-'.
+func (p *tomlParser) bareKey() (string, error) {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-') {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a key at %q", p.rest())
+	}
+	return p.input[start:p.pos], nil
+}
+
+// header This reads a [table] or [[table]] header and returns the
+// table the keys after it go in.
+func (p *tomlParser) header(doc *tomlDocument) (*tomlTable, error) {
+	array := strings.HasPrefix(p.input[p.pos:], "[[")
+	end := "]"
+	p.pos++
+	if array {
+		end = "]]"
+		p.pos++
+	}
+	p.skipSpace()
+	name, err := p.bareKey()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !strings.HasPrefix(p.input[p.pos:], end) {
+		return nil, p.errorf("expected %q after the table name %s", end, name)
+	}
+	p.pos += len(end)
+	if tables, ok := doc.tables[name]; ok && (!array || !doc.arrays[name]) {
+		return nil, p.errorf("table %s was already defined on line %d", name, tables[0].line)
+	}
+	table := &tomlTable{name: name, line: p.line, keys: map[string]tomlValue{}}
+	if array {
+		table.name = fmt.Sprintf("%s[%d]", name, len(doc.tables[name]))
+		doc.arrays[name] = true
+	}
+	doc.tables[name] = append(doc.tables[name], table)
+	return table, p.endOfLine()
+}
+
+// keyValue This reads a key = value line into table.
+func (p *tomlParser) keyValue(table *tomlTable) error {
+	line := p.line
+	key, err := p.bareKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '=' {
+		return p.errorf("expected '=' after %s", key)
+	}
+	p.pos++
+	p.skipSpace()
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	if previous, ok := table.keys[key]; ok {
+		return fmt.Errorf("line %d: %s was already set on line %d", line, key, previous.line)
+	}
+	table.keys[key] = value
+	table.order = append(table.order, key)
+	return p.endOfLine()
+}
+
+// value This reads a value.
+func (p *tomlParser) value() (tomlValue, error) {
+	value := tomlValue{line: p.line}
+	if p.pos >= len(p.input) {
+		return value, p.errorf("expected a value")
+	}
+	switch c := p.input[p.pos]; {
+	case c == '"':
+		s, err := p.basicString()
+		if err != nil {
+			return value, err
+		}
+		value.value = s
+	case c == '\'':
+		end := strings.IndexAny(p.input[p.pos+1:], "'\n")
+		if end < 0 || p.input[p.pos+1+end] != '\'' {
+			return value, p.errorf("unterminated string")
+		}
+		s := p.input[p.pos+1 : p.pos+1+end]
+		if i := strings.IndexFunc(s, isTOMLControl); i >= 0 {
+			return value, p.errorf("control character %q in a string", s[i])
+		}
+		value.value = s
+		p.pos += end + 2
+	case c == '[':
+		p.pos++
+		elements, err := p.array()
+		if err != nil {
+			return value, err
+		}
+		value.value = elements
+	default:
+		start := p.pos
+		for p.pos < len(p.input) && !strings.ContainsRune(" \t\r\n#,]", rune(p.input[p.pos])) {
+			p.pos++
+		}
+		word := p.input[start:p.pos]
+		switch word {
+		case "true", "false":
+			value.value = word == "true"
+			return value, nil
+		}
+		n, ok := tomlInteger(word)
+		if !ok {
+			return value, p.errorf("bad value %q: expected a quoted string, a whole number, true, false or an array", word)
+		}
+		value.value = n
+	}
+	return value, nil
+}
+
+// tomlEscapes What the single character escapes in a basic string
+// stand for
+var tomlEscapes = map[byte]byte{'b': '\b', 't': '\t', 'n': '\n', 'f': '\f', 'r': '\r', '"': '"', '\\': '\\'}
+
+// basicString This reads a "basic" string.  The escapes are TOML's:
+// the ones in tomlEscapes plus \uXXXX and \UXXXXXXXX for a Unicode
+// code point.  Anything else after a backslash is an error, rather
+// than being taken the way Go would take it.
+func (p *tomlParser) basicString() (string, error) {
+	var b strings.Builder
+	for i := p.pos + 1; i < len(p.input); {
+		switch c := p.input[i]; {
+		case c == '"':
+			p.pos = i + 1
+			return b.String(), nil
+		case c == '\n' || c == '\r':
+			return "", p.errorf("unterminated string")
+		case c == '\\':
+			if i+1 >= len(p.input) {
+				return "", p.errorf("unterminated string")
+			}
+			escape := p.input[i+1]
+			if r, ok := tomlEscapes[escape]; ok {
+				b.WriteByte(r)
+				i += 2
+				continue
+			}
+			digits := map[byte]int{'u': 4, 'U': 8}[escape]
+			if digits == 0 {
+				return "", p.errorf("bad escape \\%c in a string", escape)
+			}
+			hex := p.input[i+2 : min(i+2+digits, len(p.input))]
+			r, err := strconv.ParseUint(hex, 16, 32)
+			if len(hex) != digits || err != nil || !utf8.ValidRune(rune(r)) {
+				return "", p.errorf("bad escape \\%c%s in a string", escape, hex)
+			}
+			b.WriteRune(rune(r))
+			i += 2 + digits
+		case isTOMLControl(rune(c)):
+			return "", p.errorf("control character %q in a string", c)
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// isTOMLControl Whether r is a control character, which TOML doesn't
+// allow in a string other than a tab
+func isTOMLControl(r rune) bool {
+	return r < 0x20 && r != '\t' || r == 0x7f
+}
+
+// tomlInteger This parses a decimal integer the way TOML writes
+// them: an optional sign, no leading zeros, and '_' only ever between
+// two digits.
+func tomlInteger(word string) (int64, bool) {
+	digits := word
+	if digits != "" && (digits[0] == '+' || digits[0] == '-') {
+		digits = digits[1:]
+	}
+	if digits == "" || len(digits) > 1 && digits[0] == '0' {
+		return 0, false
+	}
+	for i := 0; i < len(digits); i++ {
+		switch c := digits[i]; {
+		case c == '_':
+			if i == 0 || i == len(digits)-1 || digits[i+1] == '_' {
+				return 0, false
+			}
+		case c < '0' || c > '9':
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 10, 64)
+	return n, err == nil
+}
+
+// array This reads the elements of an array, up to and including
+// its closing ']'.  Between them there can be newlines and comments.
+func (p *tomlParser) array() ([]tomlValue, error) {
+	elements := []tomlValue{}
+	for {
+		if err := p.skipBlank(); err != nil {
+			return nil, err
+		}
+		if p.pos < len(p.input) && p.input[p.pos] == ']' {
+			p.pos++
+			return elements, nil
+		}
+		element, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+		if err := p.skipBlank(); err != nil {
+			return nil, err
+		}
+		if p.pos < len(p.input) && p.input[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		if p.pos >= len(p.input) || p.input[p.pos] != ']' {
+			return nil, p.errorf("expected ',' or ']' in the array")
+		}
+	}
+}
+
+// skipBlank This skips spaces, newlines and comments inside an
+// array.
+func (p *tomlParser) skipBlank() error {
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) {
+			return p.errorf("unterminated array")
+		}
+		switch p.input[p.pos] {
+		case '#', '\r', '\n':
+			if err := p.endOfLine(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tomlFlat The keys of doc as "table.key" (just "key" before the
+// first table), with the values turned into plain Go values and the
+// line each is on.
+func tomlFlat(doc *tomlDocument) map[string]any {
+	var plain func(v tomlValue) any
+	plain = func(v tomlValue) any {
+		elements, ok := v.value.([]tomlValue)
+		if !ok {
+			return v.value
+		}
+		values := []any{}
+		for _, element := range elements {
+			values = append(values, plain(element))
+		}
+		return values
+	}
+	flat := map[string]any{}
+	add := func(table *tomlTable) {
+		for key, v := range table.keys {
+			if table.name != "" {
+				key = table.name + "." + key
+			}
+			flat[key] = plain(v)
+			flat[key+"@"] = v.line
+		}
+	}
+	add(doc.root)
+	for _, tables := range doc.tables {
+		for _, table := range tables {
+			add(table)
+		}
+	}
+	return flat
+}
+
+func TestParseTOML(t *testing.T) {
+	for _, test := range []struct {
+		name, input string
+		want        map[string]any
+	}{
+		{"literal and basic strings", `a = 'C:\dir\n' # not an escape
+b = "C:\\dir\n"
+c = ''
+d = "it's"
+e = 'say "hi"'
+`, map[string]any{
+			"a": `C:\dir\n`, "a@": 1,
+			"b": "C:\\dir\n", "b@": 2,
+			"c": "", "c@": 3,
+			"d": "it's", "d@": 4,
+			"e": `say "hi"`, "e@": 5,
+		}},
+		{"escapes", `s = "\b\t\n\f\r\"\\ \u00e9 \U0001F600 tab:	."`, map[string]any{
+			"s": "\b\t\n\f\r\"\\ é 😀 tab:\t.", "s@": 1,
+		}},
+		{"CRLF", "# comment\r\n[server]\r\nlisten = [\r\n\t\"a\", # first\r\n\t'b',\r\n]\r\nudp_size = 1232\r\n\r\nquiet = true\r\n", map[string]any{
+			"server.listen": []any{"a", "b"}, "server.listen@": 3,
+			"server.udp_size": int64(1232), "server.udp_size@": 7,
+			"server.quiet": true, "server.quiet@": 9,
+		}},
+		{"multi-line arrays", `servers = [  # the servers
+	# a comment on a line of its own
+
+	"10.0.0.1",   # trailing comma next
+
+	"10.0.0.2",
+]
+empty = [
+]
+nested = [[1, 2], [], ["x"]]
+after = 1
+`, map[string]any{
+			"servers": []any{"10.0.0.1", "10.0.0.2"}, "servers@": 1,
+			"empty": []any{}, "empty@": 8,
+			"nested": []any{[]any{int64(1), int64(2)}, []any{}, []any{"x"}}, "nested@": 10,
+			"after": int64(1), "after@": 11,
+		}},
+		{"arrays of tables", `[[upstream]]
+address = "1.1.1.1"
+[[ upstream ]]
+address = "9.9.9.9"
+[cache]
+shards = 4
+`, map[string]any{
+			"upstream[0].address": "1.1.1.1", "upstream[0].address@": 2,
+			"upstream[1].address": "9.9.9.9", "upstream[1].address@": 4,
+			"cache.shards": int64(4), "cache.shards@": 6,
+		}},
+		{"integers", "a = 1_000_000\nb = -5\nc = +7\nd = 0\ne = 9_223_372_036_854_775_807\n", map[string]any{
+			"a": int64(1000000), "a@": 1,
+			"b": int64(-5), "b@": 2,
+			"c": int64(7), "c@": 3,
+			"d": int64(0), "d@": 4,
+			"e": int64(9223372036854775807), "e@": 5,
+		}},
+		{"no newline at the end", "a = 1", map[string]any{"a": int64(1), "a@": 1}},
+	} {
+		doc, err := parseTOML(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := tomlFlat(doc); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got\n%#v\nwant\n%#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, test := range []struct {
+		name, input, want string
+	}{
+		{"Go hex escape", `a = "\x41"`, `line 1: bad escape \x in a string`},
+		{"Go bell escape", "a = 1\nb = \"\\a\"", `line 2: bad escape \a in a string`},
+		{"short unicode escape", `a = "\u00e"`, `line 1: bad escape \u00e" in a string`},
+		{"surrogate", `a = "\ud800"`, `line 1: bad escape \ud800 in a string`},
+		{"control character", "a = \"x\x01\"", `line 1: control character '\x01' in a string`},
+		{"control character literal", "a = 'x\x7f'", `line 1: control character '\x7f' in a string`},
+		{"newline in a string", "a = \"abc\nb = 1\n", "line 1: unterminated string"},
+		{"CR in a string", "a = \"abc\r\n", "line 1: unterminated string"},
+
+		{"table after array of tables", "[[t]]\na = 1\n[t]\n", "line 3: table t was already defined on line 1"},
+		{"array of tables after table", "[t]\na = 1\n\n[[t]]\n", "line 4: table t was already defined on line 1"},
+		{"table twice", "[t]\n[t]\n", "line 2: table t was already defined on line 1"},
+		{"duplicate key in an array of tables", "[[t]]\na = 1\n[[t]]\na = 1\na = 2\n", "line 5: a was already set on line 4"},
+
+		{"leading underscore", "a = _1\n", `line 1: bad value "_1": expected a quoted string, a whole number, true, false or an array`},
+		{"trailing underscore", "a = 1_\n", `line 1: bad value "1_": expected a quoted string, a whole number, true, false or an array`},
+		{"double underscore", "a = 1__0\n", `line 1: bad value "1__0": expected a quoted string, a whole number, true, false or an array`},
+		{"underscore after the sign", "a = -_1\n", `line 1: bad value "-_1": expected a quoted string, a whole number, true, false or an array`},
+		{"leading zero", "a = 012\n", `line 1: bad value "012": expected a quoted string, a whole number, true, false or an array`},
+		{"too big", "a = 9_223_372_036_854_775_808\n", `line 1: bad value "9_223_372_036_854_775_808": expected a quoted string, a whole number, true, false or an array`},
+		{"hex", "a = 0x10\n", `line 1: bad value "0x10": expected a quoted string, a whole number, true, false or an array`},
+
+		{"garbage after a number", "a = 1 2\n", `line 1: unexpected "2" after the value`},
+		{"garbage after a string", "a = \"x\" \"y\"\n", `line 1: unexpected "\"y\"" after the value`},
+		{"garbage after an array", "a = [1] x\n", `line 1: unexpected "x" after the value`},
+		{"garbage after a header", "[t] x\n", `line 1: unexpected "x" after the value`},
+		{"garbage with CRLF", "a = 1\r\nb = 2\r\nc = 3 x\r\n", `line 3: unexpected "x" after the value`},
+
+		{"EOF after =", "a =", "line 1: expected a value"},
+		{"EOF in a basic string", `a = "abc`, "line 1: unterminated string"},
+		{"EOF after a backslash", `a = "abc\`, "line 1: unterminated string"},
+		{"EOF in a literal string", "a = 'abc", "line 1: unterminated string"},
+		{"EOF in an array", "a = [1,\n  2,\n", "line 3: unterminated array"},
+		{"EOF in a header", "[server", `line 1: expected "]" after the table name server`},
+		{"EOF after a key", "a", "line 1: expected '=' after a"},
+	} {
+		_, err := parseTOML(strings.NewReader(test.input))
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		} else if err.Error() != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, err, test.want)
+		}
+	}
+}
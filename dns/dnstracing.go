@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Tracer What a Resolver reports the spans of its lookups to, for
+// distributed tracing.  It is shaped after OpenTelemetry's
+// trace.Tracer, so that one can be used with a few lines of glue:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, dns.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+//		return ctx, otelSpan{span}
+//	}
+//
+// with otelSpan turning the slog.Attrs into attribute.KeyValues.
+// Start gets the caller's context, so the spans of a lookup made
+// while a request is being traced are part of that request's trace.
+// There is a "dns.lookup" span for every Lookup (including those the
+// Resolver makes itself, for the addresses of nameservers, which are
+// children of the lookup that needed them), and under it a
+// "dns.query" span for every server asked, with the server, the
+// RTT, the RCODE and how many times the query had to be sent.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span One operation being traced, see Tracer
+type Span interface {
+	SetAttributes(attrs ...slog.Attr)
+	RecordError(err error)
+	End()
+}
+
+// Tracing The Tracer DefaultResolver reports its lookups to, nil
+// (the default) for none.  Resolvers made by New have their own, see
+// WithTracer.
+var Tracing Tracer
+
+// WithTracer This makes the Resolver report its lookups to tracer,
+// like Tracing does for DefaultResolver.
+func WithTracer(tracer Tracer) Option {
+	return func(res *Resolver) {
+		*res.tracer = tracer
+	}
+}
+
+// noSpan The Span of a Resolver with no Tracer
+type noSpan struct{}
+
+func (noSpan) SetAttributes(...slog.Attr) {}
+func (noSpan) RecordError(error)          {}
+func (noSpan) End()                       {}
+
+// startSpan This starts the span called name, with attrs, if the
+// Resolver has a Tracer.
+func (res *Resolver) startSpan(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	tracer := *res.tracer
+	if tracer == nil {
+		return ctx, noSpan{}
+	}
+	ctx, span := tracer.Start(ctx, name)
+	span.SetAttributes(attrs...)
+	return ctx, span
+}
+
+// querySpanKey The context key for the "dns.query" span of the
+// askServer a request is sent for, for exchange to fill in
+type querySpanKey struct{}
+
+// querySpan The "dns.query" span ctx is for, one that does nothing if
+// there isn't one.
+func querySpan(ctx context.Context) Span {
+	if span, ok := ctx.Value(querySpanKey{}).(Span); ok {
+		return span
+	}
+	return noSpan{}
+}
+
+// traceExchange This records on the query's span how one exchange
+// with the server went: msg being what came back, nil if nothing
+// did, after rtt, and the request having been sent retransmits more
+// times than the first.
+func traceExchange(ctx context.Context, req *serverDNSRequest, msg *DNSMessage, rtt time.Duration) {
+	span := querySpan(ctx)
+	if _, ok := span.(noSpan); ok {
+		return
+	}
+	attrs := []slog.Attr{slog.Bool("dns.tcp", req.tcp), slog.Int("dns.retransmits", int(req.retransmitted.Load()))}
+	if msg != nil {
+		attrs = append(attrs,
+			slog.String("dns.rcode", msg.Header.Status.String()),
+			slog.Int("dns.answers", len(msg.Answers)),
+			slog.Duration("dns.rtt", rtt))
+	}
+	span.SetAttributes(attrs...)
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTracer This keeps every span started with it.
+type recordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent *recordedSpan
+	attrs  map[string]slog.Value
+	errs   []error
+	ended  bool
+}
+
+type recordedSpanKey struct{}
+
+func (tracer *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	span := &recordedSpan{tracer: tracer, name: name, parent: parent, attrs: make(map[string]slog.Value)}
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	tracer.spans = append(tracer.spans, span)
+	return context.WithValue(ctx, recordedSpanKey{}, span), span
+}
+
+func (span *recordedSpan) SetAttributes(attrs ...slog.Attr) {
+	span.tracer.lock.Lock()
+	defer span.tracer.lock.Unlock()
+	for _, attr := range attrs {
+		span.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (span *recordedSpan) RecordError(err error) {
+	span.tracer.lock.Lock()
+	defer span.tracer.lock.Unlock()
+	span.errs = append(span.errs, err)
+}
+
+func (span *recordedSpan) End() {
+	span.tracer.lock.Lock()
+	defer span.tracer.lock.Unlock()
+	span.ended = true
+}
+
+// find The spans called name with the attribute dns.name being qname
+func (tracer *recordingTracer) find(name, qname string) []*recordedSpan {
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	var out []*recordedSpan
+	for _, span := range tracer.spans {
+		if span.name == name && span.attrs["dns.name"].String() == qname {
+			out = append(out, span)
+		}
+	}
+	return out
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	res := withSingleRoot(New(
+		WithTracer(tracer),
+		WithDefaultRetryPolicy(RetryPolicy{Timeout: 50 * time.Millisecond, Attempts: 1}),
+	))
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		switch {
+		case request.name == "slow.example.com":
+			return nil
+		case request.name == "big.example.com" && !request.tcp:
+			return &DNSMessage{Header: DNSHeader{Truncated: true}}
+		}
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.110")},
+		}}}
+	})
+
+	// the caller's span is the parent of the lookup's
+	ctx, caller := tracer.Start(context.Background(), "request")
+	if _, err := res.LookupCtx(ctx, "big.example.com", RTYPE_A); err != nil {
+		t.Fatal(err)
+	}
+	lookups := tracer.find("dns.lookup", "big.example.com")
+	if len(lookups) != 1 || lookups[0].parent != caller || !lookups[0].ended || lookups[0].attrs["dns.answers"].Int64() != 1 {
+		t.Fatalf("unexpected lookup spans %+v", lookups)
+	}
+	queries := tracer.find("dns.query", "big.example.com")
+	if len(queries) != 1 {
+		t.Fatalf("unexpected query spans %+v", queries)
+	}
+	query := queries[0]
+	if query.parent != lookups[0] || !query.ended || len(query.errs) != 0 {
+		t.Errorf("unexpected query span %+v", query)
+	}
+	for key, want := range map[string]string{
+		"server.address": "198.41.0.4",
+		"dns.type":       "A",
+		"dns.rcode":      "RCODE_OK",
+		"dns.tcp":        "true",
+		"dns.retries":    "1",
+		"dns.answers":    "1",
+	} {
+		if got := query.attrs[key].String(); got != want {
+			t.Errorf("query span %s = %q, want %q", key, got, want)
+		}
+	}
+	if query.attrs["dns.rtt"].Kind() != slog.KindDuration {
+		t.Errorf("query span has no RTT: %+v", query.attrs)
+	}
+
+	// a server that doesn't answer is an error on both
+	res.Lookup("slow.example.com", RTYPE_A)
+	lookups = tracer.find("dns.lookup", "slow.example.com")
+	queries = tracer.find("dns.query", "slow.example.com")
+	if len(lookups) != 1 || len(lookups[0].errs) != 1 || lookups[0].parent != nil {
+		t.Errorf("unexpected lookup spans %+v", lookups)
+	}
+	if len(queries) != 1 || len(queries[0].errs) != 1 || queries[0].attrs["dns.rcode"].Kind() != slog.KindAny {
+		t.Errorf("unexpected query spans %+v", queries)
+	}
+}
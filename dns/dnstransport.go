@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"context"
+	mathrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// serverPort The port DNS servers listen on
+const serverPort = 53
+
+// netCommManager This starts manager really talking to its server,
+// connecting with dial (nil meaning a net.Dialer, see WithDial).
+// manager has its remote set, and its tls, doh or doq for a server
+// to ask over DNS-over-TLS, HTTPS or QUIC.  Every UDP request gets
+// a socket of its own, so each query goes out from a different
+// random port (RFC 5452) and a response can only ever turn up on
+// the socket of the query it answers.
+func netCommManager(manager *serverCommManager, dial func(ctx context.Context, network, address string) (net.Conn, error)) *serverCommManager {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	manager.requests = make(chan *serverDNSRequest)
+	manager.stopped = make(chan struct{})
+	go func() {
+		var sending sync.WaitGroup
+		for req := range manager.requests {
+			sending.Add(1)
+			go func() {
+				defer sending.Done()
+				manager.send(dial, req)
+			}()
+		}
+		sending.Wait()
+		close(manager.stopped)
+	}()
+	return manager
+}
+
+// address The server's address and port, for dial
+func (manager *serverCommManager) address() string {
+	if manager.tls != nil || manager.doq != nil {
+		return netip.AddrPortFrom(*manager.remote, dotPort).String()
+	}
+	return netip.AddrPortFrom(*manager.remote, serverPort).String()
+}
+
+// send This sends req to the server, over UDP or TCP as it says (or
+// always over TLS, HTTPS or QUIC for a DoT, DoH or DoQ server), and
+// delivers the response.  It gives up at req's deadline or when its
+// lookup is done.  A request that can't even be put in wire form
+// (a name with an empty label say) or a server that can't be
+// reached just never gets a response, and so times out like any
+// other server that doesn't answer.
+func (manager *serverCommManager) send(dial func(ctx context.Context, network, address string) (net.Conn, error), req *serverDNSRequest) {
+	inflight, ok := manager.track(req)
+	if !ok {
+		return
+	}
+	defer manager.untrack(inflight)
+	packet, err := packQuery(req.id, req.name, req.qtype, req.rd, req.cd, req.edns)
+	if err != nil {
+		return
+	}
+	if manager.tsig != nil {
+		if packet, err = manager.sign(packet, req); err != nil {
+			return
+		}
+	}
+	ctx, cancel := context.WithDeadline(req.ctx, req.deadline)
+	defer cancel()
+	if manager.doh != nil {
+		manager.sendDoH(ctx, packet, req)
+	} else if manager.doq != nil {
+		manager.sendDoQ(ctx, packet, req)
+	} else if req.tcp || manager.tls != nil {
+		manager.sendTCP(ctx, dial, packet, inflight)
+	} else {
+		manager.sendUDP(ctx, dial, packet, inflight)
+	}
+}
+
+// sendUDP This is send for UDP.  Anything that arrives on the socket
+// which isn't a well-formed response to req is ignored and we carry
+// on listening, so a stray or forged packet can't cut the real
+// response off.  If nothing has come back after req's retransmit,
+// the query is sent again on the same socket, so that a response
+// to any of the copies is taken.
+func (manager *serverCommManager) sendUDP(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), packet []byte, inflight *inflightRequest) {
+	conn, err := dial(ctx, "udp", manager.address())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	req := inflight.req
+	_ = conn.SetDeadline(req.deadline)
+	// the deadline covers the timeout, this covers the lookup
+	// finishing before then
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if _, err := conn.Write(packet); err != nil {
+		return
+	}
+	retransmits := 0
+	// how long to read for before the next copy goes
+	wait := func() {
+		if retransmits < req.retransmits && req.retransmit > 0 {
+			if next := time.Now().Add(req.retransmit); next.Before(req.deadline) {
+				_ = conn.SetReadDeadline(next)
+				return
+			}
+		}
+		_ = conn.SetReadDeadline(req.deadline)
+	}
+	wait()
+	buf := wireBuffers.Get().(*[65535]byte)
+	defer wireBuffers.Put(buf)
+	for {
+		n, err := conn.Read(buf[:])
+		if err, ok := err.(net.Error); ok && err.Timeout() && retransmits < req.retransmits && time.Now().Before(req.deadline) && ctx.Err() == nil {
+			retransmits++
+			req.retransmitted.Add(1)
+			if _, err := conn.Write(packet); err != nil {
+				return
+			}
+			wait()
+			continue
+		}
+		if err != nil {
+			return
+		}
+		msg, err := manager.unpack(buf[:n], inflight.req)
+		if err != nil {
+			continue
+		}
+		if msg.Header.ID == req.id && manager.dispatch(msg) {
+			return
+		}
+	}
+}
+
+// sendTCP This is send for TCP, which goes over the connection the
+// manager keeps open to the server (see tcpConn).  If that turns
+// out to have been closed under us, by the server most likely, the
+// request is sent again on a new one.
+func (manager *serverCommManager) sendTCP(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), packet []byte, inflight *inflightRequest) {
+	for range 2 {
+		c, err := manager.tcpConn(ctx, dial)
+		if err != nil || c.exchange(ctx, packet, inflight) {
+			return
+		}
+	}
+}
+
+// inflightRequest A request the manager has sent and not yet given up
+// on, and what gets closed once it has been delivered
+type inflightRequest struct {
+	req       *serverDNSRequest
+	delivered chan struct{}
+}
+
+// track This adds req to the requests in flight to the server, which
+// is what dispatch finds the request a response is for in.  No two
+// of them ever have the same ID, so a response can only be for the
+// one: if req's ID is already taken it gets another, picked at
+// random like the first.  It returns false if every ID is taken.
+func (manager *serverCommManager) track(req *serverDNSRequest) (*inflightRequest, bool) {
+	manager.inflightLock.Lock()
+	defer manager.inflightLock.Unlock()
+	if len(manager.inflight) > 0xffff {
+		return nil, false
+	}
+	if manager.inflight == nil {
+		manager.inflight = make(map[uint16]*inflightRequest)
+	}
+	for manager.inflight[req.id] != nil {
+		req.id = uint16(mathrand.Uint32())
+	}
+	inflight := &inflightRequest{req: req, delivered: make(chan struct{})}
+	manager.inflight[req.id] = inflight
+	return inflight, true
+}
+
+// untrack This takes inflight off the requests in flight.
+func (manager *serverCommManager) untrack(inflight *inflightRequest) {
+	manager.inflightLock.Lock()
+	defer manager.inflightLock.Unlock()
+	if manager.inflight[inflight.req.id] == inflight {
+		delete(manager.inflight, inflight.req.id)
+	}
+}
+
+// dispatch This delivers msg, which came from the server, to the
+// request in flight with its ID, which is then no longer in flight.
+// It returns whether there was one and msg was really its response
+// (see deliver).
+func (manager *serverCommManager) dispatch(msg *DNSMessage) bool {
+	manager.inflightLock.Lock()
+	defer manager.inflightLock.Unlock()
+	inflight := manager.inflight[msg.Header.ID]
+	if inflight == nil || !inflight.req.deliver(*manager.remote, msg) {
+		return false
+	}
+	delete(manager.inflight, msg.Header.ID)
+	close(inflight.delivered)
+	return true
+}
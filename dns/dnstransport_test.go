@@ -0,0 +1,309 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dialLocal A WithDial function sending everything to the server at
+// addr, whichever server it was meant for.
+func dialLocal(addr string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+}
+
+func TestUDPTransport(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := unpackMessage(buf[:n])
+			if err != nil {
+				t.Errorf("bad query: %v", err)
+				continue
+			}
+			// some junk and a response to some other query first,
+			// which must not stop the real one getting through
+			conn.WriteTo([]byte{1, 2, 3}, from)
+			conn.WriteTo(wireResponse(query.Header.ID+1, 0, query.Question.QName, query.Question.QType, 0, nil), from)
+			answer := wireRecord(RTYPE_A, 300, []byte{192, 0, 2, 7})
+			conn.WriteTo(wireResponse(query.Header.ID, 0, query.Question.QName, query.Question.QType, 1, answer), from)
+		}
+	}()
+	res := withSingleRoot(New(WithDial(dialLocal(conn.LocalAddr().String()))))
+	result, err := res.Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.7")}) {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+}
+
+// tcpServer This answers every query on every connection to l with
+// an A record for addr, closing each connection after perConn
+// answers (0 meaning never), and returns how many connections were
+// made.
+func tcpServer(l net.Listener, addr [4]byte, perConn int) *atomic.Int32 {
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conn.Close()
+				for answered := 0; perConn == 0 || answered < perConn; answered++ {
+					var length [2]byte
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					query, _ := unpackMessage(buf)
+					answer := wireRecord(RTYPE_A, 300, addr[:])
+					response := wireResponse(query.Header.ID, 0, query.Question.QName, query.Question.QType, 1, answer)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+	return &conns
+}
+
+func TestTCPTransport(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer udp.Close()
+	// the TCP server goes on the same port, as it would on port 53
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	defer tcp.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, _ := unpackMessage(buf[:n])
+			udp.WriteTo(wireResponse(query.Header.ID, flagTC, query.Question.QName, query.Question.QType, 0, nil), from)
+		}
+	}()
+	conns := tcpServer(tcp, [4]byte{192, 0, 2, 8}, 0)
+	res := withSingleRoot(New(WithDial(dialLocal(udp.LocalAddr().String()))))
+	for _, name := range []string{"www.example.com", "mail.example.com"} {
+		result, err := res.Lookup(name, RTYPE_A)
+		if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.8")}) {
+			t.Errorf("unexpected result %v, %v", result, err)
+		}
+	}
+	// the second retry over TCP went over the same connection
+	if conns.Load() != 1 {
+		t.Errorf("%d TCP connections, want 1", conns.Load())
+	}
+}
+
+func TestAlwaysTCP(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer tcp.Close()
+	// a server that hangs up after every answer, so each lookup
+	// finds the connection closed and has to open another
+	conns := tcpServer(tcp, [4]byte{192, 0, 2, 9}, 1)
+	res := withSingleRoot(New(WithDial(dialLocal(tcp.Addr().String())), WithAlwaysTCP(true)))
+	for _, name := range []string{"www.example.com", "mail.example.com", "ftp.example.com"} {
+		result, err := res.Lookup(name, RTYPE_A)
+		if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.9")}) {
+			t.Errorf("unexpected result %v, %v", result, err)
+		}
+	}
+	if n := conns.Load(); n < 2 {
+		t.Errorf("%d TCP connections, want one for each lookup", n)
+	}
+}
+
+func TestOutOfOrderResponses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	names := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com"}
+	// the server waits for all the queries and then answers them
+	// last first, each with the address for its name
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var queries []*DNSMessage
+		for range names {
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+			query, _ := unpackMessage(buf)
+			queries = append(queries, query)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			query := queries[i]
+			answer := wireRecord(RTYPE_A, 300, []byte{192, 0, 2, query.Question.QName[0]})
+			response := wireResponse(query.Header.ID, 0, query.Question.QName, query.Question.QType, 1, answer)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+		}
+	}()
+	addr := parseAddrNoerror("192.0.2.53")
+	manager := netCommManager(&serverCommManager{remote: &addr}, dialLocal(l.Addr().String()))
+	results := make(chan bool, len(names))
+	for _, name := range names {
+		go func() {
+			msg := manager.exchange(context.Background(), name, RTYPE_A, true, nil, 2*time.Second)
+			results <- msg != nil && len(msg.Answers) == 1 &&
+				msg.Answers[0].RData == (A_RECORD{netip.AddrFrom4([4]byte{192, 0, 2, name[0]})})
+		}()
+	}
+	for range names {
+		if !<-results {
+			t.Errorf("a query didn't get its own answer")
+		}
+	}
+}
+
+func TestTrackUniqueIDs(t *testing.T) {
+	manager := &serverCommManager{}
+	first, _ := manager.track(&serverDNSRequest{id: 7})
+	second, _ := manager.track(&serverDNSRequest{id: 7})
+	if first.req.id != 7 || second.req.id == 7 {
+		t.Errorf("in flight with IDs %d and %d", first.req.id, second.req.id)
+	}
+	manager.untrack(first)
+	if third, _ := manager.track(&serverDNSRequest{id: 7}); third.req.id != 7 {
+		t.Errorf("ID 7 wasn't free again once untracked")
+	}
+}
+
+func TestUDPTransportIPv6(t *testing.T) {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := unpackMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			answer := wireRecord(RTYPE_A, 300, []byte{192, 0, 2, 8})
+			conn.WriteTo(wireResponse(query.Header.ID, 0, query.Question.QName, query.Question.QType, 1, answer), from)
+		}
+	}()
+	// the root is only reachable over IPv6, and dialled at its
+	// own address and port 53
+	var dialled string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialled = address
+		return dialLocal(conn.LocalAddr().String())(ctx, network, address)
+	}
+	res := New(WithDial(dial))
+	if err := res.LoadRootHints(strings.NewReader(".  NS  a.root-servers.net.\na.root-servers.net.  AAAA  2001:503:ba3e::2:30\n")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := res.Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.8")}) {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	if dialled != "[2001:503:ba3e::2:30]:53" {
+		t.Errorf("dialled %q", dialled)
+	}
+}
+
+func TestUDPRetransmit(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	// the first two copies of every query get lost
+	var lock sync.Mutex
+	var ids []uint16
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := unpackMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			lock.Lock()
+			ids = append(ids, query.Header.ID)
+			lost := len(ids)%3 != 0
+			lock.Unlock()
+			if lost {
+				continue
+			}
+			answer := wireRecord(RTYPE_A, 300, []byte{192, 0, 2, 13})
+			conn.WriteTo(wireResponse(query.Header.ID, 0, query.Question.QName, query.Question.QType, 1, answer), from)
+		}
+	}()
+	policy := RetryPolicy{Timeout: 2 * time.Second, Retransmit: 50 * time.Millisecond, Retransmits: 2}
+	res := withSingleRoot(New(WithDial(dialLocal(conn.LocalAddr().String())), WithDefaultRetryPolicy(policy)))
+	start := time.Now()
+	result, err := res.Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.13")}) {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the lookup took %v, want the retransmits sooner than the timeout", elapsed)
+	}
+	lock.Lock()
+	if len(ids) != 3 || ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Errorf("the server got IDs %v, want the same query three times", ids)
+	}
+	lock.Unlock()
+
+	// with one retransmit the query never gets through
+	policy.Timeout, policy.Retransmits = 300*time.Millisecond, 1
+	res = withSingleRoot(New(WithDial(dialLocal(conn.LocalAddr().String())), WithDefaultRetryPolicy(policy)))
+	if result, err := res.Lookup("mail.example.com", RTYPE_A); err == nil {
+		t.Errorf("got %v with the query lost every time", result)
+	}
+}
@@ -0,0 +1,349 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"maps"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// TSIG_RECORD A transaction signature (RFC 8945), which goes last in
+// the additional section and signs the whole message with a key
+// shared with the server.  TimeSigned is in seconds since the epoch
+// (48 bits of it on the wire), and the message is good from Fudge
+// seconds before then to Fudge after.  OriginalID is the ID the
+// message had when it was signed, and Error what the server made of
+// the request's signature.
+type TSIG_RECORD struct {
+	Algorithm  string `json:"algorithm"`
+	TimeSigned uint64 `json:"time_signed"`
+	Fudge      uint16 `json:"fudge"`
+	MAC        []byte `json:"mac"`
+	OriginalID uint16 `json:"original_id"`
+	Error      RCODE  `json:"error"`
+	OtherData  []byte `json:"other_data"`
+}
+
+func (t TSIG_RECORD) Dummy() {
+}
+
+// The TSIG algorithms there are TSIGKeys for (RFC 8945 6).  HMAC-MD5
+// is left out, it shouldn't be used any more.
+const (
+	TSIGHMACSHA1   = "hmac-sha1."
+	TSIGHMACSHA224 = "hmac-sha224."
+	TSIGHMACSHA256 = "hmac-sha256."
+	TSIGHMACSHA384 = "hmac-sha384."
+	TSIGHMACSHA512 = "hmac-sha512."
+)
+
+var tsigHashes = map[string]func() hash.Hash{
+	TSIGHMACSHA1:   sha1.New,
+	TSIGHMACSHA224: sha256.New224,
+	TSIGHMACSHA256: sha256.New,
+	TSIGHMACSHA384: sha512.New384,
+	TSIGHMACSHA512: sha512.New,
+}
+
+// tsigAlgorithm This is the name of a TSIG algorithm the way the
+// constants have it, in lower case and fully qualified.
+func tsigAlgorithm(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// tsigFudge How many seconds either side of the time a message was
+// signed it is still good, what RFC 8945 10 recommends.
+const tsigFudge = 300
+
+// TSIGKey A key shared with a server for TSIG: its Name (which the
+// server knows it by, like "transfer.example.com"), Algorithm (one
+// of TSIGHMACSHA1 to TSIGHMACSHA512) and Secret, which is what a
+// BIND key statement has as base64.
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+// TSIGKeys The keys DefaultResolver signs its queries to servers
+// with, by address.  A response from one of them that isn't signed
+// with the key, or whose signature doesn't check out, counts as no
+// response at all.  Changes only apply to servers the resolver
+// hasn't talked to yet.  Resolvers made by New have their own, see
+// WithTSIG.
+var TSIGKeys map[netip.Addr]TSIGKey
+
+// WithTSIG This makes the Resolver sign its queries to the server at
+// addr with key, like TSIGKeys does for DefaultResolver.
+func WithTSIG(addr netip.Addr, key TSIGKey) Option {
+	return func(res *Resolver) {
+		keys := maps.Clone(*res.tsig)
+		if keys == nil {
+			keys = make(map[netip.Addr]TSIGKey)
+		}
+		keys[addr.Unmap()] = key
+		*res.tsig = keys
+	}
+}
+
+// ErrTSIG This is what VerifyTSIG fails with, wrapped with what was
+// wrong.
+var ErrTSIG = errors.New("dns: bad TSIG")
+
+// tsigKey The TSIG key for the server at addr, nil if there isn't
+// one.
+func (res *Resolver) tsigKey(addr netip.Addr) *TSIGKey {
+	key, ok := (*res.tsig)[addr.Unmap()]
+	if !ok {
+		return nil
+	}
+	return &key
+}
+
+// SignTSIG This packs msg (see Pack) and signs it with key, as it
+// was at now.  A response is signed along with the MAC of the
+// request it answers, requestMAC, which is nil for a request.  It
+// returns the signed message and its MAC, which the response to it
+// is checked against (see VerifyTSIG).
+func SignTSIG(msg *DNSMessage, key TSIGKey, requestMAC []byte, now time.Time) (packet, mac []byte, err error) {
+	packet, err = packMessage(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signTSIG(packet, key, requestMAC, TSIG_RECORD{
+		Algorithm:  tsigAlgorithm(key.Algorithm),
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      tsigFudge,
+		OriginalID: msg.Header.ID,
+	})
+}
+
+// signTSIG This adds the TSIG record tsig to packet, with its MAC
+// worked out.
+func signTSIG(packet []byte, key TSIGKey, requestMAC []byte, tsig TSIG_RECORD) ([]byte, []byte, error) {
+	if len(packet) < 12 || binary.BigEndian.Uint16(packet[10:]) == 0xffff {
+		return nil, nil, fmt.Errorf("dns: no room for a TSIG record")
+	}
+	mac, err := tsigMAC(key, packet, requestMAC, tsig)
+	if err != nil {
+		return nil, nil, err
+	}
+	tsig.MAC = mac
+	// a writer of its own, so the names in it aren't compressed
+	w := &wireWriter{msg: packet}
+	if err := w.record(DNSAnswer{RName: key.Name, RType: RTYPE_TSIG, RClass: ANY, RData: tsig}); err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(w.msg[10:], binary.BigEndian.Uint16(w.msg[10:])+1)
+	return w.msg, mac, nil
+}
+
+// tsigMAC The MAC of message (without its TSIG record) for the TSIG
+// record tsig, which covers the request's MAC for a response, the
+// message, then the key's name and the fields of tsig other than
+// the MAC and original ID (RFC 8945 4.3).  The names go in lower
+// case and uncompressed.
+func tsigMAC(key TSIGKey, message, requestMAC []byte, tsig TSIG_RECORD) ([]byte, error) {
+	newHash, ok := tsigHashes[tsigAlgorithm(key.Algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("dns: unknown TSIG algorithm %q", key.Algorithm)
+	}
+	w := &wireWriter{}
+	if requestMAC != nil {
+		w.u16(uint16(len(requestMAC)))
+		w.msg = append(w.msg, requestMAC...)
+	}
+	w.msg = append(w.msg, message...)
+	if err := w.name(strings.ToLower(key.Name), false); err != nil {
+		return nil, err
+	}
+	w.u16(ANY)
+	w.u32(0)
+	if err := w.name(tsigAlgorithm(tsig.Algorithm), false); err != nil {
+		return nil, err
+	}
+	w.u16(uint16(tsig.TimeSigned >> 32))
+	w.u32(uint32(tsig.TimeSigned))
+	w.u16(tsig.Fudge)
+	w.u16(uint16(tsig.Error))
+	w.u16(uint16(len(tsig.OtherData)))
+	w.msg = append(w.msg, tsig.OtherData...)
+	mac := hmac.New(newHash, key.Secret)
+	mac.Write(w.msg)
+	return mac.Sum(nil), nil
+}
+
+// VerifyTSIG This checks that packet is signed with key at a time
+// within its fudge of now, along with requestMAC if it is a response
+// (see SignTSIG), and returns its MAC.  The TSIG record has to be
+// the last record in the message.  A MAC may be cut short (RFC 8945
+// 5.2.2.1), but to no less than 10 bytes or half the hash's length.
+// A response saying the server didn't take our signature fails with
+// what it said.
+func VerifyTSIG(packet []byte, key TSIGKey, requestMAC []byte, now time.Time) ([]byte, error) {
+	start, record, err := lastRecord(packet)
+	if err != nil {
+		return nil, err
+	}
+	tsig, ok := record.RData.(TSIG_RECORD)
+	if !ok {
+		return nil, fmt.Errorf("%w: not signed", ErrTSIG)
+	}
+	if !strings.EqualFold(strings.TrimSuffix(key.Name, "."), record.RName) || tsigAlgorithm(tsig.Algorithm) != tsigAlgorithm(key.Algorithm) {
+		return nil, fmt.Errorf("%w: signed with key %s (%s)", ErrTSIG, record.RName, tsig.Algorithm)
+	}
+	if tsig.Error != RCODE_OK {
+		return nil, fmt.Errorf("%w: the server said %s", ErrTSIG, tsigErrorName(tsig.Error))
+	}
+	// what was signed is the message as it was before the TSIG
+	// record went on
+	signed := append([]byte(nil), packet[:start]...)
+	binary.BigEndian.PutUint16(signed, tsig.OriginalID)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])-1)
+	mac, err := tsigMAC(key, signed, requestMAC, tsig)
+	if err != nil {
+		return nil, err
+	}
+	if len(tsig.MAC) > len(mac) || len(tsig.MAC) < max(10, len(mac)/2) {
+		return nil, fmt.Errorf("%w: MAC is %d bytes", ErrTSIG, len(tsig.MAC))
+	}
+	if !hmac.Equal(mac[:len(tsig.MAC)], tsig.MAC) {
+		return nil, fmt.Errorf("%w: the signature doesn't match", ErrTSIG)
+	}
+	if signedAt := time.Unix(int64(tsig.TimeSigned), 0); now.Sub(signedAt).Abs() > time.Duration(tsig.Fudge)*time.Second {
+		return nil, fmt.Errorf("%w: signed at %v", ErrTSIG, signedAt)
+	}
+	return tsig.MAC, nil
+}
+
+// tsigErrorName The name of a TSIG record's Error, where 16 is
+// BADSIG rather than BADVERS.
+func tsigErrorName(rcode RCODE) string {
+	if rcode == RCODE_BADSIG {
+		return "RCODE_BADSIG"
+	}
+	if name, ok := rcodeName[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE %d", rcode)
+}
+
+// lastRecord The last record in packet and where it starts, for
+// VerifyTSIG.  The records before it are only skipped over.
+func lastRecord(packet []byte) (int, DNSAnswer, error) {
+	r := &wireReader{msg: packet}
+	var counts [4]uint16
+	if len(packet) < 12 {
+		return 0, DNSAnswer{}, r.malformed("short header")
+	}
+	for i := range counts {
+		counts[i] = binary.BigEndian.Uint16(packet[4+2*i:])
+	}
+	r.off = 12
+	records := int(counts[1]) + int(counts[2]) + int(counts[3])
+	if counts[3] == 0 {
+		return 0, DNSAnswer{}, fmt.Errorf("%w: not signed", ErrTSIG)
+	}
+	for range counts[0] {
+		if _, err := r.name(); err != nil {
+			return 0, DNSAnswer{}, err
+		}
+		if _, err := r.bytes(4); err != nil {
+			return 0, DNSAnswer{}, err
+		}
+	}
+	for range records - 1 {
+		if _, err := r.name(); err != nil {
+			return 0, DNSAnswer{}, err
+		}
+		if _, err := r.bytes(8); err != nil {
+			return 0, DNSAnswer{}, err
+		}
+		length, err := r.u16()
+		if err != nil {
+			return 0, DNSAnswer{}, err
+		}
+		if _, err := r.bytes(int(length)); err != nil {
+			return 0, DNSAnswer{}, err
+		}
+	}
+	start := r.off
+	record, err := r.record()
+	if err != nil {
+		return 0, DNSAnswer{}, err
+	}
+	if r.off != len(packet) {
+		return 0, DNSAnswer{}, r.malformed("trailing bytes")
+	}
+	return start, record, nil
+}
+
+// sign This signs packet, the query for req, with the server's TSIG
+// key, keeping the MAC for checking the response against.
+func (manager *serverCommManager) sign(packet []byte, req *serverDNSRequest) ([]byte, error) {
+	packet, mac, err := signTSIG(packet, *manager.tsig, nil, TSIG_RECORD{
+		Algorithm:  tsigAlgorithm(manager.tsig.Algorithm),
+		TimeSigned: uint64(time.Now().Unix()),
+		Fudge:      tsigFudge,
+		OriginalID: req.id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	manager.inflightLock.Lock()
+	req.mac = mac
+	manager.inflightLock.Unlock()
+	return packet, nil
+}
+
+// unpack This is unpackMessage for packet, a response from the
+// server, which has to be signed with the server's TSIG key if it
+// has one.  req is the request it answers, nil for the request in
+// flight with its ID.  The TSIG record has done its job once it has
+// been checked, and doesn't make it into the message.  Whatever is
+// wrong with a response gets logged.
+func (manager *serverCommManager) unpack(packet []byte, req *serverDNSRequest) (*DNSMessage, error) {
+	msg, err := manager.unpackSigned(packet, req)
+	if err != nil {
+		manager.log().Warn("bad upstream response", "server", *manager.remote, "error", err)
+	}
+	return msg, err
+}
+
+// unpackSigned This does the work for unpack.
+func (manager *serverCommManager) unpackSigned(packet []byte, req *serverDNSRequest) (*DNSMessage, error) {
+	if manager.tsig == nil {
+		return unpackMessage(packet)
+	}
+	var mac []byte
+	manager.inflightLock.Lock()
+	if req == nil && len(packet) >= 2 {
+		if inflight := manager.inflight[binary.BigEndian.Uint16(packet)]; inflight != nil {
+			req = inflight.req
+		}
+	}
+	if req != nil {
+		mac = req.mac
+	}
+	manager.inflightLock.Unlock()
+	if mac == nil {
+		return nil, fmt.Errorf("%w: not a response to a signed query", ErrTSIG)
+	}
+	if _, err := VerifyTSIG(packet, *manager.tsig, mac, time.Now()); err != nil {
+		return nil, err
+	}
+	msg, err := unpackMessage(packet)
+	if err != nil {
+		return nil, err
+	}
+	msg.Additionals = msg.Additionals[:len(msg.Additionals)-1]
+	return msg, nil
+}
@@ -0,0 +1,144 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testTSIGKey = TSIGKey{Name: "transfer.example.com.", Algorithm: TSIGHMACSHA256, Secret: []byte("0123456789abcdef")}
+
+func TestTSIG(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	query := &DNSMessage{
+		Header:   DNSHeader{ID: 0x1234},
+		Question: DNSQuestion{QName: "example.com", QType: RTYPE_SOA, QClass: IN},
+		EDNS:     &EDNS{UDPSize: 1232},
+	}
+	packet, mac, err := SignTSIG(query, testTSIGKey, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mac) != 32 {
+		t.Errorf("HMAC-SHA256 MAC is %d bytes", len(mac))
+	}
+	if got, err := VerifyTSIG(packet, testTSIGKey, nil, now.Add(time.Minute)); err != nil || !bytes.Equal(got, mac) {
+		t.Errorf("verifying the query gave %x, %v", got, err)
+	}
+	msg, err := unpackMessage(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(msg.Additionals); n != 1 || msg.Additionals[0].RName != "transfer.example.com" || msg.EDNS == nil {
+		t.Fatalf("unexpected additional section %v", msg.Additionals)
+	}
+	if tsig := msg.Additionals[0].RData.(TSIG_RECORD); tsig.Algorithm != TSIGHMACSHA256 || tsig.TimeSigned != 1700000000 || tsig.OriginalID != 0x1234 || !bytes.Equal(tsig.MAC, mac) {
+		t.Errorf("unexpected TSIG record %+v", tsig)
+	}
+
+	// the ID may change on the way (over DoH say)
+	changed := append([]byte(nil), packet...)
+	changed[0], changed[1] = 0, 0
+	if _, err := VerifyTSIG(changed, testTSIGKey, nil, now); err != nil {
+		t.Errorf("with the ID changed: %v", err)
+	}
+
+	bad := []struct {
+		name   string
+		packet func() []byte
+		key    TSIGKey
+		now    time.Time
+	}{
+		{"tampered", func() []byte {
+			p := append([]byte(nil), packet...)
+			p[13] ^= 0x20
+			return p
+		}, testTSIGKey, now},
+		{"wrong secret", func() []byte { return packet }, TSIGKey{Name: testTSIGKey.Name, Algorithm: TSIGHMACSHA256, Secret: []byte("x")}, now},
+		{"wrong key", func() []byte { return packet }, TSIGKey{Name: "other.example.com", Algorithm: TSIGHMACSHA256, Secret: testTSIGKey.Secret}, now},
+		{"wrong algorithm", func() []byte { return packet }, TSIGKey{Name: testTSIGKey.Name, Algorithm: TSIGHMACSHA1, Secret: testTSIGKey.Secret}, now},
+		{"too late", func() []byte { return packet }, testTSIGKey, now.Add(10 * time.Minute)},
+		{"unsigned", func() []byte {
+			p, _ := packMessage(query)
+			return p
+		}, testTSIGKey, now},
+	}
+	for _, test := range bad {
+		if _, err := VerifyTSIG(test.packet(), test.key, nil, test.now); !errors.Is(err, ErrTSIG) {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+
+	// a response is signed along with the query's MAC
+	response := &DNSMessage{Header: DNSHeader{ID: 0x1234, Response: true}, Question: query.Question}
+	signed, _, err := SignTSIG(response, testTSIGKey, mac, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyTSIG(signed, testTSIGKey, mac, now); err != nil {
+		t.Errorf("verifying the response: %v", err)
+	}
+	if _, err := VerifyTSIG(signed, testTSIGKey, bytes.Repeat([]byte{1}, 32), now); !errors.Is(err, ErrTSIG) {
+		t.Errorf("the response verified with another query's MAC: %v", err)
+	}
+}
+
+func TestTSIGLookup(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	// the server only answers queries signed with the key, and
+	// signs its answers
+	var refused atomic.Int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mac, err := VerifyTSIG(buf[:n], testTSIGKey, nil, time.Now())
+			if err != nil {
+				refused.Add(1)
+				continue
+			}
+			query, _ := unpackMessage(buf[:n])
+			response := &DNSMessage{
+				Header:   DNSHeader{ID: query.Header.ID, Response: true, Authoritative: true},
+				Question: query.Question,
+				Answers:  []DNSAnswer{{RName: query.Question.QName, RType: RTYPE_A, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.89")}}},
+			}
+			if query.Question.QName == "forged.example.com" {
+				packet, _ := packMessage(response)
+				conn.WriteTo(packet, from)
+				continue
+			}
+			packet, _, _ := SignTSIG(response, testTSIGKey, mac, time.Now())
+			conn.WriteTo(packet, from)
+		}
+	}()
+	root := parseAddrNoerror("198.41.0.4")
+	policy := RetryPolicy{Timeout: 200 * time.Millisecond, Attempts: 1}
+	res := withSingleRoot(New(WithDial(dialLocal(conn.LocalAddr().String())), WithDefaultRetryPolicy(policy), WithTSIG(root, testTSIGKey)))
+	result, err := res.Lookup("www.example.com", RTYPE_A)
+	if err != nil || len(result) != 1 || result[0].RData != (A_RECORD{parseAddrNoerror("192.0.2.89")}) {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	if result, err := res.Lookup("forged.example.com", RTYPE_A); err == nil {
+		t.Errorf("got %v from an unsigned response", result)
+	}
+
+	// without the key the server won't answer
+	res = withSingleRoot(New(WithDial(dialLocal(conn.LocalAddr().String())), WithDefaultRetryPolicy(policy)))
+	if result, err := res.Lookup("www.example.com", RTYPE_A); err == nil {
+		t.Errorf("got %v without signing", result)
+	}
+	if refused.Load() == 0 {
+		t.Errorf("the server never saw an unsigned query")
+	}
+}
@@ -0,0 +1,299 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// opcodeUpdate The opcode of a dynamic update (RFC 2136 1.3)
+const opcodeUpdate = 5
+
+// Update A dynamic update (RFC 2136) to the records of a zone: the
+// prerequisites that have to hold for it to go ahead, and the
+// changes, which the server makes all at once or not at all.  Make
+// one with NewUpdate, add to it with its methods (each of which
+// returns it, so they can be chained) and send it with SendUpdate:
+//
+//	update := NewUpdate("example.com").
+//		NameNotInUse("host.example.com").
+//		Add(DNSAnswer{RName: "host.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{addr}})
+//	err := res.SendUpdate(ctx, update)
+type Update struct {
+	// Zone The zone to update, "" for SendUpdate to find the one
+	// the first name in the update is in (see FindZoneApex)
+	Zone string
+	// Server The server to send the update to, the zero value for
+	// the zone's primary (the MName of its SOA) on port 53
+	Server netip.AddrPort
+	// Key The TSIG key to sign the update with, nil for the one the
+	// Resolver has for Server if it has one (see WithTSIG).  Most
+	// servers only take signed updates.
+	Key *TSIGKey
+
+	prerequisites []DNSAnswer
+	updates       []DNSAnswer
+}
+
+// NewUpdate This starts an empty Update to zone.
+func NewUpdate(zone string) *Update {
+	return &Update{Zone: zone}
+}
+
+// RRsetExists This has the Update go ahead only if name has records
+// of type t.
+func (u *Update) RRsetExists(name string, t RTYPE) *Update {
+	u.prerequisites = append(u.prerequisites, DNSAnswer{RName: name, RType: t, RClass: ANY})
+	return u
+}
+
+// RRsetEquals This has the Update go ahead only if the records
+// of each name and type in records are exactly those.
+func (u *Update) RRsetEquals(records ...DNSAnswer) *Update {
+	for _, record := range records {
+		record.RClass, record.TTL = IN, 0
+		u.prerequisites = append(u.prerequisites, record)
+	}
+	return u
+}
+
+// RRsetAbsent This has the Update go ahead only if name has no
+// records of type t.
+func (u *Update) RRsetAbsent(name string, t RTYPE) *Update {
+	u.prerequisites = append(u.prerequisites, DNSAnswer{RName: name, RType: t, RClass: NONE})
+	return u
+}
+
+// NameInUse This has the Update go ahead only if name has records
+// of some type.
+func (u *Update) NameInUse(name string) *Update {
+	u.prerequisites = append(u.prerequisites, DNSAnswer{RName: name, RType: RTYPE_ANY, RClass: ANY})
+	return u
+}
+
+// NameNotInUse This has the Update go ahead only if name has no
+// records at all.
+func (u *Update) NameNotInUse(name string) *Update {
+	u.prerequisites = append(u.prerequisites, DNSAnswer{RName: name, RType: RTYPE_ANY, RClass: NONE})
+	return u
+}
+
+// Add This adds records to the zone, alongside any of the same
+// name and type already there.
+func (u *Update) Add(records ...DNSAnswer) *Update {
+	for _, record := range records {
+		record.RClass = IN
+		u.updates = append(u.updates, record)
+	}
+	return u
+}
+
+// Delete This deletes records from the zone, going by their name,
+// type and RDATA.
+func (u *Update) Delete(records ...DNSAnswer) *Update {
+	for _, record := range records {
+		record.RClass, record.TTL = NONE, 0
+		u.updates = append(u.updates, record)
+	}
+	return u
+}
+
+// DeleteRRset This deletes every record of type t name has.
+func (u *Update) DeleteRRset(name string, t RTYPE) *Update {
+	u.updates = append(u.updates, DNSAnswer{RName: name, RType: t, RClass: ANY})
+	return u
+}
+
+// DeleteName This deletes every record name has.
+func (u *Update) DeleteName(name string) *Update {
+	u.updates = append(u.updates, DNSAnswer{RName: name, RType: RTYPE_ANY, RClass: ANY})
+	return u
+}
+
+// Message This is the Update as it goes to the server, with ID id:
+// the zone in the question (the zone section), the prerequisites in
+// the answer section and the changes in the authority section.
+func (u *Update) Message(id uint16) *DNSMessage {
+	return &DNSMessage{
+		Header:      DNSHeader{ID: id, Opcode: opcodeUpdate},
+		Question:    DNSQuestion{QName: absolute(u.Zone), QType: RTYPE_SOA, QClass: IN},
+		Answers:     u.prerequisites,
+		Authorities: u.updates,
+	}
+}
+
+// UpdateError What SendUpdate returns when the server turns an
+// Update down, Rcode being why (see RCODE_YXDOMAIN).
+type UpdateError struct {
+	Zone   string
+	Server netip.AddrPort
+	Rcode  RCODE
+}
+
+func (e *UpdateError) Error() string {
+	return fmt.Sprintf("dns: update of %s refused by %v: %v", e.Zone, e.Server, e.Rcode)
+}
+
+// ErrEmptyUpdate What SendUpdate says about an Update with no zone
+// and no names to find it from
+var ErrEmptyUpdate = errors.New("dns: update has no zone")
+
+// SendUpdate This is DefaultResolver.SendUpdate
+func SendUpdate(ctx context.Context, u *Update) error {
+	return DefaultResolver.SendUpdate(ctx, u)
+}
+
+// SendUpdate This sends u to its Server (finding the zone and its
+// primary server with the Resolver if u doesn't say) over TCP,
+// signed if there is a key for it, and waits for the server to say
+// it is done.  The error is an *UpdateError if the server turned it
+// down, which it does if any prerequisite doesn't hold.  A signed
+// update fails unless the response is signed with the same key.
+// Nothing cached is changed, so lookups may go on getting the old
+// records until they expire.
+func (res *Resolver) SendUpdate(ctx context.Context, u *Update) error {
+	zone := u.Zone
+	if zone == "" {
+		var name string
+		for _, records := range [][]DNSAnswer{u.prerequisites, u.updates} {
+			if len(records) > 0 && name == "" {
+				name = records[0].RName
+			}
+		}
+		if name == "" {
+			return ErrEmptyUpdate
+		}
+		apex, _, err := res.FindZoneApex(name)
+		if err != nil {
+			return err
+		}
+		zone = apex
+	}
+	server := u.Server
+	if !server.IsValid() {
+		addr, err := res.primaryServer(ctx, zone)
+		if err != nil {
+			return err
+		}
+		server = netip.AddrPortFrom(addr, serverPort)
+	}
+	key := u.Key
+	if key == nil {
+		key = res.tsigKey(server.Addr())
+	}
+
+	update := *u
+	update.Zone = zone
+	msg := update.Message(uint16(mathrand.Uint32()))
+	var packet, mac []byte
+	var err error
+	if key != nil {
+		packet, mac, err = SignTSIG(msg, *key, nil, time.Now())
+	} else {
+		packet, err = packMessage(msg)
+	}
+	if err != nil {
+		return err
+	}
+	packet, err = res.exchangeTCP(ctx, server, packet)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		if _, err := VerifyTSIG(packet, *key, mac, time.Now()); err != nil {
+			return err
+		}
+	}
+	response, err := unpackMessage(packet)
+	if err != nil {
+		return err
+	}
+	if !response.Header.Response || response.Header.ID != msg.Header.ID {
+		return fmt.Errorf("dns: %v didn't answer the update", server)
+	}
+	if response.Header.Status != RCODE_OK {
+		return &UpdateError{Zone: cleanName(zone), Server: server, Rcode: response.Header.Status}
+	}
+	return nil
+}
+
+// primaryServer The address of the zone's primary server, the MName
+// of its SOA record.
+func (res *Resolver) primaryServer(ctx context.Context, zone string) (netip.Addr, error) {
+	answers, err := res.LookupCtx(ctx, absolute(zone), RTYPE_SOA)
+	var primary string
+	for _, answer := range answers {
+		if soa, ok := answer.RData.(SOA_RECORD); ok {
+			primary = soa.MName
+		}
+	}
+	if primary == "" {
+		if err == nil {
+			err = fmt.Errorf("dns: no SOA record for %s", zone)
+		}
+		return netip.Addr{}, err
+	}
+	for _, t := range []RTYPE{RTYPE_A, RTYPE_AAAA} {
+		answers, err = res.LookupCtx(ctx, absolute(primary), t)
+		for _, answer := range answers {
+			switch data := answer.RData.(type) {
+			case A_RECORD:
+				return data.A, nil
+			case AAAA_RECORD:
+				return data.AAAA, nil
+			}
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("dns: no address for %s", primary)
+	}
+	return netip.Addr{}, err
+}
+
+// exchangeTCP This sends packet to server over a TCP connection of
+// its own and returns the response, giving up when ctx is done.
+func (res *Resolver) exchangeTCP(ctx context.Context, server netip.AddrPort, packet []byte) ([]byte, error) {
+	if len(packet) > 0xffff {
+		return nil, fmt.Errorf("dns: message too long")
+	}
+	dial := res.serverDial()
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", net.JoinHostPort(server.Addr().String(), strconv.Itoa(int(server.Port()))))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packet)), uint16(len(packet)))
+	if _, err := conn.Write(append(frame, packet...)); err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	return response, nil
+}
+
+// contextErr ctx.Err() if ctx is done, which is why err happened,
+// err otherwise
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
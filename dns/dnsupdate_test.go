@@ -0,0 +1,116 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSendUpdate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	// a primary that takes updates signed with testTSIGKey, unless
+	// the name they add is already there
+	updates := make(chan *DNSMessage, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var length [2]byte
+			io.ReadFull(conn, length[:])
+			packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+			io.ReadFull(conn, packet)
+			update, err := unpackMessage(packet)
+			if err != nil {
+				t.Error(err)
+				conn.Close()
+				continue
+			}
+			updates <- update
+			response := &DNSMessage{Header: DNSHeader{ID: update.Header.ID, Response: true, Opcode: opcodeUpdate}, Question: update.Question}
+			mac, err := VerifyTSIG(packet, testTSIGKey, nil, time.Now())
+			switch {
+			case err != nil:
+				response.Header.Status = RCODE_NOTAUTH
+			case update.Answers[0].RClass == ANY:
+				response.Header.Status = RCODE_YXDOMAIN
+			}
+			var out []byte
+			if err == nil {
+				out, _, _ = SignTSIG(response, testTSIGKey, mac, time.Now())
+			} else {
+				out, _ = packMessage(response)
+			}
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...))
+			conn.Close()
+		}
+	}()
+	server := netip.MustParseAddrPort(l.Addr().String())
+
+	// the zone comes from the SOA the name is under
+	soa := SOA_RECORD{"ns1.example.com.", "hostmaster.example.com.", 1, 7200, 900, 1209600, 300}
+	res := withSingleRoot(New(WithTSIG(server.Addr(), testTSIGKey)))
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		record := DNSAnswer{RName: "example.com", RType: RTYPE_SOA, RClass: IN, TTL: 300, RData: soa}
+		if request.name == "example.com" && request.qtype == RTYPE_SOA {
+			return &DNSMessage{Answers: []DNSAnswer{record}}
+		}
+		return &DNSMessage{Header: DNSHeader{Status: RCODE_NXNAME}, Authorities: []DNSAnswer{record}}
+	})
+	addr := DNSAnswer{RName: "host.example.com", RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.105")}}
+	update := NewUpdate("").
+		NameNotInUse("host.example.com").
+		RRsetAbsent("host.example.com", RTYPE_AAAA).
+		DeleteRRset("host.example.com", RTYPE_TXT).
+		Add(addr)
+	update.Server = server
+	if err := res.SendUpdate(context.Background(), update); err != nil {
+		t.Fatal(err)
+	}
+	got := <-updates
+	if got.Header.Opcode != opcodeUpdate || cleanName(got.Question.QName) != "example.com" || got.Question.QType != RTYPE_SOA ||
+		len(got.Answers) != 2 || got.Answers[0].RClass != NONE || got.Answers[0].RType != RTYPE_ANY ||
+		len(got.Authorities) != 2 || got.Authorities[0].RClass != ANY || got.Authorities[0].RData != nil ||
+		got.Authorities[1].RClass != IN || got.Authorities[1].RData != addr.RData {
+		t.Errorf("unexpected update %+v", got)
+	}
+
+	// a prerequisite that doesn't hold
+	update = NewUpdate("example.com.").NameInUse("host.example.com").Delete(addr)
+	update.Server = server
+	var updateErr *UpdateError
+	if err := res.SendUpdate(context.Background(), update); !errors.As(err, &updateErr) || updateErr.Rcode != RCODE_YXDOMAIN || updateErr.Zone != "example.com" {
+		t.Errorf("SendUpdate returned %v", err)
+	}
+	if got := <-updates; got.Authorities[0].RClass != NONE || got.Authorities[0].TTL != 0 {
+		t.Errorf("unexpected deletion %+v", got.Authorities[0])
+	}
+
+	// without the key it isn't taken
+	update = NewUpdate("example.com").DeleteName("host.example.com")
+	update.Server = server
+	if err := New().SendUpdate(context.Background(), update); !errors.As(err, &updateErr) || updateErr.Rcode != RCODE_NOTAUTH {
+		t.Errorf("unsigned SendUpdate returned %v", err)
+	}
+	<-updates
+	// and a response with the wrong key doesn't count
+	update.Key = &TSIGKey{Name: testTSIGKey.Name, Algorithm: TSIGHMACSHA256, Secret: []byte("x")}
+	if err := New().SendUpdate(context.Background(), update); !errors.Is(err, ErrTSIG) {
+		t.Errorf("SendUpdate with the wrong key returned %v", err)
+	}
+	<-updates
+
+	if err := New().SendUpdate(context.Background(), NewUpdate("")); !errors.Is(err, ErrEmptyUpdate) {
+		t.Errorf("empty SendUpdate returned %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package dns
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// deliver This is how a comm manager hands req the response msg,
+// which arrived from the address from.  Anything that isn't the
+// response to req is dropped without a word, as if it had never
+// arrived, so that a forged or stray packet can't stand in for the
+// real answer: the ID has to be the one sent, the question has to
+// be the name (ignoring case, see CaseRandomization for that),
+// type and class asked about, and it has to have come from the
+// server req went to.  A second response once there is one waiting
+// is dropped too.  It returns whether msg was delivered, so a
+// transport knows to keep listening when it wasn't.
+func (req *serverDNSRequest) deliver(from netip.Addr, msg *DNSMessage) bool {
+	if msg == nil || !req.matches(from, msg) {
+		return false
+	}
+	select {
+	case req.response <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// matches This is the check for deliver.
+func (req *serverDNSRequest) matches(from netip.Addr, msg *DNSMessage) bool {
+	if from.Unmap() != req.server.Unmap() || msg.Header.ID != req.id {
+		return false
+	}
+	q := msg.Question
+	return strings.EqualFold(strings.TrimSuffix(q.QName, "."), strings.TrimSuffix(req.name, ".")) &&
+		q.QType == req.qtype && q.QClass == IN
+}
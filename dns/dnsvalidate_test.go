@@ -0,0 +1,47 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDeliver(t *testing.T) {
+	server := parseAddrNoerror("192.0.2.53")
+	request := &serverDNSRequest{
+		id:       0x1234,
+		server:   server,
+		name:     "wWw.Example.com",
+		qtype:    RTYPE_A,
+		response: make(chan *DNSMessage, 1),
+	}
+	good := func() *DNSMessage {
+		return &DNSMessage{
+			Header:   DNSHeader{ID: 0x1234},
+			Question: DNSQuestion{QName: "www.example.com.", QType: RTYPE_A, QClass: IN},
+		}
+	}
+	for _, test := range []struct {
+		desc string
+		from netip.Addr
+		edit func(*DNSMessage)
+	}{
+		{"wrong ID", server, func(msg *DNSMessage) { msg.Header.ID++ }},
+		{"wrong name", server, func(msg *DNSMessage) { msg.Question.QName = "mail.example.com." }},
+		{"wrong type", server, func(msg *DNSMessage) { msg.Question.QType = RTYPE_AAAA }},
+		{"wrong class", server, func(msg *DNSMessage) { msg.Question.QClass = CHAOS }},
+		{"no question", server, func(msg *DNSMessage) { msg.Question = DNSQuestion{} }},
+		{"wrong source", parseAddrNoerror("192.0.2.54"), func(*DNSMessage) {}},
+	} {
+		msg := good()
+		test.edit(msg)
+		if request.deliver(test.from, msg) || len(request.response) != 0 {
+			t.Errorf("%s: response was delivered", test.desc)
+		}
+	}
+	if !request.deliver(netip.AddrFrom16(server.As16()), good()) {
+		t.Errorf("matching response wasn't delivered")
+	}
+	if request.deliver(server, good()) {
+		t.Errorf("second response was delivered")
+	}
+}
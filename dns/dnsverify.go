@@ -0,0 +1,195 @@
+package dns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+// DNSSEC algorithm numbers (RFC 8624 lists which are still in use)
+const (
+	AlgRSASHA256       = 8
+	AlgRSASHA512       = 10
+	AlgECDSAP256SHA256 = 13
+	AlgECDSAP384SHA384 = 14
+	AlgED25519         = 15
+)
+
+// ErrUnsupportedAlgorithm The key or DS uses an algorithm or digest
+// type we can't check.
+var ErrUnsupportedAlgorithm = errors.New("unsupported DNSSEC algorithm")
+
+// ErrBadSignature The signature doesn't check out.
+var ErrBadSignature = errors.New("bad DNSSEC signature")
+
+// canonicalWireName This is name in canonical wire form (RFC 4034 6.2):
+// lower case labels, each preceded by its length, ending in the
+// root's empty label.
+func canonicalWireName(name string) []byte {
+	var wire []byte
+	if name = cleanName(name); name != "." {
+		for _, label := range strings.Split(name, ".") {
+			wire = append(wire, byte(len(label)))
+			wire = append(wire, label...)
+		}
+	}
+	return append(wire, 0)
+}
+
+// rdata The key's RDATA in wire form
+func (k DNSKEY_RECORD) rdata() []byte {
+	rdata := binary.BigEndian.AppendUint16(nil, k.Flags)
+	rdata = append(rdata, k.Protocol, k.Algorithm)
+	return append(rdata, k.PublicKey...)
+}
+
+// MatchesDS Whether ds (from zone's parent) is the digest of k,
+// the key for zone.  Digest types 1 (SHA-1), 2 (SHA-256) and 4
+// (SHA-384) are understood, anything else doesn't match.
+func (k DNSKEY_RECORD) MatchesDS(zone string, ds DS_RECORD) bool {
+	if ds.KeyTag != k.KeyTag() || ds.Algorithm != k.Algorithm {
+		return false
+	}
+	var digest []byte
+	data := append(canonicalWireName(zone), k.rdata()...)
+	switch ds.DigestType {
+	case 1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case 2:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case 4:
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(digest, ds.Digest)
+}
+
+// VerifyKeys This checks that sig, made with key, is a good
+// signature over the DNSKEY RRset keys of zone.  It doesn't look at
+// whether the signature is current, see RRSIG_RECORD.ValidAt.
+func VerifyKeys(zone string, keys []DNSKEY_RECORD, sig RRSIG_RECORD, key DNSKEY_RECORD) error {
+	if sig.TypeCovered != RTYPE_DNSKEY || cleanName(sig.SignerName) != cleanName(zone) ||
+		sig.KeyTag != key.KeyTag() || sig.Algorithm != key.Algorithm {
+		return ErrBadSignature
+	}
+	return verifySignature(key, keysSignedData(zone, keys, sig), sig.Signature)
+}
+
+// keysSignedData What sig over the DNSKEY RRset keys of zone is a
+// signature of (RFC 4034 3.1.8.1).
+func keysSignedData(zone string, keys []DNSKEY_RECORD, sig RRSIG_RECORD) []byte {
+	// The signed data is the RRSIG's RDATA up to the signature,
+	// then each record in canonical form, ordered by RDATA
+	signed := binary.BigEndian.AppendUint16(nil, uint16(sig.TypeCovered))
+	signed = append(signed, sig.Algorithm, sig.Labels)
+	signed = binary.BigEndian.AppendUint32(signed, sig.OriginalTTL)
+	signed = binary.BigEndian.AppendUint32(signed, sig.Expiration)
+	signed = binary.BigEndian.AppendUint32(signed, sig.Inception)
+	signed = binary.BigEndian.AppendUint16(signed, sig.KeyTag)
+	signed = append(signed, canonicalWireName(sig.SignerName)...)
+	rdatas := make([][]byte, len(keys))
+	for i, k := range keys {
+		rdatas[i] = k.rdata()
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+	owner := canonicalWireName(zone)
+	for _, rdata := range rdatas {
+		signed = append(signed, owner...)
+		signed = binary.BigEndian.AppendUint16(signed, uint16(RTYPE_DNSKEY))
+		signed = binary.BigEndian.AppendUint16(signed, uint16(IN))
+		signed = binary.BigEndian.AppendUint32(signed, sig.OriginalTTL)
+		signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+		signed = append(signed, rdata...)
+	}
+	return signed
+}
+
+// verifySignature This checks signature over data with key, the key
+// and signature being in their DNSSEC wire forms (RFC 3110 for RSA,
+// RFC 6605 for ECDSA and RFC 8080 for Ed25519).
+func verifySignature(key DNSKEY_RECORD, data, signature []byte) error {
+	switch key.Algorithm {
+	case AlgRSASHA256, AlgRSASHA512:
+		pub, err := rsaPublicKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		hash := crypto.SHA256
+		if key.Algorithm == AlgRSASHA512 {
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		if rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), signature) != nil {
+			return ErrBadSignature
+		}
+		return nil
+	case AlgECDSAP256SHA256, AlgECDSAP384SHA384:
+		curve, hash, size := elliptic.P256(), crypto.SHA256, 32
+		if key.Algorithm == AlgECDSAP384SHA384 {
+			curve, hash, size = elliptic.P384(), crypto.SHA384, 48
+		}
+		if len(key.PublicKey) != 2*size || len(signature) != 2*size {
+			return ErrBadSignature
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		h := hash.New()
+		h.Write(data)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			return ErrBadSignature
+		}
+		return nil
+	case AlgED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(key.PublicKey, data, signature) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
+
+// rsaPublicKey This unpacks an RSA key from a DNSKEY (RFC 3110):
+// the exponent's length in one byte (or a zero byte and then two),
+// the exponent and then the modulus.
+func rsaPublicKey(key []byte) (*rsa.PublicKey, error) {
+	if len(key) < 1 {
+		return nil, ErrBadSignature
+	}
+	explen, key := int(key[0]), key[1:]
+	if explen == 0 {
+		if len(key) < 2 {
+			return nil, ErrBadSignature
+		}
+		explen, key = int(binary.BigEndian.Uint16(key)), key[2:]
+	}
+	if explen == 0 || explen > 4 || len(key) <= explen {
+		return nil, ErrBadSignature
+	}
+	var e int
+	for _, b := range key[:explen] {
+		e = e<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(key[explen:]), E: e}, nil
+}
@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+)
+
+// View A different way of answering for some of a Server's clients,
+// split-horizon DNS: the LAN can be told about hosts the guest
+// network never sees, or have its queries forwarded somewhere else.
+// A query is answered by the first of the Server's Views whose
+// Clients include the address it came from, and by the Server as
+// it is if none do.
+//
+// Records are answered from directly, authoritatively, for every
+// name they own: a name with records there gets only those (an
+// empty answer if none are of the type asked for), and a CNAME
+// among them is followed through them and then, if it leads
+// elsewhere, with the Resolver.  ParseZone makes them from a zone
+// file.  Everything else is looked up with Resolver, which can have
+// its own Forwarders (see WithForwarders), or with the Server's
+// Resolver if it is nil.
+type View struct {
+	Name     string
+	Clients  []netip.Prefix
+	Records  []DNSAnswer
+	Resolver *Resolver
+}
+
+// serverView A View along with its Records by (cleaned) owner name
+type serverView struct {
+	*View
+	records map[string][]DNSAnswer
+}
+
+// view The view for queries from client, nil if it gets none.
+func (srv *Server) view(client netip.Addr) *serverView {
+	srv.viewsOnce.Do(func() {
+		for i := range srv.Views {
+			v := &serverView{View: &srv.Views[i], records: make(map[string][]DNSAnswer)}
+			for _, record := range v.Records {
+				name := cleanName(record.RName)
+				v.records[name] = append(v.records[name], record)
+			}
+			srv.views = append(srv.views, v)
+		}
+	})
+	client = client.Unmap()
+	for _, v := range srv.views {
+		for _, prefix := range v.Clients {
+			if prefix.Contains(client) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// localAnswers The answer from v's Records for name/t, and whether
+// they have anything for name at all.  When a CNAME in them leads
+// to a name they don't have, next is that name, for the rest of the
+// answer to be looked up.
+func (v *serverView) localAnswers(name string, t RTYPE) (answers []DNSAnswer, next string, ok bool) {
+	visited := map[string]bool{}
+	for {
+		clean := cleanName(name)
+		records := v.records[clean]
+		if len(records) == 0 {
+			if len(answers) == 0 {
+				return nil, "", false
+			}
+			return answers, name, true
+		}
+		visited[clean] = true
+		var cname *DNSAnswer
+		found := false
+		for i, record := range records {
+			if record.RType == t || t == RTYPE_ANY {
+				answers, found = append(answers, record), true
+			} else if record.RType == RTYPE_CNAME {
+				cname = &records[i]
+			}
+		}
+		if found || cname == nil {
+			return answers, "", true
+		}
+		answers = append(answers, *cname)
+		target, ok := cname.RData.(CNAME_RECORD)
+		if !ok || visited[cleanName(target.CNAME)] {
+			return answers, "", true
+		}
+		name = target.CNAME
+	}
+}
+
+// clientAddr The address of the client at addr, the zero Addr if
+// it isn't an IP address.
+func clientAddr(addr net.Addr) netip.Addr {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return addr.AddrPort().Addr().Unmap()
+	}
+	if addr == nil {
+		return netip.Addr{}
+	}
+	addrPort, _ := netip.ParseAddrPort(addr.String())
+	return addrPort.Addr().Unmap()
+}
@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestServerViews(t *testing.T) {
+	records, err := ParseZone(strings.NewReader(`$TTL 60
+nas	A	192.168.1.5
+files	CNAME	nas
+www	CNAME	www.example.com.
+loop	CNAME	loop
+`), "home.arpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := withSingleRoot(New())
+	public.connect = answeringWith("192.0.2.1")
+	lan := withSingleRoot(New())
+	lan.connect = answeringWith("192.0.2.98")
+	srv := &Server{Resolver: public, Views: []View{
+		{Name: "guest", Clients: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}},
+		{Name: "lan", Clients: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Records: records, Resolver: lan},
+	}}
+	srv.begin()
+	defer srv.running.Done()
+
+	for _, test := range []struct {
+		client string
+		name   string
+		t      RTYPE
+		want   []string
+		aa     bool
+	}{
+		{"10.0.0.1", "nas.home.arpa", RTYPE_A, []string{"192.168.1.5"}, true},
+		{"::ffff:10.0.0.1", "NAS.home.arpa", RTYPE_A, []string{"192.168.1.5"}, true},
+		{"10.0.0.1", "files.home.arpa", RTYPE_A, []string{"nas.home.arpa.", "192.168.1.5"}, true},
+		{"10.0.0.1", "nas.home.arpa", RTYPE_AAAA, nil, true},
+		{"10.0.0.1", "loop.home.arpa", RTYPE_A, []string{"loop.home.arpa."}, true},
+		// out of the records and on to the view's resolver
+		{"10.0.0.1", "www.home.arpa", RTYPE_A, []string{"www.example.com.", "192.0.2.98"}, false},
+		{"10.0.0.1", "www.example.org", RTYPE_A, []string{"192.0.2.98"}, false},
+		// the guest network matches first and gets none of it
+		{"10.1.0.1", "nas.home.arpa", RTYPE_A, []string{"192.0.2.1"}, false},
+		{"192.0.2.200", "nas.home.arpa", RTYPE_A, []string{"192.0.2.1"}, false},
+	} {
+		query := &DNSMessage{Question: DNSQuestion{QName: test.name, QType: test.t, QClass: IN}}
+		response := srv.answer(query, netip.MustParseAddr(test.client))
+		var got []string
+		for _, answer := range response.Answers {
+			switch data := answer.RData.(type) {
+			case A_RECORD:
+				got = append(got, data.A.String())
+			case CNAME_RECORD:
+				got = append(got, data.CNAME)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") || response.Header.Authoritative != test.aa || response.Header.Status != RCODE_OK {
+			t.Errorf("%s from %s: got %v (%+v), want %v", test.name, test.client, got, response.Header, test.want)
+		}
+	}
+
+	if addr := clientAddr(&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 53}); addr != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("client address %v", addr)
+	}
+}
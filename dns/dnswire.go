@@ -0,0 +1,963 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// The wire format of DNS messages (RFC 1035 4).  packMessage puts a
+// whole DNSMessage in wire form, compressing names as it goes, and
+// unpackMessage reads one back.
+
+// ErrMalformedMessage A message that doesn't follow the wire format,
+// which is what unpackMessage returns (wrapped) for anything it
+// can't make sense of.
+var ErrMalformedMessage = errors.New("dns: malformed message")
+
+// Header flag bits, in the 16 bits after the ID, and where the
+// opcode goes in them
+const (
+	flagQR      = 1 << 15
+	flagAA      = 1 << 10
+	flagTC      = 1 << 9
+	flagRD      = 1 << 8
+	flagRA      = 1 << 7
+	flagAD      = 1 << 5
+	flagCD      = 1 << 4
+	opcodeShift = 11
+)
+
+// headerSize How big the fixed header at the start of every message
+// is: the ID, the flags and the four section counts.
+const headerSize = 12
+
+// maxPointer The furthest into a message a compression pointer can
+// point, it only having 14 bits for the offset
+const maxPointer = 0x3fff
+
+// packQuery This is the query for name/t as it goes on the wire,
+// with the RD and CD bits if rd and cd are set and edns in an OPT
+// record unless it is nil.  RD is only set for Forwarders, since
+// otherwise we do the recursion ourselves.
+func packQuery(id uint16, name string, t RTYPE, rd, cd bool, edns *EDNS) ([]byte, error) {
+	return packMessage(&DNSMessage{
+		Header:   DNSHeader{ID: id, RecursionDesired: rd, CheckingDisabled: cd},
+		Question: DNSQuestion{QName: name, QType: t, QClass: IN},
+		EDNS:     edns,
+	})
+}
+
+// Pack This is msg as it goes on the wire, see packMessage.
+func (msg *DNSMessage) Pack() ([]byte, error) {
+	return packMessage(msg)
+}
+
+// UnpackMessage This reads a message off the wire, see
+// unpackMessage.
+func UnpackMessage(packet []byte) (*DNSMessage, error) {
+	return unpackMessage(packet)
+}
+
+// packMessage This puts msg in wire form: the header with all its
+// flags, the question unless it has no name, then the three record
+// sections.  With msg.EDNS set an OPT record for it goes at the end
+// of the additional section, carrying the upper bits of the status
+// (any OPT record already there is left out).  Names are compressed
+// (RFC 1035 4.1.4) wherever they can be: owner names and the names
+// in the RDATA of the types RFC 1035 defines.  The names in other
+// types' RDATA never are, as RFC 3597 4 says, since something that
+// doesn't know the type couldn't follow the pointer.  Names keep
+// their case, and only exactly the same name is pointed at, so
+// CaseRandomization survives the trip.
+func packMessage(msg *DNSMessage) ([]byte, error) {
+	h := msg.Header
+	flags := uint16(h.Opcode&0xf)<<opcodeShift | uint16(h.Status&0xf)
+	for _, flag := range []struct {
+		set bool
+		bit uint16
+	}{
+		{h.Response, flagQR}, {h.Authoritative, flagAA}, {h.Truncated, flagTC},
+		{h.RecursionDesired, flagRD}, {h.RecursionAvailable, flagRA},
+		{h.AuthenticData, flagAD}, {h.CheckingDisabled, flagCD},
+	} {
+		if flag.set {
+			flags |= flag.bit
+		}
+	}
+	additionals := msg.Additionals
+	if msg.EDNS != nil {
+		additionals = nil
+		for _, record := range msg.Additionals {
+			if record.RType != RTYPE_OPT {
+				additionals = append(additionals, record)
+			}
+		}
+		edns := *msg.EDNS
+		edns.ExtendedRcode = uint8(h.Status >> 4)
+		additionals = append(additionals, edns.record())
+	} else if h.Status > 0xf {
+		return nil, fmt.Errorf("dns: status %v needs EDNS", h.Status)
+	}
+	var qdcount uint16
+	if msg.Question.QName != "" {
+		qdcount = 1
+	}
+	sections := [][]DNSAnswer{msg.Answers, msg.Authorities, additionals}
+	w := &wireWriter{msg: make([]byte, 0, 512)}
+	w.u16(h.ID)
+	w.u16(flags)
+	w.u16(qdcount)
+	for _, section := range sections {
+		if len(section) > 0xffff {
+			return nil, fmt.Errorf("dns: too many records")
+		}
+		w.u16(uint16(len(section)))
+	}
+	if qdcount > 0 {
+		if err := w.name(msg.Question.QName, true); err != nil {
+			return nil, err
+		}
+		w.u16(uint16(msg.Question.QType))
+		w.u16(uint16(msg.Question.QClass))
+	}
+	for _, section := range sections {
+		for _, record := range section {
+			if err := w.record(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(w.msg) > 0xffff {
+		return nil, fmt.Errorf("dns: message too long")
+	}
+	return w.msg, nil
+}
+
+// wireWriter This builds a message being packed.  names says where
+// each name written so far (and each of its parents) starts, for
+// later ones to point at.
+type wireWriter struct {
+	msg   []byte
+	names map[string]int
+}
+
+func (w *wireWriter) u8(v uint8) {
+	w.msg = append(w.msg, v)
+}
+
+func (w *wireWriter) u16(v uint16) {
+	w.msg = binary.BigEndian.AppendUint16(w.msg, v)
+}
+
+func (w *wireWriter) u32(v uint32) {
+	w.msg = binary.BigEndian.AppendUint32(w.msg, v)
+}
+
+// name This writes name, each label preceded by its length and then
+// the root's empty label, or if compress is set as much of it as
+// has been written before as a pointer to that.  Labels can't
+// contain dots.
+func (w *wireWriter) name(name string, compress bool) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name)+2 > 255 {
+		return fmt.Errorf("dns: name %q too long", name)
+	}
+	if name == "" {
+		w.u8(0)
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("dns: bad label in %q", name)
+		}
+		suffix := strings.Join(labels[i:], ".")
+		if off, ok := w.names[suffix]; ok && compress {
+			w.u16(0xc000 | uint16(off))
+			return nil
+		}
+		if len(w.msg) <= maxPointer {
+			if w.names == nil {
+				w.names = make(map[string]int)
+			}
+			if _, ok := w.names[suffix]; !ok {
+				w.names[suffix] = len(w.msg)
+			}
+		}
+		w.u8(uint8(len(label)))
+		w.msg = append(w.msg, label...)
+	}
+	w.u8(0)
+	return nil
+}
+
+// record This writes one resource record.
+func (w *wireWriter) record(record DNSAnswer) error {
+	if err := w.name(record.RName, true); err != nil {
+		return err
+	}
+	w.u16(uint16(record.RType))
+	w.u16(uint16(record.RClass))
+	w.u32(record.TTL)
+	// the length goes in once the RDATA is written
+	at := len(w.msg)
+	w.u16(0)
+	if err := w.rdata(record.RData); err != nil {
+		return err
+	}
+	length := len(w.msg) - at - 2
+	if length > 0xffff {
+		return fmt.Errorf("dns: %v RDATA too long", record.RType)
+	}
+	binary.BigEndian.PutUint16(w.msg[at:], uint16(length))
+	return nil
+}
+
+// rdata This writes the RDATA rdata in the form rdata reads.
+func (w *wireWriter) rdata(rdata RDATA) error {
+	switch r := rdata.(type) {
+	case nil:
+	case A_RECORD:
+		if !r.A.Unmap().Is4() {
+			return fmt.Errorf("dns: A record for %v", r.A)
+		}
+		w.msg = append(w.msg, r.A.Unmap().AsSlice()...)
+	case AAAA_RECORD:
+		addr := r.AAAA.As16()
+		w.msg = append(w.msg, addr[:]...)
+	case NS_RECORD:
+		return w.name(r.NS, true)
+	case CNAME_RECORD:
+		return w.name(r.CNAME, true)
+	case PTR_RECORD:
+		return w.name(r.PTR, true)
+	case SOA_RECORD:
+		if err := w.name(r.MName, true); err != nil {
+			return err
+		}
+		if err := w.name(r.RName, true); err != nil {
+			return err
+		}
+		for _, field := range []uint32{r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum} {
+			w.u32(field)
+		}
+	case MX_RECORD:
+		w.u16(r.Preference)
+		return w.name(r.Exchange, true)
+	case TXT_RECORD:
+		for _, txt := range r.Txt {
+			if len(txt) > 255 {
+				return fmt.Errorf("dns: TXT string too long")
+			}
+			w.u8(uint8(len(txt)))
+			w.msg = append(w.msg, txt...)
+		}
+	case SRV_RECORD:
+		w.u16(r.Priority)
+		w.u16(r.Weight)
+		w.u16(r.Port)
+		return w.name(r.Target, false)
+	case DS_RECORD:
+		w.u16(r.KeyTag)
+		w.msg = append(w.msg, r.Algorithm, r.DigestType)
+		w.msg = append(w.msg, r.Digest...)
+	case DNSKEY_RECORD:
+		w.msg = append(w.msg, r.rdata()...)
+	case RRSIG_RECORD:
+		w.u16(uint16(r.TypeCovered))
+		w.msg = append(w.msg, r.Algorithm, r.Labels)
+		w.u32(r.OriginalTTL)
+		w.u32(r.Expiration)
+		w.u32(r.Inception)
+		w.u16(r.KeyTag)
+		if err := w.name(r.SignerName, false); err != nil {
+			return err
+		}
+		w.msg = append(w.msg, r.Signature...)
+	case TSIG_RECORD:
+		if len(r.MAC) > 0xffff || len(r.OtherData) > 0xffff {
+			return fmt.Errorf("dns: TSIG MAC or other data too long")
+		}
+		if err := w.name(r.Algorithm, false); err != nil {
+			return err
+		}
+		w.u16(uint16(r.TimeSigned >> 32))
+		w.u32(uint32(r.TimeSigned))
+		w.u16(r.Fudge)
+		w.u16(uint16(len(r.MAC)))
+		w.msg = append(w.msg, r.MAC...)
+		w.u16(r.OriginalID)
+		w.u16(uint16(r.Error))
+		w.u16(uint16(len(r.OtherData)))
+		w.msg = append(w.msg, r.OtherData...)
+	case NSEC_RECORD:
+		if err := w.name(r.NextDomain, false); err != nil {
+			return err
+		}
+		w.msg = append(w.msg, r.TypeBitmap...)
+	case NSEC3_RECORD:
+		if len(r.Salt) > 255 || len(r.NextHashed) > 255 {
+			return fmt.Errorf("dns: NSEC3 salt or hash too long")
+		}
+		w.msg = append(w.msg, r.HashAlgorithm, r.Flags)
+		w.u16(r.Iterations)
+		w.u8(uint8(len(r.Salt)))
+		w.msg = append(w.msg, r.Salt...)
+		w.u8(uint8(len(r.NextHashed)))
+		w.msg = append(w.msg, r.NextHashed...)
+		w.msg = append(w.msg, r.TypeBitmap...)
+	case TLSA_RECORD:
+		w.msg = append(w.msg, r.Usage, r.Selector, r.MatchingType)
+		w.msg = append(w.msg, r.CertData...)
+	case CAA_RECORD:
+		if len(r.Tag) > 255 {
+			return fmt.Errorf("dns: CAA tag too long")
+		}
+		w.msg = append(w.msg, r.Flags, uint8(len(r.Tag)))
+		w.msg = append(w.msg, r.Tag...)
+		w.msg = append(w.msg, r.Value...)
+	case HTTPS_RECORD:
+		return w.rdata(r.SVCB_RECORD)
+	case SVCB_RECORD:
+		w.u16(r.Priority)
+		if err := w.name(r.Target, false); err != nil {
+			return err
+		}
+		for _, param := range r.Params {
+			w.u16(uint16(param.Key))
+			w.u16(uint16(len(param.Value)))
+			w.msg = append(w.msg, param.Value...)
+		}
+	case OPT_RECORD:
+		for _, option := range r.Options {
+			w.u16(option.Code)
+			w.u16(uint16(len(option.Data)))
+			w.msg = append(w.msg, option.Data...)
+		}
+	case RAW_RECORD:
+		w.msg = append(w.msg, r.Data...)
+	default:
+		return fmt.Errorf("dns: can't pack %T", rdata)
+	}
+	return nil
+}
+
+// wireReader This walks through a message being unpacked.  Names
+// can point back to anywhere earlier in msg, which is why the whole
+// thing is kept around rather than just what is left.
+type wireReader struct {
+	msg []byte
+	off int
+	// names Where names read so far (and the names of their parents)
+	// start, and what they are, so that a pointer back to one costs
+	// nothing to follow: most names in a response are the question's
+	// name or one of its parents, and come out as the same string
+	names    [32]wireName
+	numNames int
+}
+
+// wireName A name in the message being unpacked, and where it starts
+type wireName struct {
+	off  int
+	name string
+}
+
+// cached The name that starts at off, if it has been read already
+func (r *wireReader) cached(off int) (string, bool) {
+	for _, n := range r.names[:min(r.numNames, len(r.names))] {
+		if n.off == off {
+			return n.name, true
+		}
+	}
+	return "", false
+}
+
+// remember This notes that name starts at off, the oldest of the
+// names noted going once there are too many.
+func (r *wireReader) remember(off int, name string) {
+	r.names[r.numNames%len(r.names)] = wireName{off, name}
+	r.numNames++
+}
+
+func (r *wireReader) malformed(what string) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrMalformedMessage, what, r.off)
+}
+
+func (r *wireReader) u8() (uint8, error) {
+	if r.off+1 > len(r.msg) {
+		return 0, r.malformed("short message")
+	}
+	r.off++
+	return r.msg[r.off-1], nil
+}
+
+func (r *wireReader) u16() (uint16, error) {
+	if r.off+2 > len(r.msg) {
+		return 0, r.malformed("short message")
+	}
+	r.off += 2
+	return binary.BigEndian.Uint16(r.msg[r.off-2:]), nil
+}
+
+func (r *wireReader) u32() (uint32, error) {
+	if r.off+4 > len(r.msg) {
+		return 0, r.malformed("short message")
+	}
+	r.off += 4
+	return binary.BigEndian.Uint32(r.msg[r.off-4:]), nil
+}
+
+// bytes The next n bytes, copied so they don't hold on to msg
+func (r *wireReader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.off+n > len(r.msg) {
+		return nil, r.malformed("short message")
+	}
+	r.off += n
+	return append([]byte(nil), r.msg[r.off-n:r.off]...), nil
+}
+
+// Limits on what unpackMessage will take, so that a hostile server
+// can't make it do much more work than the size of the message:
+// how many compression pointers one name can go through (a real
+// name never needs more than one per label), and the smallest a
+// question and a record can be, which the section counts are
+// checked against before anything is read.
+const (
+	maxPointerHops = 127
+	minQuestionLen = 1 + 4
+	minRecordLen   = 1 + 10
+)
+
+// name This reads a name, following compression pointers (RFC 1035
+// 4.1.4).  A pointer has to point to somewhere before itself, which
+// is all a real server ever does and means they can't go round in a
+// loop, and a name can only go through maxPointerHops of them.  It
+// stops as soon as the name is longer than a name can be (255 bytes
+// in wire form), so however the labels are put together reading it
+// costs no more than that.  The name comes back fully qualified,
+// ending in a '.'.  A name (or the end of one) that has been read
+// before is the same string as it was then, so that only the labels
+// which are new cost an allocation.
+func (r *wireReader) name() (string, error) {
+	// the name is put together in buf, and labels is where each
+	// label of it was in the message, for remember
+	var buf [255]byte
+	var labels [128]int
+	n, numLabels := 0, 0
+	var rest string
+	off := r.off
+	jumped := false
+	for hops := 0; ; {
+		if off >= len(r.msg) {
+			return "", r.malformed("short name")
+		}
+		length := int(r.msg[off])
+		// once past a pointer nothing more needs reading for
+		// r.off, so the rest of the name can come from before
+		if jumped && length&0xc0 == 0 {
+			if cached, ok := r.cached(off); ok {
+				rest = cached
+				break
+			}
+		}
+		if length == 0 {
+			if !jumped {
+				r.off = off + 1
+			}
+			break
+		}
+		switch {
+		case length&0xc0 == 0xc0:
+			if off+2 > len(r.msg) {
+				return "", r.malformed("short name")
+			}
+			if hops++; hops > maxPointerHops {
+				return "", r.malformed("too many compression pointers")
+			}
+			target := int(binary.BigEndian.Uint16(r.msg[off:]) & maxPointer)
+			if target >= off {
+				return "", r.malformed("compression pointer forwards")
+			}
+			if !jumped {
+				r.off = off + 2
+				jumped = true
+			}
+			off = target
+		case length&0xc0 != 0:
+			return "", r.malformed("bad label type")
+		default:
+			if off+1+length > len(r.msg) {
+				return "", r.malformed("short name")
+			}
+			// the wire form is the dotted one plus the root's
+			// empty label
+			if n+1+length+1 > 255 {
+				return "", r.malformed("name too long")
+			}
+			labels[numLabels] = off
+			numLabels++
+			n += copy(buf[n:], r.msg[off+1:off+1+length])
+			buf[n] = '.'
+			n++
+			off += 1 + length
+		}
+	}
+	if rest != "" && n+len(rest)+1 > 255 {
+		return "", r.malformed("name too long")
+	}
+	var name string
+	switch {
+	case n == 0 && rest == "":
+		return ".", nil
+	case n == 0:
+		return rest, nil
+	case rest == "":
+		name = string(buf[:n])
+	default:
+		name = string(buf[:n]) + rest
+	}
+	// each label read starts one of the name's parents
+	at := 0
+	for _, label := range labels[:numLabels] {
+		r.remember(label, name[at:])
+		at += int(r.msg[label]) + 1
+	}
+	return name, nil
+}
+
+// wireBuffers Buffers big enough for any message, for reading
+// responses into.  unpackMessage copies out everything it keeps, so
+// a buffer can go back as soon as the message in it is unpacked.
+var wireBuffers = sync.Pool{New: func() any { return new([65535]byte) }}
+
+// unpackMessage This turns a message off the wire into a DNSMessage.
+// Only the first question is kept (there is never more than one in
+// practice), and the OPT record, if there is one, becomes msg.EDNS
+// (see takeOPT).  More than one, or one that isn't the root's, is
+// malformed (RFC 6891 6.1.1).  Owner names come back without the trailing '.', the
+// way the rest of the package writes them, and names in RDATA with
+// it.  Anything malformed is an ErrMalformedMessage.
+func unpackMessage(packet []byte) (*DNSMessage, error) {
+	r := &wireReader{msg: packet}
+	var counts [4]uint16
+	msg := &DNSMessage{}
+	id, err := r.u16()
+	if err != nil {
+		return nil, err
+	}
+	flags, err := r.u16()
+	if err != nil {
+		return nil, err
+	}
+	for i := range counts {
+		if counts[i], err = r.u16(); err != nil {
+			return nil, err
+		}
+	}
+	msg.Header = DNSHeader{
+		ID:                 id,
+		Status:             RCODE(flags & 0xf),
+		Truncated:          flags&flagTC != 0,
+		AuthenticData:      flags&flagAD != 0,
+		CheckingDisabled:   flags&flagCD != 0,
+		Response:           flags&flagQR != 0,
+		Opcode:             uint8(flags>>opcodeShift) & 0xf,
+		Authoritative:      flags&flagAA != 0,
+		RecursionDesired:   flags&flagRD != 0,
+		RecursionAvailable: flags&flagRA != 0,
+	}
+	// a forged count can't have us going on past the end of the
+	// message, or make room for more records than could be in it
+	left := len(r.msg) - r.off
+	if int(counts[0])*minQuestionLen > left {
+		return nil, r.malformed("question count past the end")
+	}
+	left -= int(counts[0]) * minQuestionLen
+	if records := int(counts[1]) + int(counts[2]) + int(counts[3]); records*minRecordLen > left {
+		return nil, r.malformed("record counts past the end")
+	}
+	sections := []*[]DNSAnswer{&msg.Answers, &msg.Authorities, &msg.Additionals}
+	for i, section := range sections {
+		if counts[i+1] > 0 {
+			*section = make([]DNSAnswer, 0, counts[i+1])
+		}
+	}
+	for i := 0; i < int(counts[0]); i++ {
+		name, err := r.name()
+		if err != nil {
+			return nil, err
+		}
+		qtype, err := r.u16()
+		if err != nil {
+			return nil, err
+		}
+		qclass, err := r.u16()
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			msg.Question = DNSQuestion{QName: ownerName(name), QType: RTYPE(qtype), QClass: CLASS(qclass)}
+		}
+	}
+	for i, section := range sections {
+		for range counts[i+1] {
+			record, err := r.record()
+			if err != nil {
+				return nil, err
+			}
+			if record.RType == RTYPE_OPT {
+				if section != &msg.Additionals || record.RName != "." {
+					return nil, r.malformed("misplaced OPT record")
+				}
+				if msg.EDNS != nil {
+					return nil, r.malformed("more than one OPT record")
+				}
+				// as takeOPT would, without copying the
+				// additional section
+				msg.EDNS = ednsFromRecord(record)
+				msg.Header.Status = RCODE(msg.EDNS.ExtendedRcode)<<4 | msg.Header.Status&0xf
+				continue
+			}
+			*section = append(*section, record)
+		}
+	}
+	return msg, nil
+}
+
+// ownerName This is name (from wireReader.name) the way owner names
+// are written everywhere else, without the trailing '.'
+func ownerName(name string) string {
+	if name == "." {
+		return name
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// record This reads one resource record.
+func (r *wireReader) record() (DNSAnswer, error) {
+	name, err := r.name()
+	if err != nil {
+		return DNSAnswer{}, err
+	}
+	t, err := r.u16()
+	if err != nil {
+		return DNSAnswer{}, err
+	}
+	class, err := r.u16()
+	if err != nil {
+		return DNSAnswer{}, err
+	}
+	ttl, err := r.u32()
+	if err != nil {
+		return DNSAnswer{}, err
+	}
+	length, err := r.u16()
+	if err != nil {
+		return DNSAnswer{}, err
+	}
+	end := r.off + int(length)
+	if end > len(r.msg) {
+		return DNSAnswer{}, r.malformed("short RDATA")
+	}
+	var rdata RDATA
+	// the prerequisites and deletions in a dynamic update have no
+	// RDATA whatever their type (RFC 2136 2.4, 2.5)
+	if length > 0 || CLASS(class) != ANY && CLASS(class) != NONE {
+		if rdata, err = r.rdata(RTYPE(t), end); err != nil {
+			return DNSAnswer{}, err
+		}
+	}
+	if r.off != end {
+		return DNSAnswer{}, r.malformed(fmt.Sprintf("%v RDATA has the wrong length", RTYPE(t)))
+	}
+	return DNSAnswer{RName: ownerName(name), RType: RTYPE(t), RClass: CLASS(class), TTL: ttl, RData: rdata}, nil
+}
+
+// rdata This reads the RDATA of a t record, which ends at end.
+// Types we don't model become a RAW_RECORD.
+func (r *wireReader) rdata(t RTYPE, end int) (RDATA, error) {
+	// the RDATA is all there (record checked), so reading past
+	// end only needs to be caught for the variable length parts
+	rest := func() ([]byte, error) { return r.bytes(end - r.off) }
+	var err error
+	switch t {
+	case RTYPE_A:
+		if end-r.off != 4 {
+			return nil, r.malformed("bad A record")
+		}
+		// straight out of the message, there is nothing to copy
+		addr := netip.AddrFrom4([4]byte(r.msg[r.off:end]))
+		r.off = end
+		return A_RECORD{addr}, nil
+	case RTYPE_AAAA:
+		if end-r.off != 16 {
+			return nil, r.malformed("bad AAAA record")
+		}
+		addr := netip.AddrFrom16([16]byte(r.msg[r.off:end]))
+		r.off = end
+		return AAAA_RECORD{addr}, nil
+	case RTYPE_NS:
+		var rec NS_RECORD
+		rec.NS, err = r.name()
+		return rec, err
+	case RTYPE_CNAME:
+		var rec CNAME_RECORD
+		rec.CNAME, err = r.name()
+		return rec, err
+	case RTYPE_PTR:
+		var rec PTR_RECORD
+		rec.PTR, err = r.name()
+		return rec, err
+	case RTYPE_SOA:
+		var rec SOA_RECORD
+		if rec.MName, err = r.name(); err != nil {
+			return nil, err
+		}
+		if rec.RName, err = r.name(); err != nil {
+			return nil, err
+		}
+		for _, field := range []*uint32{&rec.Serial, &rec.Refresh, &rec.Retry, &rec.Expire, &rec.Minimum} {
+			if *field, err = r.u32(); err != nil {
+				return nil, err
+			}
+		}
+		return rec, nil
+	case RTYPE_MX:
+		var rec MX_RECORD
+		if rec.Preference, err = r.u16(); err != nil {
+			return nil, err
+		}
+		rec.Exchange, err = r.name()
+		return rec, err
+	case RTYPE_TXT:
+		var rec TXT_RECORD
+		for r.off < end {
+			var length uint8
+			var txt []byte
+			if length, err = r.u8(); err != nil {
+				return nil, err
+			}
+			if r.off+int(length) > end {
+				return nil, r.malformed("TXT string past the end")
+			}
+			if txt, err = r.bytes(int(length)); err != nil {
+				return nil, err
+			}
+			rec.Txt = append(rec.Txt, string(txt))
+		}
+		return rec, nil
+	case RTYPE_SRV:
+		var rec SRV_RECORD
+		for _, field := range []*uint16{&rec.Priority, &rec.Weight, &rec.Port} {
+			if *field, err = r.u16(); err != nil {
+				return nil, err
+			}
+		}
+		rec.Target, err = r.name()
+		return rec, err
+	case RTYPE_DS:
+		var rec DS_RECORD
+		if rec.KeyTag, err = r.u16(); err != nil {
+			return nil, err
+		}
+		if rec.Algorithm, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if rec.DigestType, err = r.u8(); err != nil {
+			return nil, err
+		}
+		rec.Digest, err = rest()
+		return rec, err
+	case RTYPE_DNSKEY:
+		var rec DNSKEY_RECORD
+		if rec.Flags, err = r.u16(); err != nil {
+			return nil, err
+		}
+		if rec.Protocol, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if rec.Algorithm, err = r.u8(); err != nil {
+			return nil, err
+		}
+		rec.PublicKey, err = rest()
+		return rec, err
+	case RTYPE_RRSIG:
+		var rec RRSIG_RECORD
+		var covered uint16
+		if covered, err = r.u16(); err != nil {
+			return nil, err
+		}
+		rec.TypeCovered = RTYPE(covered)
+		if rec.Algorithm, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if rec.Labels, err = r.u8(); err != nil {
+			return nil, err
+		}
+		for _, field := range []*uint32{&rec.OriginalTTL, &rec.Expiration, &rec.Inception} {
+			if *field, err = r.u32(); err != nil {
+				return nil, err
+			}
+		}
+		if rec.KeyTag, err = r.u16(); err != nil {
+			return nil, err
+		}
+		if rec.SignerName, err = r.name(); err != nil {
+			return nil, err
+		}
+		rec.Signature, err = rest()
+		return rec, err
+	case RTYPE_TSIG:
+		var rec TSIG_RECORD
+		if rec.Algorithm, err = r.name(); err != nil {
+			return nil, err
+		}
+		var high uint16
+		var low uint32
+		if high, err = r.u16(); err != nil {
+			return nil, err
+		}
+		if low, err = r.u32(); err != nil {
+			return nil, err
+		}
+		rec.TimeSigned = uint64(high)<<32 | uint64(low)
+		if rec.Fudge, err = r.u16(); err != nil {
+			return nil, err
+		}
+		var length, rcode uint16
+		if length, err = r.u16(); err != nil {
+			return nil, err
+		}
+		if rec.MAC, err = r.bytes(int(length)); err != nil {
+			return nil, err
+		}
+		if rec.OriginalID, err = r.u16(); err != nil {
+			return nil, err
+		}
+		if rcode, err = r.u16(); err != nil {
+			return nil, err
+		}
+		rec.Error = RCODE(rcode)
+		if length, err = r.u16(); err != nil {
+			return nil, err
+		}
+		rec.OtherData, err = r.bytes(int(length))
+		return rec, err
+	case RTYPE_NSEC:
+		var rec NSEC_RECORD
+		if rec.NextDomain, err = r.name(); err != nil {
+			return nil, err
+		}
+		rec.TypeBitmap, err = rest()
+		return rec, err
+	case RTYPE_NSEC3:
+		var rec NSEC3_RECORD
+		var length uint8
+		if rec.HashAlgorithm, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if rec.Flags, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if rec.Iterations, err = r.u16(); err != nil {
+			return nil, err
+		}
+		if length, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if rec.Salt, err = r.bytes(int(length)); err != nil {
+			return nil, err
+		}
+		if length, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if rec.NextHashed, err = r.bytes(int(length)); err != nil {
+			return nil, err
+		}
+		rec.TypeBitmap, err = rest()
+		return rec, err
+	case RTYPE_TLSA:
+		var rec TLSA_RECORD
+		for _, field := range []*uint8{&rec.Usage, &rec.Selector, &rec.MatchingType} {
+			if *field, err = r.u8(); err != nil {
+				return nil, err
+			}
+		}
+		rec.CertData, err = rest()
+		return rec, err
+	case RTYPE_CAA:
+		var rec CAA_RECORD
+		var length uint8
+		var tag, value []byte
+		if rec.Flags, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if length, err = r.u8(); err != nil {
+			return nil, err
+		}
+		if tag, err = r.bytes(int(length)); err != nil {
+			return nil, err
+		}
+		if value, err = rest(); err != nil {
+			return nil, err
+		}
+		rec.Tag, rec.Value = string(tag), string(value)
+		return rec, nil
+	case RTYPE_SVCB, RTYPE_HTTPS:
+		var rec SVCB_RECORD
+		if rec.Priority, err = r.u16(); err != nil {
+			return nil, err
+		}
+		if rec.Target, err = r.name(); err != nil {
+			return nil, err
+		}
+		for r.off < end {
+			var param SvcParam
+			var key, length uint16
+			if key, err = r.u16(); err != nil {
+				return nil, err
+			}
+			if length, err = r.u16(); err != nil {
+				return nil, err
+			}
+			if r.off+int(length) > end {
+				return nil, r.malformed("SvcParam past the end")
+			}
+			param.Key = SvcParamKey(key)
+			if param.Value, err = r.bytes(int(length)); err != nil {
+				return nil, err
+			}
+			rec.Params = append(rec.Params, param)
+		}
+		if t == RTYPE_HTTPS {
+			return HTTPS_RECORD{rec}, nil
+		}
+		return rec, nil
+	case RTYPE_OPT:
+		var rec OPT_RECORD
+		for r.off < end {
+			var option EDNSOption
+			var length uint16
+			if option.Code, err = r.u16(); err != nil {
+				return nil, err
+			}
+			if length, err = r.u16(); err != nil {
+				return nil, err
+			}
+			if r.off+int(length) > end {
+				return nil, r.malformed("EDNS option past the end")
+			}
+			if option.Data, err = r.bytes(int(length)); err != nil {
+				return nil, err
+			}
+			rec.Options = append(rec.Options, option)
+		}
+		return rec, nil
+	}
+	data, err := rest()
+	return RAW_RECORD{Type: uint16(t), Data: data}, err
+}
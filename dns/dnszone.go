@@ -0,0 +1,947 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseZone This reads a master file (RFC 1035 5) and returns its
+// records in the order they are in it.  Names that don't end in a
+// '.' are relative to origin ("." if it is ""), which $ORIGIN
+// changes and "@" stands for.  A record without a TTL gets the one
+// from $TTL (RFC 2308 4), or failing that the last one given, and
+// one starting with a blank has the owner of the one before.
+// Parentheses carry a record over more than one line, ';' starts a
+// comment and text can be quoted, with the usual \X and \DDD
+// escapes.  $INCLUDE reads another file, relative to the current
+// directory (see ParseZoneFile).  RDATA is read in the presentation
+// form of its type for every type the package has a record for
+// apart from NULL, or for any type in the generic form of RFC 3597
+// ("\# length hex"), types we don't model coming back as a
+// RAW_RECORD.  Owner names come back without the trailing '.', and
+// names in RDATA with it, as unpackMessage has them.  Labels can't
+// have a '.' in them, escaped or not.
+func ParseZone(r io.Reader, origin string) ([]DNSAnswer, error) {
+	p := &zoneParser{}
+	if err := p.parse(r, "", zoneOrigin(origin), 0); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// ParseZoneFile This is ParseZone for a file on disk, with $INCLUDE
+// relative to the directory it is in.
+func ParseZoneFile(path, origin string) ([]DNSAnswer, error) {
+	p := &zoneParser{}
+	if err := p.include(path, zoneOrigin(origin), 0); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// CachePreload This is DefaultResolver.CachePreload
+func CachePreload(records []DNSAnswer) {
+	DefaultResolver.CachePreload(records)
+}
+
+// CachePreload This puts records (from ParseZone say) in the cache
+// as though a server had just given them as answers, each RRset
+// replacing whatever was cached for it and expiring with its TTL.
+// NS records and addresses are cached as delegations and glue as
+// well, so lookups below a zone's cuts go to its servers.  Records
+// that should never expire are for CachePin.
+func (res *Resolver) CachePreload(records []DNSAnswer) {
+	for _, set := range groupRRsets(records) {
+		res.answerSet(*set, true)
+		switch set.t {
+		case RTYPE_NS, RTYPE_A, RTYPE_AAAA:
+			if set.class == IN {
+				res.infraSet(set.name, set.t, ttlExpires(set.ttl), set.data)
+			}
+		}
+	}
+}
+
+// maxZoneIncludes How deep $INCLUDE can go, so a file including
+// itself is an error rather than the end of the stack
+const maxZoneIncludes = 16
+
+// zoneOrigin This is origin fully qualified, "." if it is empty.
+func zoneOrigin(origin string) string {
+	if origin == "" {
+		return "."
+	}
+	return absolute(origin)
+}
+
+// zoneParser What ParseZone keeps from one record to the next: the
+// records so far, the owner, class and TTL of the last one, and the
+// $TTL.
+type zoneParser struct {
+	records    []DNSAnswer
+	owner      string
+	class      CLASS
+	ttl        uint32
+	haveTTL    bool
+	defaultTTL uint32
+	haveDefTTL bool
+}
+
+// include This parses the file at path, with origin as its origin,
+// for ParseZoneFile and $INCLUDE.
+func (p *zoneParser) include(path, origin string, depth int) error {
+	if depth > maxZoneIncludes {
+		return fmt.Errorf("%s: $INCLUDE nested too deep", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("loading zone: %w", err)
+	}
+	defer f.Close()
+	if err := p.parse(f, filepath.Dir(path), origin, depth); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// parse This reads the entries in r, one of which may $INCLUDE
+// files relative to dir.  The origin only lasts until the end of
+// r, the TTLs and last owner carry on.
+func (p *zoneParser) parse(r io.Reader, dir, origin string, depth int) error {
+	lex := &zoneLexer{r: bufio.NewReader(r), line: 1}
+	for {
+		tokens, blank, line, err := lex.entry()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if !blank && strings.HasPrefix(tokens[0].text, "$") && !tokens[0].quoted {
+			if err := p.control(tokens, dir, &origin, depth); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			continue
+		}
+		record, err := p.record(tokens, blank, origin)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		p.records = append(p.records, record)
+	}
+}
+
+// control This carries out a $ORIGIN, $TTL or $INCLUDE entry.
+func (p *zoneParser) control(tokens []zoneToken, dir string, origin *string, depth int) error {
+	args := tokens[1:]
+	switch directive := strings.ToUpper(tokens[0].text); directive {
+	case "$ORIGIN":
+		if len(args) != 1 {
+			return fmt.Errorf("$ORIGIN takes a name")
+		}
+		name, err := zoneName(args[0], *origin)
+		if err != nil {
+			return err
+		}
+		*origin = name
+	case "$TTL":
+		if len(args) != 1 {
+			return fmt.Errorf("$TTL takes a TTL")
+		}
+		ttl, ok := parseTTL(args[0].text)
+		if !ok {
+			return fmt.Errorf("bad TTL %q", args[0].text)
+		}
+		p.defaultTTL, p.haveDefTTL = ttl, true
+	case "$INCLUDE":
+		if len(args) != 1 && len(args) != 2 {
+			return fmt.Errorf("$INCLUDE takes a file and maybe an origin")
+		}
+		path, err := unescapeZone(args[0].text)
+		if err != nil {
+			return err
+		}
+		if dir != "" && !filepath.IsAbs(string(path)) {
+			path = []byte(filepath.Join(dir, string(path)))
+		}
+		// the included file's origin doesn't come back with it
+		// (RFC 1035 5.1)
+		included := *origin
+		if len(args) == 2 {
+			if included, err = zoneName(args[1], *origin); err != nil {
+				return err
+			}
+		}
+		return p.include(string(path), included, depth+1)
+	default:
+		return fmt.Errorf("unknown directive %s", directive)
+	}
+	return nil
+}
+
+// record This reads a record out of the tokens of its entry: the
+// owner unless the entry started with a blank, the TTL and class
+// in either order, both optional, the type and then the RDATA.
+func (p *zoneParser) record(tokens []zoneToken, blank bool, origin string) (DNSAnswer, error) {
+	if !blank {
+		owner, err := zoneName(tokens[0], origin)
+		if err != nil {
+			return DNSAnswer{}, err
+		}
+		p.owner = owner
+		tokens = tokens[1:]
+	} else if p.owner == "" {
+		return DNSAnswer{}, fmt.Errorf("no owner for the first record")
+	}
+	var ttl uint32
+	var haveTTL, haveClass bool
+	class := p.class
+	for len(tokens) > 0 && !tokens[0].quoted {
+		if t, ok := parseTTL(tokens[0].text); ok && !haveTTL {
+			ttl, haveTTL = t, true
+		} else if c, ok := parseClass(tokens[0].text); ok && !haveClass {
+			class, haveClass = c, true
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return DNSAnswer{}, fmt.Errorf("no type")
+	}
+	t, ok := parseType(tokens[0].text)
+	if !ok || tokens[0].quoted {
+		return DNSAnswer{}, fmt.Errorf("unknown type %q", tokens[0].text)
+	}
+	switch {
+	case haveTTL:
+		p.ttl, p.haveTTL = ttl, true
+	case p.haveDefTTL:
+		ttl = p.defaultTTL
+	case p.haveTTL:
+		ttl = p.ttl
+	default:
+		return DNSAnswer{}, fmt.Errorf("no TTL and no $TTL")
+	}
+	if class == 0 {
+		class = IN
+	}
+	p.class = class
+	rdata, err := parseZoneRDATA(t, tokens[1:], origin)
+	if err != nil {
+		return DNSAnswer{}, fmt.Errorf("%v record: %w", t, err)
+	}
+	return DNSAnswer{RName: ownerName(p.owner), RType: t, RClass: class, TTL: ttl, RData: rdata}, nil
+}
+
+// zoneToken One word of an entry, and whether it was in quotes.
+// Escapes are left in, since what they mean depends on what the
+// token is (see unescapeZone).
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneLexer This splits a master file up into entries, each a line
+// or more if there are parentheses, and the entries into tokens.
+type zoneLexer struct {
+	r    *bufio.Reader
+	line int
+}
+
+// entry The tokens of the next entry, whether it started with a
+// blank (so has no owner) and the line it started on.  At the end
+// of the file it returns io.EOF.
+func (l *zoneLexer) entry() (tokens []zoneToken, blank bool, line int, err error) {
+	var word strings.Builder
+	inWord, quoted := false, false
+	parens := 0
+	lineStart := true
+	line = l.line
+	end := func() {
+		if inWord {
+			tokens = append(tokens, zoneToken{text: word.String(), quoted: quoted})
+			word.Reset()
+			inWord, quoted = false, false
+		}
+	}
+	for {
+		c, err := l.r.ReadByte()
+		if err == io.EOF {
+			if quoted {
+				return nil, false, line, fmt.Errorf("unterminated quotes")
+			}
+			if parens > 0 {
+				return nil, false, line, fmt.Errorf("unbalanced parentheses")
+			}
+			end()
+			if len(tokens) == 0 {
+				return nil, false, line, io.EOF
+			}
+			return tokens, blank, line, nil
+		}
+		if err != nil {
+			return nil, false, line, err
+		}
+		if quoted {
+			switch c {
+			case '"':
+				end()
+			case '\\':
+				word.WriteByte(c)
+				next, err := l.r.ReadByte()
+				if err != nil {
+					return nil, false, line, fmt.Errorf("unterminated quotes")
+				}
+				if next == '\n' {
+					l.line++
+				}
+				word.WriteByte(next)
+			case '\n':
+				l.line++
+				word.WriteByte(c)
+			default:
+				word.WriteByte(c)
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\r':
+			if lineStart && len(tokens) == 0 && !inWord && parens == 0 {
+				blank = true
+			}
+			end()
+		case '\n':
+			l.line++
+			end()
+			if parens == 0 {
+				if len(tokens) > 0 {
+					return tokens, blank, line, nil
+				}
+				// nothing on that line, the entry starts on the
+				// next
+				blank, line = false, l.line
+			}
+		case ';':
+			end()
+			for c != '\n' {
+				if c, err = l.r.ReadByte(); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				_ = l.r.UnreadByte()
+			}
+		case '(':
+			end()
+			parens++
+		case ')':
+			end()
+			if parens--; parens < 0 {
+				return nil, false, line, fmt.Errorf("unbalanced parentheses")
+			}
+		case '"':
+			end()
+			inWord, quoted = true, true
+		case '\\':
+			next, err := l.r.ReadByte()
+			if err != nil {
+				return nil, false, line, fmt.Errorf("escape at the end of the file")
+			}
+			word.WriteByte(c)
+			word.WriteByte(next)
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+		lineStart = c == '\n'
+	}
+}
+
+// unescapeZone This is s with its \X and \DDD escapes (RFC 1035
+// 5.1) turned into the bytes they stand for.
+func unescapeZone(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return nil, fmt.Errorf("escape at the end of %q", s)
+		}
+		if s[i+1] >= '0' && s[i+1] <= '9' {
+			if i+4 > len(s) {
+				return nil, fmt.Errorf("bad escape in %q", s)
+			}
+			n, err := strconv.ParseUint(s[i+1:i+4], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad escape in %q", s)
+			}
+			out = append(out, byte(n))
+			i += 3
+			continue
+		}
+		out = append(out, s[i+1])
+		i++
+	}
+	return out, nil
+}
+
+// zoneName This reads a name, fully qualifying it with origin unless
+// it ends in a '.'.  "@" is origin itself.
+func zoneName(token zoneToken, origin string) (string, error) {
+	s := token.text
+	if s == "@" && !token.quoted {
+		return origin, nil
+	}
+	if s == "." {
+		return ".", nil
+	}
+	// split on the dots that aren't escaped
+	var labels []string
+	qualified := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '.':
+			labels = append(labels, s[start:i])
+			start = i + 1
+			if start == len(s) {
+				qualified = true
+			}
+		}
+	}
+	if !qualified {
+		labels = append(labels, s[start:])
+	}
+	var name strings.Builder
+	for _, label := range labels {
+		raw, err := unescapeZone(label)
+		if err != nil {
+			return "", err
+		}
+		if len(raw) == 0 || len(raw) > 63 || slices.Contains(raw, '.') {
+			return "", fmt.Errorf("bad name %q", s)
+		}
+		name.Write(raw)
+		name.WriteByte('.')
+	}
+	if !qualified && origin != "." {
+		name.WriteString(origin)
+	}
+	if name.Len() > 254 {
+		return "", fmt.Errorf("name %q too long", s)
+	}
+	return name.String(), nil
+}
+
+// parseTTL This reads a TTL, either a number of seconds or with
+// units as BIND has them ("1h30m", "2w"), and says if it is one.
+func parseTTL(s string) (uint32, bool) {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, false
+	}
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), true
+	}
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, n uint64
+	digits := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			n = n*10 + uint64(c-'0')
+			digits = true
+		case units[c|0x20] != 0 && digits:
+			total += n * units[c|0x20]
+			n, digits = 0, false
+		default:
+			return 0, false
+		}
+		if n > 1<<32 || total > 1<<32 {
+			return 0, false
+		}
+	}
+	total += n
+	if total > 1<<32-1 {
+		return 0, false
+	}
+	return uint32(total), true
+}
+
+// parseClass This reads a class, by name or as CLASSnnn (RFC 3597 5)
+func parseClass(s string) (CLASS, bool) {
+	switch strings.ToUpper(s) {
+	case "IN":
+		return IN, true
+	case "CH", "CHAOS":
+		return CHAOS, true
+	case "HS", "HESIOD":
+		return HESIOD, true
+	}
+	if len(s) > 5 && strings.EqualFold(s[:5], "CLASS") {
+		if n, err := strconv.ParseUint(s[5:], 10, 16); err == nil {
+			return CLASS(n), true
+		}
+	}
+	return 0, false
+}
+
+// parseType This reads a type, by name or as TYPEnnn (RFC 3597 5)
+func parseType(s string) (RTYPE, bool) {
+	upper := strings.ToUpper(s)
+	for t, name := range rtypeName {
+		if name == upper {
+			return t, true
+		}
+	}
+	if len(s) > 4 && upper[:4] == "TYPE" {
+		if n, err := strconv.ParseUint(s[4:], 10, 16); err == nil {
+			return RTYPE(n), true
+		}
+	}
+	return 0, false
+}
+
+// errZoneRDATA What reading RDATA fails with when there are too
+// few or too many fields for the type
+var errZoneRDATA = errors.New("wrong number of fields")
+
+// parseZoneRDATA This reads the RDATA of a t record from its fields,
+// names in it being relative to origin.
+func parseZoneRDATA(t RTYPE, fields []zoneToken, origin string) (RDATA, error) {
+	if len(fields) > 0 && fields[0].text == `\#` && !fields[0].quoted {
+		return genericRDATA(t, fields[1:])
+	}
+	f := &zoneFields{fields: fields, origin: origin}
+	var rdata RDATA
+	switch t {
+	case RTYPE_A, RTYPE_AAAA:
+		addr, err := netip.ParseAddr(f.text())
+		if err != nil || addr.Is4() != (t == RTYPE_A) || addr.Zone() != "" {
+			return nil, fmt.Errorf("bad address")
+		}
+		if t == RTYPE_A {
+			rdata = A_RECORD{addr}
+		} else {
+			rdata = AAAA_RECORD{addr}
+		}
+	case RTYPE_NS:
+		rdata = NS_RECORD{f.name()}
+	case RTYPE_CNAME:
+		rdata = CNAME_RECORD{f.name()}
+	case RTYPE_PTR:
+		rdata = PTR_RECORD{f.name()}
+	case RTYPE_MX:
+		rdata = MX_RECORD{Preference: uint16(f.number(16)), Exchange: f.name()}
+	case RTYPE_SOA:
+		rec := SOA_RECORD{MName: f.name(), RName: f.name(), Serial: uint32(f.number(32))}
+		for _, field := range []*uint32{&rec.Refresh, &rec.Retry, &rec.Expire, &rec.Minimum} {
+			*field = f.ttl()
+		}
+		rdata = rec
+	case RTYPE_TXT:
+		var rec TXT_RECORD
+		for f.more() {
+			rec.Txt = append(rec.Txt, string(f.characterString()))
+		}
+		if len(rec.Txt) == 0 {
+			return nil, errZoneRDATA
+		}
+		rdata = rec
+	case RTYPE_SRV:
+		rdata = SRV_RECORD{Priority: uint16(f.number(16)), Weight: uint16(f.number(16)), Port: uint16(f.number(16)), Target: f.name()}
+	case RTYPE_CAA:
+		rdata = CAA_RECORD{Flags: uint8(f.number(8)), Tag: f.text(), Value: string(f.characterString())}
+	case RTYPE_TLSA:
+		rdata = TLSA_RECORD{Usage: uint8(f.number(8)), Selector: uint8(f.number(8)), MatchingType: uint8(f.number(8)), CertData: f.hex()}
+	case RTYPE_DS:
+		rdata = DS_RECORD{KeyTag: uint16(f.number(16)), Algorithm: uint8(f.number(8)), DigestType: uint8(f.number(8)), Digest: f.hex()}
+	case RTYPE_DNSKEY:
+		rdata = DNSKEY_RECORD{Flags: uint16(f.number(16)), Protocol: uint8(f.number(8)), Algorithm: uint8(f.number(8)), PublicKey: f.base64()}
+	case RTYPE_RRSIG:
+		covered, ok := parseType(f.text())
+		if !ok {
+			f.fail(fmt.Errorf("bad type covered"))
+		}
+		rdata = RRSIG_RECORD{
+			TypeCovered: covered,
+			Algorithm:   uint8(f.number(8)),
+			Labels:      uint8(f.number(8)),
+			OriginalTTL: f.ttl(),
+			Expiration:  f.time(),
+			Inception:   f.time(),
+			KeyTag:      uint16(f.number(16)),
+			SignerName:  f.name(),
+			Signature:   f.base64(),
+		}
+	case RTYPE_NSEC:
+		rdata = NSEC_RECORD{NextDomain: f.name(), TypeBitmap: f.types()}
+	case RTYPE_NSEC3:
+		rec := NSEC3_RECORD{HashAlgorithm: uint8(f.number(8)), Flags: uint8(f.number(8)), Iterations: uint16(f.number(16))}
+		if salt := f.text(); salt != "-" {
+			var err error
+			if rec.Salt, err = hex.DecodeString(salt); err != nil {
+				f.fail(fmt.Errorf("bad salt"))
+			}
+		}
+		next, err := nsec3Encoding.DecodeString(strings.ToUpper(f.text()))
+		if err != nil {
+			f.fail(fmt.Errorf("bad next hashed owner name"))
+		}
+		rec.NextHashed = next
+		rec.TypeBitmap = f.types()
+		rdata = rec
+	case RTYPE_SVCB, RTYPE_HTTPS:
+		rec := SVCB_RECORD{Priority: uint16(f.number(16)), Target: f.name()}
+		for f.more() && f.err == nil {
+			token := f.next()
+			// key="value" comes in two tokens
+			if strings.HasSuffix(token.text, "=") && f.more() && f.fields[0].quoted {
+				token.text += f.next().text
+			}
+			param, err := parseSvcParam(token)
+			if err != nil {
+				return nil, err
+			}
+			rec.Params = append(rec.Params, param)
+		}
+		slices.SortFunc(rec.Params, func(a, b SvcParam) int { return int(a.Key) - int(b.Key) })
+		for i := 1; i < len(rec.Params); i++ {
+			if rec.Params[i].Key == rec.Params[i-1].Key {
+				return nil, fmt.Errorf("%v given twice", rec.Params[i].Key)
+			}
+		}
+		if t == RTYPE_HTTPS {
+			rdata = HTTPS_RECORD{rec}
+		} else {
+			rdata = rec
+		}
+	default:
+		return nil, fmt.Errorf(`no presentation form for %v, use \# instead`, t)
+	}
+	if f.err == nil && f.more() {
+		f.err = errZoneRDATA
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return rdata, nil
+}
+
+// genericRDATA This reads RDATA in the generic form, its length then
+// the bytes in hex, and turns it into a record of type t as
+// unpackMessage would.
+func genericRDATA(t RTYPE, fields []zoneToken) (RDATA, error) {
+	if len(fields) == 0 {
+		return nil, errZoneRDATA
+	}
+	length, err := strconv.ParseUint(fields[0].text, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad length %q", fields[0].text)
+	}
+	var digits strings.Builder
+	for _, field := range fields[1:] {
+		digits.WriteString(field.text)
+	}
+	data, err := hex.DecodeString(digits.String())
+	if err != nil || len(data) != int(length) {
+		return nil, fmt.Errorf("bad RDATA, want %d bytes in hex", length)
+	}
+	r := &wireReader{msg: data}
+	rdata, err := r.rdata(t, len(data))
+	if err == nil && r.off != len(data) {
+		err = r.malformed(fmt.Sprintf("%v RDATA has the wrong length", t))
+	}
+	return rdata, err
+}
+
+// zoneFields The fields of some RDATA being read, and the first
+// thing wrong with them.  Once something has been the rest of the
+// reads just return zero values, so parseZoneRDATA only needs to
+// check at the end.
+type zoneFields struct {
+	fields []zoneToken
+	origin string
+	err    error
+}
+
+func (f *zoneFields) fail(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *zoneFields) more() bool {
+	return len(f.fields) > 0
+}
+
+func (f *zoneFields) next() zoneToken {
+	if len(f.fields) == 0 {
+		f.fail(errZoneRDATA)
+		return zoneToken{}
+	}
+	token := f.fields[0]
+	f.fields = f.fields[1:]
+	return token
+}
+
+func (f *zoneFields) text() string {
+	return f.next().text
+}
+
+func (f *zoneFields) name() string {
+	token := f.next()
+	if f.err != nil {
+		return ""
+	}
+	name, err := zoneName(token, f.origin)
+	if err != nil {
+		f.fail(err)
+	}
+	return name
+}
+
+func (f *zoneFields) number(bits int) uint64 {
+	s := f.text()
+	if f.err != nil {
+		return 0
+	}
+	n, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		f.fail(fmt.Errorf("bad number %q", s))
+	}
+	return n
+}
+
+func (f *zoneFields) ttl() uint32 {
+	s := f.text()
+	if f.err != nil {
+		return 0
+	}
+	ttl, ok := parseTTL(s)
+	if !ok {
+		f.fail(fmt.Errorf("bad TTL %q", s))
+	}
+	return ttl
+}
+
+// time This reads an RRSIG time, as YYYYMMDDHHmmSS in UTC or as
+// seconds since the epoch (RFC 4034 3.2).
+func (f *zoneFields) time() uint32 {
+	s := f.text()
+	if f.err != nil {
+		return 0
+	}
+	if len(s) == 14 {
+		t, err := time.Parse("20060102150405", s)
+		if err != nil {
+			f.fail(fmt.Errorf("bad time %q", s))
+		}
+		return uint32(t.Unix())
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		f.fail(fmt.Errorf("bad time %q", s))
+	}
+	return uint32(n)
+}
+
+// characterString This reads a <character-string>, which can't be
+// longer than 255 bytes.
+func (f *zoneFields) characterString() []byte {
+	token := f.next()
+	if f.err != nil {
+		return nil
+	}
+	s, err := unescapeZone(token.text)
+	if err != nil {
+		f.fail(err)
+	} else if len(s) > 255 {
+		f.fail(fmt.Errorf("string longer than 255 bytes"))
+	}
+	return s
+}
+
+// rest The fields left, run together, for data that may be split
+// up with spaces
+func (f *zoneFields) rest() string {
+	if len(f.fields) == 0 {
+		f.fail(errZoneRDATA)
+	}
+	var b strings.Builder
+	for _, field := range f.fields {
+		b.WriteString(field.text)
+	}
+	f.fields = nil
+	return b.String()
+}
+
+func (f *zoneFields) hex() []byte {
+	data, err := hex.DecodeString(f.rest())
+	if err != nil {
+		f.fail(fmt.Errorf("bad hex"))
+	}
+	return data
+}
+
+func (f *zoneFields) base64() []byte {
+	data, err := base64.StdEncoding.DecodeString(f.rest())
+	if err != nil {
+		f.fail(fmt.Errorf("bad base64"))
+	}
+	return data
+}
+
+// types This reads the rest of the fields as a list of types and
+// makes the type bitmap of an NSEC or NSEC3 record out of them.
+func (f *zoneFields) types() []byte {
+	var types []RTYPE
+	for f.more() {
+		s := f.text()
+		t, ok := parseType(s)
+		if !ok {
+			f.fail(fmt.Errorf("unknown type %q", s))
+		}
+		types = append(types, t)
+	}
+	return typeBitmap(types)
+}
+
+// typeBitmap This is the type bitmap for types, the other way round
+// from typeBitmapTypes.
+func typeBitmap(types []RTYPE) []byte {
+	types = slices.Clone(types)
+	slices.Sort(types)
+	types = slices.Compact(types)
+	var bitmap []byte
+	for len(types) > 0 {
+		window := types[0] >> 8
+		var bits [32]byte
+		n := 0
+		for len(types) > 0 && types[0]>>8 == window {
+			low := types[0] & 0xff
+			bits[low/8] |= 0x80 >> (low % 8)
+			n = int(low/8) + 1
+			types = types[1:]
+		}
+		bitmap = append(append(bitmap, byte(window), byte(n)), bits[:n]...)
+	}
+	return bitmap
+}
+
+// parseSvcParam This reads one of an SVCB or HTTPS record's
+// parameters, key=value or just key (RFC 9460 2.1).  Lists are
+// separated by commas, which can be escaped in an alpn.
+func parseSvcParam(token zoneToken) (SvcParam, error) {
+	s := token.text
+	name, value, hasValue := strings.Cut(s, "=")
+	key, ok := parseSvcParamKey(name)
+	if !ok {
+		return SvcParam{}, fmt.Errorf("unknown SvcParamKey %q", name)
+	}
+	param := SvcParam{Key: key}
+	if !hasValue || value == "" {
+		if key == SVCB_NO_DEFAULT_ALPN || key > SVCB_IPV6HINT {
+			return param, nil
+		}
+		return SvcParam{}, fmt.Errorf("%v needs a value", key)
+	}
+	switch key {
+	case SVCB_MANDATORY:
+		for _, item := range strings.Split(value, ",") {
+			k, ok := parseSvcParamKey(item)
+			if !ok {
+				return SvcParam{}, fmt.Errorf("unknown SvcParamKey %q", item)
+			}
+			param.Value = binary.BigEndian.AppendUint16(param.Value, uint16(k))
+		}
+	case SVCB_ALPN:
+		raw, err := unescapeZone(value)
+		if err != nil {
+			return SvcParam{}, err
+		}
+		// a comma escaped a second time (\\, in the file) is one
+		// inside an ID
+		var ids [][]byte
+		var id []byte
+		for i := 0; i < len(raw); i++ {
+			switch {
+			case raw[i] == '\\' && i+1 < len(raw):
+				id = append(id, raw[i+1])
+				i++
+			case raw[i] == ',':
+				ids, id = append(ids, id), nil
+			default:
+				id = append(id, raw[i])
+			}
+		}
+		for _, id := range append(ids, id) {
+			if len(id) == 0 || len(id) > 255 {
+				return SvcParam{}, fmt.Errorf("bad alpn %q", value)
+			}
+			param.Value = append(append(param.Value, byte(len(id))), id...)
+		}
+	case SVCB_NO_DEFAULT_ALPN:
+		return SvcParam{}, fmt.Errorf("no-default-alpn takes no value")
+	case SVCB_PORT:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return SvcParam{}, fmt.Errorf("bad port %q", value)
+		}
+		param.Value = binary.BigEndian.AppendUint16(nil, uint16(port))
+	case SVCB_IPV4HINT, SVCB_IPV6HINT:
+		for _, item := range strings.Split(value, ",") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil || addr.Is4() != (key == SVCB_IPV4HINT) {
+				return SvcParam{}, fmt.Errorf("bad %v %q", key, item)
+			}
+			param.Value = append(param.Value, addr.AsSlice()...)
+		}
+	case SVCB_ECH:
+		ech, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return SvcParam{}, fmt.Errorf("bad ech")
+		}
+		param.Value = ech
+	default:
+		raw, err := unescapeZone(value)
+		if err != nil {
+			return SvcParam{}, err
+		}
+		param.Value = raw
+	}
+	return param, nil
+}
+
+// parseSvcParamKey This reads a SvcParamKey, by name or as keyNNNNN.
+func parseSvcParamKey(s string) (SvcParamKey, bool) {
+	for key, name := range svcParamKeyName {
+		if name == s {
+			return key, true
+		}
+	}
+	if strings.HasPrefix(s, "key") {
+		if n, err := strconv.ParseUint(s[3:], 10, 16); err == nil {
+			return SvcParamKey(n), true
+		}
+	}
+	return 0, false
+}
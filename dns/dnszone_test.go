@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		2h         ; refresh
+		30m        ; retry
+		2w         ; expire
+		300 )      ; minimum
+	NS	ns1
+	NS	ns2.example.net.
+	MX	10 mail
+ns1	300	A	192.0.2.1
+	IN 300	AAAA	2001:db8::1
+www	CNAME	@
+txt	TXT	"v=spf1 -all; not a comment" plain "a\"quote" "\065\066"
+_sip._tcp	SRV	10 60 5060 sip
+@	CAA	0 issue "letsencrypt.org"
+sub	DS	12345 8 2 ( 0123456789abcdef
+		0123456789abcdef )
+svc	HTTPS	1 . alpn=h2,h3 port=8443 ipv4hint=192.0.2.2 key65000="hi"
+nsec	NSEC	www.example.com. A NS SOA MX RRSIG NSEC
+gen	TYPE65534	\# 3 abcdef
+gena	A	\# 4 c0000205
+$ORIGIN sub
+deep	PTR	www.example.com.
+`
+
+func TestParseZone(t *testing.T) {
+	records, err := ParseZone(strings.NewReader(testZone), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DNSAnswer{
+		{RName: "example.com", RType: RTYPE_SOA, RClass: IN, TTL: 3600, RData: SOA_RECORD{
+			MName: "ns1.example.com.", RName: "hostmaster.example.com.",
+			Serial: 2024010101, Refresh: 7200, Retry: 1800, Expire: 1209600, Minimum: 300,
+		}},
+		{RName: "example.com", RType: RTYPE_NS, RClass: IN, TTL: 3600, RData: NS_RECORD{"ns1.example.com."}},
+		{RName: "example.com", RType: RTYPE_NS, RClass: IN, TTL: 3600, RData: NS_RECORD{"ns2.example.net."}},
+		{RName: "example.com", RType: RTYPE_MX, RClass: IN, TTL: 3600, RData: MX_RECORD{10, "mail.example.com."}},
+		{RName: "ns1.example.com", RType: RTYPE_A, RClass: IN, TTL: 300, RData: A_RECORD{parseAddrNoerror("192.0.2.1")}},
+		{RName: "ns1.example.com", RType: RTYPE_AAAA, RClass: IN, TTL: 300, RData: AAAA_RECORD{parseAddrNoerror("2001:db8::1")}},
+		{RName: "www.example.com", RType: RTYPE_CNAME, RClass: IN, TTL: 3600, RData: CNAME_RECORD{"example.com."}},
+		{RName: "txt.example.com", RType: RTYPE_TXT, RClass: IN, TTL: 3600, RData: TXT_RECORD{[]string{"v=spf1 -all; not a comment", "plain", `a"quote`, "AB"}}},
+		{RName: "_sip._tcp.example.com", RType: RTYPE_SRV, RClass: IN, TTL: 3600, RData: SRV_RECORD{10, 60, 5060, "sip.example.com."}},
+		{RName: "example.com", RType: RTYPE_CAA, RClass: IN, TTL: 3600, RData: CAA_RECORD{0, "issue", "letsencrypt.org"}},
+		{RName: "sub.example.com", RType: RTYPE_DS, RClass: IN, TTL: 3600, RData: DS_RECORD{12345, 8, 2, []byte{
+			0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef,
+		}}},
+		{RName: "svc.example.com", RType: RTYPE_HTTPS, RClass: IN, TTL: 3600, RData: HTTPS_RECORD{SVCB_RECORD{Priority: 1, Target: ".", Params: []SvcParam{
+			{SVCB_ALPN, []byte("\x02h2\x02h3")},
+			{SVCB_PORT, []byte{0x20, 0xfb}},
+			{SVCB_IPV4HINT, []byte{192, 0, 2, 2}},
+			{65000, []byte("hi")},
+		}}}},
+		{RName: "nsec.example.com", RType: RTYPE_NSEC, RClass: IN, TTL: 3600, RData: NSEC_RECORD{"www.example.com.", []byte{0, 6, 0x62, 0x01, 0, 0, 0, 0x03}}},
+		{RName: "gen.example.com", RType: 65534, RClass: IN, TTL: 3600, RData: RAW_RECORD{65534, []byte{0xab, 0xcd, 0xef}}},
+		{RName: "gena.example.com", RType: RTYPE_A, RClass: IN, TTL: 3600, RData: A_RECORD{parseAddrNoerror("192.0.2.5")}},
+		{RName: "deep.sub.example.com", RType: RTYPE_PTR, RClass: IN, TTL: 3600, RData: PTR_RECORD{"www.example.com."}},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %v", len(records), len(want), records)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(records[i], want[i]) {
+			t.Errorf("record %d is %+v, want %+v", i, records[i], want[i])
+		}
+	}
+	if types, _ := typeBitmapTypes(records[12].RData.(NSEC_RECORD).TypeBitmap); !reflect.DeepEqual(types, []RTYPE{RTYPE_A, RTYPE_NS, RTYPE_SOA, RTYPE_MX, RTYPE_RRSIG, RTYPE_NSEC}) {
+		t.Errorf("NSEC types came back as %v", types)
+	}
+
+	// without $TTL a record takes the last TTL given
+	records, err = ParseZone(strings.NewReader("a 60 A 192.0.2.1\nb A 192.0.2.2\n"), "example.org")
+	if err != nil || len(records) != 2 || records[1].TTL != 60 || records[1].RName != "b.example.org" {
+		t.Errorf("unexpected records %v, %v", records, err)
+	}
+
+	for _, bad := range []string{
+		"a A 192.0.2.1\n",
+		"$TTL 60\na A 2001:db8::1\n",
+		"$TTL 60\na MX 10\n",
+		"$TTL 60\na MX 10 b c\n",
+		"$TTL 60\na A ( 192.0.2.1\n",
+		"$TTL 60\na WKS 192.0.2.1\n",
+		"$TTL 60\na BOGUS x\n",
+		"$TTL 60\na\\.b A 192.0.2.1\n",
+		"$TTL 60\na TXT \"unterminated\n",
+		"$TTL 60\na A \\# 4 c000\n",
+		"$FOO bar\n",
+		" A 192.0.2.1\n",
+	} {
+		if records, err := ParseZone(strings.NewReader(bad), "example.com"); err == nil {
+			t.Errorf("%q parsed as %v", bad, records)
+		}
+	}
+}
+
+func TestParseZoneFile(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "hosts.inc"), []byte("host A 192.0.2.7\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "loop.inc"), []byte("$INCLUDE loop.inc\n"), 0o644)
+	path := filepath.Join(dir, "example.com.zone")
+	os.WriteFile(path, []byte("$TTL 60\n$INCLUDE hosts.inc lan.example.com.\nafter A 192.0.2.8\n"), 0o644)
+	records, err := ParseZoneFile(path, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].RName != "host.lan.example.com" || records[1].RName != "after.example.com" {
+		t.Errorf("unexpected records %v", records)
+	}
+	if _, err := ParseZoneFile(filepath.Join(dir, "loop.inc"), "example.com"); err == nil {
+		t.Errorf("a file including itself parsed")
+	}
+}
+
+func TestCachePreload(t *testing.T) {
+	res := withSingleRoot(New())
+	res.connect = fakeCommManager(func(addr netip.Addr, request *serverDNSRequest) *DNSMessage {
+		t.Errorf("asked %v about %s", addr, request.name)
+		return nil
+	})
+	records, err := ParseZone(strings.NewReader(testZone), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.CachePreload(records)
+	result, err := res.Lookup("www.example.com", RTYPE_MX)
+	if err != nil || len(result) != 2 || result[1].RData != (MX_RECORD{10, "mail.example.com."}) {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	if addr, ok := res.nameserverAddr("ns1.example.com"); !ok || addr != parseAddrNoerror("192.0.2.1") {
+		t.Errorf("ns1 glue is %v, %v", addr, ok)
+	}
+}
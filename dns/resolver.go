@@ -0,0 +1,610 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver Everything a resolver needs to keep between lookups:
+// its caches, the managers for the servers it talks to and the root
+// hints and trust anchors it starts from, along with its settings.
+// Resolvers are completely independent of each other, so a process
+// can have several set up differently.  The package level functions
+// (Lookup, InitCache and so on) all use DefaultResolver, make others
+// with New.
+//
+// The package level settings (MinCacheTTL, ParallelQueries,
+// AlwaysTCP and so on) are DefaultResolver's alone.  Each has a With
+// option (WithCacheTTLs, WithParallelQueries, WithAlwaysTCP and so
+// on) to set it on the others.
+type Resolver struct {
+	// The answer and infrastructure caches, see dnsCacheTable, and
+	// the one for multicast DNS answers (see MDNSCacheTTL)
+	cache *dnsCacheTable
+	infra *dnsCacheTable
+	mdns  *dnsCacheTable
+	// The random seed for nameHash and serverHash
+	seed []byte
+
+	serverComm []*serverCommUnit
+	// connect This makes the manager for a server we haven't talked
+	// to before, nil meaning plainConnect (or netCommManager, if
+	// there is a dial or proxy or the server is one of the DoT, DoH
+	// or DoQ ones)
+	connect func(*netip.Addr) *serverCommManager
+	// plainConnect This makes the managers for servers asked over
+	// plain UDP and TCP, nil meaning netCommManager.  For
+	// DefaultResolver it points at commConnect, which the tests
+	// swap for their own.
+	plainConnect *func(*netip.Addr) *serverCommManager
+	// dial This is how connections to the servers get made, nil
+	// meaning a net.Dialer (see WithDial)
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// The proxy to connect through, see UpstreamProxy
+	proxy *string
+
+	// The policy and budget for lookups which don't say otherwise,
+	// the limits on how many lookups and queries can be going at
+	// once (see limiter), the search domains and DNS64.  For
+	// DefaultResolver these point at the package level settings so
+	// they can be changed at any time.
+	retry   *RetryPolicy
+	budget  *Budget
+	lookups *limiter
+	queries *limiter
+	search  *[]string
+	ndots   *int
+	// DNS64, see WithDNS64
+	dns64       *bool
+	dns64Prefix *netip.Prefix
+	// The servers to ask over DNS-over-TLS, DNS-over-HTTPS and
+	// DNS-over-QUIC, see WithDoT, WithDoH and WithDoQ
+	dot *map[netip.Addr]DoTServer
+	doh *map[netip.Addr]DoHServer
+	doq *map[netip.Addr]DoQServer
+	// The limit on the queries sent each server, see RateLimit
+	rateLimit *RateLimit
+	// Which addresses the servers are reached at, see ServerNetwork
+	network *string
+	// The keys to sign queries to servers with, see WithTSIG
+	tsig *map[netip.Addr]TSIGKey
+	// The recursive resolvers to forward queries to, see
+	// WithForwarders
+	forwarders *[]netip.Addr
+	// The recursive resolvers to forward the queries for some zones
+	// to, see WithForwardZone
+	forwardZones *map[string][]netip.Addr
+	// The multicast DNS groups to ask about .local names, see WithMDNS
+	mdnsGroups *[]netip.AddrPort
+	// Where to log to, see WithLogger
+	logger **slog.Logger
+	// What to report the lookups to, see WithTracer
+	tracer *Tracer
+	// Which lookups are slow and what to do about them, see
+	// WithSlowLookups
+	slowThreshold *time.Duration
+	onSlow        *func(SlowLookup)
+	// The counters for Metrics
+	metrics *resolverMetrics
+	// The range cache TTLs are clamped to, see WithCacheTTLs
+	minTTL *time.Duration
+	maxTTL *time.Duration
+	// When popular answers get refreshed early, see WithPrefetch
+	prefetchWindow    *time.Duration
+	prefetchThreshold *uint64
+	// Whether new records are added to what is cached, see
+	// WithMergeRRsets
+	mergeRRsets *bool
+	// How many lookups WarmCache runs at once, see
+	// WithWarmParallelism
+	warmParallelism *int
+	// What goes into the queries sent to the servers, see
+	// WithCaseRandomization, WithDNSCookies, WithUDPPayloadSize and
+	// WithECSSourceBits
+	caseRandomization *bool
+	cookies           *bool
+	udpPayloadSize    *uint16
+	ecsBits4          *int
+	ecsBits6          *int
+	// The cache hooks, see WithCacheHooks
+	hooks *cacheHooks
+	// How many servers are asked at once, see WithParallelQueries
+	parallelQueries *int
+	// When servers get marked down, see WithBreaker
+	breakerThreshold  *int
+	breakerBackoff    *time.Duration
+	breakerMaxBackoff *time.Duration
+	// Whether every query goes over TCP and how long idle TCP
+	// connections are kept, see WithAlwaysTCP and WithTCPIdleTimeout
+	alwaysTCP      *bool
+	tcpIdleTimeout *time.Duration
+	// How long unused server managers are kept, see
+	// WithIdleServerTimeout
+	idleServerTimeout *time.Duration
+	// How deep glueless nameservers can go, see WithMaxGluelessDepth
+	maxGluelessDepth *int
+	// When the root gets primed again, see WithPriming
+	primeWindow *time.Duration
+	primeRetry  *time.Duration
+	// How long multicast DNS queries wait and their answers are
+	// cached for, see WithMDNSTimeouts
+	mdnsTimeout  *time.Duration
+	mdnsCacheTTL *time.Duration
+	// The RFC 5011 hold-downs, see WithHoldDowns
+	addHoldDown    *time.Duration
+	removeHoldDown *time.Duration
+
+	// The root hints currently in use and the file they came from
+	// (if any) so ReloadRootHints knows where to look.  primed is
+	// what the last priming query got (see Prime), which is used in
+	// place of the hints until primedExpires.  rootLock covers all
+	// of them, and also makes sure only one set of hints is being
+	// put into the cache at a time.
+	rootLock      sync.Mutex
+	root          *rootHints
+	rootHintsPath string
+	primed        *rootHints
+	primedExpires time.Time
+	// When priming should next happen, as UnixNano (0 until Prime
+	// is first called), and whether it is happening right now
+	nextPrime atomic.Int64
+	priming   atomic.Bool
+
+	// The DNSSEC trust anchors, see TrustAnchor
+	anchorLock sync.Mutex
+	anchors    []TrustAnchor
+
+	// What Close needs: whether it has been called, done which it
+	// cancels with shutdown, and running which counts the lookups
+	// and background goroutines it waits for (see begin)
+	lifeLock sync.Mutex
+	closed   bool
+	done     context.Context
+	shutdown context.CancelFunc
+	running  sync.WaitGroup
+}
+
+// DefaultResolver The Resolver the package level functions use.  It
+// has no shards until InitCache and InitServerComm are called.
+var DefaultResolver = newDefaultResolver()
+
+// newResolver This makes a Resolver with no shards yet and its own
+// settings, all zero.
+func newResolver() *Resolver {
+	res := &Resolver{
+		retry:         new(RetryPolicy),
+		budget:        new(Budget),
+		lookups:       newLimiter(new(int)),
+		queries:       newLimiter(new(int)),
+		search:        new([]string),
+		ndots:         new(int),
+		dns64:         new(bool),
+		dns64Prefix:   new(netip.Prefix),
+		dot:           new(map[netip.Addr]DoTServer),
+		doh:           new(map[netip.Addr]DoHServer),
+		doq:           new(map[netip.Addr]DoQServer),
+		rateLimit:     new(RateLimit),
+		network:       new(string),
+		proxy:         new(string),
+		tsig:          new(map[netip.Addr]TSIGKey),
+		forwarders:    new([]netip.Addr),
+		forwardZones:  new(map[string][]netip.Addr),
+		mdnsGroups:    new([]netip.AddrPort),
+		logger:        new(*slog.Logger),
+		tracer:        new(Tracer),
+		slowThreshold: new(time.Duration),
+		onSlow:        new(func(SlowLookup)),
+		metrics:       newResolverMetrics(),
+		root:          defaultRootHints(),
+		anchors:       builtinTrustAnchors(),
+
+		minTTL:            new(time.Duration),
+		maxTTL:            new(time.Duration),
+		prefetchWindow:    new(time.Duration),
+		prefetchThreshold: new(uint64),
+		mergeRRsets:       new(bool),
+		warmParallelism:   new(int),
+		caseRandomization: new(bool),
+		cookies:           new(bool),
+		udpPayloadSize:    new(uint16),
+		ecsBits4:          new(int),
+		ecsBits6:          new(int),
+		hooks:             newCacheHooks(),
+		plainConnect:      new(func(*netip.Addr) *serverCommManager),
+		parallelQueries:   new(int),
+		breakerThreshold:  new(int),
+		breakerBackoff:    new(time.Duration),
+		breakerMaxBackoff: new(time.Duration),
+		alwaysTCP:         new(bool),
+		tcpIdleTimeout:    new(time.Duration),
+		idleServerTimeout: new(time.Duration),
+		maxGluelessDepth:  new(int),
+		primeWindow:       new(time.Duration),
+		primeRetry:        new(time.Duration),
+		mdnsTimeout:       new(time.Duration),
+		mdnsCacheTTL:      new(time.Duration),
+		addHoldDown:       new(time.Duration),
+		removeHoldDown:    new(time.Duration),
+	}
+	res.cache = &dnsCacheTable{maxBytes: new(int64), evictFirst: soonestExpiring, hash: res.nameHash}
+	res.infra = &dnsCacheTable{maxBytes: new(int64), evictFirst: leastUsed, hash: res.nameHash, infra: true}
+	res.mdns = &dnsCacheTable{maxBytes: new(int64), evictFirst: soonestExpiring, hash: res.nameHash}
+	for _, c := range []*dnsCacheTable{res.cache, res.infra, res.mdns} {
+		c.maxTTL, c.hooks = res.maxTTL, res.hooks
+	}
+	res.done, res.shutdown = context.WithCancel(context.Background())
+	return res
+}
+
+// newDefaultResolver This makes DefaultResolver, whose settings are
+// the package level ones.
+func newDefaultResolver() *Resolver {
+	res := newResolver()
+	res.cache.maxBytes = &MaxCacheBytes
+	res.infra.maxBytes = &MaxInfraCacheBytes
+	res.lookups.limit = &MaxConcurrentLookups
+	res.queries.limit = &MaxInflightQueries
+	res.retry = &DefaultRetryPolicy
+	res.budget = &DefaultBudget
+	res.search = &SearchDomains
+	res.ndots = &Ndots
+	res.dns64 = &DNS64
+	res.dns64Prefix = &DNS64Prefix
+	res.dot = &DoTServers
+	res.doh = &DoHServers
+	res.doq = &DoQServers
+	res.rateLimit = &UpstreamRateLimit
+	res.network = &ServerNetwork
+	res.proxy = &UpstreamProxy
+	res.tsig = &TSIGKeys
+	res.forwarders = &Forwarders
+	res.forwardZones = &ForwardZones
+	res.mdnsGroups = &MDNSGroups
+	res.logger = &Logger
+	res.tracer = &Tracing
+	res.slowThreshold = &SlowLookupThreshold
+	res.onSlow = &OnSlowLookup
+	res.minTTL = &MinCacheTTL
+	res.maxTTL = &MaxCacheTTL
+	res.prefetchWindow = &PrefetchWindow
+	res.prefetchThreshold = &PrefetchThreshold
+	res.mergeRRsets = &MergeRRsets
+	res.warmParallelism = &WarmParallelism
+	res.caseRandomization = &CaseRandomization
+	res.cookies = &DNSCookies
+	res.udpPayloadSize = &UDPPayloadSize
+	res.ecsBits4 = &ECSSourceBits4
+	res.ecsBits6 = &ECSSourceBits6
+	*res.hooks = cacheHooks{&OnCacheInsert, &OnCacheHit, &OnCacheEvict, &OnCacheExpire}
+	res.plainConnect = &commConnect
+	res.parallelQueries = &ParallelQueries
+	res.breakerThreshold = &BreakerThreshold
+	res.breakerBackoff = &BreakerBackoff
+	res.breakerMaxBackoff = &BreakerMaxBackoff
+	res.alwaysTCP = &AlwaysTCP
+	res.tcpIdleTimeout = &TCPIdleTimeout
+	res.idleServerTimeout = &IdleServerTimeout
+	res.maxGluelessDepth = &MaxGluelessDepth
+	res.primeWindow, res.primeRetry = &PrimeWindow, &PrimeRetry
+	res.mdnsTimeout, res.mdnsCacheTTL = &MDNSTimeout, &MDNSCacheTTL
+	res.addHoldDown, res.removeHoldDown = &AddHoldDown, &RemoveHoldDown
+	for _, c := range []*dnsCacheTable{res.cache, res.infra, res.mdns} {
+		c.maxTTL = res.maxTTL
+	}
+	return res
+}
+
+// Option Something to set up differently on a Resolver made by New
+type Option func(*Resolver)
+
+// DefaultShards How many shards each of the caches, and the server
+// managers, get on a Resolver made by New unless an Option says
+// otherwise.
+const DefaultShards = 64
+
+// WithCacheShards This gives each of the caches n shards.
+func WithCacheShards(n uint) Option {
+	return func(res *Resolver) {
+		res.cache.init(n)
+		res.infra.init(n)
+		res.mdns.init(n)
+	}
+}
+
+// WithServerShards This gives the server managers n shards.
+func WithServerShards(n uint) Option {
+	return func(res *Resolver) {
+		res.initServerComm(n)
+	}
+}
+
+// WithMaxCacheBytes This limits the size of the answer and
+// infrastructure caches, like MaxCacheBytes and MaxInfraCacheBytes
+// do for DefaultResolver.
+func WithMaxCacheBytes(answers, infra int64) Option {
+	return func(res *Resolver) {
+		*res.cache.maxBytes = answers
+		*res.infra.maxBytes = infra
+	}
+}
+
+// WithDefaultRetryPolicy This is the RetryPolicy for lookups which
+// don't set one with WithRetryPolicy, in place of DefaultRetryPolicy.
+func WithDefaultRetryPolicy(policy RetryPolicy) Option {
+	return func(res *Resolver) {
+		*res.retry = policy
+	}
+}
+
+// WithDefaultBudget This is the Budget for lookups which don't set
+// one with WithBudget, in place of DefaultBudget.
+func WithDefaultBudget(budget Budget) Option {
+	return func(res *Resolver) {
+		*res.budget = budget
+	}
+}
+
+// New This makes a new Resolver, with its own empty caches and the
+// default root hints.  Without any options it has DefaultShards
+// shards everywhere and starts off with the current
+// DefaultRetryPolicy and DefaultBudget, cache TTL range, prefetch,
+// RRset merging, WarmCache and query settings (CaseRandomization,
+// DNSCookies, UDPPayloadSize and the ECS source bits), server
+// settings (ParallelQueries, the breaker, TCP and idle timeouts and
+// MaxGluelessDepth), priming, multicast DNS timeouts and hold-downs,
+// but unlike DefaultResolver it doesn't follow later changes to
+// them.  Its
+// caches have no size limit and no hooks, it has no limit on how
+// much it does at once, it has no search domains, DNS64 is off and
+// it doesn't use multicast DNS.
+func New(opts ...Option) *Resolver {
+	res := newResolver()
+	*res.retry = DefaultRetryPolicy
+	*res.budget = DefaultBudget
+	*res.minTTL, *res.maxTTL = MinCacheTTL, MaxCacheTTL
+	*res.prefetchWindow, *res.prefetchThreshold = PrefetchWindow, PrefetchThreshold
+	*res.mergeRRsets = MergeRRsets
+	*res.warmParallelism = WarmParallelism
+	*res.caseRandomization = CaseRandomization
+	*res.cookies = DNSCookies
+	*res.udpPayloadSize = UDPPayloadSize
+	*res.ecsBits4, *res.ecsBits6 = ECSSourceBits4, ECSSourceBits6
+	*res.parallelQueries = ParallelQueries
+	*res.breakerThreshold, *res.breakerBackoff, *res.breakerMaxBackoff = BreakerThreshold, BreakerBackoff, BreakerMaxBackoff
+	*res.alwaysTCP, *res.tcpIdleTimeout = AlwaysTCP, TCPIdleTimeout
+	*res.idleServerTimeout = IdleServerTimeout
+	*res.maxGluelessDepth = MaxGluelessDepth
+	*res.primeWindow, *res.primeRetry = PrimeWindow, PrimeRetry
+	*res.mdnsTimeout, *res.mdnsCacheTTL = MDNSTimeout, MDNSCacheTTL
+	*res.addHoldDown, *res.removeHoldDown = AddHoldDown, RemoveHoldDown
+	*res.ndots = 1
+	*res.dns64Prefix = NAT64WellKnownPrefix
+	res.seed = make([]byte, 16)
+	_, _ = rand.Read(res.seed)
+	res.cache.init(DefaultShards)
+	res.infra.init(DefaultShards)
+	res.mdns.init(DefaultShards)
+	res.initServerComm(DefaultShards)
+	for _, opt := range opts {
+		opt(res)
+	}
+	res.initRoot()
+	return res
+}
+
+// commConnect This makes the manager for addr using the Resolver's
+// connect function, or plainConnect if it is an ordinary server.
+func (res *Resolver) commConnect(addr *netip.Addr) *serverCommManager {
+	if res.connect != nil {
+		return res.connect(addr)
+	}
+	manager := &serverCommManager{remote: addr}
+	if manager.doh = res.dohUpstream(*addr); manager.doh == nil {
+		if manager.tls = res.dotConfig(*addr); manager.tls == nil {
+			manager.doq = res.doqUpstream(*addr)
+		}
+	}
+	manager.tsig = res.tsigKey(*addr)
+	dial := res.serverDial()
+	if manager.doh == nil && manager.tls == nil && manager.doq == nil && manager.tsig == nil && dial == nil && *res.plainConnect != nil {
+		return (*res.plainConnect)(addr)
+	}
+	return netCommManager(manager, dial)
+}
+
+// CachePin This is DefaultResolver.CachePin
+func CachePin(name string, t RTYPE, data []RDATA) {
+	DefaultResolver.CachePin(name, t, data)
+}
+
+// CacheUnpin This is DefaultResolver.CacheUnpin
+func CacheUnpin(name string, t RTYPE) {
+	DefaultResolver.CacheUnpin(name, t)
+}
+
+// ResizeCache This is DefaultResolver.ResizeCache
+func ResizeCache(n uint) {
+	DefaultResolver.ResizeCache(n)
+}
+
+// ResizeInfraCache This is DefaultResolver.ResizeInfraCache
+func ResizeInfraCache(n uint) {
+	DefaultResolver.ResizeInfraCache(n)
+}
+
+// CacheBytes This is DefaultResolver.CacheBytes
+func CacheBytes() int64 {
+	return DefaultResolver.CacheBytes()
+}
+
+// FlushName This is DefaultResolver.FlushName
+func FlushName(name string) {
+	DefaultResolver.FlushName(name)
+}
+
+// FlushType This is DefaultResolver.FlushType
+func FlushType(name string, t RTYPE) {
+	DefaultResolver.FlushType(name, t)
+}
+
+// FlushSubtree This is DefaultResolver.FlushSubtree
+func FlushSubtree(suffix string) {
+	DefaultResolver.FlushSubtree(suffix)
+}
+
+// StartCacheSweeper This is DefaultResolver.StartCacheSweeper
+func StartCacheSweeper(interval time.Duration) (stop func()) {
+	return DefaultResolver.StartCacheSweeper(interval)
+}
+
+// QueryLookup This is DefaultResolver.QueryLookup
+func QueryLookup(name string, t RTYPE) []*DNSAnswer {
+	return DefaultResolver.QueryLookup(name, t)
+}
+
+// QueryLookupCtx This is DefaultResolver.QueryLookupCtx
+func QueryLookupCtx(ctx context.Context, name string, t RTYPE) []*DNSAnswer {
+	return DefaultResolver.QueryLookupCtx(ctx, name, t)
+}
+
+// Lookup This is DefaultResolver.Lookup
+func Lookup(name string, t RTYPE) ([]*DNSAnswer, error) {
+	return DefaultResolver.Lookup(name, t)
+}
+
+// LookupCtx This is DefaultResolver.LookupCtx
+func LookupCtx(ctx context.Context, name string, t RTYPE) ([]*DNSAnswer, error) {
+	return DefaultResolver.LookupCtx(ctx, name, t)
+}
+
+// WarmCache This is DefaultResolver.WarmCache
+func WarmCache(names []string, types []RTYPE) {
+	DefaultResolver.WarmCache(names, types)
+}
+
+// SaveCache This is DefaultResolver.SaveCache
+func SaveCache(w io.Writer) error {
+	return DefaultResolver.SaveCache(w)
+}
+
+// LoadCache This is DefaultResolver.LoadCache
+func LoadCache(r io.Reader) error {
+	return DefaultResolver.LoadCache(r)
+}
+
+// CacheStats This is DefaultResolver.CacheStats
+func CacheStats() CacheStatistics {
+	return DefaultResolver.CacheStats()
+}
+
+// InfraCacheStats This is DefaultResolver.InfraCacheStats
+func InfraCacheStats() CacheStatistics {
+	return DefaultResolver.InfraCacheStats()
+}
+
+// Stats This is DefaultResolver.Stats
+func Stats() LatencyStats {
+	return DefaultResolver.Stats()
+}
+
+// DumpCache This is DefaultResolver.DumpCache
+func DumpCache() []CacheRecord {
+	return DefaultResolver.DumpCache()
+}
+
+// LoadRootHints This is DefaultResolver.LoadRootHints
+func LoadRootHints(r io.Reader) error {
+	return DefaultResolver.LoadRootHints(r)
+}
+
+// LoadRootHintsFile This is DefaultResolver.LoadRootHintsFile
+func LoadRootHintsFile(path string) error {
+	return DefaultResolver.LoadRootHintsFile(path)
+}
+
+// ReloadRootHints This is DefaultResolver.ReloadRootHints
+func ReloadRootHints() error {
+	return DefaultResolver.ReloadRootHints()
+}
+
+// Prime This is DefaultResolver.Prime
+func Prime(ctx context.Context) error {
+	return DefaultResolver.Prime(ctx)
+}
+
+// TrustAnchors This is DefaultResolver.TrustAnchors
+func TrustAnchors() []TrustAnchor {
+	return DefaultResolver.TrustAnchors()
+}
+
+// LoadTrustAnchors This is DefaultResolver.LoadTrustAnchors
+func LoadTrustAnchors(r io.Reader) error {
+	return DefaultResolver.LoadTrustAnchors(r)
+}
+
+// LoadTrustAnchorsFile This is DefaultResolver.LoadTrustAnchorsFile
+func LoadTrustAnchorsFile(path string) error {
+	return DefaultResolver.LoadTrustAnchorsFile(path)
+}
+
+// SaveTrustAnchorState This is DefaultResolver.SaveTrustAnchorState
+func SaveTrustAnchorState(w io.Writer) error {
+	return DefaultResolver.SaveTrustAnchorState(w)
+}
+
+// LoadTrustAnchorState This is DefaultResolver.LoadTrustAnchorState
+func LoadTrustAnchorState(r io.Reader) error {
+	return DefaultResolver.LoadTrustAnchorState(r)
+}
+
+// RefreshTrustAnchors This is DefaultResolver.RefreshTrustAnchors
+func RefreshTrustAnchors(ctx context.Context) error {
+	return DefaultResolver.RefreshTrustAnchors(ctx)
+}
+
+// StartTrustAnchorUpdates This is DefaultResolver.StartTrustAnchorUpdates
+func StartTrustAnchorUpdates(path string, interval time.Duration, onError func(error)) (stop func(), err error) {
+	return DefaultResolver.StartTrustAnchorUpdates(path, interval, onError)
+}
+
+// LookupMX This is DefaultResolver.LookupMX
+func LookupMX(name string) ([]MX_RECORD, error) {
+	return DefaultResolver.LookupMX(name)
+}
+
+// FindZoneApex This is DefaultResolver.FindZoneApex
+func FindZoneApex(name string) (string, SOA_RECORD, error) {
+	return DefaultResolver.FindZoneApex(name)
+}
+
+// LookupAddr This is DefaultResolver.LookupAddr
+func LookupAddr(addr netip.Addr) ([]string, error) {
+	return DefaultResolver.LookupAddr(addr)
+}
+
+// LookupCAA This is DefaultResolver.LookupCAA
+func LookupCAA(name string) ([]CAA_RECORD, error) {
+	return DefaultResolver.LookupCAA(name)
+}
+
+// LookupTLSA This is DefaultResolver.LookupTLSA
+func LookupTLSA(port uint16, proto, host string) ([]TLSA_RECORD, error) {
+	return DefaultResolver.LookupTLSA(port, proto, host)
+}
+
+// LookupSRV This is DefaultResolver.LookupSRV
+func LookupSRV(service, proto, name string) ([]SRV_RECORD, error) {
+	return DefaultResolver.LookupSRV(service, proto, name)
+}
+
+// ResolveSRV This is DefaultResolver.ResolveSRV
+func ResolveSRV(service, proto, name string) ([]SRVTarget, error) {
+	return DefaultResolver.ResolveSRV(service, proto, name)
+}
@@ -0,0 +1,177 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// answeringWith A fake server connection for New resolvers, every
+// server answers every A query with addr.
+func answeringWith(addr string) func(*netip.Addr) *serverCommManager {
+	return fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror(addr)},
+		}}}
+	})
+}
+
+func TestResolversIndependent(t *testing.T) {
+	initTestsData(4)
+	one := New(WithCacheShards(4), WithServerShards(4))
+	one.connect = answeringWith("10.0.0.1")
+	two := New()
+	two.connect = answeringWith("10.0.0.2")
+
+	for _, test := range []struct {
+		res  *Resolver
+		want string
+	}{{one, "10.0.0.1"}, {two, "10.0.0.2"}} {
+		result, err := test.res.Lookup("www.example.com", RTYPE_A)
+		if err != nil || len(result) != 1 || result[0].RData.(A_RECORD).A != parseAddrNoerror(test.want) {
+			t.Errorf("unexpected result %v, %v; want %s", result, err, test.want)
+		}
+	}
+	// each has only its own answer cached, and the default
+	// resolver has nothing
+	if entry := one.cacheLookup("www.example.com", RTYPE_A); entry == nil || entry.data[0].(A_RECORD).A != parseAddrNoerror("10.0.0.1") {
+		t.Errorf("unexpected cache entry %v", entry)
+	}
+	if entry := DefaultResolver.cacheLookup("www.example.com", RTYPE_A); entry != nil {
+		t.Errorf("the default resolver cached %v", entry)
+	}
+	one.FlushName("www.example.com")
+	if entry := two.cacheLookup("www.example.com", RTYPE_A); entry == nil {
+		t.Errorf("flushing one resolver flushed the other")
+	}
+}
+
+func TestResolverOptions(t *testing.T) {
+	res := New(WithDefaultBudget(Budget{Queries: 1}), WithMaxCacheBytes(1000, 2000))
+	res.connect = fakeCommManager(func(netip.Addr, *serverDNSRequest) *DNSMessage {
+		return &DNSMessage{Header: DNSHeader{Status: RCODE_SERVFAIL}}
+	})
+	if _, err := res.Lookup("www.example.com", RTYPE_A); !errors.Is(err, ErrTooManyQueries) {
+		t.Errorf("expected ErrTooManyQueries, got %v", err)
+	}
+	if *res.cache.maxBytes != 1000 || *res.infra.maxBytes != 2000 {
+		t.Errorf("unexpected limits %v and %v", *res.cache.maxBytes, *res.infra.maxBytes)
+	}
+	if DefaultBudget.Queries == 1 || MaxCacheBytes == 1000 {
+		t.Errorf("the options changed the package level defaults")
+	}
+}
+
+func TestResolverSettings(t *testing.T) {
+	initTestsData(4)
+	OnCacheInsert = func(CacheEvent) { t.Errorf("DefaultResolver's hook was called") }
+	defer func() { OnCacheInsert = nil }()
+	var inserts atomic.Int32
+	res := New(WithCacheTTLs(time.Minute, 2*time.Minute), WithCaseRandomization(true), WithDNSCookies(false),
+		WithECSSourceBits(16, 48), WithCacheHooks(func(CacheEvent) { inserts.Add(1) }, nil, nil, nil))
+	var lock sync.Mutex
+	var requests []*serverDNSRequest
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		lock.Lock()
+		requests = append(requests, request)
+		lock.Unlock()
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+		}}}
+	})
+	ctx := WithClientSubnet(context.Background(), netip.MustParsePrefix("198.51.100.77/32"))
+	name := "www.randomized.example.com"
+	if _, err := res.LookupCtx(ctx, name, RTYPE_A); err != nil {
+		t.Fatal(err)
+	}
+	if entry := res.cacheLookup(name, RTYPE_A); entry == nil || entry.ttl(*res.maxTTL) > 120 {
+		t.Errorf("the TTL of %v wasn't clamped to 2 minutes", entry)
+	}
+	if inserts.Load() == 0 {
+		t.Errorf("the Resolver's insert hook wasn't called")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	randomized, subnet := false, false
+	for _, request := range requests {
+		randomized = randomized || request.name != strings.ToLower(request.name)
+		if request.edns == nil {
+			t.Errorf("query for %s without EDNS", request.name)
+			continue
+		}
+		for _, option := range request.edns.Options {
+			if option.Code == ednsCookie {
+				t.Errorf("query for %s with a cookie", request.name)
+			}
+			if option.Code == ednsClientSubnet {
+				subnet = true
+				if option.Data[2] != 16 {
+					t.Errorf("client subnet sent with %d bits", option.Data[2])
+				}
+			}
+		}
+	}
+	if !randomized || !subnet {
+		t.Errorf("of the %d queries none had their case randomized (%v) or a client subnet (%v)", len(requests), randomized, subnet)
+	}
+	if MaxCacheTTL == 2*time.Minute || CaseRandomization || !DNSCookies || ECSSourceBits4 == 16 {
+		t.Errorf("the options changed the package level defaults")
+	}
+}
+
+func TestResolverServerSettings(t *testing.T) {
+	initTestsData(4)
+	var defaultConnects atomic.Int32
+	commConnect = func(addr *netip.Addr) *serverCommManager {
+		defaultConnects.Add(1)
+		return simpleCommManager(addr)
+	}
+	res := New(WithBreaker(1, time.Minute, time.Minute), WithAlwaysTCP(true), WithTCPIdleTimeout(time.Second))
+	addr := parseAddrNoerror("10.53.0.1")
+	// with no connect of its own an ordinary server gets a manager
+	// from netCommManager, not from DefaultResolver's commConnect
+	res.commConnect(&addr).close()
+	if defaultConnects.Load() != 0 {
+		t.Errorf("a New Resolver used DefaultResolver's commConnect")
+	}
+
+	var tcp atomic.Bool
+	res.connect = fakeCommManager(func(_ netip.Addr, request *serverDNSRequest) *DNSMessage {
+		tcp.Store(request.tcp)
+		return &DNSMessage{Answers: []DNSAnswer{{
+			RName: request.name, RType: RTYPE_A, TTL: 300, RData: A_RECORD{parseAddrNoerror("10.0.0.1")},
+		}}}
+	})
+	if _, err := res.Lookup("www.example.com", RTYPE_A); err != nil {
+		t.Fatal(err)
+	}
+	if !tcp.Load() {
+		t.Errorf("the query didn't go over TCP")
+	}
+	manager := res.getServerComm(&addr)
+	defer manager.release()
+	manager.recordFailure()
+	if until := time.Until(time.Unix(0, manager.downUntil.Load())); !manager.down() || until < 59*time.Second {
+		t.Errorf("down for %v after one failure, want a minute", until)
+	}
+	if tcpIdle := manager.tcpIdle(); tcpIdle != time.Second {
+		t.Errorf("TCP idle timeout %v, want 1s", tcpIdle)
+	}
+
+	// DefaultResolver's servers still go by the package level ones
+	other := DefaultResolver.getServerComm(&addr)
+	defer other.release()
+	other.recordFailure()
+	if other.down() || other.tcpAlways() {
+		t.Errorf("the options changed DefaultResolver's settings")
+	}
+	if BreakerThreshold == 1 || AlwaysTCP || TCPIdleTimeout == time.Second {
+		t.Errorf("the options changed the package level defaults")
+	}
+}
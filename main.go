@@ -1,6 +1,13 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"ECS-158-HW1/dns"
 )
 
@@ -8,5 +15,39 @@ import (
 // the <icon src="AllIcons.Actions.Execute"/> icon in the gutter and select the <b>Run</b> menu item from here.</p>
 
 func main() {
-	dns.InitCache(1024)
+	config := flag.String("config", "", "run a server as the config `file` says (see dns.ParseConfig)")
+	check := flag.Bool("check", false, "only check the config file")
+	flag.Parse()
+	if *config == "" {
+		dns.InitCache(1024)
+		return
+	}
+	cfg, err := dns.LoadConfigFile(*config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *check {
+		return
+	}
+	srv, err := cfg.Server()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	closed := make(chan struct{})
+	go func() {
+		<-signals
+		srv.Close()
+		close(closed)
+	}()
+	if err := cfg.ListenAndServe(srv); !errors.Is(err, dns.ErrServerClosed) {
+		srv.Close()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the Resolver and the log file are closed too before exiting
+	<-closed
 }